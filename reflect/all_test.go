@@ -1097,6 +1097,206 @@ func TestChan(t *testing.T) {
 	}
 }
 
+func TestChanTryClose(t *testing.T) {
+	c := make(chan int, 1)
+	c <- 1
+	cv := ValueOf(c)
+	if !cv.TryClose() {
+		t.Errorf("TryClose of open channel returned false")
+	}
+	if cv.TryClose() {
+		t.Errorf("TryClose of closed channel returned true")
+	}
+	if v, ok := <-c; v != 1 || !ok {
+		t.Errorf("receive after TryClose = %d, %v; want 1, true", v, ok)
+	}
+	if _, ok := <-c; ok {
+		t.Errorf("channel not closed by TryClose")
+	}
+}
+
+func TestChanPeek(t *testing.T) {
+	c := make(chan string, 2)
+	cv := ValueOf(c)
+	if x, ok := cv.Peek(); ok || x.IsValid() {
+		t.Errorf("Peek on empty channel = %v, %v; want zero Value, false", x, ok)
+	}
+	c <- "a"
+	c <- "b"
+	for i := 0; i < 2; i++ {
+		if x, ok := cv.Peek(); !ok || x.String() != "a" {
+			t.Errorf("Peek = %v, %v; want a, true", x, ok)
+		}
+	}
+	if v := <-c; v != "a" {
+		t.Errorf("receive after Peek = %q, want a", v)
+	}
+	if x, ok := cv.Peek(); !ok || x.String() != "b" {
+		t.Errorf("Peek = %v, %v; want b, true", x, ok)
+	}
+	if x, ok := ValueOf(make(chan int)).Peek(); ok || x.IsValid() {
+		t.Errorf("Peek on unbuffered channel = %v, %v; want zero Value, false", x, ok)
+	}
+}
+
+func TestChanRecvRemaining(t *testing.T) {
+	c := make(chan int, 3)
+	for i := 1; i <= 3; i++ {
+		c <- i
+	}
+	close(c)
+	cv := ValueOf(c)
+	for i := 1; i <= 3; i++ {
+		x, ok, n := cv.RecvRemaining()
+		if !ok || x.Int() != int64(i) || n != 3-i {
+			t.Errorf("RecvRemaining = %v, %v, %d; want %d, true, %d", x, ok, n, i, 3-i)
+		}
+	}
+	if x, ok, n := cv.RecvRemaining(); ok || x.Int() != 0 || n != 0 {
+		t.Errorf("RecvRemaining on closed empty channel = %v, %v, %d; want 0, false, 0", x, ok, n)
+	}
+
+	// 等待的发送者在接收之后补进 buffer 的元素也算在内。
+	c = make(chan int, 1)
+	c <- 1
+	go func() { c <- 2 }()
+	time.Sleep(10 * time.Millisecond)
+	if x, ok, n := ValueOf(c).RecvRemaining(); !ok || x.Int() != 1 || n != 1 {
+		t.Errorf("RecvRemaining with a waiting sender = %v, %v, %d; want 1, true, 1", x, ok, n)
+	}
+}
+
+func TestChanSendRecvMany(t *testing.T) {
+	c := make(chan *int, 4)
+	cv := ValueOf(c)
+	in := []*int{new(int), new(int), new(int), new(int), new(int)}
+	if n := cv.SendMany(ValueOf(in), false); n != 4 {
+		t.Errorf("SendMany = %d, want 4", n)
+	}
+	out := make([]*int, 3)
+	if n, ok := cv.RecvMany(ValueOf(out), true); n != 3 || !ok {
+		t.Errorf("RecvMany = %d, %v; want 3, true", n, ok)
+	}
+	for i, p := range out {
+		if p != in[i] {
+			t.Errorf("RecvMany element %d = %p, want %p", i, p, in[i])
+		}
+	}
+	close(c)
+	if n, ok := cv.RecvMany(ValueOf(out), true); n != 1 || !ok || out[0] != in[3] {
+		t.Errorf("RecvMany = %d, %v, %p; want 1, true, %p", n, ok, out[0], in[3])
+	}
+	if n, ok := cv.RecvMany(ValueOf(out), true); n != 0 || ok {
+		t.Errorf("RecvMany on closed empty channel = %d, %v; want 0, false", n, ok)
+	}
+
+	shouldPanic(func() { ValueOf(make(chan int, 1)).SendMany(ValueOf([]int8{1}), false) })
+}
+
+func TestChanCancel(t *testing.T) {
+	c := make(chan int)
+	cv := ValueOf(c)
+	cc := new(runtime.ChanCancel)
+	done := make(chan bool)
+	for i := 0; i < 3; i++ {
+		go func() {
+			x, ok := cv.RecvCancel(cc)
+			done <- !x.IsValid() && !ok
+		}()
+		go func() {
+			done <- !cv.SendCancel(ValueOf(1), cc)
+		}()
+	}
+	go func() {
+		done <- !ValueOf((chan int)(nil)).SendCancel(ValueOf(1), cc)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cc.Cancel()
+	for i := 0; i < 7; i++ {
+		if !<-done {
+			t.Errorf("canceled channel operation succeeded")
+		}
+	}
+	if !cc.Canceled() {
+		t.Errorf("Canceled = false after Cancel")
+	}
+
+	// After Cancel, operations that can proceed at once still do.
+	b := make(chan int, 1)
+	bv := ValueOf(b)
+	if !bv.SendCancel(ValueOf(2), cc) {
+		t.Errorf("SendCancel with room in the buffer failed")
+	}
+	if x, ok := bv.RecvCancel(cc); !ok || x.Int() != 2 {
+		t.Errorf("RecvCancel = %v, %v; want 2, true", x, ok)
+	}
+	if x, ok := bv.RecvCancel(cc); ok || x.IsValid() {
+		t.Errorf("RecvCancel on empty channel after Cancel = %v, %v; want zero Value, false", x, ok)
+	}
+
+	// A ChanCancel that is never canceled does not get in the way.
+	cc = new(runtime.ChanCancel)
+	go func() {
+		c <- 3
+	}()
+	if x, ok := cv.RecvCancel(cc); !ok || x.Int() != 3 {
+		t.Errorf("RecvCancel = %v, %v; want 3, true", x, ok)
+	}
+}
+
+func TestChanTimeout(t *testing.T) {
+	const timeout = int64(10 * time.Millisecond)
+	c := make(chan int)
+	cv := ValueOf(c)
+	if cv.SendTimeout(ValueOf(1), timeout) {
+		t.Errorf("SendTimeout on unbuffered channel with no receiver succeeded")
+	}
+	if x, ok := cv.RecvTimeout(timeout); ok || x.IsValid() {
+		t.Errorf("RecvTimeout with no sender = %v, %v; want zero Value, false", x, ok)
+	}
+	go func() {
+		c <- 2
+	}()
+	if x, ok := cv.RecvTimeout(int64(time.Minute)); !ok || x.Int() != 2 {
+		t.Errorf("RecvTimeout = %v, %v; want 2, true", x, ok)
+	}
+
+	// A zero timeout still sends or receives if it can do so at once.
+	b := make(chan int, 1)
+	bv := ValueOf(b)
+	if !bv.SendTimeout(ValueOf(3), 0) {
+		t.Errorf("SendTimeout with room in the buffer failed")
+	}
+	close(b)
+	if x, ok := bv.RecvTimeout(0); !ok || x.Int() != 3 {
+		t.Errorf("RecvTimeout = %v, %v; want 3, true", x, ok)
+	}
+	if x, ok := bv.RecvTimeout(timeout); ok || !x.IsValid() || x.Int() != 0 {
+		t.Errorf("RecvTimeout on closed channel = %v, %v; want 0, false", x, ok)
+	}
+}
+
+func TestChanCloseAndDrain(t *testing.T) {
+	c := make(chan string, 4)
+	c <- "a"
+	c <- "b"
+	<-c
+	c <- "c"
+	s := ValueOf(c).CloseAndDrain().Interface().([]string)
+	if len(s) != 2 || s[0] != "b" || s[1] != "c" {
+		t.Errorf("CloseAndDrain = %q, want [b c]", s)
+	}
+	if v, ok := <-c; ok {
+		t.Errorf("receive after CloseAndDrain = %q, %v; want closed channel", v, ok)
+	}
+	shouldPanic(func() { ValueOf(c).CloseAndDrain() })
+
+	u := make(chan int)
+	if s := ValueOf(u).CloseAndDrain().Interface().([]int); len(s) != 0 {
+		t.Errorf("CloseAndDrain of unbuffered channel = %v, want []", s)
+	}
+}
+
 // caseInfo describes a single case in a select test.
 type caseInfo struct {
 	desc      string
@@ -3717,6 +3917,43 @@ func TestChanOf(t *testing.T) {
 	checkSameType(t, Zero(ChanOf(BothDir, TypeOf(T1(1)))).Interface(), (chan T1)(nil))
 }
 
+func TestChanOfLargeElem(t *testing.T) {
+	// Element types of 64 kB and more cannot be written in Go source,
+	// but the runtime supports them.
+	type big struct {
+		p [5000]*int
+		b [40000]byte
+	}
+	ct := ChanOf(BothDir, TypeOf(big{}))
+	for _, size := range []int{0, 3} {
+		v := MakeChan(ct, size)
+		go func() {
+			for i := 0; i < 5; i++ {
+				x := new(big)
+				n := i
+				x.p[len(x.p)-1] = &n
+				x.b[len(x.b)-1] = byte(i)
+				v.Send(ValueOf(x).Elem())
+			}
+			v.Close()
+		}()
+		for i := 0; ; i++ {
+			runtime.GC()
+			e, ok := v.Recv()
+			if !ok {
+				if i != 5 {
+					t.Errorf("chan(%d): received %d values, want 5", size, i)
+				}
+				break
+			}
+			x := e.Interface().(big)
+			if *x.p[len(x.p)-1] != i || x.b[len(x.b)-1] != byte(i) {
+				t.Fatalf("chan(%d): value %d corrupted", size, i)
+			}
+		}
+	}
+}
+
 func TestChanOfDir(t *testing.T) {
 	// check construction and use of type not in binary
 	type T string
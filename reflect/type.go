@@ -1428,10 +1428,13 @@ func ChanOf(dir ChanDir, t Type) Type {
 		return ch
 	}
 
-	// This restriction is imposed by the gc compiler and the runtime.
-	if typ.size >= 1<<16 {
+	// The runtime cannot send elements described by a GC program
+	// directly to a receiver's stack.
+	// The gc compiler also rejects elements of 64 kB or more,
+	// but the runtime handles those.
+	if typ.kind&kindGCProg != 0 {
 		lookupCache.Unlock()
-		panic("reflect.ChanOf: element size too large")
+		panic("reflect.ChanOf: element type too large")
 	}
 
 	// Look in known types.
@@ -680,6 +680,28 @@ func (v Value) Close() {
 	chanclose(v.pointer())
 }
 
+// TryClose closes the channel v unless it is already closed and reports
+// whether it did. Unlike Close, it does not panic if v is already closed.
+// It panics if v's Kind is not Chan.
+func (v Value) TryClose() bool {
+	v.mustBe(Chan)
+	v.mustBeExported()
+	return chantryclose(v.pointer())
+}
+
+// CloseAndDrain closes the channel v and returns the elements that
+// were buffered in it but not yet received, as a slice of v's element
+// type. Unlike receiving from v after Close, no other receiver can take
+// some of those elements meanwhile.
+// It panics if v's Kind is not Chan.
+func (v Value) CloseAndDrain() Value {
+	v.mustBe(Chan)
+	v.mustBeExported()
+	p, n := chanclosedrain(v.pointer())
+	s := sliceHeader{p, n, n}
+	return Value{SliceOf(v.typ.Elem()).common(), unsafe.Pointer(&s), flagIndir | flag(Slice)}
+}
+
 // Complex returns v's underlying value, as a complex128.
 // It panics if v's Kind is not Complex64 or Complex128
 func (v Value) Complex() complex128 {
@@ -1252,6 +1274,34 @@ func (v Value) Pointer() uintptr {
 	panic(&ValueError{"reflect.Value.Pointer", v.kind()})
 }
 
+// Peek returns the value at the head of the channel v's buffer without
+// receiving it. If the buffer is empty, which is always the case for an
+// unbuffered channel, x is the zero Value and ok is false. Another
+// receiver may take the value as soon as Peek returns.
+// It panics if v's Kind is not Chan.
+func (v Value) Peek() (x Value, ok bool) {
+	v.mustBe(Chan)
+	v.mustBeExported()
+	tt := (*chanType)(unsafe.Pointer(v.typ))
+	if ChanDir(tt.dir)&RecvDir == 0 {
+		panic("reflect: peek on send-only channel")
+	}
+	t := tt.elem
+	x = Value{t, nil, flag(t.Kind())}
+	var p unsafe.Pointer
+	if ifaceIndir(t) {
+		p = unsafe_New(t)
+		x.ptr = p
+		x.flag |= flagIndir
+	} else {
+		p = unsafe.Pointer(&x.ptr)
+	}
+	if !chanpeek(v.typ, v.pointer(), p) {
+		return Value{}, false
+	}
+	return x, true
+}
+
 // Recv receives and returns a value from the channel v.
 // It panics if v's Kind is not Chan.
 // The receive blocks until a value is ready.
@@ -1260,12 +1310,15 @@ func (v Value) Pointer() uintptr {
 func (v Value) Recv() (x Value, ok bool) {
 	v.mustBe(Chan)
 	v.mustBeExported()
-	return v.recv(false)
+	return v.recv(false, nil, nil, nil)
 }
 
-// internal recv, possibly non-blocking (nb).
+// internal recv, possibly non-blocking (nb), cancelable (cc != nil) or
+// limited to *timeout nanoseconds (timeout != nil).
+// If left != nil, the receive blocks and stores the number of elements
+// still buffered in *left.
 // v is known to be a channel.
-func (v Value) recv(nb bool) (val Value, ok bool) {
+func (v Value) recv(nb bool, cc *runtime.ChanCancel, left *int, timeout *int64) (val Value, ok bool) {
 	tt := (*chanType)(unsafe.Pointer(v.typ))
 	if ChanDir(tt.dir)&RecvDir == 0 {
 		panic("reflect: recv on send-only channel")
@@ -1280,25 +1333,86 @@ func (v Value) recv(nb bool) (val Value, ok bool) {
 	} else {
 		p = unsafe.Pointer(&val.ptr)
 	}
-	selected, ok := chanrecv(v.typ, v.pointer(), nb, p)
+	var selected bool
+	switch {
+	case cc != nil:
+		selected, ok = chanrecvcancel(v.typ, v.pointer(), p, cc)
+	case timeout != nil:
+		selected, ok = chanrecvt(v.typ, v.pointer(), p, *timeout)
+	case left != nil:
+		ok, *left = chanrecvleft(v.typ, v.pointer(), p)
+		selected = true
+	default:
+		selected, ok = chanrecv(v.typ, v.pointer(), nb, p)
+	}
 	if !selected {
 		val = Value{}
 	}
 	return
 }
 
+// RecvCancel is like Recv, but gives up if cc is canceled before a value
+// is ready. In that case x is the zero Value and ok is false, as for a
+// TryRecv that would block.
+func (v Value) RecvCancel(cc *runtime.ChanCancel) (x Value, ok bool) {
+	v.mustBe(Chan)
+	v.mustBeExported()
+	return v.recv(false, cc, nil, nil)
+}
+
+// RecvTimeout is like Recv, but gives up if no value is ready within
+// timeout nanoseconds. In that case x is the zero Value and ok is false,
+// as for a TryRecv that would block.
+func (v Value) RecvTimeout(timeout int64) (x Value, ok bool) {
+	v.mustBe(Chan)
+	v.mustBeExported()
+	return v.recv(false, nil, nil, &timeout)
+}
+
+// RecvRemaining is like Recv, but also returns the number of values
+// still buffered in v right after x was received. The count is taken
+// together with the receive, so a consumer draining a closed channel can
+// stop as soon as remaining is 0 without racing on Len.
+func (v Value) RecvRemaining() (x Value, ok bool, remaining int) {
+	v.mustBe(Chan)
+	v.mustBeExported()
+	x, ok = v.recv(false, nil, &remaining, nil)
+	return
+}
+
+// RecvMany receives up to x.Len() values from the channel v into the
+// slice x and returns how many it received. If block is true and no
+// value is ready, it waits until at least one is. ok is false if v is
+// closed and has no values left; x is not touched in that case.
+// It panics if v's Kind is not Chan, if x's Kind is not Slice, or if
+// x's element type is not v's element type.
+func (v Value) RecvMany(x Value, block bool) (n int, ok bool) {
+	v.mustBe(Chan)
+	v.mustBeExported()
+	tt := (*chanType)(unsafe.Pointer(v.typ))
+	if ChanDir(tt.dir)&RecvDir == 0 {
+		panic("reflect: recv on send-only channel")
+	}
+	x.mustBe(Slice)
+	x.mustBeExported()
+	typesMustMatch("reflect.Value.RecvMany", x.typ.Elem(), tt.elem)
+	s := (*sliceHeader)(x.ptr)
+	return chanrecvmany(v.typ, v.pointer(), s.Data, s.Len, block)
+}
+
 // Send sends x on the channel v.
 // It panics if v's kind is not Chan or if x's type is not the same type as v's element type.
 // As in Go, x's value must be assignable to the channel's element type.
 func (v Value) Send(x Value) {
 	v.mustBe(Chan)
 	v.mustBeExported()
-	v.send(x, false)
+	v.send(x, false, nil, nil)
 }
 
-// internal send, possibly non-blocking.
+// internal send, possibly non-blocking, cancelable (cc != nil) or
+// limited to *timeout nanoseconds (timeout != nil).
 // v is known to be a channel.
-func (v Value) send(x Value, nb bool) (selected bool) {
+func (v Value) send(x Value, nb bool, cc *runtime.ChanCancel, timeout *int64) (selected bool) {
 	tt := (*chanType)(unsafe.Pointer(v.typ))
 	if ChanDir(tt.dir)&SendDir == 0 {
 		panic("reflect: send on recv-only channel")
@@ -1311,9 +1425,50 @@ func (v Value) send(x Value, nb bool) (selected bool) {
 	} else {
 		p = unsafe.Pointer(&x.ptr)
 	}
+	if cc != nil {
+		return chansendcancel(v.typ, v.pointer(), p, cc)
+	}
+	if timeout != nil {
+		return chansendt(v.typ, v.pointer(), p, *timeout)
+	}
 	return chansend(v.typ, v.pointer(), p, nb)
 }
 
+// SendCancel is like Send, but gives up if cc is canceled before x can
+// be sent. It reports whether the value was sent.
+func (v Value) SendCancel(x Value, cc *runtime.ChanCancel) bool {
+	v.mustBe(Chan)
+	v.mustBeExported()
+	return v.send(x, false, cc, nil)
+}
+
+// SendTimeout is like Send, but gives up if x cannot be sent within
+// timeout nanoseconds. It reports whether the value was sent.
+func (v Value) SendTimeout(x Value, timeout int64) bool {
+	v.mustBe(Chan)
+	v.mustBeExported()
+	return v.send(x, false, nil, &timeout)
+}
+
+// SendMany sends up to x.Len() values from the slice x on the channel v,
+// in order, and returns how many it sent. If block is true and v has no
+// room, it waits until at least one value can be sent.
+// It panics if v's Kind is not Chan, if x's Kind is not Slice, or if
+// x's element type is not v's element type.
+func (v Value) SendMany(x Value, block bool) int {
+	v.mustBe(Chan)
+	v.mustBeExported()
+	tt := (*chanType)(unsafe.Pointer(v.typ))
+	if ChanDir(tt.dir)&SendDir == 0 {
+		panic("reflect: send on recv-only channel")
+	}
+	x.mustBe(Slice)
+	x.mustBeExported()
+	typesMustMatch("reflect.Value.SendMany", x.typ.Elem(), tt.elem)
+	s := (*sliceHeader)(x.ptr)
+	return chansendmany(v.typ, v.pointer(), s.Data, s.Len, block)
+}
+
 // Set assigns x to the value v.
 // It panics if CanSet returns false.
 // As in Go, x's value must be assignable to v's type.
@@ -1644,7 +1799,7 @@ func (v Value) String() string {
 func (v Value) TryRecv() (x Value, ok bool) {
 	v.mustBe(Chan)
 	v.mustBeExported()
-	return v.recv(true)
+	return v.recv(true, nil, nil, nil)
 }
 
 // TrySend attempts to send x on the channel v but will not block.
@@ -1654,7 +1809,7 @@ func (v Value) TryRecv() (x Value, ok bool) {
 func (v Value) TrySend(x Value) bool {
 	v.mustBe(Chan)
 	v.mustBeExported()
-	return v.send(x, true)
+	return v.send(x, true, nil, nil)
 }
 
 // Type returns v's type.
@@ -2437,6 +2592,8 @@ func cvtI2I(v Value, typ Type) Value {
 // implemented in ../runtime
 func chancap(ch unsafe.Pointer) int
 func chanclose(ch unsafe.Pointer)
+func chantryclose(ch unsafe.Pointer) bool
+func chanclosedrain(ch unsafe.Pointer) (p unsafe.Pointer, n int)
 func chanlen(ch unsafe.Pointer) int
 
 //go:noescape
@@ -2445,6 +2602,22 @@ func chanrecv(t *rtype, ch unsafe.Pointer, nb bool, val unsafe.Pointer) (selecte
 //go:noescape
 func chansend(t *rtype, ch unsafe.Pointer, val unsafe.Pointer, nb bool) bool
 
+func chanrecvcancel(t *rtype, ch unsafe.Pointer, val unsafe.Pointer, cc *runtime.ChanCancel) (selected, received bool)
+
+func chanrecvleft(t *rtype, ch unsafe.Pointer, val unsafe.Pointer) (received bool, left int)
+
+func chansendcancel(t *rtype, ch unsafe.Pointer, val unsafe.Pointer, cc *runtime.ChanCancel) bool
+
+func chanrecvt(t *rtype, ch unsafe.Pointer, val unsafe.Pointer, timeout int64) (selected, received bool)
+
+func chansendt(t *rtype, ch unsafe.Pointer, val unsafe.Pointer, timeout int64) bool
+
+func chanpeek(t *rtype, ch unsafe.Pointer, val unsafe.Pointer) bool
+
+func chanrecvmany(t *rtype, ch unsafe.Pointer, val unsafe.Pointer, n int, block bool) (received int, ok bool)
+
+func chansendmany(t *rtype, ch unsafe.Pointer, val unsafe.Pointer, n int, block bool) int
+
 func makechan(typ *rtype, size uint64) (ch unsafe.Pointer)
 func makemap(t *rtype) (m unsafe.Pointer)
 
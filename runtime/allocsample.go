@@ -0,0 +1,119 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Allocation sampling.
+//
+// 和 MemProfileRate 的 heap profile 不同，这里不需要 bucket 哈希表，也不跟踪对象的释放。
+// 平均每分配 rate 字节采样一次，把 {size, type, stack} 写到一个固定大小的环形缓冲区里，
+// 工具可以用 ReadAllocSamples 把缓冲区取出来。缓冲区满了以后覆盖最老的样本。
+// 每个 P 的 mcache 里用 next_allocsample 记录距离下次采样还要分配多少字节，
+// 所以没有采样的分配只需要做一次减法。
+
+package runtime
+
+const (
+	allocSampleBufSize = 256 // 环形缓冲区的大小
+	allocSampleDepth   = 16  // 每个样本记录的栈深度
+)
+
+// An AllocSample describes one sampled heap allocation.
+type AllocSample struct {
+	Size   uintptr                   // bytes allocated, rounded up to the size class
+	Type   string                    // name of the allocated type, "" if unknown
+	Stack0 [allocSampleDepth]uintptr // stack trace of the allocation; ends at first 0 entry
+}
+
+// Stack returns the stack trace associated with the sample,
+// a prefix of s.Stack0.
+func (s *AllocSample) Stack() []uintptr {
+	for i, v := range s.Stack0 {
+		if v == 0 {
+			return s.Stack0[0:i]
+		}
+	}
+	return s.Stack0[0:]
+}
+
+var allocSampleRate int32 // 0 表示关闭采样
+
+var allocSample struct {
+	lock    mutex
+	buf     [allocSampleBufSize]AllocSample
+	head    uint64 // 下一个写入的位置
+	tail    uint64 // 下一个读取的位置
+	dropped uint64 // 被覆盖掉、没有读到的样本数
+}
+
+// SetAllocSampleRate sets the average number of bytes allocated between
+// two allocation samples and returns the previous rate. A rate of 0
+// turns sampling off. Sampling is independent of MemProfileRate.
+// Like MemProfileRate, the rate should be set once, as early as possible.
+func SetAllocSampleRate(rate int) int {
+	if rate < 0 {
+		rate = 0
+	}
+	if rate > 0x3fffffff { // make 2*rate not overflow
+		rate = 0x3fffffff
+	}
+	old := int(allocSampleRate)
+	allocSampleRate = int32(rate)
+	return old
+}
+
+// ReadAllocSamples copies pending allocation samples into p, oldest
+// first, and removes them from the buffer. It returns the number of
+// samples copied and the number of samples overwritten since the last
+// call before anybody could read them.
+func ReadAllocSamples(p []AllocSample) (n int, dropped uint64) {
+	lock(&allocSample.lock)
+	for n < len(p) && allocSample.tail < allocSample.head {
+		p[n] = allocSample.buf[allocSample.tail%allocSampleBufSize]
+		allocSample.tail++
+		n++
+	}
+	dropped = allocSample.dropped
+	allocSample.dropped = 0
+	unlock(&allocSample.lock)
+	return
+}
+
+// allocSampleRecord 由 mallocgc 在 mp.mallocing 清零之后调用，
+// c.next_allocsample 用完了，记录一个样本并选择下一次采样的位置。
+func allocSampleRecord(size uintptr, typ *_type) {
+	mp := acquirem()
+	c := mp.mcache
+	rate := allocSampleRate
+	if rate <= 0 {
+		releasem(mp)
+		return
+	}
+	// 和 profilealloc 一样在 [0, 2*rate) 里随机，
+	// 减掉这次分配多出来的部分，避免接近 rate 的对象被少采样。
+	next := int32(fastrand1()) % (2 * rate)
+	next -= int32(size) - c.next_allocsample
+	if next < 0 {
+		next = 0
+	}
+	c.next_allocsample = next
+
+	var stk [allocSampleDepth]uintptr
+	callers(3, stk[:]) // 跳过 allocSampleRecord, mallocgc 和 newobject 这类入口函数
+	var name string
+	if typ != nil {
+		name = *typ._string
+	}
+
+	lock(&allocSample.lock)
+	if allocSample.head-allocSample.tail == allocSampleBufSize {
+		allocSample.tail++
+		allocSample.dropped++
+	}
+	s := &allocSample.buf[allocSample.head%allocSampleBufSize]
+	s.Size = size
+	s.Type = name
+	s.Stack0 = stk
+	allocSample.head++
+	unlock(&allocSample.lock)
+	releasem(mp)
+}
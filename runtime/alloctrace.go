@@ -0,0 +1,48 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Allocation tracing.
+//
+// 每次 mallocgc 分配内存后(包括 tiny 分配和 largeAlloc)，如果设置了 GODEBUG=alloctrace=1
+// 或者用 SetAllocHook 注册了回调，就报告这次分配的大小、sizeclass、类型名和调用 mallocgc 的 pc。
+// 没有注册回调时 alloctrace=1 直接 print 一行。
+// 与 allocfreetrace 不同，这里不打印调用栈，开销小一些。
+
+package runtime
+
+var allocHook func(size uintptr, sizeclass int32, typ string, pc uintptr)
+
+// SetAllocHook registers hook to be called after every heap allocation
+// with the requested size, the size class (0 for large objects), the
+// name of the allocated type ("" if unknown) and the PC of the runtime
+// function that called the allocator (newobject, makeslice and so on).
+// A nil hook removes it.
+//
+// The hook runs on the allocating goroutine. Allocations made by the
+// hook itself are not reported. SetAllocHook is not synchronized with
+// running allocations and should be called early, before starting
+// other goroutines.
+func SetAllocHook(hook func(size uintptr, sizeclass int32, typ string, pc uintptr)) {
+	allocHook = hook
+}
+
+// allocTrace 由 mallocgc 在 mp.mallocing 清零之后调用，这时可以安全地分配内存。
+func allocTrace(size uintptr, sizeclass int32, typ *_type, pc uintptr) {
+	gp := getg()
+	if gp.inallochook || gp == gp.m.g0 {
+		return
+	}
+	var name string
+	if typ != nil {
+		name = *typ._string
+	}
+	hook := allocHook
+	if hook == nil {
+		print("alloctrace: size=", size, " class=", sizeclass, " type=", name, " pc=", hex(pc), "\n")
+		return
+	}
+	gp.inallochook = true
+	hook(size, sizeclass, name, pc)
+	gp.inallochook = false
+}
@@ -0,0 +1,181 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Manually managed arenas.
+//
+// Arena 直接从 page heap 拿 span(状态是 _MSpanManual, 和栈的 span 一样不归 GC 管理)，
+// 在 span 里按顺序切出对象，Free 的时候把所有 span 一次还给 mheap。
+// 一个请求里临时用到的数据放在 arena 里，GC 不需要分配、扫描和回收它们。
+//
+//	Arena.spans -> span -> span -> ...   按 arenaSpanPages 页从 heap 拿，大对象单独一个 span
+//	               ^ cur/end 是当前在切分的 span 的剩余部分
+//
+// GC 不扫描 arena, 所以 arena 里的对象不能包含指针，否则它们指向的 heap 对象会被回收;
+// heap 中指向 arena 的指针 GC 会忽略(见 heapBitsForObject)，Free 之后就不能再使用了。
+// 和栈的 span 一样，GC 期间 span 不能从 _MSpanManual 变成 free, 这时 Free 的 span
+// 先放到 arenaFreeQueue 里，在 GC 结束的时候由 freeArenaSpans 还给 heap。
+
+package runtime
+
+import "unsafe"
+
+const (
+	arenaSpanPages = 8                                // 每次从 heap 拿 64K
+	arenaMaxSmall  = arenaSpanPages << _PageShift / 4 // 更大的对象单独一个 span
+)
+
+// An Arena is a region of memory that is freed all at once by Free
+// instead of by the garbage collector. Objects allocated in an arena
+// must not contain pointers and must not be used after Free.
+// An Arena is safe for concurrent use by multiple goroutines.
+type Arena struct {
+	lock  mutex
+	spans mspan   // list of spans owned by the arena
+	cur   uintptr // next free byte in the current span
+	end   uintptr // end of the current span
+	size  uintptr // bytes in spans
+}
+
+// GC 期间 Free 的 span, GC 结束的时候还给 heap。
+var arenaFreeQueue struct {
+	lock  mutex
+	spans mspan
+}
+
+// NewArena returns a new, empty arena.
+func NewArena() *Arena {
+	a := new(Arena)
+	mSpanList_Init(&a.spans)
+	return a
+}
+
+// New allocates a zeroed object in a with the dynamic type of proto
+// and returns a pointer to it. It panics if the type contains pointers.
+func (a *Arena) New(proto interface{}) unsafe.Pointer {
+	return arenaNewObject(a, arenaProtoType(proto))
+}
+
+// NewArray allocates a zeroed array of n elements with the dynamic type
+// of proto in a and returns a pointer to the first element.
+// It panics if the type contains pointers.
+func (a *Arena) NewArray(proto interface{}, n int) unsafe.Pointer {
+	return arenaNewArray(a, arenaProtoType(proto), uintptr(n))
+}
+
+// Size returns the number of bytes of memory a has obtained from the heap.
+func (a *Arena) Size() uintptr {
+	lock(&a.lock)
+	n := a.size
+	unlock(&a.lock)
+	return n
+}
+
+// Free returns all memory of a to the heap at once. All objects
+// allocated in a become invalid. The arena can be used again afterwards.
+func (a *Arena) Free() {
+	systemstack(func() {
+		arenaFree(a)
+	})
+}
+
+func arenaProtoType(proto interface{}) *_type {
+	t := (*eface)(unsafe.Pointer(&proto))._type
+	if t == nil {
+		panic(errorString("runtime: arena allocation of nil type"))
+	}
+	return t
+}
+
+// arenaNewObject 是 arena 版的 newobject。
+func arenaNewObject(a *Arena, typ *_type) unsafe.Pointer {
+	return arenaNewArray(a, typ, 1)
+}
+
+// arenaNewArray 是 arena 版的 newarray。
+func arenaNewArray(a *Arena, typ *_type, n uintptr) unsafe.Pointer {
+	if typ.kind&kindNoPointers == 0 {
+		panic(errorString("runtime: arena allocation of type " + *typ._string + " with pointers"))
+	}
+	if int(n) < 0 || (typ.size > 0 && n > maxMem/uintptr(typ.size)) {
+		panic(errorString("runtime: arena allocation size out of range"))
+	}
+	size := uintptr(typ.size) * n
+	if size == 0 {
+		return unsafe.Pointer(&zerobase)
+	}
+	var p unsafe.Pointer
+	systemstack(func() {
+		p = arenaAlloc(a, size, uintptr(typ.align))
+	})
+	return p
+}
+
+// arenaAlloc 在 a 中分配 size 字节、按 align 对齐的清零的内存。在 system stack 上运行。
+func arenaAlloc(a *Arena, size, align uintptr) unsafe.Pointer {
+	if align == 0 {
+		align = 1
+	}
+	lock(&a.lock)
+	if size > arenaMaxSmall {
+		s := arenaNewSpan(a, round(size, _PageSize)>>_PageShift)
+		unlock(&a.lock)
+		return unsafe.Pointer(s.base())
+	}
+	p := round(a.cur, align)
+	if a.cur == 0 || p+size > a.end {
+		s := arenaNewSpan(a, arenaSpanPages)
+		p = s.base()
+		a.end = p + s.npages<<_PageShift
+	}
+	a.cur = p + size
+	unlock(&a.lock)
+	return unsafe.Pointer(p)
+}
+
+// arenaNewSpan 从 heap 拿一个 npage 页清零的 span 挂到 a 上, 调用者持有 a.lock。
+func arenaNewSpan(a *Arena, npage uintptr) *mspan {
+	s := mHeap_AllocManual(&mheap_, npage)
+	if s == nil {
+		unlock(&a.lock)
+		throw("out of memory")
+	}
+	if s.needzero != 0 {
+		memclr(unsafe.Pointer(s.base()), npage<<_PageShift)
+		s.needzero = 0
+	}
+	mSpanList_Insert(&a.spans, s)
+	a.size += npage << _PageShift
+	return s
+}
+
+// arenaFree 把 a 的所有 span 还给 heap。在 system stack 上运行，所以 gcphase 在这期间不会变。
+func arenaFree(a *Arena) {
+	lock(&a.lock)
+	for !mSpanList_IsEmpty(&a.spans) {
+		s := a.spans.next
+		mSpanList_Remove(s)
+		if gcphase == _GCoff {
+			mHeap_FreeManual(&mheap_, s)
+		} else {
+			lock(&arenaFreeQueue.lock)
+			mSpanList_Insert(&arenaFreeQueue.spans, s)
+			unlock(&arenaFreeQueue.lock)
+		}
+	}
+	a.cur = 0
+	a.end = 0
+	a.size = 0
+	unlock(&a.lock)
+}
+
+// freeArenaSpans 在 GC 结束的时候把 GC 期间 Free 的 span 还给 heap。
+func freeArenaSpans() {
+	lock(&arenaFreeQueue.lock)
+	for !mSpanList_IsEmpty(&arenaFreeQueue.spans) {
+		s := arenaFreeQueue.spans.next
+		mSpanList_Remove(s)
+		mHeap_FreeManual(&mheap_, s)
+	}
+	unlock(&arenaFreeQueue.lock)
+}
@@ -0,0 +1,128 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Black box recorder.
+//
+// 程序因为 fatal error 挂掉时(throw)，或者用户主动调用 WriteBlackbox 时，
+// 把 memstats、各个 sizeclass 的 span 占用情况、itab 表的概况以及所有 goroutine 的栈
+// 写到一个 fd 中，用于事后分析。
+// 写之前所有的内容先 print 到一个用 sysAlloc 申请的 buffer 里，不依赖 heap，所以 crash 时也能用。
+
+package runtime
+
+import "unsafe"
+
+const blackboxBufSize = 1 << 20
+
+var blackbox struct {
+	fd  uintptr // 0 表示没有注册
+	buf []byte  // sysAlloc 申请的内存, 第一次用时才申请
+}
+
+// SetBlackbox registers fd to receive a snapshot of the runtime state
+// (memory statistics, span occupancy, itab summary and all goroutine stacks)
+// when the program dies of a fatal runtime error. A zero fd disables it.
+// Setting GODEBUG=blackbox=1 has the same effect as SetBlackbox(2).
+func SetBlackbox(fd uintptr) {
+	blackbox.fd = fd
+}
+
+// WriteBlackbox writes a snapshot of the runtime state to fd.
+// It stops the world while writing. It is meant to be called on demand,
+// for example from a signal handler installed with os/signal.
+func WriteBlackbox(fd uintptr) {
+	stopTheWorld("write blackbox")
+	gp := getg()
+	sp := getcallersp(unsafe.Pointer(&fd))
+	pc := getcallerpc(unsafe.Pointer(&fd))
+	systemstack(func() {
+		blackboxWrite(fd, gp, pc, sp)
+	})
+	startTheWorld()
+}
+
+// blackboxThrow 由 dopanic_m 在 fatal error 时调用，这时 world 已经被 freezetheworld 冻结了。
+func blackboxThrow(gp *g, pc, sp uintptr) {
+	fd := blackbox.fd
+	if fd == 0 && debug.blackbox != 0 {
+		fd = 2
+	}
+	if fd == 0 {
+		return
+	}
+	blackboxWrite(fd, gp, pc, sp)
+}
+
+// Must run on the system stack, print output is diverted to g0.writebuf.
+func blackboxWrite(fd uintptr, gp *g, pc, sp uintptr) {
+	if blackbox.buf == nil {
+		p := sysAlloc(blackboxBufSize, &memstats.other_sys)
+		if p == nil {
+			return
+		}
+		blackbox.buf = (*[blackboxBufSize]byte)(p)[:0:blackboxBufSize]
+	}
+
+	g0 := getg()
+	g0.writebuf = blackbox.buf[:0]
+	print("go blackbox snapshot\n")
+	blackboxMemStats()
+	blackboxSpans()
+	blackboxItabs()
+	print("\ngoroutines:\n")
+	goroutineheader(gp)
+	traceback(pc, sp, 0, gp)
+	tracebackothers(gp)
+	n := len(g0.writebuf)
+	g0.writebuf = nil
+
+	write(fd, unsafe.Pointer(&blackbox.buf[0]), int32(n))
+}
+
+// 这里只是打印 memstats 中的原始值，crash 时不能调用 updatememstats 去 flush mcache。
+func blackboxMemStats() {
+	print("\nmemstats:\n")
+	print("heap_live=", memstats.heap_live, " heap_scan=", memstats.heap_scan, " heap_marked=", memstats.heap_marked, "\n")
+	print("heap_sys=", memstats.heap_sys, " heap_idle=", memstats.heap_idle, " heap_inuse=", memstats.heap_inuse, " heap_released=", memstats.heap_released, "\n")
+	print("stacks_inuse=", memstats.stacks_inuse, " mspan_inuse=", memstats.mspan_inuse, " mcache_inuse=", memstats.mcache_inuse, " gc_sys=", memstats.gc_sys, " other_sys=", memstats.other_sys, "\n")
+	print("next_gc=", memstats.next_gc, " numgc=", memstats.numgc, " pause_total_ns=", memstats.pause_total_ns, "\n")
+}
+
+// 统计每个 sizeclass 正在使用的 span 数量，以及这些 span 中 object 的占用情况。
+func blackboxSpans() {
+	var nspans, ninuse, ncap [_NumSizeClasses]uintptr
+	var nlarge, largebytes uintptr
+	for _, s := range h_allspans {
+		if s.state != mSpanInUse {
+			continue
+		}
+		if s.sizeclass == 0 {
+			nlarge++
+			largebytes += s.npages << _PageShift
+			continue
+		}
+		nspans[s.sizeclass]++
+		ninuse[s.sizeclass] += uintptr(s.ref)
+		ncap[s.sizeclass] += (s.npages << _PageShift) / s.elemsize
+	}
+	print("\nspans (class size nspans inuse/cap):\n")
+	for i := 1; i < _NumSizeClasses; i++ {
+		if nspans[i] == 0 {
+			continue
+		}
+		print(i, " ", class_to_size[i], " ", nspans[i], " ", ninuse[i], "/", ncap[i], "\n")
+	}
+	print("large ", nlarge, " spans ", largebytes, " bytes\n")
+}
+
+func blackboxItabs() {
+	var n, bad int
+	iterate_itabs(func(m *itab) {
+		n++
+		if m.bad != 0 {
+			bad++
+		}
+	})
+	print("\nitabs: ", n, " (", bad, " bad)\n")
+}
@@ -147,10 +147,12 @@ func cmalloc(n uintptr) unsafe.Pointer {
 	if args.ret == nil {
 		throw("C malloc failed")
 	}
+	cgoTrackAlloc(args.ret, n)
 	return args.ret
 }
 
 func cfree(p unsafe.Pointer) {
+	cgoTrackFree(p)
 	cgocall(_cgo_free, p)
 }
 
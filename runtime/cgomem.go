@@ -0,0 +1,117 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Accounting of C memory allocated through cmalloc.
+//
+// cmalloc 分配的每一块内存都登记在一个 hash 表里(key 是地址)，cfree 时从中删除，
+// 这样 cfree 才能知道释放的大小。总量体现在 MemStats 的 CgoAlloc/CgoMallocs/CgoFrees 中，
+// 每一块的信息在 heap dump 中以 tagCgoAlloc 记录输出。
+// 设置 GODEBUG=cgotrack=1 时，还会记录调用 cmalloc 的 Go 调用栈，方便找到是谁分配的。
+
+package runtime
+
+import "unsafe"
+
+const (
+	cgoBlockHashSize = 1 << 10
+	cgoBlockStack    = 4 // cgotrack 模式下记录的调用栈深度
+)
+
+type cgoBlock struct {
+	next *cgoBlock
+	p    uintptr
+	size uintptr
+	stk  [cgoBlockStack]uintptr // cgotrack=1 时才有值
+}
+
+var cgoBlocks struct {
+	lock mutex
+	hash *[cgoBlockHashSize]*cgoBlock // 第一次用时才用 sysAlloc 申请
+	free *cgoBlock                    // 从 hash 中删除的 cgoBlock, 重复使用
+}
+
+func cgoBlockHash(p uintptr) uintptr {
+	return (p >> 4) % cgoBlockHashSize
+}
+
+// cgoTrackAlloc 登记一块 C 内存, 由 cmalloc 调用。
+func cgoTrackAlloc(p unsafe.Pointer, n uintptr) {
+	var stk [cgoBlockStack]uintptr
+	if debug.cgotrack != 0 {
+		// 跳过 callers, cgoTrackAlloc 和 cmalloc
+		callers(3, stk[:])
+	}
+
+	lock(&cgoBlocks.lock)
+	if cgoBlocks.hash == nil {
+		cgoBlocks.hash = (*[cgoBlockHashSize]*cgoBlock)(sysAlloc(unsafe.Sizeof(*cgoBlocks.hash), &memstats.other_sys))
+		if cgoBlocks.hash == nil {
+			throw("runtime: cannot allocate memory")
+		}
+	}
+	b := cgoBlocks.free
+	if b != nil {
+		cgoBlocks.free = b.next
+	} else {
+		b = (*cgoBlock)(persistentalloc(unsafe.Sizeof(cgoBlock{}), 0, &memstats.other_sys))
+	}
+	b.p = uintptr(p)
+	b.size = n
+	b.stk = stk
+	h := cgoBlockHash(b.p)
+	b.next = cgoBlocks.hash[h]
+	cgoBlocks.hash[h] = b
+	unlock(&cgoBlocks.lock)
+
+	xadd64(&memstats.cgo_alloc, int64(n))
+	xadd64(&memstats.cgo_nmalloc, 1)
+}
+
+// cgoTrackFree 删除 p 的登记, 由 cfree 调用。
+// 不是 cmalloc 分配的内存(比如 C 代码自己 malloc 的)不在表中，直接忽略。
+func cgoTrackFree(p unsafe.Pointer) {
+	lock(&cgoBlocks.lock)
+	if cgoBlocks.hash == nil {
+		unlock(&cgoBlocks.lock)
+		return
+	}
+	var n uintptr
+	found := false
+	h := cgoBlockHash(uintptr(p))
+	for bp := &cgoBlocks.hash[h]; *bp != nil; bp = &(*bp).next {
+		b := *bp
+		if b.p == uintptr(p) {
+			*bp = b.next
+			n = b.size
+			found = true
+			*b = cgoBlock{}
+			b.next = cgoBlocks.free
+			cgoBlocks.free = b
+			break
+		}
+	}
+	unlock(&cgoBlocks.lock)
+
+	if found {
+		xadd64(&memstats.cgo_alloc, -int64(n))
+		xadd64(&memstats.cgo_nfree, 1)
+	}
+}
+
+// iterate_cgoblocks 对每一块还没有释放的 C 内存调用 fn，调用时持有 cgoBlocks.lock。
+func iterate_cgoblocks(fn func(p, size uintptr, stk []uintptr)) {
+	lock(&cgoBlocks.lock)
+	if cgoBlocks.hash != nil {
+		for _, b := range cgoBlocks.hash {
+			for ; b != nil; b = b.next {
+				n := 0
+				for n < len(b.stk) && b.stk[n] != 0 {
+					n++
+				}
+				fn(b.p, b.size, b.stk[:n])
+			}
+		}
+	}
+	unlock(&cgoBlocks.lock)
+}
@@ -11,55 +11,95 @@ import "unsafe"
 const (
 	maxAlign  = 8
 	hchanSize = unsafe.Sizeof(hchan{}) + uintptr(-int(unsafe.Sizeof(hchan{}))&(maxAlign-1))
+
+	// 同步 channel 只分配到 lock 为止, 见 hchan。
+	hchanSyncSize = (unsafe.Offsetof(hchan{}.sendx) - _CacheLineSize + maxAlign - 1) &^ (maxAlign - 1)
 )
 
+// hchan 的字段按谁来写分成几组, 组之间隔开一个 cache line:
+//
+//	qcount 之后的一组     创建之后基本只读的字段, 以及 lock 和等待队列, 两边都要用
+//	sendx                只有发送者修改
+//	recvx                只有接收者修改
+//
+// 一个发送者和一个接收者同时在跑的时候(特别是不加锁的 spsc channel), sendx 和 recvx
+// 不会在同一个 cache line 上来回传递。makechan 把 buffer 紧跟着分配在 hchan 后面,
+// 最后的 padding 让第一个元素和 recvx 也不在同一个 cache line 上。
+// 同步 channel 没有 buffer, 用不到 sendx 之后的字段, makechan 只给它分配
+// hchanSyncSize 字节, 所以只有带缓冲的 channel 要多用这几个 cache line 的内存。
+// qcount 和 dataqsiz 必须在最前面, 编译器直接读它们实现 len 和 cap。
 type hchan struct {
 	qcount   uint           // total data in the queue
 	dataqsiz uint           // size of the circular queue
 	buf      unsafe.Pointer // points to an array of dataqsiz elements
-	elemsize uint16
+	elemsize uintptr
 	closed   uint32
-	elemtype *_type // element type
-	sendx    uint   // send index
-	recvx    uint   // receive index
-	recvq    waitq  // list of recv waiters
-	sendq    waitq  // list of send waiters
+	elemtype *_type  // element type
+	spsc     uint32  // 单生产者单消费者, 见 chanspsc.go
+	spscwait uint32  // spsc channel 上准备等待的 goroutine 数, 原子操作
+	makepc   uintptr // 调用 make 的 pc, 死锁时打印, 见 chandeadlock.go
+	closepc  uintptr // 调用 close 的 pc, 见 GODEBUG=chanpanicdetail
+	closegid int64   // 调用 close 的 goroutine id
+	recvq    waitq   // list of recv waiters
+	sendq    waitq   // list of send waiters
 	lock     mutex
+
+	_       [_CacheLineSize]byte
+	sendx   uint    // send index
+	sendseq uintptr // 只在 debugChan 时使用, 见 chanseq.go
+	seqmax  uintptr
+	_       [_CacheLineSize]byte
+	recvx   uint // receive index
+	recvseq uintptr
+	clearx  uint // buffer 中 clearx 之前的空位都清过了, 见 chanbufclear
+	_       [_CacheLineSize]byte
 }
 
 type waitq struct {
-	first *sudog
-	last  *sudog
+	first  *sudog
+	last   *sudog
+	single *sudog // 队列中只有一个不在 select 中、没有超时的等待者时指向它, 见 dequeue
+	nlifo  uint32 // 连续从队尾唤醒的次数, 见 GODEBUG=chanlifo
 }
 
 //go:linkname reflect_makechan reflect.makechan
 func reflect_makechan(t *chantype, size int64) *hchan {
-	return makechan(t, size)
+	c := makechan(t, size)
+	c.makepc = getcallerpc(unsafe.Pointer(&t))
+	return c
 }
 
 func makechan(t *chantype, size int64) *hchan {
 	elem := t.elem
 
-	// compiler checks this but be safe.
-	if elem.size >= 1<<16 {
+	// elemsize 已经是 uintptr, 元素大小本身没有限制(gc 编译器仍然拒绝 64KB 以上的元素, 只能通过 reflect 创建)。
+	// 但是 syncsend 直接写接收者的栈, 要用 typeBitsBulkBarrier, 它只认识 ptrmask,
+	// 所以指针数据大到需要 GC program 描述的元素类型仍然不支持。
+	if elem.kind&kindGCProg != 0 {
 		throw("makechan: invalid channel element type")
 	}
 	if hchanSize%maxAlign != 0 || elem.align > maxAlign {
 		throw("makechan: bad alignment")
 	}
-	if size < 0 || int64(uintptr(size)) != size || (elem.size > 0 && uintptr(size) > (_MaxMem-hchanSize)/uintptr(elem.size)) {
+	if size < 0 || int64(uintptr(size)) != size || (elem.size > 0 && uintptr(size) > (maxMem-hchanSize)/uintptr(elem.size)) {
 		panic("makechan: size out of range")
 	}
 
 	var c *hchan
-	if elem.kind&kindNoPointers != 0 || size == 0 {
+	if size == 0 {
+		// 同步 channel 不会碰 sendx 之后的字段, 不用分配 padding, 见 hchan。
+		// 和下面一样, 这里没有 GC 需要关心的指针。
+		c = (*hchan)(mallocgc(hchanSyncSize, nil, flagNoScan))
+		// race detector uses this location for synchronization
+		c.buf = unsafe.Pointer(c)
+	} else if elem.kind&kindNoPointers != 0 {
 		// Allocate memory in one call.
 		// Hchan does not contain pointers interesting for GC in this case:
 		// buf points into the same allocation, elemtype is persistent.
 		// SudoG's are referenced from their owning thread so they can't be collected.
 		// TODO(dvyukov,rlh): Rethink when collector can move allocated objects.
 		c = (*hchan)(mallocgc(hchanSize+uintptr(size)*uintptr(elem.size), nil, flagNoScan))
-		if size > 0 && elem.size != 0 {
+		if elem.size != 0 {
 			c.buf = add(unsafe.Pointer(c), hchanSize)
 		} else {
 			// race detector uses this location for synchronization
@@ -70,22 +110,60 @@ func makechan(t *chantype, size int64) *hchan {
 		c = new(hchan)
 		c.buf = newarray(elem, uintptr(size))
 	}
-	c.elemsize = uint16(elem.size)
+	c.elemsize = elem.size
 	c.elemtype = elem
 	c.dataqsiz = uint(size)
+	c.makepc = getcallerpc(unsafe.Pointer(&t))
+	if debug.chanregistry > 0 {
+		chanregister(c)
+	}
 
 	return c
 }
 
 // chanbuf(c, i) 返回 buffer 中第 i 位数据的地址(指针)
 func chanbuf(c *hchan, i uint) unsafe.Pointer {
-	return add(c.buf, uintptr(i)*uintptr(c.elemsize))
+	return add(c.buf, uintptr(i)*c.elemsize)
+}
+
+// chanbufclear 在接收者从 recvx 开始取走 n 个元素之后、移动 recvx 和 qcount 之前调用,
+// 清掉空出来的位置, 免得 GC 通过 buffer 留着已经被接收的值。
+//
+// 元素没有指针的时候不需要清。有指针的时候不是每次接收都清, 而是:
+//
+//	recvx 回绕到 0 时一次清掉 buffer 中所有的空位: 这时剩下的 qcount-n 个元素正好在 [0, qcount-n) 中, 后面都是空位
+//	buffer 被取空时清掉上次清过之后取走的位置 [clearx, recvx+n), 这时 buffer 里一个旧值都不剩
+//
+// clearx 之前的空位要么已经清过, 要么还没有被接收过, 所以每个位置每一圈最多清一次。
+// 取走之后 recvx+n 追上 sendx 就是取空了(刚取走了元素, 不可能是满的)。
+// 调用者持有 c.lock, 发送者不会同时往空位里写。代价是 buffer 一直不空的时候,
+// 最多一圈之内被接收的值还留在 buffer 里。spsc channel 上发送者不加锁, 随时可能写空位, 只能马上清掉取走的位置。
+func chanbufclear(c *hchan, n uint) {
+	if c.elemtype.kind&kindNoPointers != 0 {
+		return
+	}
+	if c.spsc != 0 {
+		memclr(chanbuf(c, c.recvx), uintptr(n)*c.elemsize)
+		return
+	}
+	end := c.recvx + n
+	if end == c.dataqsiz {
+		left := c.qcount - n
+		memclr(chanbuf(c, left), uintptr(c.dataqsiz-left)*c.elemsize)
+		c.clearx = 0
+		return
+	}
+	if end != c.sendx {
+		return
+	}
+	memclr(chanbuf(c, c.clearx), uintptr(end-c.clearx)*c.elemsize)
+	c.clearx = end
 }
 
 // entry point for c <- x from compiled code
 //go:nosplit
 func chansend1(t *chantype, c *hchan, elem unsafe.Pointer) {
-	chansend(t, c, elem, true, getcallerpc(unsafe.Pointer(&t)))
+	chansend(t, c, elem, true, nil, getcallerpc(unsafe.Pointer(&t)))
 }
 
 /*
@@ -100,8 +178,12 @@ func chansend1(t *chantype, c *hchan, elem unsafe.Pointer) {
  * been closed.  it is easiest to loop and re-run
  * the operation; we'll see that it's now closed.
  * 如果参数 block == false, 那么该函数不会阻塞，而是直接返回是否成功发送数据到 channel
+ * tmo 不为 nil 时阻塞到 tmo 的 timer 触发为止, 超时返回 false, 见 chansendt
  */
-func chansend(t *chantype, c *hchan, ep unsafe.Pointer, block bool, callerpc uintptr) bool {
+func chansend(t *chantype, c *hchan, ep unsafe.Pointer, block bool, tmo *chanTimeout, callerpc uintptr) bool {
+	if raceenabled {
+		raceReadObjectPC(t.elem, ep, callerpc, funcPC(chansend))
+	}
 	// channel 的值是 nil
 	if c == nil {
 		if !block {
@@ -109,10 +191,18 @@ func chansend(t *chantype, c *hchan, ep unsafe.Pointer, block bool, callerpc uin
 			return false
 		}
 		// 项一个 nil 的 channel 发送数据, 永远 block 在这里
-		gopark(nil, nil, "chan send (nil chan)", traceEvGoStop, 2)
+		gopark(nil, nil, waitReasonChanSendNilChan, traceEvGoStop, 2)
 		throw("unreachable")
 	}
 
+	if raceenabled {
+		racereadpc(unsafe.Pointer(c), callerpc, funcPC(chansend))
+	}
+
+	if c.spsc != 0 && chansendSPSC(c, ep) {
+		return true
+	}
+
 	// Fast path: check for failed non-blocking operation without acquiring the lock.
 	//
 	// After observing that the channel is not closed, we observe that the channel is
@@ -129,17 +219,29 @@ func chansend(t *chantype, c *hchan, ep unsafe.Pointer, block bool, callerpc uin
 	// channel wasn't closed during the first observation.
 	// 快速通道, 在不需要加锁的情况下完成操作
 	// 如果操作(不阻塞发送 && channel 没有关闭 && 目前没有 goroutine 正在读这个 channel), 这直接返回 false
+	var r0 uintptr
+	if debugChan && c.dataqsiz > 0 {
+		r0 = atomicloaduintptr(&c.recvseq)
+	}
 	if !block && c.closed == 0 && ((c.dataqsiz == 0 && c.recvq.first == nil) ||
 		(c.dataqsiz > 0 && c.qcount == c.dataqsiz)) {
+		if debugChan && c.dataqsiz > 0 {
+			chanseqfull(c, r0)
+		}
 		return false
 	}
 
+	// 开启了 block profile 时记录开始等待的时间, 被唤醒时对方在 sudog.releasetime 中填上唤醒的时间
 	var t0 int64
+	if blockprofilerate > 0 {
+		t0 = cputicks()
+	}
 
 	lock(&c.lock)
 
 	// channel 已经被 close 了，直接 panic
 	if c.closed != 0 {
+		printchanclosed(c)
 		unlock(&c.lock)
 		panic("send on closed channel")
 	}
@@ -148,6 +250,9 @@ func chansend(t *chantype, c *hchan, ep unsafe.Pointer, block bool, callerpc uin
 	if c.dataqsiz == 0 { // synchronous channel
 		sg := c.recvq.dequeue()
 		if sg != nil { // found a waiting receiver
+			if raceenabled {
+				racesync(c, sg)
+			}
 			unlock(&c.lock)
 
 			recvg := sg.g
@@ -159,7 +264,7 @@ func chansend(t *chantype, c *hchan, ep unsafe.Pointer, block bool, callerpc uin
 			if sg.releasetime != 0 {
 				sg.releasetime = cputicks()
 			}
-			goready(recvg, 3)
+			chanready(sg, 3)
 			return true
 		}
 
@@ -178,12 +283,23 @@ func chansend(t *chantype, c *hchan, ep unsafe.Pointer, block bool, callerpc uin
 		}
 		mysg.elem = ep
 		mysg.waitlink = nil
-		gp.waiting = mysg
 		mysg.g = gp
+		mysg.c = c
 		mysg.selectdone = nil
+		if tmo != nil && !tmo.arm(mysg) {
+			unlock(&c.lock)
+			mysg.elem = nil
+			releaseSudog(mysg)
+			return false
+		}
+		gp.waiting = mysg
 		gp.param = nil
 		c.sendq.enqueue(mysg)
-		goparkunlock(&c.lock, "chan send", traceEvGoBlockSend, 3)
+		if tmo != nil || !chansyncspin(c, mysg) {
+			tpark := chanparkstart()
+			goparkunlock(&c.lock, waitReasonChanSend, traceEvGoBlockSend, 3)
+			chanparkdone(tpark)
+		}
 
 		// someone woke us up.
 		// goroutine 被唤醒了, 因为有其他 goroutine 要从 channel 中读取数据
@@ -191,10 +307,20 @@ func chansend(t *chantype, c *hchan, ep unsafe.Pointer, block bool, callerpc uin
 			throw("G waiting list is corrupted!")
 		}
 		gp.waiting = nil
+		if mysg.releasetime > 0 {
+			blockevent(int64(mysg.releasetime)-t0, 2)
+		}
+		mysg.selectdone = nil
 		if gp.param == nil {
+			if tmo != nil && tmo.timedout {
+				mysg.elem = nil
+				releaseSudog(mysg)
+				return false
+			}
 			if c.closed == 0 {
 				throw("chansend: spurious wakeup")
 			}
+			printchanclosed(c)
 			panic("send on closed channel")
 		}
 		gp.param = nil
@@ -203,6 +329,36 @@ func chansend(t *chantype, c *hchan, ep unsafe.Pointer, block bool, callerpc uin
 	}
 
 	// asynchronous channel
+	// buffer 是空的而且有接收者在等待时, 跟同步 channel 一样直接把数据复制给接收者, 不经过 buffer,
+	// 省掉写入 buffer 再由接收者读出来的一次复制。
+	// select 中等待的接收者只能从 buffer 中取数据(见 selectgo 的 pass 3), 写入 buffer 后再唤醒它。
+	var recvsg *sudog
+	if c.qcount == 0 {
+		if sg := c.recvq.dequeue(); sg != nil {
+			if sg.selectdone == nil {
+				if raceenabled {
+					// 和经过 buffer 一样同步, 使用的是接收者本来会读的位置。
+					raceacquire(chanbuf(c, c.recvx))
+					racerelease(chanbuf(c, c.recvx))
+					raceacquireg(sg.g, chanbuf(c, c.recvx))
+					racereleaseg(sg.g, chanbuf(c, c.recvx))
+				}
+				unlock(&c.lock)
+				recvg := sg.g
+				if sg.elem != nil {
+					syncsend(c, sg, ep)
+				}
+				recvg.param = unsafe.Pointer(sg)
+				if sg.releasetime != 0 {
+					sg.releasetime = cputicks()
+				}
+				chanready(sg, 3)
+				return true
+			}
+			recvsg = sg
+		}
+	}
+
 	// wait for some space to write our data
 	var t1 int64
 	// 循环等待 channel 有空位了, 这个循环内 goroutine 可能会被反复的 block 和 ready, 但直到把数据放到 buffer 了才退出循环
@@ -211,58 +367,110 @@ func chansend(t *chantype, c *hchan, ep unsafe.Pointer, block bool, callerpc uin
 			unlock(&c.lock)
 			return false
 		}
+		if c.spsc != 0 && chanspscWait(c, true) {
+			continue
+		}
 		gp := getg()
 		mysg := acquireSudog()
 		mysg.releasetime = 0
 		if t0 != 0 {
 			mysg.releasetime = -1
 		}
+		// 接收者取走一个元素后会把 ep 复制到空出来的位置, 见 sendqhandoff。
+		// 和同步 channel 一样把 mysg 挂在 gp.waiting 上, 栈被复制时 mysg.elem 会被调整。
 		mysg.g = gp
-		mysg.elem = nil
+		mysg.c = c
+		mysg.elem = ep
+		mysg.waitlink = nil
 		mysg.selectdone = nil
+		if tmo != nil && !tmo.arm(mysg) {
+			unlock(&c.lock)
+			mysg.elem = nil
+			releaseSudog(mysg)
+			if c.spsc != 0 {
+				chanspscWaitDone(c)
+			}
+			return false
+		}
+		gp.waiting = mysg
+		gp.param = nil
 		// 加到 sendq 队列中
 		c.sendq.enqueue(mysg)
 		// 阻塞等待被唤醒
-		goparkunlock(&c.lock, "chan send", traceEvGoBlockSend|futile, 3)
+		tpark := chanparkstart()
+		goparkunlock(&c.lock, waitReasonChanSend, traceEvGoBlockSend|futile, 3)
+		chanparkdone(tpark)
 
-		// someone woke us up - try again
-		// channel 有空间了, 被唤醒, 参见 chanrecv() 方法, 那里会因为读 channel 操作而唤醒这里的写 channel goroutine
+		// someone woke us up
+		// 参见 chanrecv() 方法, 那里会因为读 channel 操作而唤醒这里的写 channel goroutine
+		if mysg != gp.waiting {
+			throw("G waiting list is corrupted!")
+		}
+		gp.waiting = nil
 		if mysg.releasetime > 0 {
 			t1 = mysg.releasetime
 		}
+		sent := gp.param != nil
+		gp.param = nil
+		mysg.selectdone = nil
+		mysg.elem = nil
 		releaseSudog(mysg)
+		if c.spsc != 0 {
+			chanspscWaitDone(c)
+		}
+		if sent {
+			// 接收者已经把数据放进了 buffer
+			if t1 > 0 {
+				blockevent(t1-t0, 2)
+			}
+			return true
+		}
+		// 被 close、超时或者没有交给我们位置的唤醒(select, chanspscWake) - try again
+		if tmo != nil && tmo.timedout {
+			return false
+		}
 		lock(&c.lock)
 		if c.closed != 0 { // 被唤醒后发现 channel 已经被 close 了, 直接 panic
+			printchanclosed(c)
 			unlock(&c.lock)
 			panic("send on closed channel")
 		}
 	}
 
+	if raceenabled {
+		raceacquire(chanbuf(c, c.sendx))
+		racerelease(chanbuf(c, c.sendx))
+	}
 	typedmemmove(c.elemtype, chanbuf(c, c.sendx), ep)
 	c.sendx++
 	if c.sendx == c.dataqsiz {
 		c.sendx = 0
 	}
-	c.qcount++
+	chanqadd(c, 1)
 
 	// wake up a waiting receiver
 	// 把数据成功放到 channel buffer 中后, 尝试唤醒一个等待接收 channel 的 goroutine
-	sg := c.recvq.dequeue()
+	sg := recvsg
+	if sg == nil {
+		sg = c.recvq.dequeue()
+	}
 	if sg != nil {
-		recvg := sg.g
 		unlock(&c.lock)
 		if sg.releasetime != 0 {
 			sg.releasetime = cputicks()
 		}
-		goready(recvg, 3)
+		chanready(sg, 3)
 	} else {
 		unlock(&c.lock)
 	}
+	if t1 > 0 {
+		blockevent(t1-t0, 2)
+	}
 	return true
 }
 
 func syncsend(c *hchan, sg *sudog, elem unsafe.Pointer) {
-	// Send on unbuffered channel is the only operation
+	// Send on an unbuffered or empty-buffered channel is the only operation
 	// in the entire runtime where one goroutine
 	// writes to the stack of another goroutine. The GC assumes that
 	// stack writes only happen when the goroutine is running and are
@@ -276,6 +484,88 @@ func syncsend(c *hchan, sg *sudog, elem unsafe.Pointer) {
 	sg.elem = nil
 }
 
+// 同步 channel 上没有对方时, 等待者先在 chansyncspin 中自旋一会儿再 gopark。
+// 自旋时 sudog 已经在等待队列中, 晚到一点点的对方照常 dequeue 它、交接数据, 只是不能 goready
+// 一个还在运行的 g, 所以用 sudog.spin 交接:
+//
+//	等待者持有 c.lock 时把 spin 设成 sudogSpinning, 释放锁开始自旋
+//	对方在 dequeue 中(持有 c.lock)把 sudogSpinning 改成 sudogClaimed, 交接完 elem 和 gp.param 之后
+//	在 chanready 中改成 sudogHanded, 代替 goready
+//	等待者自旋结束后重新加锁, spin 仍然是 sudogSpinning 就说明没有被取走, 改回 0 照常 gopark;
+//	否则等到 sudogHanded, 和被唤醒一样继续
+//
+// 对方从 claim 到 chanready 之间不能被抢占(acquirem), 否则等待者要一直等它, 连 stop the world 都会被挡住。
+var chanspinoff bool // 只给测试用, 关掉自旋作比较
+
+const (
+	sudogSpinning = 1
+	sudogClaimed  = 2
+	sudogHanded   = 3
+)
+
+// chansyncspin 在 sg 已经放进同步 channel 的等待队列、准备 gopark 之前调用, 调用者持有 c.lock。
+// 多核机器上释放锁, 和 sync.Mutex 一样有限地自旋(见 sync_runtime_canSpin), 等对方取走 sg。
+// 返回 true 表示对方已经完成了交接, 这时不再持有 c.lock, 调用者和被唤醒之后一样处理;
+// 返回 false 时仍然持有 c.lock, sg 还在队列中, 调用者照常 gopark。
+// 自旋在 system stack 上进行, 这样对方读写 sg.elem 指向的栈时栈不会被移动。
+func chansyncspin(c *hchan, sg *sudog) (handed bool) {
+	if chanspinoff || !sync_runtime_canSpin(0) {
+		return false
+	}
+	systemstack(func() {
+		atomicstore(&sg.spin, sudogSpinning)
+		unlock(&c.lock)
+		for i := 0; sync_runtime_canSpin(i); i++ {
+			procyield(active_spin_cnt)
+			if atomicload(&sg.spin) != sudogSpinning {
+				break
+			}
+		}
+		lock(&c.lock)
+		if sg.spin == sudogSpinning {
+			// 没有对方来, 仍然在队列中
+			sg.spin = 0
+			return
+		}
+		unlock(&c.lock)
+		for atomicload(&sg.spin) != sudogHanded {
+			procyield(active_spin_cnt)
+		}
+		sg.spin = 0
+		handed = true
+	})
+	return
+}
+
+// claimspin 在 dequeue 取出 sgp 时调用, 持有 c.lock。sgp.g 还在自旋的话标记为已经取走,
+// 并且在 chanready 之前不让当前 M 被抢占。
+func (sgp *sudog) claimspin() {
+	if sgp.spin == sudogSpinning {
+		acquirem()
+		atomicstore(&sgp.spin, sudogClaimed)
+	}
+}
+
+// chanready 唤醒从等待队列中取出的 sg.g, 代替 goready(sg.g, traceskip)。
+// sg.g 还在 chansyncspin 中自旋时只告诉它交接已经完成, 之后不能再使用 sg。
+func chanready(sg *sudog, traceskip int) {
+	if atomicload(&sg.spin) == sudogClaimed {
+		atomicstore(&sg.spin, sudogHanded)
+		releasem(getg().m)
+		return
+	}
+	goready(sg.g, traceskip+1)
+}
+
+// racesync 告诉 race detector 当前 goroutine 和 sg.g 通过同步 channel 交换了数据,
+// 相当于两边都对同一个位置做了一次 acquire 和 release。
+func racesync(c *hchan, sg *sudog) {
+	racerelease(chanbuf(c, 0))
+	raceacquireg(sg.g, chanbuf(c, 0))
+	racereleaseg(sg.g, chanbuf(c, 0))
+	raceacquire(chanbuf(c, 0))
+}
+
 func closechan(c *hchan) {
 	if c == nil {
 		panic("close of nil channel")
@@ -287,7 +577,80 @@ func closechan(c *hchan) {
 		panic("close of closed channel")
 	}
 
+	if raceenabled {
+		callerpc := getcallerpc(unsafe.Pointer(&c))
+		racewritepc(unsafe.Pointer(c), callerpc, funcPC(closechan))
+		racerelease(unsafe.Pointer(c))
+	}
+	closechanLocked(c, getcallerpc(unsafe.Pointer(&c)))
+}
+
+// tryclosechan closes c unless it is already closed, and reports whether
+// it closed it. Shutdown paths with several possible closers can use it
+// instead of recovering from the double-close panic.
+func tryclosechan(c *hchan) bool {
+	if c == nil {
+		panic("close of nil channel")
+	}
+
+	lock(&c.lock)
+	if c.closed != 0 {
+		unlock(&c.lock)
+		return false
+	}
+
+	if raceenabled {
+		callerpc := getcallerpc(unsafe.Pointer(&c))
+		racewritepc(unsafe.Pointer(c), callerpc, funcPC(tryclosechan))
+		racerelease(unsafe.Pointer(c))
+	}
+	closechanLocked(c, getcallerpc(unsafe.Pointer(&c)))
+	return true
+}
+
+// closechandrain 和 closechan 一样关闭 c, 同时把 buffer 中还没有被接收的元素取出来,
+// 放到新分配的数组 buf 中, 返回 buf 和元素个数 n。数组的长度是 c 的容量。
+// 不用再在 close 之后循环接收剩下的元素, 那样的话别的接收者可能同时在取, 结果不确定。
+// spsc channel 上只能由唯一的接收者调用, 因为不加锁的接收看不到 c.lock。
+func closechandrain(c *hchan) (buf unsafe.Pointer, n int) {
+	if c == nil {
+		panic("close of nil channel")
+	}
+	if c.dataqsiz > 0 {
+		// qcount 不会超过 dataqsiz, 在加锁之前分配。
+		buf = newarray(c.elemtype, uintptr(c.dataqsiz))
+	}
+
+	lock(&c.lock)
+	if c.closed != 0 {
+		unlock(&c.lock)
+		panic("close of closed channel")
+	}
+	if raceenabled {
+		callerpc := getcallerpc(unsafe.Pointer(&c))
+		racewritepc(unsafe.Pointer(c), callerpc, funcPC(closechandrain))
+		racerelease(unsafe.Pointer(c))
+	}
+	n = int(c.qcount)
+	chanbufget(c, buf, n)
+	chanqadd(c, -n)
+	closechanLocked(c, getcallerpc(unsafe.Pointer(&c)))
+	return
+}
+
+// closechanLocked 标记 c 已经关闭并唤醒所有等待者, 调用者持有 c.lock, 返回时已经释放。
+// pc 是调用 close 的位置, 和当前 goroutine 一起记下来, 向已经关闭的 channel 发送时打印。
+func closechanLocked(c *hchan, pc uintptr) {
 	c.closed = 1
+	c.closepc = pc
+	c.closegid = getg().m.curg.goid
+
+	// 先在持有锁的时候把所有等待者取出来, 通过 g.schedlink 串成链表,
+	// unlock 之后再逐个 goready。等待者很多时不会让其他想要 c.lock 的 goroutine
+	// 一直等着, 被唤醒的 goroutine 也不会马上在 c.lock 上阻塞。
+	// 还在 chansyncspin 中自旋的等待者没有 gopark, 通过 sudog.next 另外串起来, 用 chanready 通知。
+	var glist *g
+	var spun *sudog
 
 	// release all readers
 	for {
@@ -297,8 +660,17 @@ func closechan(c *hchan) {
 		}
 		gp := sg.g
 		sg.elem = nil
+		if sg.releasetime != 0 {
+			sg.releasetime = cputicks()
+		}
 		gp.param = nil
-		goready(gp, 3)
+		if sg.spin == sudogClaimed {
+			sg.next = spun
+			spun = sg
+			continue
+		}
+		gp.schedlink.set(glist)
+		glist = gp
 	}
 
 	// release all writers
@@ -309,21 +681,70 @@ func closechan(c *hchan) {
 		}
 		gp := sg.g
 		sg.elem = nil
+		if sg.releasetime != 0 {
+			sg.releasetime = cputicks()
+		}
 		gp.param = nil
-		goready(gp, 3)
+		if sg.spin == sudogClaimed {
+			sg.next = spun
+			spun = sg
+			continue
+		}
+		gp.schedlink.set(glist)
+		glist = gp
 	}
 	unlock(&c.lock)
+
+	for spun != nil {
+		sg := spun
+		spun = sg.next
+		sg.next = nil
+		chanready(sg, 3)
+	}
+
+	// Ready all Gs now that we've dropped the channel lock.
+	for glist != nil {
+		gp := glist
+		glist = glist.schedlink.ptr()
+		gp.schedlink = 0
+		goready(gp, 3)
+	}
+}
+
+// printchanclosed 在 "send on closed channel" panic 之前打印 c 的状态和是谁关闭的 c,
+// 只在 GODEBUG=chanpanicdetail=1 时打印。closepc 和 closegid 在关闭之后不再改变,
+// 调用者不一定持有 c.lock, 这时 buffer 占用只是一个参考值。
+func printchanclosed(c *hchan) {
+	if debug.chanpanicdetail == 0 {
+		return
+	}
+	print("send on closed channel: chan ", *c.elemtype._string, " len=", c.qcount, " cap=", c.dataqsiz, "\n")
+	print("\tclosed by goroutine ", c.closegid, "\n")
+	printchanpc("\tclosed at ", c.closepc)
 }
 
 // entry points for <- c from compiled code
 //go:nosplit
 func chanrecv1(t *chantype, c *hchan, elem unsafe.Pointer) {
-	chanrecv(t, c, elem, true)
+	chanrecv(t, c, elem, true, nil, nil)
 }
 
 //go:nosplit
 func chanrecv2(t *chantype, c *hchan, elem unsafe.Pointer) (received bool) {
-	_, received = chanrecv(t, c, elem, true)
+	_, received = chanrecv(t, c, elem, true, nil, nil)
+	return
+}
+
+// chanrecvleft is a blocking receive that also returns how many
+// elements were still buffered in c right after this one was taken.
+// The count is read under c.lock in the same critical section as the
+// receive, so a consumer draining a closed channel can stop exactly when
+// it reaches 0 instead of racing on len(c). It is 0 for a synchronous
+// channel, for an element handed over directly by a waiting sender, and
+// when c is closed and empty. On a single-producer/single-consumer
+// channel the sender does not take the lock, so the count is only a hint.
+func chanrecvleft(t *chantype, c *hchan, ep unsafe.Pointer) (received bool, left int) {
+	_, received = chanrecv(t, c, ep, true, nil, &left)
 	return
 }
 
@@ -331,8 +752,16 @@ func chanrecv2(t *chantype, c *hchan, elem unsafe.Pointer) (received bool) {
 // ep may be nil, in which case received data is ignored.
 // If block == false and no elements are available, returns (false, false).
 // Otherwise, if c is closed, zeros *ep and returns (true, false).
+// So a non-blocking receive tells empty, closed and received apart in one
+// call; the compiler uses this for select with a default case (selectnbrecv2)
+// and reflect for TryRecv.
 // Otherwise, fills in *ep with an element and returns (true, true).
-func chanrecv(t *chantype, c *hchan, ep unsafe.Pointer, block bool) (selected, received bool) {
+// If tmo != nil, chanrecv blocks only until tmo's timer fires and then
+// returns (false, false), see chanrecvt.
+// If left != nil and an element is taken from c's buffer, *left is set
+// to the number of elements still buffered, counted before c.lock is
+// released; it is left alone otherwise. See chanrecvleft.
+func chanrecv(t *chantype, c *hchan, ep unsafe.Pointer, block bool, tmo *chanTimeout, left *int) (selected, received bool) {
 	// raceenabled: don't need to check ep, as it is always on the stack.
 
 	// 同 chansend 一样, 从一个 nil 的 channel 读取数据, 也会永远 block
@@ -340,10 +769,18 @@ func chanrecv(t *chantype, c *hchan, ep unsafe.Pointer, block bool) (selected, r
 		if !block {
 			return
 		}
-		gopark(nil, nil, "chan receive (nil chan)", traceEvGoStop, 2)
+		gopark(nil, nil, waitReasonChanReceiveNilChan, traceEvGoStop, 2)
 		throw("unreachable")
 	}
 
+	if c.spsc != 0 && chanrecvSPSC(c, ep) {
+		if left != nil {
+			// 不加锁的发送者随时可能再放进来一个, 只能是一个参考值
+			*left = int(atomicloaduint(&c.qcount))
+		}
+		return true, true
+	}
+
 	// Fast path: check for failed non-blocking operation without acquiring the lock.
 	//
 	// After observing that the channel is not ready for receiving, we observe that the
@@ -356,12 +793,24 @@ func chanrecv(t *chantype, c *hchan, ep unsafe.Pointer, block bool) (selected, r
 	//
 	// The order of operations is important here: reversing the operations can lead to
 	// incorrect behavior when racing with a close.
+	var s0 uintptr
+	if debugChan && c.dataqsiz > 0 {
+		s0 = atomicloaduintptr(&c.sendseq)
+	}
 	if !block && (c.dataqsiz == 0 && c.sendq.first == nil ||
 		c.dataqsiz > 0 && atomicloaduint(&c.qcount) == 0) &&
 		atomicload(&c.closed) == 0 {
+		if debugChan && c.dataqsiz > 0 {
+			chanseqempty(c, s0)
+		}
 		return
 	}
 
+	var t0 int64
+	if blockprofilerate > 0 {
+		t0 = cputicks()
+	}
+
 	lock(&c.lock)
 	if c.dataqsiz == 0 { // synchronous channel
 		if c.closed != 0 {
@@ -370,6 +819,9 @@ func chanrecv(t *chantype, c *hchan, ep unsafe.Pointer, block bool) (selected, r
 
 		sg := c.sendq.dequeue()
 		if sg != nil {
+			if raceenabled {
+				racesync(c, sg)
+			}
 			unlock(&c.lock)
 
 			if ep != nil {
@@ -381,7 +833,7 @@ func chanrecv(t *chantype, c *hchan, ep unsafe.Pointer, block bool) (selected, r
 			if sg.releasetime != 0 {
 				sg.releasetime = cputicks()
 			}
-			goready(gp, 3)
+			chanready(sg, 3)
 			selected = true
 			received = true
 			return
@@ -396,22 +848,41 @@ func chanrecv(t *chantype, c *hchan, ep unsafe.Pointer, block bool) (selected, r
 		gp := getg()
 		mysg := acquireSudog()
 		mysg.releasetime = 0
+		if t0 != 0 {
+			mysg.releasetime = -1
+		}
 		mysg.elem = ep
 		mysg.waitlink = nil
-		gp.waiting = mysg
 		mysg.g = gp
+		mysg.c = c
 		mysg.selectdone = nil
+		if tmo != nil && !tmo.arm(mysg) {
+			unlock(&c.lock)
+			mysg.elem = nil
+			releaseSudog(mysg)
+			return
+		}
+		gp.waiting = mysg
 		gp.param = nil
 		c.recvq.enqueue(mysg)
-		goparkunlock(&c.lock, "chan receive", traceEvGoBlockRecv, 3)
+		if tmo != nil || !chansyncspin(c, mysg) {
+			tpark := chanparkstart()
+			goparkunlock(&c.lock, waitReasonChanReceive, traceEvGoBlockRecv, 3)
+			chanparkdone(tpark)
+		}
 
 		// someone woke us up
 		if mysg != gp.waiting {
 			throw("G waiting list is corrupted!")
 		}
 		gp.waiting = nil
+		if mysg.releasetime > 0 {
+			blockevent(mysg.releasetime-t0, 2)
+		}
 		haveData := gp.param != nil
 		gp.param = nil
+		mysg.selectdone = nil
+		mysg.elem = nil
 		releaseSudog(mysg)
 
 		if haveData {
@@ -420,6 +891,9 @@ func chanrecv(t *chantype, c *hchan, ep unsafe.Pointer, block bool) (selected, r
 			received = true
 			return
 		}
+		if tmo != nil && tmo.timedout {
+			return
+		}
 
 		lock(&c.lock)
 		if c.closed == 0 {
@@ -430,6 +904,7 @@ func chanrecv(t *chantype, c *hchan, ep unsafe.Pointer, block bool) (selected, r
 
 	// asynchronous channel
 	// wait for some data to appear
+	var t1 int64
 	for futile := byte(0); c.qcount <= 0; futile = traceFutileWakeup {
 		if c.closed != 0 {
 			selected, received = recvclosed(c, ep)
@@ -440,46 +915,104 @@ func chanrecv(t *chantype, c *hchan, ep unsafe.Pointer, block bool) (selected, r
 			unlock(&c.lock)
 			return
 		}
+		if c.spsc != 0 && chanspscWait(c, false) {
+			continue
+		}
 
 		// wait for someone to send an element
+		// 发送者可能直接把数据复制到 ep, 这时 gp.param 不为 nil, 见 chansend。
+		// 和同步 channel 一样把 mysg 挂在 gp.waiting 上, 栈被复制时 mysg.elem 会被调整。
 		gp := getg()
 		mysg := acquireSudog()
 		mysg.releasetime = 0
-		mysg.elem = nil
+		if t0 != 0 {
+			mysg.releasetime = -1
+		}
+		mysg.elem = ep
+		mysg.waitlink = nil
 		mysg.g = gp
+		mysg.c = c
 		mysg.selectdone = nil
+		if tmo != nil && !tmo.arm(mysg) {
+			unlock(&c.lock)
+			mysg.elem = nil
+			releaseSudog(mysg)
+			if c.spsc != 0 {
+				chanspscWaitDone(c)
+			}
+			return
+		}
+		gp.waiting = mysg
+		gp.param = nil
 
 		c.recvq.enqueue(mysg)
-		goparkunlock(&c.lock, "chan receive", traceEvGoBlockRecv|futile, 3)
+		tpark := chanparkstart()
+		goparkunlock(&c.lock, waitReasonChanReceive, traceEvGoBlockRecv|futile, 3)
+		chanparkdone(tpark)
 		// someone woke us up - try again
+		if mysg != gp.waiting {
+			throw("G waiting list is corrupted!")
+		}
+		gp.waiting = nil
+		if mysg.releasetime > 0 {
+			t1 = mysg.releasetime
+		}
+		haveData := gp.param != nil
+		gp.param = nil
+		mysg.selectdone = nil
+		mysg.elem = nil
 		releaseSudog(mysg)
+		if c.spsc != 0 {
+			chanspscWaitDone(c)
+		}
+		if haveData {
+			// a sender sent us some data. It already wrote to ep.
+			if t1 > 0 {
+				blockevent(t1-t0, 2)
+			}
+			selected = true
+			received = true
+			return
+		}
+		if tmo != nil && tmo.timedout {
+			return
+		}
 		lock(&c.lock)
 	}
 
+	if raceenabled {
+		raceacquire(chanbuf(c, c.recvx))
+		racerelease(chanbuf(c, c.recvx))
+	}
 	if ep != nil {
 		typedmemmove(c.elemtype, ep, chanbuf(c, c.recvx))
 	}
-	memclr(chanbuf(c, c.recvx), uintptr(c.elemsize))
+	chanbufclear(c, 1)
 
 	c.recvx++
 	if c.recvx == c.dataqsiz {
 		c.recvx = 0
 	}
-	c.qcount--
+	chanqadd(c, -1)
 
 	// ping a sender now that there is space
-	sg := c.sendq.dequeue()
+	sg := sendqhandoff(c)
+	if left != nil {
+		*left = int(c.qcount) // 包括 sendqhandoff 刚刚替发送者放进去的元素
+	}
 	if sg != nil {
-		gp := sg.g
 		unlock(&c.lock)
 		if sg.releasetime != 0 {
 			sg.releasetime = cputicks()
 		}
-		goready(gp, 3)
+		chanready(sg, 3)
 	} else {
 		unlock(&c.lock)
 	}
 
+	if t1 > 0 {
+		blockevent(t1-t0, 2)
+	}
 	selected = true
 	received = true
 	return
@@ -489,13 +1022,77 @@ func chanrecv(t *chantype, c *hchan, ep unsafe.Pointer, block bool) (selected, r
 // when the receiver encounters a closed channel.
 // Caller must hold c.lock, recvclosed will release the lock.
 func recvclosed(c *hchan, ep unsafe.Pointer) (selected, recevied bool) {
+	if raceenabled {
+		raceacquire(unsafe.Pointer(c))
+	}
 	unlock(&c.lock)
 	if ep != nil {
-		memclr(ep, uintptr(c.elemsize))
+		memclr(ep, c.elemsize)
 	}
 	return true, false
 }
 
+// sendqhandoff 在接收者从 buffer 中取走一个元素之后调用, 调用者持有 c.lock。
+// 它从 c.sendq 中取出一个等待的发送者, 由调用者在释放锁之后 goready。
+// 如果是 chansend 中等待的发送者, 就把它的元素直接复制到刚空出来的位置, 并设置 gp.param
+// 告诉它发送已经完成, 它醒来之后不用再重新加锁和别的发送者争这个位置。
+// select 和 chansendt 中等待的发送者(selectdone 不为 nil)只被唤醒, 自己重新检查 buffer。
+func sendqhandoff(c *hchan) *sudog {
+	sg := c.sendq.dequeue()
+	if sg == nil || sg.selectdone != nil || sg.elem == nil {
+		return sg
+	}
+	if raceenabled {
+		// 替 sg.g 写入, 和它自己写 buffer 一样同步。
+		raceacquireg(sg.g, chanbuf(c, c.sendx))
+		racereleaseg(sg.g, chanbuf(c, c.sendx))
+	}
+	typedmemmove(c.elemtype, chanbuf(c, c.sendx), sg.elem)
+	c.sendx++
+	if c.sendx == c.dataqsiz {
+		c.sendx = 0
+	}
+	chanqadd(c, 1)
+	sg.elem = nil
+	sg.g.param = unsafe.Pointer(sg)
+	return sg
+}
+
+// chanpeek copies the element at the head of c's buffer to ep without
+// removing it. It returns false, leaving ep unchanged, if the buffer is
+// empty, which is always the case for a synchronous channel.
+// 只是看一眼, 不会唤醒等待的发送者; 返回之后队头的元素可能已经被别的接收者取走了。
+// spsc channel 上只能由唯一的接收者调用, 它不加锁地读队头。
+func chanpeek(t *chantype, c *hchan, ep unsafe.Pointer) bool {
+	if c == nil || c.dataqsiz == 0 {
+		return false
+	}
+	if c.spsc != 0 {
+		if !chanspscCanRecv(c) {
+			return false
+		}
+		if raceenabled {
+			raceacquire(chanbuf(c, c.recvx))
+		}
+		typedmemmove(c.elemtype, ep, chanbuf(c, c.recvx))
+		return true
+	}
+	if atomicloaduint(&c.qcount) == 0 {
+		return false
+	}
+	lock(&c.lock)
+	if c.qcount == 0 {
+		unlock(&c.lock)
+		return false
+	}
+	if raceenabled {
+		raceacquire(chanbuf(c, c.recvx))
+	}
+	typedmemmove(c.elemtype, ep, chanbuf(c, c.recvx))
+	unlock(&c.lock)
+	return true
+}
+
 // compiler implements
 //
 //	select {
@@ -514,7 +1111,7 @@ func recvclosed(c *hchan, ep unsafe.Pointer) (selected, recevied bool) {
 //	}
 //
 func selectnbsend(t *chantype, c *hchan, elem unsafe.Pointer) (selected bool) {
-	return chansend(t, c, elem, false, getcallerpc(unsafe.Pointer(&t)))
+	return chansend(t, c, elem, false, nil, getcallerpc(unsafe.Pointer(&t)))
 }
 
 // compiler implements
@@ -528,15 +1125,14 @@ func selectnbsend(t *chantype, c *hchan, elem unsafe.Pointer) (selected bool) {
 //
 // as
 //
-//	if selectnbrecv(&v, c) {
+//	if selected, _ := selectnbrecv(&v, c); selected {
 //		... foo
 //	} else {
 //		... bar
 //	}
 //
-func selectnbrecv(t *chantype, elem unsafe.Pointer, c *hchan) (selected bool) {
-	selected, _ = chanrecv(t, c, elem, false)
-	return
+func selectnbrecv(t *chantype, elem unsafe.Pointer, c *hchan) (selected, received bool) {
+	return chanrecv(t, c, elem, false, nil, nil)
 }
 
 // compiler implements
@@ -550,16 +1146,26 @@ func selectnbrecv(t *chantype, elem unsafe.Pointer, c *hchan) (selected bool) {
 //
 // as
 //
-//	if c != nil && selectnbrecv2(&v, &ok, c) {
+//	if selected, ok = selectnbrecv2(&v, c); selected {
 //		... foo
 //	} else {
 //		... bar
 //	}
 //
-func selectnbrecv2(t *chantype, elem unsafe.Pointer, received *bool, c *hchan) (selected bool) {
-	// TODO(khr): just return 2 values from this function, now that it is in Go.
-	selected, *received = chanrecv(t, c, elem, false)
-	return
+// chanrecv 对 nil channel 的非阻塞接收返回 (false, false), 所以不需要先检查 c != nil。
+// 和 selectnbrecv 一样, 只是 ok 也要赋值。
+func selectnbrecv2(t *chantype, elem unsafe.Pointer, c *hchan) (selected, received bool) {
+	return chanrecv(t, c, elem, false, nil, nil)
+}
+
+//go:linkname reflect_chanrecvleft reflect.chanrecvleft
+func reflect_chanrecvleft(t *chantype, c *hchan, elem unsafe.Pointer) (received bool, left int) {
+	return chanrecvleft(t, c, elem)
+}
+
+//go:linkname reflect_chanpeek reflect.chanpeek
+func reflect_chanpeek(t *chantype, c *hchan, elem unsafe.Pointer) bool {
+	return chanpeek(t, c, elem)
 }
 
 //go:linkname reflect_chanclose reflect.chanclose
@@ -567,13 +1173,61 @@ func reflect_chanclose(c *hchan) {
 	closechan(c)
 }
 
+//go:linkname reflect_chantryclose reflect.chantryclose
+func reflect_chantryclose(c *hchan) bool {
+	return tryclosechan(c)
+}
+
+//go:linkname reflect_chanclosedrain reflect.chanclosedrain
+func reflect_chanclosedrain(c *hchan) (unsafe.Pointer, int) {
+	return closechandrain(c)
+}
+
+// SetChanWaitPriority sets the priority of the calling goroutine's
+// future channel waits and returns the previous setting. When several
+// goroutines are blocked sending to or receiving from a channel, the one
+// with the highest priority is served first; goroutines of equal priority
+// are served in the order they blocked. The default priority is 0.
+func SetChanWaitPriority(prio int32) int32 {
+	gp := getg()
+	old := gp.chanprio
+	gp.chanprio = prio
+	return old
+}
+
+// enqueue 把 sgp 放在队列中所有优先级不低于它的等待者之后, dequeue 总是从队头取,
+// 所以优先级高的先被唤醒, 同一优先级先进先出。
+// 大部分等待者的优先级都是 0, 这时只需要和 q.last 比较一次。
 func (q *waitq) enqueue(sgp *sudog) {
 	sgp.next = nil
+	sgp.enqtime = 0
+	if debug.chanleak > 0 {
+		sgp.enqtime = nanotime()
+	}
 	x := q.last
 	if x == nil {
 		sgp.prev = nil
 		q.first = sgp
 		q.last = sgp
+		if sgp.selectdone == nil {
+			q.single = sgp
+		}
+		return
+	}
+	q.single = nil
+	if x.prio < sgp.prio {
+		for x.prev != nil && x.prev.prio < sgp.prio {
+			x = x.prev
+		}
+		// 插在 x 前面
+		sgp.next = x
+		sgp.prev = x.prev
+		if x.prev != nil {
+			x.prev.next = sgp
+		} else {
+			q.first = sgp
+		}
+		x.prev = sgp
 		return
 	}
 	sgp.prev = x
@@ -581,20 +1235,89 @@ func (q *waitq) enqueue(sgp *sudog) {
 	q.last = sgp
 }
 
+// dequeueSudoG 把 sgp 从 q 中删掉, 不管它在队列的什么位置, 通过 prev/next 在 O(1) 时间内完成。
+// select 被唤醒后用它把其他 case 的 sudog 摘下来, chansendt/chanrecvt 超时的时候用它放弃等待。
+// sgp 可能已经被 dequeue 取走了, 这时 prev 和 next 都是 nil 而且不是 q.first, 什么都不做。
+// 调用者持有 channel 的锁。
+func (q *waitq) dequeueSudoG(sgp *sudog) {
+	q.unlink(sgp)
+	q.updatesingle()
+}
+
+func (q *waitq) unlink(sgp *sudog) {
+	x := sgp.prev
+	y := sgp.next
+	if x != nil {
+		if y != nil {
+			// middle of queue
+			x.next = y
+			y.prev = x
+			sgp.next = nil
+			sgp.prev = nil
+			return
+		}
+		// end of queue
+		x.next = nil
+		q.last = x
+		sgp.prev = nil
+		return
+	}
+	if y != nil {
+		// start of queue
+		y.prev = nil
+		q.first = y
+		sgp.next = nil
+		return
+	}
+
+	// x==y==nil.  Either sgp is the only element in the queue,
+	// or it has already been removed.  Use q.first to disambiguate.
+	if q.first == sgp {
+		q.first = nil
+		q.last = nil
+	}
+}
+
+// dequeue 一般从队头取出等待时间最长的 sudog。
+// 设置了 GODEBUG=chanlifo=N 时从队尾取最晚开始等待的 sudog: 它的栈和数据更可能还在 cache 中,
+// ping-pong 式的负载延迟更低。代价是不公平, 所以连续 N 次之后从队头取一次。
+// 队尾的优先级比队头低的时候(见 SetChanWaitPriority)总是从队头取。
+//
+// 只有一个等待者而且它不在 select 中时(大部分只有一个接收者的 channel 稳定下来就是这样),
+// q.single 就是它, 直接取走, 不需要检查 chanlifo 和 selectdone。
+// 有第二个等待者 enqueue 或者唯一的等待者在 select 中、带超时时 q.single 是 nil, 走下面的循环。
 func (q *waitq) dequeue() *sudog {
+	if sgp := q.single; sgp != nil {
+		q.single = nil
+		q.first = nil
+		q.last = nil
+		q.nlifo = 0
+		sgp.claimspin()
+		return sgp
+	}
 	for {
 		sgp := q.first
 		if sgp == nil {
 			return nil
 		}
-		y := sgp.next
-		if y == nil {
-			q.first = nil
-			q.last = nil
+		if debug.chanlifo > 0 && q.last != sgp && q.last.prio == sgp.prio && q.nlifo < uint32(debug.chanlifo) {
+			q.nlifo++
+			sgp = q.last
+			x := sgp.prev
+			x.next = nil
+			q.last = x
+			sgp.prev = nil // mark as removed (see dequeueSudog)
 		} else {
-			y.prev = nil
-			q.first = y
-			sgp.next = nil // mark as removed (see dequeueSudog)
+			q.nlifo = 0
+			y := sgp.next
+			if y == nil {
+				q.first = nil
+				q.last = nil
+			} else {
+				y.prev = nil
+				q.first = y
+				sgp.next = nil // mark as removed (see dequeueSudog)
+			}
 		}
 
 		// if sgp participates in a select and is already signaled, ignore it
@@ -605,6 +1328,16 @@ func (q *waitq) dequeue() *sudog {
 			}
 		}
 
+		q.updatesingle()
+		sgp.claimspin()
 		return sgp
 	}
 }
+
+// updatesingle 在等待者被删除之后重新计算 q.single: 剩下的唯一一个等待者不在 select 中时可以走 dequeue 的快速路径。
+func (q *waitq) updatesingle() {
+	q.single = nil
+	if sgp := q.first; sgp != nil && sgp == q.last && sgp.selectdone == nil {
+		q.single = sgp
+	}
+}
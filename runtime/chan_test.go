@@ -5,7 +5,11 @@
 package runtime_test
 
 import (
+	"internal/testenv"
+	"os/exec"
+	"reflect"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -557,6 +561,878 @@ func TestShrinkStackDuringBlockedSend(t *testing.T) {
 	<-done
 }
 
+func TestChanDirectHandoff(t *testing.T) {
+	// Receivers parked on an empty buffered channel get the value
+	// copied straight to them, even if their stacks moved meanwhile.
+	type big struct {
+		a [64]int
+		p *int
+	}
+	c := make(chan big, 3)
+	done := make(chan bool)
+	const n = 4
+	for i := 0; i < n; i++ {
+		go func() {
+			var pad [1 << 10]byte // grow the stack so that GC can shrink it
+			v := <-c
+			for j, x := range v.a {
+				if x != j || *v.p != 42 {
+					t.Errorf("received corrupted value %v", v)
+					break
+				}
+			}
+			done <- pad[0] == 0
+		}()
+	}
+	time.Sleep(10 * time.Millisecond) // let the receivers park
+	runtime.GC()
+	x := 42
+	for i := 0; i < n; i++ {
+		var v big
+		for j := range v.a {
+			v.a[j] = j
+		}
+		v.p = &x
+		c <- v
+		if len(c) > 1 {
+			t.Errorf("%d values buffered with receivers waiting", len(c))
+		}
+	}
+	for i := 0; i < n; i++ {
+		<-done
+	}
+}
+
+func TestChanTimeout(t *testing.T) {
+	const d = int64(20 * time.Millisecond)
+	for _, size := range []int{0, 1} {
+		c := make(chan int, size)
+		if _, selected, _ := runtime.ChanRecvTimeout(c, d); selected {
+			t.Errorf("chan(%d): receive on empty channel did not time out", size)
+		}
+		for i := 0; i < size; i++ {
+			c <- i
+		}
+		if runtime.ChanSendTimeout(c, 1, d) {
+			t.Errorf("chan(%d): send on full channel did not time out", size)
+		}
+		for i := 0; i < size; i++ {
+			<-c
+		}
+
+		// The channel must still work after a waiter timed out.
+		go func() {
+			time.Sleep(time.Millisecond)
+			c <- 42
+		}()
+		if v, selected, received := runtime.ChanRecvTimeout(c, int64(time.Minute)); !selected || !received || v != 42 {
+			t.Errorf("chan(%d): received %v, %v, %v; want 42, true, true", size, v, selected, received)
+		}
+		go func() {
+			time.Sleep(time.Millisecond)
+			<-c
+		}()
+		if !runtime.ChanSendTimeout(c, 1, int64(time.Minute)) {
+			t.Errorf("chan(%d): send timed out with a receiver", size)
+		}
+
+		go func() {
+			time.Sleep(time.Millisecond)
+			close(c)
+		}()
+		if _, selected, received := runtime.ChanRecvTimeout(c, int64(time.Minute)); !selected || received {
+			t.Errorf("chan(%d): receive on closed channel returned %v, %v; want true, false", size, selected, received)
+		}
+	}
+	if _, selected, _ := runtime.ChanRecvTimeout(nil, d); selected {
+		t.Errorf("receive on nil channel did not time out")
+	}
+}
+
+func TestChanTimeoutRace(t *testing.T) {
+	// Deadlines that fire while values are being handed over must
+	// neither lose nor duplicate a value.
+	c := make(chan int)
+	const n = 1000
+	go func() {
+		for i := 0; i < n; {
+			if runtime.ChanSendTimeout(c, i, int64(time.Microsecond)) {
+				i++
+			}
+		}
+	}()
+	for i := 0; i < n; {
+		v, selected, _ := runtime.ChanRecvTimeout(c, int64(time.Microsecond))
+		if !selected {
+			continue
+		}
+		if v != i {
+			t.Fatalf("received %d, want %d", v, i)
+		}
+		i++
+	}
+}
+
+func TestChanWaitPriority(t *testing.T) {
+	// Blocked senders are served highest priority first and in FIFO
+	// order within a priority, for plain sends and selects alike.
+	c := make(chan int)
+	prios := []int32{0, 0, 2, 1, 2, 0}
+	for i, prio := range prios {
+		go func(i int, prio int32) {
+			runtime.SetChanWaitPriority(prio)
+			if i%2 == 0 {
+				c <- i
+			} else {
+				select {
+				case c <- i:
+				case <-make(chan int):
+				}
+			}
+		}(i, prio)
+		time.Sleep(5 * time.Millisecond) // let it block
+	}
+	want := []int{2, 4, 3, 0, 1, 5}
+	for _, w := range want {
+		if v := <-c; v != w {
+			t.Fatalf("received %d, want %d (order %v)", v, w, want)
+		}
+	}
+}
+
+func TestChanCloseDrain(t *testing.T) {
+	// Concurrent receivers and a drain must see every buffered value
+	// exactly once.
+	const n = 100
+	c := make(chan int, n)
+	for i := 0; i < n; i++ {
+		c <- i
+	}
+	var wg sync.WaitGroup
+	got := make([][]int, 4)
+	for r := range got {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for v := range c {
+				got[r] = append(got[r], v)
+			}
+		}(r)
+	}
+	drained := runtime.ChanCloseDrain(c)
+	wg.Wait()
+	seen := make([]bool, n)
+	for _, vs := range append(got, drained) {
+		for _, v := range vs {
+			if seen[v] {
+				t.Fatalf("value %d received twice", v)
+			}
+			seen[v] = true
+		}
+	}
+	for v, ok := range seen {
+		if !ok {
+			t.Fatalf("value %d lost", v)
+		}
+	}
+	for i := 1; i < len(drained); i++ {
+		if drained[i] != drained[i-1]+1 {
+			t.Fatalf("drained values out of order: %v", drained)
+		}
+	}
+}
+
+func TestChanBatch(t *testing.T) {
+	for _, size := range []int{0, 1, 7, 64} {
+		c := make(chan int, size)
+		const n = 1000
+		go func() {
+			vs := make([]int, 10)
+			for i := 0; i < n; {
+				for j := range vs {
+					vs[j] = i + j
+				}
+				if i+len(vs) > n {
+					vs = vs[:n-i]
+				}
+				i += runtime.ChanSendMany(c, vs, true)
+			}
+			close(c)
+		}()
+		vs := make([]int, 13)
+		next := 0
+		for {
+			m, ok := runtime.ChanRecvMany(c, vs, true)
+			if !ok {
+				break
+			}
+			if m == 0 {
+				t.Fatalf("chan(%d): blocking ChanRecvMany returned no values", size)
+			}
+			for _, v := range vs[:m] {
+				if v != next {
+					t.Fatalf("chan(%d): received %d, want %d", size, v, next)
+				}
+				next++
+			}
+		}
+		if next != n {
+			t.Fatalf("chan(%d): received %d values, want %d", size, next, n)
+		}
+	}
+
+	c := make(chan int, 4)
+	if m := runtime.ChanSendMany(c, []int{1, 2, 3, 4, 5, 6}, false); m != 4 {
+		t.Errorf("non-blocking ChanSendMany sent %d values, want 4", m)
+	}
+	if m := runtime.ChanSendMany(c, []int{7}, false); m != 0 {
+		t.Errorf("non-blocking ChanSendMany on full channel sent %d values", m)
+	}
+	vs := make([]int, 3)
+	if m, ok := runtime.ChanRecvMany(c, vs, false); m != 3 || !ok || vs[0] != 1 || vs[2] != 3 {
+		t.Errorf("ChanRecvMany = %d, %v, %v; want 3, true, [1 2 3]", m, ok, vs)
+	}
+	close(c)
+	if m, ok := runtime.ChanRecvMany(c, vs, false); m != 1 || !ok || vs[0] != 4 {
+		t.Errorf("ChanRecvMany after close = %d, %v, %v; want 1, true, [4 ...]", m, ok, vs)
+	}
+	if m, ok := runtime.ChanRecvMany(c, vs, false); m != 0 || ok {
+		t.Errorf("ChanRecvMany on drained closed channel = %d, %v; want 0, false", m, ok)
+	}
+}
+
+func TestChanBatchFastPath(t *testing.T) {
+	// Batch operations move several elements under one lock while the
+	// non-blocking fast paths of other goroutines look at the buffer
+	// without it. With -tags chandebug every fast path failure is
+	// checked against the sequence numbers.
+	t.Logf("debugChan=%v", runtime.ChanDebug)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	n := 20000
+	if testing.Short() {
+		n = 2000
+	}
+	c := make(chan int, 8)
+	var senders, receivers sync.WaitGroup
+	var sent, received int64
+	for i := 0; i < 4; i++ {
+		senders.Add(1)
+		go func(batch bool) {
+			defer senders.Done()
+			vs := []int{1, 1, 1, 1, 1, 1}
+			for left := n; left > 0; {
+				if batch {
+					m := len(vs)
+					if m > left {
+						m = left
+					}
+					left -= runtime.ChanSendMany(c, vs[:m], true)
+					continue
+				}
+				select {
+				case c <- 1:
+					left--
+				default:
+					runtime.Gosched()
+				}
+			}
+			atomic.AddInt64(&sent, int64(n))
+		}(i%2 == 0)
+		receivers.Add(1)
+		go func(batch bool) {
+			defer receivers.Done()
+			vs := make([]int, 5)
+			for {
+				if batch {
+					m, ok := runtime.ChanRecvMany(c, vs, true)
+					if !ok {
+						return
+					}
+					for _, v := range vs[:m] {
+						atomic.AddInt64(&received, int64(v))
+					}
+					continue
+				}
+				select {
+				case v, ok := <-c:
+					if !ok {
+						return
+					}
+					atomic.AddInt64(&received, int64(v))
+				default:
+					runtime.Gosched()
+				}
+			}
+		}(i%2 == 0)
+	}
+	senders.Wait()
+	close(c)
+	receivers.Wait()
+	if sent != received {
+		t.Fatalf("sent %d values, received %d", sent, received)
+	}
+}
+
+func TestChanBatchFastPathChanDebug(t *testing.T) {
+	if runtime.ChanDebug {
+		t.Skip("already built with -tags chandebug")
+	}
+	if testing.Short() {
+		t.Skip("rebuilds the runtime with -tags chandebug")
+	}
+	testenv.MustHaveGoBuild(t)
+	out, err := exec.Command("go", "test", "-short", "-v", "-tags", "chandebug", "-run", "^TestChanBatchFastPath$", "runtime").CombinedOutput()
+	if err != nil {
+		t.Fatalf("go test -tags chandebug failed: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "debugChan=true") {
+		t.Fatalf("go test -tags chandebug did not enable debugChan:\n%s", out)
+	}
+}
+
+func TestChanBatchPointers(t *testing.T) {
+	// Pointers copied in bulk into and out of the buffer must stay
+	// visible to a concurrent GC, including across the wraparound.
+	c := make(chan *int, 7)
+	const n = 2000
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			runtime.GC()
+		}
+		done <- true
+	}()
+	go func() {
+		vs := make([]*int, 5)
+		for i := 0; i < n; {
+			m := len(vs)
+			if i+m > n {
+				m = n - i
+			}
+			for j := 0; j < m; j++ {
+				v := i + j
+				vs[j] = &v
+			}
+			sent := runtime.ChanSendManyPtr(c, vs[:m], true)
+			for j := range vs {
+				vs[j] = nil
+			}
+			i += sent
+		}
+		close(c)
+	}()
+	vs := make([]*int, 3)
+	next := 0
+	for iter := 0; ; iter++ {
+		m, ok := runtime.ChanRecvManyPtr(c, vs, true)
+		if !ok {
+			break
+		}
+		if iter%64 == 0 {
+			runtime.GC()
+		}
+		for _, p := range vs[:m] {
+			if *p != next {
+				t.Fatalf("received %d, want %d", *p, next)
+			}
+			next++
+		}
+	}
+	if next != n {
+		t.Fatalf("received %d values, want %d", next, n)
+	}
+	<-done
+}
+
+func TestChanCloseSite(t *testing.T) {
+	c := make(chan int)
+	if pc, goid := runtime.ChanCloseSite(c); pc != 0 || goid != 0 {
+		t.Fatalf("open channel has close site %#x, goroutine %d", pc, goid)
+	}
+	done := make(chan bool)
+	go func() {
+		close(c)
+		done <- true
+	}()
+	<-done
+	pc, goid := runtime.ChanCloseSite(c)
+	if f := runtime.FuncForPC(pc); f == nil || !strings.HasPrefix(f.Name(), "runtime_test.TestChanCloseSite") {
+		t.Errorf("close site %#x is not in TestChanCloseSite", pc)
+	}
+	if goid == 0 {
+		t.Errorf("closing goroutine not recorded")
+	}
+}
+
+func liveChannels() []runtime.ChanRecord {
+	n, _ := runtime.LiveChannels(nil)
+	for {
+		p := make([]runtime.ChanRecord, n+10)
+		m, ok := runtime.LiveChannels(p)
+		if ok {
+			return p[:m]
+		}
+		n = m
+	}
+}
+
+func findChannel(addr uintptr) *runtime.ChanRecord {
+	for _, r := range liveChannels() {
+		if r.Addr == addr {
+			return &r
+		}
+	}
+	return nil
+}
+
+func TestLiveChannels(t *testing.T) {
+	defer runtime.SetChanRegistry(runtime.SetChanRegistry(1))
+	c := make(chan string, 3)
+	c <- "a"
+	c <- "b"
+	addr := reflect.ValueOf(c).Pointer()
+	r := findChannel(addr)
+	if r == nil {
+		t.Fatalf("channel %#x not in LiveChannels", addr)
+	}
+	if r.ElemType != "string" || r.Len != 2 || r.Cap != 3 || r.Closed {
+		t.Errorf("record = %+v, want string element, len 2, cap 3, open", *r)
+	}
+	if f := runtime.FuncForPC(r.MakePC); f == nil || f.Name() != "runtime_test.TestLiveChannels" {
+		t.Errorf("MakePC %#x is not in TestLiveChannels", r.MakePC)
+	}
+	close(c)
+	if r := findChannel(addr); r == nil || !r.Closed {
+		t.Errorf("closed channel not reported as closed")
+	}
+
+	// Registered channels are still collected.
+	addr = func() uintptr {
+		d := make(chan *int, 1)
+		return reflect.ValueOf(d).Pointer()
+	}()
+	runtime.GC()
+	runtime.GC()
+	if findChannel(addr) != nil {
+		t.Errorf("unreachable channel %#x still in LiveChannels after GC", addr)
+	}
+}
+
+func TestChanBufClear(t *testing.T) {
+	// Received values must not be kept alive by the buffer once the
+	// receive index has wrapped around.
+	const n = 4
+	c := make(chan *[64]byte, n)
+	fin := make(chan bool, n)
+	for lap := 0; lap < 2; lap++ {
+		for i := 0; i < n; i++ {
+			v := new([64]byte)
+			runtime.SetFinalizer(v, func(*[64]byte) { fin <- true })
+			c <- v
+		}
+		for i := 0; i < n; i++ {
+			<-c
+		}
+	}
+	for i := 0; i < 2*n; i++ {
+		runtime.GC()
+		select {
+		case <-fin:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d received values still reachable", 2*n-i, 2*n)
+		}
+	}
+}
+
+func TestChanPollRecv(t *testing.T) {
+	// A non-blocking receive distinguishes an empty channel, a received
+	// value and a closed channel without a second probe.
+	const (
+		empty = iota
+		value
+		closed
+	)
+	poll := func(c chan int) (int, int) {
+		select {
+		case v, ok := <-c:
+			if ok {
+				return value, v
+			}
+			return closed, v
+		default:
+			return empty, 0
+		}
+	}
+	for _, size := range []int{0, 1} {
+		c := make(chan int, size)
+		if st, _ := poll(c); st != empty {
+			t.Errorf("chan(%d): poll of empty channel = %d, want empty", size, st)
+		}
+		if size > 0 {
+			c <- 7
+			if st, v := poll(c); st != value || v != 7 {
+				t.Errorf("chan(%d): poll = %d, %d; want value, 7", size, st, v)
+			}
+			c <- 8
+		}
+		close(c)
+		if size > 0 {
+			if st, v := poll(c); st != value || v != 8 {
+				t.Errorf("chan(%d): poll of closed channel with buffered value = %d, %d; want value, 8", size, st, v)
+			}
+		}
+		if st, _ := poll(c); st != closed {
+			t.Errorf("chan(%d): poll of closed channel = %d, want closed", size, st)
+		}
+	}
+	var nilc chan int
+	if st, _ := poll(nilc); st != empty {
+		t.Errorf("poll of nil channel = %d, want empty", st)
+	}
+}
+
+func TestChanLeakCheck(t *testing.T) {
+	defer runtime.SetChanLeak(runtime.SetChanLeak(1))
+	c := make(chan int)
+	go chanLeakWaiter(c)
+	time.Sleep(100 * time.Millisecond)
+	buf := make([]byte, 1<<16)
+	out := string(buf[:runtime.ChanLeakCheck(buf, int64(50*time.Millisecond))])
+	close(c)
+	for _, want := range []string{
+		"goroutines parked on channels for more than",
+		"channel made by runtime_test.TestChanLeakCheck",
+		"[chan receive]",
+		"runtime_test.chanLeakWaiter",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("report:\n%s\n\nwant report containing: %s", out, want)
+		}
+	}
+	if out := string(buf[:runtime.ChanLeakCheck(buf, int64(time.Hour))]); out != "" {
+		t.Errorf("report with a one hour threshold:\n%s", out)
+	}
+}
+
+func chanLeakWaiter(c chan int) {
+	<-c
+}
+
+func TestChanRecvSingle(t *testing.T) {
+	c := make(chan int)
+	stop := make(chan bool)
+	done := make(chan int, 2)
+	waitRecv := func(n int) {
+		for runtime.ChanWaiters(c) != n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	go func() { done <- <-c }()
+	waitRecv(1)
+	if !runtime.ChanRecvSingle(c) {
+		t.Fatalf("one receiver: not cached")
+	}
+
+	// 第二个接收者在 select 中, 缓存失效
+	go func() {
+		select {
+		case v := <-c:
+			done <- v
+		case <-stop:
+			done <- -1
+		}
+	}()
+	waitRecv(2)
+	if runtime.ChanRecvSingle(c) {
+		t.Fatalf("receiver and select: still cached")
+	}
+
+	// select 离开之后剩下的接收者又可以走快速路径
+	close(stop)
+	if v := <-done; v != -1 {
+		t.Fatalf("select received %d, want it to take the stop case", v)
+	}
+	waitRecv(1)
+	if !runtime.ChanRecvSingle(c) {
+		t.Fatalf("remaining receiver: not cached")
+	}
+	c <- 42
+	if v := <-done; v != 42 {
+		t.Fatalf("received %d, want 42", v)
+	}
+	if runtime.ChanRecvSingle(c) {
+		t.Fatalf("no receivers: still cached")
+	}
+}
+
+func TestChanWaitStats(t *testing.T) {
+	defer runtime.SetChanStats(runtime.SetChanStats(1))
+	before := runtime.ReadChanWaitStats()
+	c := make(chan int)
+	done := make(chan bool)
+	go func() {
+		<-c
+		done <- true
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if s := runtime.ReadChanWaitStats(); s.SudogsInUse == 0 {
+		t.Errorf("SudogsInUse = 0 with a goroutine blocked in receive")
+	}
+	c <- 1
+	<-done
+	after := runtime.ReadChanWaitStats()
+	if after.Blocks <= before.Blocks {
+		t.Errorf("Blocks = %d, want more than %d", after.Blocks, before.Blocks)
+	}
+	if d := after.ParkNs - before.ParkNs; d < uint64(50*time.Millisecond) {
+		t.Errorf("ParkNs grew by %v, want at least 50ms", time.Duration(d))
+	}
+	if after.AvgParkNs == 0 || after.AvgParkNs > after.ParkNs {
+		t.Errorf("AvgParkNs = %d, ParkNs = %d", after.AvgParkNs, after.ParkNs)
+	}
+
+	// Without GODEBUG=chanstats blocking operations are not counted.
+	runtime.SetChanStats(0)
+	go func() {
+		<-c
+		done <- true
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c <- 1
+	<-done
+	if s := runtime.ReadChanWaitStats(); s.Blocks != after.Blocks {
+		t.Errorf("Blocks = %d with chanstats off, want %d", s.Blocks, after.Blocks)
+	}
+}
+
+func TestChanBufClearStress(t *testing.T) {
+	// Received slots may stay dirty only between clearx and recvx, and
+	// the buffer must be completely clean whenever it is drained, with
+	// concurrent senders and receivers, batch receives that wrap around
+	// and receives that only partly drain the buffer.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	n := 20000
+	if testing.Short() {
+		n = 2000
+	}
+	c := make(chan *int, 5)
+	var wg sync.WaitGroup
+	var received int64
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(batch bool) {
+			defer wg.Done()
+			vs := []*int{new(int), new(int), new(int)}
+			for left := n; left > 0; {
+				if batch {
+					m := len(vs)
+					if m > left {
+						m = left
+					}
+					left -= runtime.ChanSendManyPtr(c, vs[:m], true)
+					continue
+				}
+				c <- new(int)
+				left--
+			}
+		}(i == 0)
+	}
+	done := make(chan bool)
+	for i := 0; i < 2; i++ {
+		go func(batch bool) {
+			vs := make([]*int, 3)
+			block := false
+			for {
+				if batch {
+					// Alternate blocking and non-blocking batches, so
+					// some of them take whatever is left.
+					block = !block
+					m, ok := runtime.ChanRecvManyPtr(c, vs, block)
+					if !ok {
+						break
+					}
+					if m == 0 {
+						runtime.Gosched()
+					}
+					atomic.AddInt64(&received, int64(m))
+					continue
+				}
+				if _, ok := <-c; !ok {
+					break
+				}
+				atomic.AddInt64(&received, 1)
+			}
+			done <- true
+		}(i == 0)
+	}
+	stop := make(chan bool)
+	checked := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				checked <- true
+				return
+			default:
+			}
+			if _, outside := runtime.ChanBufStale(c); outside != 0 {
+				t.Errorf("%d received slots left dirty before clearx or after recvx", outside)
+				<-stop
+				checked <- true
+				return
+			}
+			runtime.Gosched()
+		}
+	}()
+	wg.Wait()
+	close(c)
+	<-done
+	<-done
+	close(stop)
+	<-checked
+	if received != int64(2*n) {
+		t.Fatalf("received %d values, want %d", received, 2*n)
+	}
+	if stale, _ := runtime.ChanBufStale(c); stale != 0 {
+		t.Fatalf("%d received values still in the drained buffer", stale)
+	}
+
+	// Drain a partly filled buffer without wrapping around.
+	c = make(chan *int, 8)
+	for i := 0; i < 3; i++ {
+		c <- new(int)
+	}
+	<-c
+	if stale, _ := runtime.ChanBufStale(c); stale != 1 {
+		t.Errorf("after one receive %d stale slots, want 1", stale)
+	}
+	vs := make([]*int, 8)
+	if m, _ := runtime.ChanRecvManyPtr(c, vs, false); m != 2 {
+		t.Fatalf("ChanRecvManyPtr received %d values, want 2", m)
+	}
+	if stale, _ := runtime.ChanBufStale(c); stale != 0 {
+		t.Errorf("%d received values still in the drained buffer", stale)
+	}
+}
+
+func TestChanPeek(t *testing.T) {
+	if _, ok := runtime.ChanPeek(make(chan int)); ok {
+		t.Errorf("peek on unbuffered channel succeeded")
+	}
+	for _, spsc := range []bool{false, true} {
+		c := make(chan int, 3)
+		if spsc {
+			runtime.DeclareChanSPSC(c)
+		}
+		if _, ok := runtime.ChanPeek(c); ok {
+			t.Errorf("spsc=%v: peek on empty channel succeeded", spsc)
+		}
+		for i := 1; i <= 3; i++ {
+			c <- i
+		}
+		for i := 1; i <= 3; i++ {
+			if v, ok := runtime.ChanPeek(c); !ok || v != i {
+				t.Errorf("spsc=%v: peek = %d, %v; want %d, true", spsc, v, ok, i)
+			}
+			if v, ok := runtime.ChanPeek(c); !ok || v != i {
+				t.Errorf("spsc=%v: second peek = %d, %v; want %d, true", spsc, v, ok, i)
+			}
+			if v := <-c; v != i {
+				t.Errorf("spsc=%v: received %d after peek, want %d", spsc, v, i)
+			}
+		}
+		close(c)
+		if _, ok := runtime.ChanPeek(c); ok {
+			t.Errorf("spsc=%v: peek on closed empty channel succeeded", spsc)
+		}
+	}
+}
+
+func TestChanSendSlotHandoff(t *testing.T) {
+	// Senders blocked on a full buffered channel get the slot freed by
+	// a receiver, with their value copied from their (possibly moved)
+	// stacks. Values from each sender must arrive complete and in order.
+	const (
+		P = 4
+		N = 200
+	)
+	type msg struct {
+		sender, seq int
+		pad         [32]int
+	}
+	c := make(chan msg, 1)
+	for p := 0; p < P; p++ {
+		go func(p int) {
+			for i := 0; i < N; i++ {
+				m := msg{sender: p, seq: i}
+				for j := range m.pad {
+					m.pad[j] = p*N + i
+				}
+				c <- m
+				if i%50 == 0 {
+					stackGrowthRecursive(20)
+				}
+			}
+		}(p)
+	}
+	var next [P]int
+	for i := 0; i < P*N; i++ {
+		m := <-c
+		if m.seq != next[m.sender] {
+			t.Fatalf("sender %d: received seq %d, want %d", m.sender, m.seq, next[m.sender])
+		}
+		next[m.sender]++
+		for _, x := range m.pad {
+			if x != m.sender*N+m.seq {
+				t.Fatalf("sender %d seq %d: corrupted value %v", m.sender, m.seq, m.pad)
+			}
+		}
+		if i%100 == 0 {
+			runtime.GC()
+		}
+	}
+}
+
+func TestChanLIFO(t *testing.T) {
+	defer runtime.SetChanLIFO(runtime.SetChanLIFO(2))
+	// Receivers 0..3 block in order. With chanlifo=2 the two most
+	// recent are woken first, then the oldest once, then LIFO again.
+	c := make(chan int)
+	got := make(chan [2]int, 4)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			got <- [2]int{<-c, i}
+		}(i)
+		time.Sleep(5 * time.Millisecond) // let it block
+	}
+	for v := 0; v < 4; v++ {
+		c <- v
+	}
+	var order [4]int
+	for i := 0; i < 4; i++ {
+		r := <-got
+		order[r[0]] = r[1]
+	}
+	if want := [4]int{3, 2, 0, 1}; order != want {
+		t.Errorf("receivers woken in order %v, want %v", order, want)
+	}
+}
+
+func TestHchanLayout(t *testing.T) {
+	// The sender's and receiver's indexes, and the inline buffer that
+	// follows the header, must not be able to share a cache line.
+	sendx, recvx, size, syncSize, line := runtime.HchanLayout()
+	if recvx-sendx < line || size-recvx < line {
+		t.Errorf("hchan sendx at %d, recvx at %d, size %d; want them %d bytes apart", sendx, recvx, size, line)
+	}
+	// Unbuffered channels never touch sendx and beyond, so they must not
+	// pay for the padding.
+	if syncSize > sendx-line {
+		t.Errorf("unbuffered hchan size %d, want at most %d", syncSize, sendx-line)
+	}
+}
+
 func TestSelectDuplicateChannel(t *testing.T) {
 	// This test makes sure we can queue a G on
 	// the same channel multiple times.
@@ -586,6 +1462,94 @@ func TestSelectDuplicateChannel(t *testing.T) {
 	c <- 8 // wake up B.  This operation used to fail because c.recvq was corrupted (it tries to wake up an already running G instead of B)
 }
 
+func TestChanSPSC(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	N := 100000
+	if testing.Short() {
+		N = 10000
+	}
+	for _, size := range []int{1, 2, 7, 64} {
+		c := make(chan *int, size)
+		runtime.DeclareChanSPSC(c)
+		go func() {
+			for i := 0; i < N; i++ {
+				v := i
+				c <- &v
+				if i%1000 == 0 {
+					runtime.Gosched()
+				}
+			}
+			close(c)
+		}()
+		n := 0
+		for p := range c {
+			if *p != n {
+				t.Fatalf("size %d: received %d, want %d", size, *p, n)
+			}
+			n++
+			if n%777 == 0 {
+				time.Sleep(time.Microsecond) // let the buffer fill up
+			}
+		}
+		if n != N {
+			t.Fatalf("size %d: received %d values, want %d", size, n, N)
+		}
+	}
+
+	// Non-blocking operations.
+	c := make(chan int, 2)
+	runtime.DeclareChanSPSC(c)
+	select {
+	case <-c:
+		t.Fatalf("received from empty channel")
+	default:
+	}
+	c <- 1
+	c <- 2
+	select {
+	case c <- 3:
+		t.Fatalf("sent to full channel")
+	default:
+	}
+	if v, ok := <-c; v != 1 || !ok {
+		t.Fatalf("received %v, %v; want 1, true", v, ok)
+	}
+	close(c)
+	if v, ok := <-c; v != 2 || !ok {
+		t.Fatalf("received %v, %v after close; want 2, true", v, ok)
+	}
+	if v, ok := <-c; v != 0 || ok {
+		t.Fatalf("received %v, %v from drained closed channel; want 0, false", v, ok)
+	}
+}
+
+func TestChanSPSCMisuse(t *testing.T) {
+	mustPanic := func(name string, f func()) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s did not panic", name)
+			}
+		}()
+		f()
+	}
+	mustPanic("unbuffered", func() { runtime.DeclareChanSPSC(make(chan int)) })
+	mustPanic("not a channel", func() { runtime.DeclareChanSPSC(1) })
+	mustPanic("non-empty", func() {
+		c := make(chan int, 1)
+		c <- 1
+		runtime.DeclareChanSPSC(c)
+	})
+	mustPanic("select", func() {
+		c := make(chan int, 1)
+		d := make(chan int)
+		runtime.DeclareChanSPSC(c)
+		select {
+		case <-c:
+		case <-d:
+		}
+	})
+}
+
 func BenchmarkChanNonblocking(b *testing.B) {
 	myc := make(chan int)
 	b.RunParallel(func(pb *testing.PB) {
@@ -716,6 +1680,34 @@ func BenchmarkChanContended(b *testing.B) {
 	})
 }
 
+func benchmarkChanLargeElem(b *testing.B, size int) {
+	type large [32 << 10]byte
+	c := make(chan large, size)
+	done := make(chan bool)
+	b.SetBytes(int64(len(large{})))
+	go func() {
+		var v large
+		for i := 0; i < b.N; i++ {
+			v = <-c
+		}
+		_ = v
+		done <- true
+	}()
+	var v large
+	for i := 0; i < b.N; i++ {
+		c <- v
+	}
+	<-done
+}
+
+func BenchmarkChanLargeElemSync(b *testing.B) {
+	benchmarkChanLargeElem(b, 0)
+}
+
+func BenchmarkChanLargeElemBuffered(b *testing.B) {
+	benchmarkChanLargeElem(b, 16)
+}
+
 func BenchmarkChanSync(b *testing.B) {
 	const CallsPerSched = 1000
 	procs := 2
@@ -789,6 +1781,103 @@ func benchmarkChanProdCons(b *testing.B, chanSize, localWork int) {
 	}
 }
 
+func benchmarkChanSPSC(b *testing.B, spsc bool) {
+	c := make(chan int, 128)
+	if spsc {
+		runtime.DeclareChanSPSC(c)
+	}
+	done := make(chan bool)
+	go func() {
+		for range c {
+		}
+		done <- true
+	}()
+	for i := 0; i < b.N; i++ {
+		c <- i
+	}
+	close(c)
+	<-done
+}
+
+func BenchmarkChanSPSC(b *testing.B) {
+	benchmarkChanSPSC(b, true)
+}
+
+func BenchmarkChanSPSCLocked(b *testing.B) {
+	benchmarkChanSPSC(b, false)
+}
+
+func BenchmarkChanBatch(b *testing.B) {
+	c := make(chan int, 128)
+	done := make(chan bool)
+	go func() {
+		vs := make([]int, 32)
+		for {
+			if _, ok := runtime.ChanRecvMany(c, vs, true); !ok {
+				break
+			}
+		}
+		done <- true
+	}()
+	vs := make([]int, 32)
+	for i := 0; i < b.N; i += len(vs) {
+		for j := 0; j < len(vs); {
+			j += runtime.ChanSendMany(c, vs[j:], true)
+		}
+	}
+	close(c)
+	<-done
+}
+
+// benchmarkChanWaitPolicy measures the cost of handing values to a pool
+// of blocked receivers and logs how evenly the work was spread, the
+// fairness that chanlifo gives up for speed.
+func benchmarkChanWaitPolicy(b *testing.B, lifo int32) {
+	defer runtime.SetChanLIFO(runtime.SetChanLIFO(lifo))
+	workers := 4 * runtime.GOMAXPROCS(0)
+	c := make(chan int)
+	counts := make([]int, workers)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			for range c {
+				counts[w]++
+			}
+			wg.Done()
+		}(w)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c <- i
+	}
+	close(c)
+	wg.Wait()
+	b.StopTimer()
+	min, max := b.N, 0
+	for _, n := range counts {
+		if n < min {
+			min = n
+		}
+		if n > max {
+			max = n
+		}
+	}
+	b.Logf("N=%d: busiest receiver served %d values, idlest %d", b.N, max, min)
+}
+
+func BenchmarkChanWaitFIFO(b *testing.B) {
+	benchmarkChanWaitPolicy(b, 0)
+}
+
+func BenchmarkChanWaitLIFO(b *testing.B) {
+	benchmarkChanWaitPolicy(b, 1<<30)
+}
+
+func BenchmarkChanWaitLIFO16(b *testing.B) {
+	benchmarkChanWaitPolicy(b, 16)
+}
+
 func BenchmarkChanProdCons0(b *testing.B) {
 	benchmarkChanProdCons(b, 0, 0)
 }
@@ -894,6 +1983,31 @@ func BenchmarkChanSem(b *testing.B) {
 	})
 }
 
+func BenchmarkChanCloseWaiters(b *testing.B) {
+	const n = 100000
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		c := make(chan bool)
+		var ready, done sync.WaitGroup
+		ready.Add(n)
+		done.Add(n)
+		for j := 0; j < n; j++ {
+			go func() {
+				ready.Done()
+				<-c
+				done.Done()
+			}()
+		}
+		ready.Wait()
+		for runtime.ChanWaiters(c) < n {
+			runtime.Gosched()
+		}
+		b.StartTimer()
+		close(c)
+		done.Wait()
+	}
+}
+
 func BenchmarkChanPopular(b *testing.B) {
 	const n = 1000
 	c := make(chan bool)
@@ -920,3 +2034,76 @@ func BenchmarkChanPopular(b *testing.B) {
 	}
 	wg.Wait()
 }
+
+// 同步 channel 上的等待者先自旋再 gopark, 对方在它自旋时交接数据或者 close channel。
+func TestChanSyncSpin(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	defer runtime.SetChanSyncSpin(runtime.SetChanSyncSpin(true))
+	const (
+		P = 4
+		N = 10000
+	)
+	for iter := 0; iter < 10; iter++ {
+		c := make(chan int)
+		sums := make(chan int)
+		for p := 0; p < P; p++ {
+			go func() {
+				sum := 0
+				for v := range c {
+					sum += v
+				}
+				sums <- sum
+			}()
+		}
+		var wg sync.WaitGroup
+		for p := 0; p < P; p++ {
+			wg.Add(1)
+			go func(p int) {
+				defer wg.Done()
+				for i := p; i < N; i += P {
+					c <- i
+				}
+			}(p)
+		}
+		wg.Wait()
+		close(c)
+		sum := 0
+		for p := 0; p < P; p++ {
+			sum += <-sums
+		}
+		if want := N * (N - 1) / 2; sum != want {
+			t.Fatalf("iteration %d: received sum %d, want %d", iter, sum, want)
+		}
+	}
+}
+
+func benchmarkChanSyncContended(b *testing.B, spin bool) {
+	defer runtime.SetChanSyncSpin(runtime.SetChanSyncSpin(spin))
+	procs := runtime.GOMAXPROCS(-1)
+	c := make(chan int)
+	done := make(chan bool)
+	for p := 0; p < procs; p++ {
+		go func() {
+			for range c {
+			}
+			done <- true
+		}()
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c <- 0
+		}
+	})
+	close(c)
+	for p := 0; p < procs; p++ {
+		<-done
+	}
+}
+
+func BenchmarkChanSyncContendedSpin(b *testing.B) {
+	benchmarkChanSyncContended(b, true)
+}
+
+func BenchmarkChanSyncContendedNoSpin(b *testing.B) {
+	benchmarkChanSyncContended(b, false)
+}
@@ -0,0 +1,212 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Batch send and receive on buffered channels.
+//
+// 元素很小的时候, 有缓冲的 channel 上的开销主要是每个元素一次 lock/unlock 和一次唤醒。
+// chansendmany/chanrecvmany 加一次锁移动多个元素:
+//
+//	buffer 满(空)时先用 chansend/chanrecv 阻塞地移动第一个元素, 和普通的发送/接收一样等待
+//	然后在同一次加锁中移动 buffer 能容纳(已有)的尽量多的元素, qcount 只修改一次
+//	最后每移动一个元素最多唤醒一个等待的对方。接收时和 chanrecv 一样把空出来的位置交给等待的发送者
+//	(见 sendqhandoff), 发送时被唤醒的接收者回到 chanrecv 的循环里重新检查 buffer
+//
+// 无缓冲的 channel 没有 buffer 可以批量操作, 每次只移动一个元素。
+// 在 spsc channel 上调用者必须是唯一的发送者(接收者)。
+
+package runtime
+
+import "unsafe"
+
+// chansendmany sends up to n elements from the array at ep on c and
+// returns how many were sent. If block is true and the buffer is full,
+// it waits until at least one element can be sent.
+func chansendmany(t *chantype, c *hchan, ep unsafe.Pointer, n int, block bool, callerpc uintptr) int {
+	if n <= 0 {
+		return 0
+	}
+	if c == nil || c.dataqsiz == 0 {
+		if chansend(t, c, ep, block, nil, callerpc) {
+			return 1
+		}
+		return 0
+	}
+
+	sent := 0
+	lock(&c.lock)
+	if c.closed != 0 {
+		printchanclosed(c)
+		unlock(&c.lock)
+		panic("send on closed channel")
+	}
+	if c.qcount >= c.dataqsiz {
+		unlock(&c.lock)
+		if !chansend(t, c, ep, block, nil, callerpc) {
+			return 0
+		}
+		sent = 1
+		lock(&c.lock)
+		if c.closed != 0 {
+			unlock(&c.lock)
+			return sent
+		}
+	}
+
+	m := int(c.dataqsiz - c.qcount)
+	if m > n-sent {
+		m = n - sent
+	}
+	chanbufput(c, add(ep, uintptr(sent)*c.elemsize), m)
+	chanqadd(c, m)
+	chanwakemany(&c.recvq, m)
+	unlock(&c.lock)
+	return sent + m
+}
+
+//go:linkname reflect_chansendmany reflect.chansendmany
+func reflect_chansendmany(t *chantype, c *hchan, ep unsafe.Pointer, n int, block bool) int {
+	return chansendmany(t, c, ep, n, block, getcallerpc(unsafe.Pointer(&t)))
+}
+
+// chanrecvmany receives up to n elements from c into the array at ep and
+// returns how many were received. If block is true and the buffer is
+// empty, it waits until at least one element arrives. ok is false if c
+// is closed and has no elements left; ep is not touched in that case.
+func chanrecvmany(t *chantype, c *hchan, ep unsafe.Pointer, n int, block bool) (received int, ok bool) {
+	if n <= 0 {
+		return 0, true
+	}
+	if c == nil || c.dataqsiz == 0 {
+		selected, recv := chanrecv(t, c, ep, block, nil, nil)
+		if recv {
+			return 1, true
+		}
+		return 0, !selected
+	}
+
+	lock(&c.lock)
+	if c.qcount == 0 {
+		if c.closed != 0 {
+			unlock(&c.lock)
+			return 0, false
+		}
+		unlock(&c.lock)
+		selected, recv := chanrecv(t, c, ep, block, nil, nil)
+		if !recv {
+			return 0, !selected
+		}
+		received = 1
+		lock(&c.lock)
+	}
+
+	m := int(c.qcount)
+	if m > n-received {
+		m = n - received
+	}
+	chanbufget(c, add(ep, uintptr(received)*c.elemsize), m)
+	chanqadd(c, -m)
+	for i := 0; i < m; i++ {
+		sg := sendqhandoff(c)
+		if sg == nil {
+			break
+		}
+		if sg.releasetime != 0 {
+			sg.releasetime = cputicks()
+		}
+		chanready(sg, 3)
+	}
+	unlock(&c.lock)
+	return received + m, true
+}
+
+//go:linkname reflect_chanrecvmany reflect.chanrecvmany
+func reflect_chanrecvmany(t *chantype, c *hchan, ep unsafe.Pointer, n int, block bool) (received int, ok bool) {
+	return chanrecvmany(t, c, ep, n, block)
+}
+
+// chanwakemany 唤醒 q 中最多 n 个等待者, 调用者持有 c.lock。
+// 在持有锁的时候调用 goready, 被唤醒的 goroutine 要等我们 unlock 之后才能拿到锁。
+// n 不会超过 buffer 的大小, 不像 closechan 那样需要把唤醒挪到锁外面。
+func chanwakemany(q *waitq, n int) {
+	for ; n > 0; n-- {
+		sg := q.dequeue()
+		if sg == nil {
+			return
+		}
+		if sg.releasetime != 0 {
+			sg.releasetime = cputicks()
+		}
+		chanready(sg, 4)
+	}
+}
+
+// chanbufput 把 src 开始的 n 个连续元素复制到 buffer 的 sendx 处并移动 sendx, 调用者持有 c.lock,
+// 并且保证 buffer 里至少有 n 个空位。qcount 由调用者修改。
+func chanbufput(c *hchan, src unsafe.Pointer, n int) {
+	for n > 0 {
+		m := n
+		if r := int(c.dataqsiz - c.sendx); m > r {
+			m = r // 环形 buffer 回绕, 分两段复制
+		}
+		if raceenabled {
+			for i := 0; i < m; i++ {
+				raceacquire(chanbuf(c, c.sendx+uint(i)))
+				racerelease(chanbuf(c, c.sendx+uint(i)))
+			}
+		}
+		chanbufmove(c.elemtype, chanbuf(c, c.sendx), src, uintptr(m)*c.elemsize)
+		src = add(src, uintptr(m)*c.elemsize)
+		c.sendx += uint(m)
+		if c.sendx == c.dataqsiz {
+			c.sendx = 0
+		}
+		n -= m
+	}
+}
+
+// chanbufget 把 buffer 中 recvx 开始的 n 个元素复制到 dst, 清空这些位置并移动 recvx,
+// 调用者持有 c.lock, 并且保证 buffer 里至少有 n 个元素。qcount 由调用者修改。
+func chanbufget(c *hchan, dst unsafe.Pointer, n int) {
+	for n > 0 {
+		m := n
+		if r := int(c.dataqsiz - c.recvx); m > r {
+			m = r
+		}
+		if raceenabled {
+			for i := 0; i < m; i++ {
+				raceacquire(chanbuf(c, c.recvx+uint(i)))
+				racerelease(chanbuf(c, c.recvx+uint(i)))
+			}
+		}
+		size := uintptr(m) * c.elemsize
+		chanbufmove(c.elemtype, dst, chanbuf(c, c.recvx), size)
+		chanbufclear(c, uint(m))
+		dst = add(dst, size)
+		c.recvx += uint(m)
+		if c.recvx == c.dataqsiz {
+			c.recvx = 0
+		}
+		n -= m
+	}
+}
+
+// chanbufmove copies size bytes of consecutive elements of type typ
+// from src to dst and then executes the write barriers for the whole
+// range at once, instead of one typedmemmove per element.
+// The buffer is allocated by newarray, so the heap bitmap covers it
+// and heapBitsBulkBarrier finds the pointer slots of every element.
+// If dst is the caller's own stack, heapBitsBulkBarrier unwinds the
+// stack barriers instead, just as typedmemmove does.
+//
+// Like typedmemmove, there must be no preemption point between the
+// memmove and the barrier; both are nosplit.
+//
+//go:nosplit
+func chanbufmove(typ *_type, dst, src unsafe.Pointer, size uintptr) {
+	memmove(dst, src, size)
+	if typ.kind&kindNoPointers != 0 {
+		return
+	}
+	heapBitsBulkBarrier(uintptr(dst), size)
+}
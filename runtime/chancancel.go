@@ -0,0 +1,128 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Channel send/receive that another goroutine can cancel.
+//
+// 不关闭 channel 而中止一个阻塞的发送/接收, 原来只能 select 再加一个 cancel channel,
+// 或者另外起一个 goroutine 转发。chansendcancel/chanrecvcancel 和 chansendt/chanrecvt 一样
+// 在阻塞的地方挂一个 chanTimeout, 只是没有 timer, 而是登记到 ChanCancel 的链表上:
+//
+//	操作开始:  加 cc.lock, 已经取消了就只做一次非阻塞的尝试, 否则把 tmo 挂到 cc.waiters 上
+//	Cancel:    加 cc.lock 标记 canceled 并取下整个链表, 释放锁之后对每个 tmo 做 timer 触发时做的事情
+//	操作结束:  加 cc.lock 把 tmo 从链表上摘下来(如果还在的话)
+//
+// Cancel 和 timer 一样通过 cas(&tmo.done, 0, 1) 和发送者/接收者/closechan 竞争,
+// 所以等待者只会被唤醒一次, 被 Cancel 唤醒时 tmo.timedout 为 true, 和超时一样返回。
+// Cancel 不同时持有 cc.lock 和 c.lock, 不需要规定两个锁的顺序。
+
+package runtime
+
+import "unsafe"
+
+// A ChanCancel cancels the blocking channel operations that were started
+// with it. The zero value is ready to use. A ChanCancel can be shared by
+// any number of operations, and must not be copied after first use.
+type ChanCancel struct {
+	lock     mutex
+	canceled uint32
+	waiters  *chanTimeout // 链表, 通过 chanTimeout.cnext 串起来
+}
+
+// Cancel aborts every channel operation currently blocked with cc, and
+// makes operations started with cc from now on give up instead of blocking.
+// The channels themselves are not affected. Calling Cancel more than once
+// does nothing.
+func (cc *ChanCancel) Cancel() {
+	lock(&cc.lock)
+	if cc.canceled != 0 {
+		unlock(&cc.lock)
+		return
+	}
+	atomicstore(&cc.canceled, 1)
+	tmo := cc.waiters
+	cc.waiters = nil
+	unlock(&cc.lock)
+
+	for tmo != nil {
+		next := tmo.cnext
+		tmo.cnext = nil
+		// 操作可能已经完成了, 这时 tmo.done 为 1, chanTimeoutFire 什么都不做。
+		chanTimeoutFire(tmo, 0)
+		tmo = next
+	}
+}
+
+// Canceled reports whether Cancel has been called.
+func (cc *ChanCancel) Canceled() bool {
+	return atomicload(&cc.canceled) != 0
+}
+
+// add 把 tmo 挂到 cc 上, 返回 false 表示 cc 已经被取消了。
+func (cc *ChanCancel) add(tmo *chanTimeout) bool {
+	lock(&cc.lock)
+	if cc.canceled != 0 {
+		unlock(&cc.lock)
+		return false
+	}
+	tmo.cnext = cc.waiters
+	cc.waiters = tmo
+	unlock(&cc.lock)
+	return true
+}
+
+// remove 把 tmo 从 cc 上摘下来, Cancel 已经取下整个链表的话什么都不做。
+func (cc *ChanCancel) remove(tmo *chanTimeout) {
+	lock(&cc.lock)
+	for p := &cc.waiters; *p != nil; p = &(*p).cnext {
+		if *p == tmo {
+			*p = tmo.cnext
+			tmo.cnext = nil
+			break
+		}
+	}
+	unlock(&cc.lock)
+}
+
+// chansendcancel is like a blocking chansend, but returns false without
+// sending if cc is canceled before the value can be sent.
+func chansendcancel(t *chantype, c *hchan, ep unsafe.Pointer, cc *ChanCancel, callerpc uintptr) bool {
+	if c == nil {
+		// 在 nil channel 上只能等到被取消, 换成一个别人拿不到的 channel 来等。
+		c = makechan(t, 0)
+	}
+	tmo := &chanTimeout{c: c, send: true, done: 1}
+	if !cc.add(tmo) {
+		return chansend(t, c, ep, false, nil, callerpc)
+	}
+	// 发送时 panic 的话 tmo 留在 cc 的链表上, Cancel 时发现 done 为 1 什么都不做。
+	ok := chansend(t, c, ep, true, tmo, callerpc)
+	cc.remove(tmo)
+	return ok
+}
+
+// chanrecvcancel is like a blocking chanrecv, but gives up if cc is
+// canceled before a value arrives or c is closed. It returns
+// (false, false) in that case.
+func chanrecvcancel(t *chantype, c *hchan, ep unsafe.Pointer, cc *ChanCancel) (selected, received bool) {
+	if c == nil {
+		c = makechan(t, 0)
+	}
+	tmo := &chanTimeout{c: c, send: false, done: 1}
+	if !cc.add(tmo) {
+		return chanrecv(t, c, ep, false, nil, nil)
+	}
+	selected, received = chanrecv(t, c, ep, true, tmo, nil)
+	cc.remove(tmo)
+	return
+}
+
+//go:linkname reflect_chansendcancel reflect.chansendcancel
+func reflect_chansendcancel(t *chantype, c *hchan, elem unsafe.Pointer, cc *ChanCancel) bool {
+	return chansendcancel(t, c, elem, cc, getcallerpc(unsafe.Pointer(&t)))
+}
+
+//go:linkname reflect_chanrecvcancel reflect.chanrecvcancel
+func reflect_chanrecvcancel(t *chantype, c *hchan, elem unsafe.Pointer, cc *ChanCancel) (selected, received bool) {
+	return chanrecvcancel(t, c, elem, cc)
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Channel wait graph for the deadlock report.
+//
+// checkdead 发现所有 goroutine 都在等待时只能报告 "all goroutines are asleep"。
+// 大部分这样的死锁都是 goroutine 在互相等 channel, 所以在 throw 之前打印等待图:
+//
+//	每个在 channel 上阻塞的 goroutine 挂在 gp.waiting 上的 sudog(select 有多个), sudog.c 是它等待的 channel
+//	sudog 在 c.sendq 中就是在等发送, 在 c.recvq 中就是在等接收
+//	对每个 channel 打印 make 它的位置, 以及同一个 channel 上在等待的其他 goroutine
+//
+// 这时没有 goroutine 在运行, 所以不加 c.lock 直接读等待队列。
+// 等待图在 "fatal error: all goroutines are asleep" 之后由 dopanic_m 打印。
+
+package runtime
+
+import "unsafe"
+
+// chandeadlock 由 checkdead 在因为死锁 throw 之前设置, dopanic_m 看到后打印等待图。
+var chandeadlock bool
+
+func printchanwaitgraph() {
+	lock(&allglock)
+	header := false
+	for _, gp := range allgs {
+		if isSystemGoroutine(gp) || readgstatus(gp)&^_Gscan != _Gwaiting {
+			continue
+		}
+		if gp.waiting == nil {
+			if gp.waitreason == waitReasonChanSendNilChan || gp.waitreason == waitReasonChanReceiveNilChan || gp.waitreason == waitReasonSelectNoCases {
+				if !header {
+					print("\ngoroutines blocked on channels:\n")
+					header = true
+				}
+				print("goroutine ", gp.goid, " [", gp.waitreason.String(), "]\n")
+			}
+			continue
+		}
+		for sg := gp.waiting; sg != nil; sg = sg.waitlink {
+			c := sg.c
+			if c == nil {
+				continue
+			}
+			if !header {
+				print("\ngoroutines blocked on channels:\n")
+				header = true
+			}
+			if sg == gp.waiting {
+				print("goroutine ", gp.goid, " [", gp.waitreason.String(), "]\n")
+			}
+			q, other := &c.recvq, &c.sendq
+			dir := "receive from"
+			if waitqHas(&c.sendq, sg) {
+				q, other = &c.sendq, &c.recvq
+				dir = "send on"
+			}
+			print("\t", dir, " chan ", hex(uintptr(unsafe.Pointer(c))))
+			if c.dataqsiz > 0 {
+				print(" (", c.qcount, "/", c.dataqsiz, " buffered)")
+			}
+			print("\n")
+			printchanpc("\t\tmade by ", c.makepc)
+			printwaiters("\t\talso waiting on the same side:", q, gp)
+			printwaiters("\t\twaiting on the other side:", other, gp)
+		}
+	}
+	unlock(&allglock)
+}
+
+func waitqHas(q *waitq, sg *sudog) bool {
+	for s := q.first; s != nil; s = s.next {
+		if s == sg {
+			return true
+		}
+	}
+	return false
+}
+
+// printchanpc 打印 label 和 pc 所在的函数和位置, pc 是 getcallerpc 得到的返回地址。
+func printchanpc(label string, pc uintptr) {
+	f := findfunc(pc)
+	if f == nil {
+		return
+	}
+	tracepc := pc // back up to CALL instruction for funcline.
+	if pc > f.entry {
+		tracepc -= _PCQuantum
+	}
+	file, line := funcline(f, tracepc)
+	print(label, funcname(f), " at ", file, ":", line, "\n")
+}
+
+// printwaiters 打印 q 中除了 self 之外的等待者。
+func printwaiters(label string, q *waitq, self *g) {
+	n := 0
+	for s := q.first; s != nil; s = s.next {
+		if s.g == self {
+			continue
+		}
+		if n == 0 {
+			print(label)
+		}
+		print(" goroutine ", s.g.goid)
+		n++
+	}
+	if n > 0 {
+		print("\n")
+	}
+}
@@ -0,0 +1,10 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build chandebug
+
+package runtime
+
+// debugChan 打开 chanseq.go 中的检查, 用 go test -tags chandebug runtime 测试。
+const debugChan = true
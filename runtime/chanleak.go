@@ -0,0 +1,91 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Reporting goroutines parked on channels for a long time.
+//
+// 忘记关闭或者没有人再读写的 channel 会让等在上面的 goroutine 永远泄漏, 只要程序里还有别的
+// goroutine 在跑, checkdead 就发现不了。GODEBUG=chanleak=N 时:
+//
+//	waitq.enqueue 在 sudog.enqtime 中记下开始等待的时间
+//	sysmon 每 N 秒唤醒一次 chanleakmonitor (和 forcegc 一样, 监视的 goroutine 平时 park 着,
+//	不挂 timer, 不影响 checkdead)
+//	chanleakmonitor stop the world, 打印所有在 channel 上等了超过 N 秒的 goroutine:
+//	等待的 channel、gopark 的原因和栈
+//
+// goroutine 在 channel 上等待时 gp.waiting 指向它的 sudog (select 时是所有 case 的 sudog 链表),
+// world 停下来时可以放心地读。
+
+package runtime
+
+import "unsafe"
+
+var chanleak struct {
+	lock mutex
+	g    *g
+	idle uint32
+}
+
+func init() {
+	if debug.chanleak > 0 {
+		go chanleakmonitor()
+	}
+}
+
+func chanleakmonitor() {
+	chanleak.g = getg()
+	for {
+		lock(&chanleak.lock)
+		atomicstore(&chanleak.idle, 1)
+		goparkunlock(&chanleak.lock, waitReasonChanLeakMonitorIdle, traceEvGoBlock, 1)
+		// this goroutine is explicitly resumed by sysmon
+		stopTheWorld("chan leak check")
+		systemstack(func() {
+			chanleakprint(int64(debug.chanleak) * 1e9)
+		})
+		startTheWorld()
+	}
+}
+
+// chanleakwake 由 sysmon 调用, 唤醒 chanleakmonitor 做一次检查。
+func chanleakwake() {
+	if atomicload(&chanleak.idle) == 0 {
+		return // 还没有启动, 或者上一次检查还没有做完
+	}
+	lock(&chanleak.lock)
+	chanleak.idle = 0
+	chanleak.g.schedlink = 0
+	injectglist(chanleak.g)
+	unlock(&chanleak.lock)
+}
+
+// chanleakprint 打印在 channel 上等待超过 threshold 纳秒的 goroutine, world 已经停下来了。
+func chanleakprint(threshold int64) {
+	now := nanotime()
+	n := 0
+	lock(&allglock)
+	for _, gp := range allgs {
+		if readgstatus(gp)&^_Gscan != _Gwaiting || isSystemGoroutine(gp) {
+			continue
+		}
+		sg := gp.waiting
+		if sg == nil || sg.c == nil || sg.enqtime == 0 || now-sg.enqtime < threshold {
+			continue
+		}
+		if n == 0 {
+			print("goroutines parked on channels for more than ", threshold/1e9, "s:\n")
+		}
+		n++
+		print("\ngoroutine ", gp.goid, " parked for ", (now-sg.enqtime)/1e9, "s on")
+		for s := sg; s != nil; s = s.waitlink {
+			print(" ", hex(uintptr(unsafe.Pointer(s.c))))
+		}
+		print("\n")
+		if sg.c.makepc != 0 {
+			printchanpc("\tchannel made by ", sg.c.makepc)
+		}
+		goroutineheader(gp)
+		traceback(^uintptr(0), ^uintptr(0), 0, gp)
+	}
+	unlock(&allglock)
+}
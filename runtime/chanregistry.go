@@ -0,0 +1,113 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Registry of live channels.
+//
+// GODEBUG=chanregistry=1 时 makechan 把每个新建的 channel 登记到 chanregistry 中,
+// LiveChannels 可以列出所有还活着的 channel, 和 goroutine dump 一样用来排查问题。
+//
+// 登记表不能让 channel 一直活着, 所以它和 heap profile 一样用 special record 实现:
+//
+//	makechan:  分配一个 specialchan 挂到 hchan 上(addspecial), 同时串到 chanregistry 的链表中,
+//	           specialchan 在 fixalloc 分配的内存里, 其中 hchan 的地址是 uintptr, GC 看不到
+//	sweep:     hchan 被回收之前 freespecial 调用 chanunregister 把它从链表中摘下来
+//
+// 所以持有 chanregistry.lock 时链表中的 hchan 都还没有被回收, 可以读。但是其中可能有已经不可达、
+// 只是还没有 sweep 的 channel, 不能把它们的指针交出去, 否则会让 GC 认为已经死了的对象重新活过来。
+// LiveChannels 只复制一份快照, 不加 c.lock (sweep 时不能等 c.lock), 长度等字段只是参考值。
+
+package runtime
+
+import "unsafe"
+
+// The described object is a channel registered by GODEBUG=chanregistry.
+type specialchan struct {
+	special special
+	c       uintptr // *hchan, 不让 GC 看到
+	next    *specialchan
+	prev    *specialchan
+}
+
+var chanregistry struct {
+	lock mutex
+	head *specialchan
+	n    int
+}
+
+// A ChanRecord describes a live channel, as returned by LiveChannels.
+type ChanRecord struct {
+	Addr     uintptr // address of the channel; identifies it among the records
+	MakePC   uintptr // program counter of the make call that created it
+	ElemType string  // element type
+	Len, Cap int     // buffered elements and buffer capacity
+	Closed   bool
+}
+
+// LiveChannels returns n, the number of channels registered since the
+// program started with GODEBUG=chanregistry=1 and not yet garbage collected.
+// If len(p) >= n, LiveChannels copies a record for each channel into p
+// and returns n, true. If len(p) < n, LiveChannels does not change p and
+// returns n, false. The records are a snapshot taken without stopping the
+// channels' users, so Len and Closed may already be stale. Channels that
+// have become unreachable may still be listed until they are swept.
+func LiveChannels(p []ChanRecord) (n int, ok bool) {
+	lock(&chanregistry.lock)
+	n = chanregistry.n
+	if len(p) >= n {
+		ok = true
+		i := 0
+		for s := chanregistry.head; s != nil; s = s.next {
+			c := (*hchan)(unsafe.Pointer(s.c))
+			p[i] = ChanRecord{
+				Addr:     s.c,
+				MakePC:   c.makepc,
+				ElemType: *c.elemtype._string,
+				Len:      int(atomicloaduint(&c.qcount)),
+				Cap:      int(c.dataqsiz),
+				Closed:   atomicload(&c.closed) != 0,
+			}
+			i++
+		}
+	}
+	unlock(&chanregistry.lock)
+	return
+}
+
+// chanregister 在 makechan 中调用, 把 c 登记到 chanregistry。
+func chanregister(c *hchan) {
+	lock(&mheap_.speciallock)
+	s := (*specialchan)(fixAlloc_Alloc(&mheap_.specialchanalloc))
+	unlock(&mheap_.speciallock)
+	s.special.kind = _KindSpecialChan
+	s.c = uintptr(unsafe.Pointer(c))
+	s.prev = nil
+
+	lock(&chanregistry.lock)
+	s.next = chanregistry.head
+	if s.next != nil {
+		s.next.prev = s
+	}
+	chanregistry.head = s
+	chanregistry.n++
+	unlock(&chanregistry.lock)
+
+	if !addspecial(unsafe.Pointer(c), &s.special) {
+		throw("chanregister: channel already registered")
+	}
+}
+
+// chanunregister 在 sweep 回收 hchan 之前调用。
+func chanunregister(s *specialchan) {
+	lock(&chanregistry.lock)
+	if s.prev != nil {
+		s.prev.next = s.next
+	} else {
+		chanregistry.head = s.next
+	}
+	if s.next != nil {
+		s.next.prev = s.prev
+	}
+	chanregistry.n--
+	unlock(&chanregistry.lock)
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Channel operation sequence checks.
+//
+// chansend/chanrecv 的快速通道和 spsc channel 的不加锁路径都依赖读写的先后顺序
+// (见 chansend 中的注释和 chanspsc.go), 改错了顺序只会偶尔出现元素丢失或者重复。
+// 用 -tags chandebug 编译时 debugChan 为 true (见 chandebug.go), 每个 channel 多维护几个计数:
+//
+//	sendseq   进入 buffer 的元素总数, 由发送的一方在 qcount 增加之前增加
+//	recvseq   离开 buffer 的元素总数, 由接收的一方在 qcount 减少之前增加
+//	seqmax    一次移动过的最多元素个数, 在增加 sendseq/recvseq 之前更新, 只增不减
+//
+// 两边每次移动元素时都检查对方的计数: 接收的总数不能超过发送的总数, buffer 中的元素不能超过容量,
+// 持有 c.lock 时 sendseq-recvseq 必须正好等于 qcount, 并且和 sendx, recvx 对得上。
+// 快速通道返回"不能完成"之前也检查它依据的那次观察和计数是一致的。
+// 计数都用原子操作, 不加锁的一方也可以读。只对有缓冲的 channel 有意义。
+
+package runtime
+
+// chanseqput 在 n 个元素放进 buffer、sendx 已经移动之后, qcount 增加之前调用。
+// locked 表示调用者持有 c.lock (不是 spsc channel 上不加锁的发送)。
+func chanseqput(c *hchan, n int, locked bool) {
+	chanseqmax(c, n)
+	s := xadduintptr(&c.sendseq, uintptr(n))
+	r := atomicloaduintptr(&c.recvseq)
+	if s-r > uintptr(c.dataqsiz) {
+		print("runtime: chan sendseq=", s, " recvseq=", r, " cap=", c.dataqsiz, "\n")
+		throw("chan: more elements in buffer than its capacity")
+	}
+	if locked {
+		chanseqcheck(c, int(c.qcount)+n)
+	}
+}
+
+// chanseqtake 在 n 个元素从 buffer 中取走、recvx 已经移动之后, qcount 减少之前调用。
+func chanseqtake(c *hchan, n int, locked bool) {
+	chanseqmax(c, n)
+	r := xadduintptr(&c.recvseq, uintptr(n))
+	s := atomicloaduintptr(&c.sendseq)
+	if int(s-r) < 0 {
+		print("runtime: chan sendseq=", s, " recvseq=", r, "\n")
+		throw("chan: received more elements than were sent")
+	}
+	if locked {
+		chanseqcheck(c, int(c.qcount)-n)
+	}
+}
+
+// chanseqmax 把 c.seqmax 提高到至少 n。
+// chansendmany/chanrecvmany 一次移动多个元素, 计数和 qcount 之间最多差 seqmax 而不是 1。
+func chanseqmax(c *hchan, n int) {
+	for {
+		b := atomicloaduintptr(&c.seqmax)
+		if uintptr(n) <= b || casuintptr(&c.seqmax, b, uintptr(n)) {
+			return
+		}
+	}
+}
+
+// chanseqcheck 检查持有 c.lock 时计数和 buffer 的状态一致, qcount 是这次修改之后的值。
+// spsc channel 上不加锁的一方可能同时在移动元素, 只检查对面的计数。
+func chanseqcheck(c *hchan, qcount int) {
+	if c.spsc != 0 {
+		return
+	}
+	s, r := c.sendseq, c.recvseq
+	if s-r != uintptr(qcount) || (c.recvx+uint(qcount))%c.dataqsiz != c.sendx {
+		print("runtime: chan sendseq=", s, " recvseq=", r, " qcount=", qcount, " sendx=", c.sendx, " recvx=", c.recvx, " cap=", c.dataqsiz, "\n")
+		throw("chan: sequence numbers do not match the buffer")
+	}
+}
+
+// chanseqfull 检查快速通道的判断: 在读到 r0 之后看到 buffer 满了。
+// 那一刻 qcount 等于容量, 而 sendseq 在 qcount 增加之前增加; 同时最多有一个接收正在进行
+// (持有锁或者唯一的接收者), 它可能已经增加了 recvseq 还没有减少 qcount, 一次最多 seqmax 个元素。
+// recvseq 又不会减小, 所以现在的 sendseq 至少是 r0+容量-seqmax。
+// seqmax 在 recvseq 增加之前更新, 这里在观察之后读它, 不会比那次接收移动的元素少。
+func chanseqfull(c *hchan, r0 uintptr) {
+	s := atomicloaduintptr(&c.sendseq)
+	b := chanseqslack(c)
+	if int(s-r0-uintptr(c.dataqsiz)+b) < 0 {
+		print("runtime: chan sendseq=", s, " recvseq before=", r0, " cap=", c.dataqsiz, " batch=", b, "\n")
+		throw("chan: send fast path saw a full buffer that was not full")
+	}
+}
+
+// chanseqempty 和 chanseqfull 相反: 在读到 s0 之后看到 buffer 空了,
+// 那一刻完成的接收和完成的发送一样多, 最多还有一个发送已经增加了 sendseq 还没有增加 qcount,
+// 所以现在的 recvseq 至少是 s0-seqmax。
+func chanseqempty(c *hchan, s0 uintptr) {
+	r := atomicloaduintptr(&c.recvseq)
+	b := chanseqslack(c)
+	if int(r-s0+b) < 0 {
+		print("runtime: chan recvseq=", r, " sendseq before=", s0, " batch=", b, "\n")
+		throw("chan: receive fast path saw an empty buffer that was not empty")
+	}
+}
+
+// chanseqslack 返回计数和 qcount 之间最多可以差多少个元素, 至少是 1。
+func chanseqslack(c *hchan) uintptr {
+	if b := atomicloaduintptr(&c.seqmax); b > 1 {
+		return b
+	}
+	return 1
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Single-producer/single-consumer buffered channels.
+//
+// 有缓冲的 channel 每次发送和接收都要加 c.lock。如果用 DeclareChanSPSC 声明了
+// channel 只有一个发送者和一个接收者, 两边不冲突的时候就不加锁:
+//
+//	sendx 只由发送者修改, recvx 只由接收者修改, 各自读写自己那一端的 buffer 槽位,
+//	只有 qcount 是两边共享的, 用原子操作增减。
+//	发送者先写元素再 qcount+1, 接收者看到 qcount > 0 之后才读元素, 反过来也一样。
+//
+// 需要阻塞(buffer 满/空)、channel 已经 close 的时候走原来加锁的路径。加锁路径在 spsc channel 上
+// 也用原子操作修改 qcount (chanqadd)。麻烦的是不加锁的一方怎么知道对面在等待:
+//
+//	等待者(加锁路径): spscwait+1, 再检查一次 qcount, 条件仍然不满足才 enqueue 并 gopark
+//	不加锁的一方:      qcount±1,   再读 spscwait, 不为 0 就加锁从等待队列里唤醒一个
+//
+// 两边都是先原子地写再读对方写的那个字, 至少有一方能看到另一方, 所以不会丢失唤醒。
+// 等待者在持有 c.lock 时增加 spscwait, 一直到 gopark 之后才释放锁, 所以唤醒的一方
+// 拿到锁的时候等待者一定已经在队列里了。
+//
+// 多个 case 的 select 会在不加锁路径看不见的地方等待, 所以 spsc channel 不能用在 select 中,
+// selectsend/selectrecv 会 panic。只有一个 case 加 default 的 select 用的是 chansend/chanrecv, 可以使用。
+
+package runtime
+
+import "unsafe"
+
+// DeclareChanSPSC declares that the buffered channel ch will only ever
+// be sent to by one goroutine at a time and received from by one
+// goroutine at a time. Sends and receives on such a channel do not take
+// the channel lock unless they have to block. ch must not be used in a
+// select statement with more than one case.
+//
+// DeclareChanSPSC panics if ch is not a buffered channel or if it is
+// not empty.
+func DeclareChanSPSC(ch interface{}) {
+	e := (*eface)(unsafe.Pointer(&ch))
+	if e._type == nil || e._type.kind&kindMask != kindChan {
+		panic("DeclareChanSPSC: not a channel")
+	}
+	c := (*hchan)(e.data)
+	if c == nil || c.dataqsiz == 0 {
+		panic("DeclareChanSPSC: not a buffered channel")
+	}
+	lock(&c.lock)
+	if c.qcount != 0 || c.closed != 0 || c.recvq.first != nil || c.sendq.first != nil {
+		unlock(&c.lock)
+		panic("DeclareChanSPSC: channel already in use")
+	}
+	atomicstore(&c.spsc, 1)
+	unlock(&c.lock)
+}
+
+// chanqadd 修改 c.qcount, spsc channel 上用原子操作。调用者持有 c.lock。
+func chanqadd(c *hchan, delta int) {
+	if debugChan {
+		if delta > 0 {
+			chanseqput(c, delta, true)
+		} else if delta < 0 {
+			chanseqtake(c, -delta, true)
+		}
+	}
+	if c.spsc != 0 {
+		xadduintptr((*uintptr)(unsafe.Pointer(&c.qcount)), uintptr(delta))
+		return
+	}
+	c.qcount = uint(int(c.qcount) + delta)
+}
+
+// chanspscWait 在加锁路径准备 gopark 之前调用, send 表示等待的是 buffer 有空位还是有数据。
+// 返回 true 表示登记之后条件已经满足, 不需要等待了。
+// 返回 false 时调用者 gopark, 被唤醒之后调用 chanspscWaitDone。
+func chanspscWait(c *hchan, send bool) bool {
+	xadd(&c.spscwait, 1)
+	if send && chanspscCanSend(c) || !send && chanspscCanRecv(c) {
+		xadd(&c.spscwait, -1)
+		return true
+	}
+	return false
+}
+
+func chanspscWaitDone(c *hchan) {
+	xadd(&c.spscwait, -1)
+}
+
+func chanspscCanSend(c *hchan) bool { return atomicloaduint(&c.qcount) < c.dataqsiz }
+func chanspscCanRecv(c *hchan) bool { return atomicloaduint(&c.qcount) > 0 }
+
+// chansendSPSC 是 spsc channel 上不加锁的发送, 不能完成时返回 false, 由调用者走加锁的路径。
+func chansendSPSC(c *hchan, ep unsafe.Pointer) bool {
+	if atomicload(&c.closed) != 0 || !chanspscCanSend(c) {
+		return false
+	}
+	if raceenabled {
+		raceacquire(chanbuf(c, c.sendx))
+		racerelease(chanbuf(c, c.sendx))
+	}
+	typedmemmove(c.elemtype, chanbuf(c, c.sendx), ep)
+	c.sendx++
+	if c.sendx == c.dataqsiz {
+		c.sendx = 0
+	}
+	if debugChan {
+		chanseqput(c, 1, false)
+	}
+	xadduintptr((*uintptr)(unsafe.Pointer(&c.qcount)), 1)
+	if atomicload(&c.spscwait) != 0 {
+		chanspscWake(c, &c.recvq)
+	}
+	return true
+}
+
+// chanrecvSPSC 是 spsc channel 上不加锁的接收, buffer 为空时返回 false。
+// channel 被 close 之后仍然可以不加锁地取走 buffer 中剩下的元素。
+func chanrecvSPSC(c *hchan, ep unsafe.Pointer) bool {
+	if !chanspscCanRecv(c) {
+		return false
+	}
+	if raceenabled {
+		raceacquire(chanbuf(c, c.recvx))
+		racerelease(chanbuf(c, c.recvx))
+	}
+	if ep != nil {
+		typedmemmove(c.elemtype, ep, chanbuf(c, c.recvx))
+	}
+	chanbufclear(c, 1)
+	c.recvx++
+	if c.recvx == c.dataqsiz {
+		c.recvx = 0
+	}
+	if debugChan {
+		chanseqtake(c, 1, false)
+	}
+	xadduintptr((*uintptr)(unsafe.Pointer(&c.qcount)), ^uintptr(0))
+	if atomicload(&c.spscwait) != 0 {
+		chanspscWake(c, &c.sendq)
+	}
+	return true
+}
+
+// chanspscWake 唤醒 q 中的一个等待者。
+// 它被唤醒后回到加锁路径的循环里重新检查 qcount, 和加锁路径上的 chansend/chanrecv 唤醒对方一样。
+func chanspscWake(c *hchan, q *waitq) {
+	lock(&c.lock)
+	sg := q.dequeue()
+	unlock(&c.lock)
+	if sg != nil {
+		if sg.releasetime != 0 {
+			sg.releasetime = cputicks()
+		}
+		chanready(sg, 4)
+	}
+}
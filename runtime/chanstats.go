@@ -0,0 +1,72 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Channel wait statistics.
+//
+// 设置 GODEBUG=chanstats=1 时, 不用 execution trace 也能知道程序在 channel 上阻塞了多少:
+//
+//	sudogs   acquireSudog 加一, releaseSudog 减一, 包括 channel、select 和信号量用的 sudog
+//	nblock   chansend/chanrecv/select 每次 gopark 之前加一
+//	nwake    被唤醒之后加一, 同时把这次 gopark 的时间加到 parkns 上
+//
+// 平均阻塞时间用 parkns/nwake 计算, 还没有被唤醒的等待不计算在内。
+// 在 nil channel 上和没有 case 的 select 里永远阻塞不计算。
+// 打开时每个 sudog 和每次阻塞都要改全局的计数, 还要在持有 c.lock 时读一次 nanotime,
+// 所以默认是关掉的: 没有设置时 acquireSudog/releaseSudog 和每次阻塞只多读一次 debug.chanstats。
+// 一个 sudog 只在打开时取到的才计数(见 sudog.stat), 中途打开或者关掉时 SudogsInUse 也不会算错。
+
+package runtime
+
+var chanstats struct {
+	sudogs uint64 // xadd64 -1 之后按 int64 读
+	nblock uint64
+	nwake  uint64
+	parkns uint64
+}
+
+// ChanWaitStats describes how often channel operations block.
+// The counters are cumulative and only advance while GODEBUG=chanstats=1,
+// except SudogsInUse, which counts the sudogs acquired while it was set.
+type ChanWaitStats struct {
+	SudogsInUse uint64 // sudogs held by goroutines waiting on channels, select or semaphores
+	Blocks      uint64 // channel sends, receives and selects that had to park
+	ParkNs      uint64 // nanoseconds spent parked by the operations that have resumed
+	AvgParkNs   uint64 // ParkNs divided by the number of operations that have resumed
+}
+
+// ReadChanWaitStats returns the channel wait statistics.
+// Unlike ReadMemStats, it does not stop the world.
+func ReadChanWaitStats() ChanWaitStats {
+	s := ChanWaitStats{
+		Blocks: atomicload64(&chanstats.nblock),
+		ParkNs: atomicload64(&chanstats.parkns),
+	}
+	if n := int64(atomicload64(&chanstats.sudogs)); n > 0 {
+		s.SudogsInUse = uint64(n)
+	}
+	if n := atomicload64(&chanstats.nwake); n > 0 {
+		s.AvgParkNs = s.ParkNs / n
+	}
+	return s
+}
+
+// chanparkstart 在 channel 操作 gopark 之前调用, 返回值交给被唤醒之后的 chanparkdone。
+// 没有打开 chanstats 时返回 0, chanparkdone 什么都不做。
+func chanparkstart() int64 {
+	if debug.chanstats == 0 {
+		return 0
+	}
+	xadd64(&chanstats.nblock, 1)
+	return nanotime()
+}
+
+func chanparkdone(t0 int64) {
+	if t0 == 0 {
+		return
+	}
+	if d := nanotime() - t0; d > 0 {
+		xadd64(&chanstats.parkns, d)
+	}
+	xadd64(&chanstats.nwake, 1)
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Channel send/receive with a deadline.
+//
+// 带超时的发送/接收本来要写成 select 加一个 time.After, 每次都要 selectgo 对所有 case 加锁,
+// 还要多一个 channel 和 timer goroutine 的唤醒。chansendt/chanrecvt 直接在 chansend/chanrecv
+// 阻塞的地方挂一个 timer:
+//
+//	等待者: 持有 c.lock 时检查 timer 是否已经触发, 没有就把 sudog.selectdone 指向 tmo.done 再 gopark
+//	timer:   加 c.lock, cas(&tmo.done, 0, 1) 成功后把 sudog 从等待队列中删掉并唤醒等待者
+//
+// 和 select 一样, 发送者/接收者/closechan 在 waitq.dequeue 中也要 cas(sg.selectdone, 0, 1),
+// 所以一个等待的 sudog 只会被唤醒一次。timer 唤醒时 gp.param 为 nil, 等待者根据 tmo.timedout
+// 区分是超时还是 channel 被 close 了。
+//
+// 因为 selectdone 不为 nil, 有缓冲的 channel 上 chansend 不会把数据直接交给带超时的接收者,
+// 而是和 select 中的接收者一样先写 buffer 再唤醒。
+
+package runtime
+
+import "unsafe"
+
+type chanTimeout struct {
+	t        timer
+	c        *hchan
+	sg       *sudog // 正在等待的 sudog, done 为 0 时才有效
+	send     bool   // sg 在 c.sendq 还是 c.recvq 中
+	done     uint32 // 用作 sg.selectdone
+	fired    bool   // timer 已经触发(或者被取消), 持有 c.lock 时读写
+	timedout bool   // 等待者是被 timer (或者 ChanCancel) 唤醒的
+
+	cnext *chanTimeout // ChanCancel 的等待链表, 见 chancancel.go
+}
+
+// chansendt is like a blocking chansend, but gives up at the deadline
+// (in nanotime units) and returns false if the value was not sent by then.
+func chansendt(t *chantype, c *hchan, ep unsafe.Pointer, deadline int64, callerpc uintptr) bool {
+	if c == nil {
+		timeSleep(deadline - nanotime())
+		return false
+	}
+	if deadline <= nanotime() {
+		return chansend(t, c, ep, false, nil, callerpc)
+	}
+	tmo := newChanTimeout(c, deadline, true)
+	ok := chansend(t, c, ep, true, tmo, callerpc)
+	// 发送时 panic 的话 timer 留在堆里, 触发时发现 done 为 1 什么都不做。
+	deltimer(&tmo.t)
+	return ok
+}
+
+// chanrecvt is like a blocking chanrecv, but gives up at the deadline.
+// If no value arrived and c was not closed by then, it returns (false, false).
+func chanrecvt(t *chantype, c *hchan, ep unsafe.Pointer, deadline int64) (selected, received bool) {
+	if c == nil {
+		timeSleep(deadline - nanotime())
+		return
+	}
+	if deadline <= nanotime() {
+		return chanrecv(t, c, ep, false, nil, nil)
+	}
+	tmo := newChanTimeout(c, deadline, false)
+	selected, received = chanrecv(t, c, ep, true, tmo, nil)
+	deltimer(&tmo.t)
+	return
+}
+
+// reflectDeadline 把 reflect 传来的相对时间换成 nanotime 的 deadline, 溢出时当作永远不超时。
+func reflectDeadline(timeout int64) int64 {
+	d := nanotime() + timeout
+	if timeout > 0 && d < 0 {
+		d = 1<<63 - 1
+	}
+	return d
+}
+
+//go:linkname reflect_chansendt reflect.chansendt
+func reflect_chansendt(t *chantype, c *hchan, elem unsafe.Pointer, timeout int64) bool {
+	return chansendt(t, c, elem, reflectDeadline(timeout), getcallerpc(unsafe.Pointer(&t)))
+}
+
+//go:linkname reflect_chanrecvt reflect.chanrecvt
+func reflect_chanrecvt(t *chantype, c *hchan, elem unsafe.Pointer, timeout int64) (selected, received bool) {
+	return chanrecvt(t, c, elem, reflectDeadline(timeout))
+}
+
+func newChanTimeout(c *hchan, deadline int64, send bool) *chanTimeout {
+	tmo := &chanTimeout{c: c, send: send, done: 1}
+	tmo.t.when = deadline
+	tmo.t.f = chanTimeoutFire
+	tmo.t.arg = tmo
+	addtimer(&tmo.t)
+	return tmo
+}
+
+// arm 在 gopark 之前调用, 调用者持有 c.lock。
+// 返回 false 表示已经超时, 调用者不要再等待。
+func (tmo *chanTimeout) arm(sg *sudog) bool {
+	if tmo.fired {
+		return false
+	}
+	tmo.done = 0
+	tmo.sg = sg
+	sg.selectdone = &tmo.done
+	return true
+}
+
+func chanTimeoutFire(arg interface{}, seq uintptr) {
+	tmo := arg.(*chanTimeout)
+	c := tmo.c
+	lock(&c.lock)
+	tmo.fired = true
+	sg := tmo.sg
+	if sg == nil || !cas(&tmo.done, 0, 1) {
+		// 等待者已经被唤醒了, 或者还没有开始等待。
+		unlock(&c.lock)
+		return
+	}
+	if tmo.send {
+		c.sendq.dequeueSudoG(sg)
+	} else {
+		c.recvq.dequeueSudoG(sg)
+	}
+	tmo.sg = nil
+	tmo.timedout = true
+	if sg.releasetime != 0 {
+		sg.releasetime = cputicks()
+	}
+	unlock(&c.lock)
+	goready(sg.g, 4)
+}
@@ -0,0 +1,45 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Verification of zeroed allocations, GODEBUG=checkzero=1.
+//
+// 小对象的清零是延迟的: sweep 释放对象时只把第二个字置成非 0 表示"需要清零"，
+// mallocgc 看到第二个字是 0 就认为整个对象已经是 0 了，不再 memclr;
+// 2 个字以内的对象只清第一个字(freelist 的 next 指针)。大对象看 span 的 needzero。
+// 任何一处弄错了，新对象里就会留下旧数据，而且很难查。
+// 打开 checkzero 之后，mallocgc 对没有 flagNoZero 的分配检查返回的内存真的全是 0，
+// 不是的话打印对象所在的 span 和 sizeclass 然后 throw。
+
+package runtime
+
+import "unsafe"
+
+// checkZeroOffset 返回 [x, x+size) 中第一个不为 0 的字节的偏移，全是 0 时返回 size。
+func checkZeroOffset(x unsafe.Pointer, size uintptr) uintptr {
+	off := uintptr(0)
+	for ; off+ptrSize <= size; off += ptrSize {
+		if *(*uintptr)(add(x, off)) != 0 {
+			break
+		}
+	}
+	for ; off < size; off++ {
+		if *(*byte)(add(x, off)) != 0 {
+			return off
+		}
+	}
+	return size
+}
+
+// checkZero 由 mallocgc 在 GODEBUG=checkzero=1 时调用，x 是从 span s 中分配的 size 字节的新对象。
+func checkZero(x unsafe.Pointer, size uintptr, s *mspan) {
+	off := checkZeroOffset(x, size)
+	if off == size {
+		return
+	}
+	print("runtime: object ", x, " size ", size, " not zeroed: byte at offset ", off, " = ", hex(*(*byte)(add(x, off))), "\n")
+	if s != nil {
+		print("runtime: span ", hex(s.base()), " npages ", s.npages, " sizeclass ", s.sizeclass, " elemsize ", s.elemsize, " needzero ", s.needzero, "\n")
+	}
+	throw("checkzero: allocated memory not zeroed")
+}
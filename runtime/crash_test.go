@@ -138,6 +138,25 @@ func TestSimpleDeadlock(t *testing.T) {
 	testDeadlock(t, simpleDeadlockSource)
 }
 
+func TestChanDeadlockGraph(t *testing.T) {
+	output := executeTest(t, chanDeadlockSource, nil)
+	want := "fatal error: all goroutines are asleep - deadlock!\n"
+	if !strings.HasPrefix(output, want) {
+		t.Fatalf("output does not start with %q:\n%s", want, output)
+	}
+	for _, want := range []string{
+		"goroutines blocked on channels:",
+		"receive from chan",
+		"send on chan",
+		"made by main.main",
+		"also waiting on the same side: goroutine",
+	} {
+		if !strings.Contains(output, want) {
+			t.Fatalf("output:\n%s\n\nwant output containing: %s", output, want)
+		}
+	}
+}
+
 func TestInitDeadlock(t *testing.T) {
 	testDeadlock(t, initDeadlockSource)
 }
@@ -293,6 +312,22 @@ func main() {
 }
 `
 
+const chanDeadlockSource = `
+package main
+func main() {
+	a := make(chan int)
+	b := make(chan int, 1)
+	b <- 1
+	go func() {
+		<-a
+	}()
+	go func() {
+		b <- 2
+	}()
+	<-a
+}
+`
+
 const initDeadlockSource = `
 package main
 func init() {
@@ -587,3 +622,30 @@ func main() {
 	fmt.Println("done")
 }
 `
+
+func TestAllocFaultPersistent(t *testing.T) {
+	output := executeTest(t, allocFaultPersistentSource, nil)
+	for _, want := range []string{
+		"runtime: injected persistentalloc failure of ",
+		"fatal error: out of memory",
+	} {
+		if !strings.Contains(output, want) {
+			t.Fatalf("output:\n%s\n\nwant output containing: %s", output, want)
+		}
+	}
+}
+
+const allocFaultPersistentSource = `
+package main
+import "runtime"
+type I interface{ M() }
+type T int
+func (T) M() {}
+var e interface{} = T(1)
+func main() {
+	runtime.SetAllocFault(runtime.AllocFault{Sites: runtime.AllocFaultPersistent, Goroutine: true})
+	// The first assertion of T to I allocates its itab with persistentalloc.
+	e.(I).M()
+	println("itab allocated")
+}
+`
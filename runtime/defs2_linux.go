@@ -59,6 +59,7 @@ const (
 	MAP_FIXED   = C.MAP_FIXED
 
 	MADV_DONTNEED = C.MADV_DONTNEED
+	MADV_FREE     = C.MADV_FREE
 
 	SA_RESTART  = C.SA_RESTART
 	SA_ONSTACK  = C.SA_ONSTACK
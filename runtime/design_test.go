@@ -0,0 +1,194 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Benchmarks used to compare alternative designs of the allocator,
+// the channel implementation and the interface conversion code.
+// All of them are named BenchmarkDesign*, so one command runs the
+// whole suite against a given runtime:
+//
+//	go test -run=NONE -bench=Design -benchmem runtime > old.txt
+//	(switch the implementation, rebuild)
+//	go test -run=NONE -bench=Design -benchmem runtime > new.txt
+//	benchcmp old.txt new.txt
+
+package runtime_test
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+)
+
+var designSink interface{}
+
+// Allocator: one benchmark per representative size class, serial and
+// spread over all Ps. The objects die immediately, so the GC keeps
+// returning them to the span freelists and the benchmark covers both
+// allocation and free.
+
+func benchDesignAlloc(b *testing.B, size int) {
+	b.SetBytes(int64(size))
+	for i := 0; i < b.N; i++ {
+		designSink = make([]byte, size)
+	}
+}
+
+func benchDesignAllocParallel(b *testing.B, size int) {
+	b.SetBytes(int64(size))
+	b.RunParallel(func(pb *testing.PB) {
+		var x []byte
+		for pb.Next() {
+			x = make([]byte, size)
+		}
+		designSink = x
+	})
+}
+
+func BenchmarkDesignAlloc8(b *testing.B)      { benchDesignAlloc(b, 8) }
+func BenchmarkDesignAlloc64(b *testing.B)     { benchDesignAlloc(b, 64) }
+func BenchmarkDesignAlloc512(b *testing.B)    { benchDesignAlloc(b, 512) }
+func BenchmarkDesignAlloc4096(b *testing.B)   { benchDesignAlloc(b, 4096) }
+func BenchmarkDesignAlloc32768(b *testing.B)  { benchDesignAlloc(b, 32768) }
+func BenchmarkDesignAllocLarge(b *testing.B)  { benchDesignAlloc(b, 256<<10) }
+func BenchmarkDesignAllocPar8(b *testing.B)   { benchDesignAllocParallel(b, 8) }
+func BenchmarkDesignAllocPar512(b *testing.B) { benchDesignAllocParallel(b, 512) }
+func BenchmarkDesignAllocParLarge(b *testing.B) {
+	benchDesignAllocParallel(b, 256<<10)
+}
+
+func BenchmarkDesignAllocPointers(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		designSink = make([]*byte, 8)
+	}
+}
+
+// Channels.
+
+func benchDesignChanSPSC(b *testing.B, size int) {
+	c := make(chan int, size)
+	done := make(chan bool)
+	go func() {
+		for range c {
+		}
+		done <- true
+	}()
+	for i := 0; i < b.N; i++ {
+		c <- i
+	}
+	close(c)
+	<-done
+}
+
+func benchDesignChanMPMC(b *testing.B, size int) {
+	procs := runtime.GOMAXPROCS(-1)
+	c := make(chan int, size)
+	var wg sync.WaitGroup
+	for p := 0; p < procs; p++ {
+		wg.Add(1)
+		go func() {
+			for range c {
+			}
+			wg.Done()
+		}()
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c <- 0
+		}
+	})
+	close(c)
+	wg.Wait()
+}
+
+func BenchmarkDesignChanSPSCSync(b *testing.B)    { benchDesignChanSPSC(b, 0) }
+func BenchmarkDesignChanSPSC1(b *testing.B)       { benchDesignChanSPSC(b, 1) }
+func BenchmarkDesignChanSPSC128(b *testing.B)     { benchDesignChanSPSC(b, 128) }
+func BenchmarkDesignChanMPMCSync(b *testing.B)    { benchDesignChanMPMC(b, 0) }
+func BenchmarkDesignChanMPMC128(b *testing.B)     { benchDesignChanMPMC(b, 128) }
+func BenchmarkDesignChanSelect2(b *testing.B)     { benchDesignChanSelect(b, 2) }
+func BenchmarkDesignChanSelect2Sync(b *testing.B) { benchDesignChanSelect(b, 0) }
+
+func benchDesignChanSelect(b *testing.B, size int) {
+	c1 := make(chan int, size)
+	c2 := make(chan int, size)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			select {
+			case <-c1:
+			case <-c2:
+			}
+		}
+		done <- true
+	}()
+	for i := 0; i < b.N; i++ {
+		if i&1 == 0 {
+			c1 <- i
+		} else {
+			c2 <- i
+		}
+	}
+	<-done
+}
+
+// Interface conversions. The Many variants go through many distinct
+// (interface, type) pairs so that the itab table, not a per-call-site
+// cache, is what gets measured.
+
+type designT0 int
+type designT1 int
+type designT2 int
+type designT3 int
+type designT4 int
+type designT5 int
+type designT6 int
+type designT7 int
+
+func (designT0) Method1() {}
+func (designT1) Method1() {}
+func (designT2) Method1() {}
+func (designT3) Method1() {}
+func (designT4) Method1() {}
+func (designT5) Method1() {}
+func (designT6) Method1() {}
+func (designT7) Method1() {}
+
+var designValues = []interface{}{
+	designT0(0), designT1(1), designT2(2), designT3(3),
+	designT4(4), designT5(5), designT6(6), designT7(7),
+}
+
+func BenchmarkDesignConvT2ESmall(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		designSink = TS(i)
+	}
+}
+
+func BenchmarkDesignConvT2ELarge(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		designSink = TL{uintptr(i), 0}
+	}
+}
+
+func BenchmarkDesignConvT2I(b *testing.B) {
+	var x I1
+	for i := 0; i < b.N; i++ {
+		x = TM(i)
+	}
+	designSink = x
+}
+
+func BenchmarkDesignAssertE2IMany(b *testing.B) {
+	var x I1
+	for i := 0; i < b.N; i++ {
+		x = designValues[i&7].(I1)
+	}
+	designSink = x
+}
+
+func BenchmarkDesignAssertE2I2Miss(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_, ok = designValues[i&7].(I2)
+	}
+}
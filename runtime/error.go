@@ -19,28 +19,60 @@ type Error interface {
 
 // A TypeAssertionError explains a failed type assertion.
 type TypeAssertionError struct {
-	interfaceString string
-	concreteString  string
-	assertedString  string
-	missingMethod   string // one method needed by Interface, missing from Concrete
+	_interface    *_type // 被断言的接口值的静态类型, nil 表示 interface{} 或者不知道
+	concrete      *_type // 接口值中的动态类型, nil 表示接口值是 nil
+	asserted      *_type // 断言成的类型
+	missingMethod string // one method needed by asserted, missing from concrete
 }
 
 func (*TypeAssertionError) RuntimeError() {}
 
+// Interface returns the static type of the interface value the
+// assertion was made on, or "" if it is not known.
+func (e *TypeAssertionError) Interface() string {
+	return typeString(e._interface)
+}
+
+// Concrete returns the dynamic type held by the interface value,
+// or "" if the value was nil.
+func (e *TypeAssertionError) Concrete() string {
+	return typeString(e.concrete)
+}
+
+// Asserted returns the type the value was asserted to.
+func (e *TypeAssertionError) Asserted() string {
+	return typeString(e.asserted)
+}
+
+// MissingMethod returns the name of a method of the asserted interface
+// that the concrete type does not have, or "" if the assertion failed
+// for another reason.
+func (e *TypeAssertionError) MissingMethod() string {
+	return e.missingMethod
+}
+
 func (e *TypeAssertionError) Error() string {
-	inter := e.interfaceString
-	if inter == "" {
-		inter = "interface"
+	inter := "interface"
+	if e._interface != nil {
+		inter = *e._interface._string
 	}
-	if e.concreteString == "" {
-		return "interface conversion: " + inter + " is nil, not " + e.assertedString
+	as := *e.asserted._string
+	if e.concrete == nil {
+		return "interface conversion: " + inter + " is nil, not " + as
 	}
+	cs := *e.concrete._string
 	if e.missingMethod == "" {
-		return "interface conversion: " + inter + " is " + e.concreteString +
-			", not " + e.assertedString
+		return "interface conversion: " + inter + " is " + cs + ", not " + as
+	}
+	return "interface conversion: " + cs + " is not " + as + ": missing method " + e.missingMethod
+}
+
+// typeString 返回 t 的名字, t 是 nil 时返回 ""。
+func typeString(t *_type) string {
+	if t == nil {
+		return ""
 	}
-	return "interface conversion: " + e.concreteString + " is not " + e.assertedString +
-		": missing method " + e.missingMethod
+	return *t._string
 }
 
 // An errorString represents a runtime error described by a single string.
@@ -7,3 +7,20 @@
 package runtime
 
 var NewOSProc0 = newosproc0
+
+// MmapFixedClobbers maps a page, asks mmap_fixed for the same address
+// and reports whether the first mapping was replaced.
+func MmapFixedClobbers() bool {
+	p := mmap(nil, _PAGE_SIZE, _PROT_READ|_PROT_WRITE, _MAP_ANON|_MAP_PRIVATE, -1, 0)
+	if uintptr(p) < 4096 {
+		throw("mmap failed")
+	}
+	*(*byte)(p) = 1
+	q := mmap_fixed(p, _PAGE_SIZE, _PROT_READ|_PROT_WRITE, _MAP_ANON|_MAP_PRIVATE, -1, 0)
+	clobbered := *(*byte)(p) != 1
+	if q != p && uintptr(q) >= 4096 {
+		munmap(q, _PAGE_SIZE)
+	}
+	munmap(p, _PAGE_SIZE)
+	return clobbered
+}
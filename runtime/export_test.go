@@ -154,3 +154,523 @@ func BenchSetType(n int, x interface{}) {
 const PtrSize = ptrSize
 
 var TestingAssertE2I2GC = &testingAssertE2I2GC
+
+type ArenaLayout struct {
+	P          uintptr
+	PSize      uintptr
+	SpansSize  uintptr
+	BitmapSize uintptr
+	Spans      uintptr
+	Bitmap     uintptr
+	ArenaStart uintptr
+	ArenaEnd   uintptr
+	ArenaLimit uintptr
+	Reserved   bool
+	Probes     int
+	Hint       uintptr
+}
+
+// ReserveArena runs the 64-bit arena setup of mallocinit for goos/goarch
+// against a fake reserve function.
+func ReserveArena(goos, goarch string, reserve func(v unsafe.Pointer, n uintptr, reserved *bool) unsafe.Pointer) ArenaLayout {
+	l := reserveArena(goos, goarch, arenaTotalBits(goos, goarch), 0, reserve)
+	return ArenaLayout{l.p, l.pSize, l.spansSize, l.bitmapSize, l.spans, l.bitmap, l.arenaStart, l.arenaEnd, l.arenaLimit, l.reserved, l.probes, l.hint}
+}
+
+var ArenaHint = arenaHint
+var ArenaFootprint = arenaFootprint
+var ArenaProbeBits = arenaProbeBits
+
+func SetMaxMem(n uintptr) (old uintptr) {
+	old, maxMem = maxMem, n
+	return
+}
+
+var ArenaHintASLR = arenaHintASLR
+
+const ArenaChunk = _ArenaChunk
+
+const HeapAllocChunk = _HeapAllocChunk
+
+var NUMAChunks = numaChunks
+
+var CgoTrackAlloc = cgoTrackAlloc
+var CgoTrackFree = cgoTrackFree
+
+var MallocPoison = mallocPoison
+var MallocPoisonCheck = mallocPoisonCheck
+
+// ReserveArena32 runs the 32-bit arena setup of mallocinit against a fake reserve function.
+func ReserveArena32(limit, end uintptr, reserve func(v unsafe.Pointer, n uintptr, reserved *bool) unsafe.Pointer) ArenaLayout {
+	l := reserveArena32(limit, end, reserve)
+	return ArenaLayout{l.p, l.pSize, l.spansSize, l.bitmapSize, l.spans, l.bitmap, l.arenaStart, l.arenaEnd, l.arenaLimit, l.reserved, l.probes, l.hint}
+}
+
+type PersistentRegion struct {
+	r persistentRegion
+}
+
+func NewPersistentRegion() *PersistentRegion {
+	r := new(PersistentRegion)
+	persistentRegionInit(&r.r, &memstats.other_sys)
+	return r
+}
+
+func (r *PersistentRegion) Alloc(size, align uintptr) unsafe.Pointer {
+	return persistentRegionAlloc(&r.r, size, align)
+}
+
+func (r *PersistentRegion) Reset()       { persistentRegionReset(&r.r) }
+func (r *PersistentRegion) Free()        { persistentRegionFree(&r.r) }
+func (r *PersistentRegion) Sys() uintptr { return r.r.sys }
+
+func RawMem(size uintptr) unsafe.Pointer     { return rawmem(size) }
+func RawFree(p unsafe.Pointer, size uintptr) { rawfree(p, size) }
+
+func PersistentAlloc(size uintptr) unsafe.Pointer {
+	return persistentalloc(size, 0, &memstats.other_sys)
+}
+
+var WriteHeapLayout = runtime_debug_WriteHeapLayout
+
+// MCacheCached returns the number of spans and stack bytes cached by the current P.
+func MCacheCached() (spans int, stackBytes uintptr) {
+	mp := acquirem()
+	c := mp.mcache
+	for _, s := range c.alloc {
+		if s != &emptymspan {
+			spans++
+		}
+	}
+	for _, s := range c.largecache {
+		if s != nil {
+			spans++
+		}
+	}
+	for _, l := range c.stackcache {
+		stackBytes += l.size
+	}
+	releasem(mp)
+	return
+}
+
+// A HeapCheckpoint is a snapshot of the allocator metadata,
+// see heapreplay_test.go.
+type HeapCheckpoint struct {
+	PageSize   uintptr
+	MaxSmall   uintptr
+	ClassSize  []uint32 // class_to_size
+	ClassPages []uint32 // class_to_allocnpages
+	Spans      []CheckpointSpan
+}
+
+type CheckpointSpan struct {
+	Base      uintptr // relative to arena_start
+	NPages    uintptr
+	State     uint8
+	SizeClass uint8
+	Free      []uintptr // offsets of the objects on the freelist, for in-use small object spans
+}
+
+const (
+	SpanInUse  = _MSpanInUse
+	SpanFree   = _MSpanFree
+	SpanStack  = _MSpanStack
+	SpanCached = _MSpanCached
+	SpanManual = _MSpanManual
+)
+
+// ReadHeapCheckpoint snapshots the span states and freelists.
+// The buffers are allocated before the world is stopped, so that
+// taking the snapshot does not change the heap; if they turn out to
+// be too small it starts over.
+func ReadHeapCheckpoint() *HeapCheckpoint {
+	c := &HeapCheckpoint{PageSize: _PageSize, MaxSmall: _MaxSmallSize}
+	for i := range class_to_size {
+		c.ClassSize = append(c.ClassSize, uint32(class_to_size[i]))
+		c.ClassPages = append(c.ClassPages, uint32(class_to_allocnpages[i]))
+	}
+	nspan, nfree := 0, 0
+	for {
+		spans := make([]CheckpointSpan, 0, nspan+64)
+		free := make([]uintptr, 0, nfree+4096)
+		stopTheWorld("heap checkpoint")
+		nspan, nfree = 0, 0
+		for i := uintptr(0); i < uintptr(mheap_.nspan); i++ {
+			s := h_allspans[i]
+			if s.state == _MSpanDead {
+				continue
+			}
+			nspan++
+			cs := CheckpointSpan{Base: s.base() - mheap_.arena_start, NPages: s.npages, State: s.state, SizeClass: s.sizeclass}
+			if s.state == _MSpanInUse && s.sizeclass != 0 {
+				start := len(free)
+				for v := s.freelist; v.ptr() != nil; v = v.ptr().next {
+					nfree++
+					if len(free) < cap(free) {
+						free = append(free, uintptr(v)-s.base())
+					}
+				}
+				cs.Free = free[start:len(free):len(free)]
+			}
+			if len(spans) < cap(spans) {
+				spans = append(spans, cs)
+			}
+		}
+		startTheWorld()
+		if nspan <= len(spans) && nfree <= len(free) {
+			c.Spans = spans
+			return c
+		}
+	}
+}
+
+const (
+	MaxMem       = _MaxMem
+	MaxSmallSize = _MaxSmallSize
+	HeapPageSize = _PageSize
+)
+
+var RoundupSize = roundupsize
+
+// MallocGC allocates size bytes with mallocgc. Objects with pointers are
+// typed as arrays of *byte, so size is rounded up to a multiple of PtrSize.
+func MallocGC(size uintptr, noscan, nozero bool) unsafe.Pointer {
+	var flags uint32
+	var typ *_type
+	if noscan {
+		flags |= flagNoScan
+	} else {
+		var x interface{} = (*byte)(nil)
+		typ = (*eface)(unsafe.Pointer(&x))._type
+		size = round(size, ptrSize)
+	}
+	if nozero {
+		flags |= flagNoZero
+	}
+	return mallocgc(size, typ, flags)
+}
+
+// NewArray calls newarray with the dynamic type of proto.
+func NewArray(proto interface{}, n uintptr) unsafe.Pointer {
+	return newarray((*eface)(unsafe.Pointer(&proto))._type, n)
+}
+
+var CheckZeroOffset = checkZeroOffset
+
+// SetCheckZero turns GODEBUG=checkzero on or off and returns the previous setting.
+func SetCheckZero(on bool) bool {
+	old := debug.checkzero != 0
+	debug.checkzero = 0
+	if on {
+		debug.checkzero = 1
+	}
+	return old
+}
+
+// VerifyHeapErr runs the checks of VerifyHeap and returns the first
+// inconsistency instead of crashing. If corrupt is not nil, the ref count
+// of the span holding it is off by one while the checks run.
+func VerifyHeapErr(corrupt unsafe.Pointer) string {
+	stopTheWorld("verify heap")
+	var msg string
+	systemstack(func() {
+		var s *mspan
+		if corrupt != nil {
+			s = mHeap_LookupMaybe(&mheap_, corrupt)
+			s.ref--
+		}
+		_, msg = verifyheap_m()
+		if s != nil {
+			s.ref++
+		}
+	})
+	startTheWorld()
+	return msg
+}
+
+// ChanSendTimeout sends v on c, giving up after ns nanoseconds.
+func ChanSendTimeout(c chan int, v int, ns int64) bool {
+	i := interface{}(c)
+	e := (*eface)(unsafe.Pointer(&i))
+	return chansendt((*chantype)(unsafe.Pointer(e._type)), (*hchan)(e.data), unsafe.Pointer(&v), nanotime()+ns, getcallerpc(unsafe.Pointer(&c)))
+}
+
+// ChanRecvTimeout receives from c, giving up after ns nanoseconds.
+func ChanRecvTimeout(c chan int, ns int64) (v int, selected, received bool) {
+	i := interface{}(c)
+	e := (*eface)(unsafe.Pointer(&i))
+	selected, received = chanrecvt((*chantype)(unsafe.Pointer(e._type)), (*hchan)(e.data), unsafe.Pointer(&v), nanotime()+ns)
+	return
+}
+
+// ChanCloseDrain closes c and returns the values still buffered in it.
+func ChanCloseDrain(c chan int) []int {
+	i := interface{}(c)
+	p, n := closechandrain((*hchan)((*eface)(unsafe.Pointer(&i)).data))
+	if n == 0 {
+		return nil
+	}
+	return (*[1 << 20]int)(p)[:n:n]
+}
+
+// ChanDebug reports whether the runtime was built with -tags chandebug.
+const ChanDebug = debugChan
+
+// ChanSendMany sends up to len(vs) values from vs on c.
+func ChanSendMany(c chan int, vs []int, block bool) int {
+	i := interface{}(c)
+	e := (*eface)(unsafe.Pointer(&i))
+	return chansendmany((*chantype)(unsafe.Pointer(e._type)), (*hchan)(e.data), unsafe.Pointer(&vs[0]), len(vs), block, getcallerpc(unsafe.Pointer(&c)))
+}
+
+// ChanRecvMany receives up to len(vs) values from c into vs.
+func ChanRecvMany(c chan int, vs []int, block bool) (int, bool) {
+	i := interface{}(c)
+	e := (*eface)(unsafe.Pointer(&i))
+	return chanrecvmany((*chantype)(unsafe.Pointer(e._type)), (*hchan)(e.data), unsafe.Pointer(&vs[0]), len(vs), block)
+}
+
+// ChanSendManyPtr and ChanRecvManyPtr are ChanSendMany and ChanRecvMany
+// for pointer elements, to exercise the bulk write barrier.
+func ChanSendManyPtr(c chan *int, vs []*int, block bool) int {
+	i := interface{}(c)
+	e := (*eface)(unsafe.Pointer(&i))
+	return chansendmany((*chantype)(unsafe.Pointer(e._type)), (*hchan)(e.data), unsafe.Pointer(&vs[0]), len(vs), block, getcallerpc(unsafe.Pointer(&c)))
+}
+
+func ChanRecvManyPtr(c chan *int, vs []*int, block bool) (int, bool) {
+	i := interface{}(c)
+	e := (*eface)(unsafe.Pointer(&i))
+	return chanrecvmany((*chantype)(unsafe.Pointer(e._type)), (*hchan)(e.data), unsafe.Pointer(&vs[0]), len(vs), block)
+}
+
+// ChanPeek returns the value at the head of c's buffer without receiving it.
+func ChanPeek(c chan int) (v int, ok bool) {
+	i := interface{}(c)
+	e := (*eface)(unsafe.Pointer(&i))
+	ok = chanpeek((*chantype)(unsafe.Pointer(e._type)), (*hchan)(e.data), unsafe.Pointer(&v))
+	return
+}
+
+// ChanWaiters returns the number of goroutines parked on channel c.
+func ChanWaiters(c interface{}) int {
+	h := (*hchan)((*eface)(unsafe.Pointer(&c)).data)
+	n := 0
+	lock(&h.lock)
+	for _, q := range [...]*waitq{&h.recvq, &h.sendq} {
+		for sg := q.first; sg != nil; sg = sg.next {
+			n++
+		}
+	}
+	unlock(&h.lock)
+	return n
+}
+
+// ChanRecvSingle reports whether the receive queue of channel c holds
+// exactly one waiter that the next send can take without a select check.
+func ChanRecvSingle(c interface{}) bool {
+	h := (*hchan)((*eface)(unsafe.Pointer(&c)).data)
+	lock(&h.lock)
+	ok := h.recvq.single != nil
+	unlock(&h.lock)
+	return ok
+}
+
+// ChanCloseSite returns the call site and goroutine id recorded when c
+// was closed, as printed by GODEBUG=chanpanicdetail.
+func ChanCloseSite(c chan int) (pc uintptr, goid int64) {
+	i := interface{}(c)
+	h := (*hchan)((*eface)(unsafe.Pointer(&i)).data)
+	return h.closepc, h.closegid
+}
+
+// SetChanRegistry sets GODEBUG=chanregistry and returns the previous setting.
+func SetChanRegistry(n int32) int32 {
+	old := debug.chanregistry
+	debug.chanregistry = n
+	return old
+}
+
+// SetChanLeak sets GODEBUG=chanleak and returns the previous setting.
+// It does not start the monitor; use ChanLeakCheck to run a check.
+func SetChanLeak(n int32) int32 {
+	old := debug.chanleak
+	debug.chanleak = n
+	return old
+}
+
+// ChanLeakCheck writes the GODEBUG=chanleak report for goroutines parked
+// on channels for more than threshold nanoseconds into buf.
+func ChanLeakCheck(buf []byte, threshold int64) int {
+	stopTheWorld("chan leak check")
+	n := 0
+	systemstack(func() {
+		g0 := getg()
+		g0.writebuf = buf[0:0:len(buf)]
+		chanleakprint(threshold)
+		n = len(g0.writebuf)
+		g0.writebuf = nil
+	})
+	startTheWorld()
+	return n
+}
+
+// SetChanLIFO sets GODEBUG=chanlifo and returns the previous setting.
+func SetChanLIFO(n int32) int32 {
+	old := debug.chanlifo
+	debug.chanlifo = n
+	return old
+}
+
+// ChanBufStale returns how many free slots of c's buffer still hold a
+// pointer, and how many of those lie outside the slots received since
+// the buffer was last cleared.
+func ChanBufStale(c chan *int) (stale, outside int) {
+	i := interface{}(c)
+	h := (*hchan)((*eface)(unsafe.Pointer(&i)).data)
+	lock(&h.lock)
+	for j := uint(0); j < h.dataqsiz; j++ {
+		if (j+h.dataqsiz-h.recvx)%h.dataqsiz < h.qcount || *(**int)(chanbuf(h, j)) == nil {
+			continue
+		}
+		stale++
+		if j < h.clearx || j >= h.recvx {
+			outside++
+		}
+	}
+	unlock(&h.lock)
+	return
+}
+
+// HchanLayout returns the offsets of sendx and recvx in hchan, the size
+// of the hchan header, the size allocated for an unbuffered channel, and
+// the cache line size.
+func HchanLayout() (sendx, recvx, size, syncSize, line uintptr) {
+	var c hchan
+	return unsafe.Offsetof(c.sendx), unsafe.Offsetof(c.recvx), hchanSize, hchanSyncSize, _CacheLineSize
+}
+
+// ItabTableCheck adds n made-up itabs to an empty itab table, looking
+// them up again as it goes and at the end, and returns the size the
+// table grew to and whether every lookup found the right itab.
+func ItabTableCheck(n int) (size int, ok bool) {
+	t := &itabTableType{size: itabInitSize}
+	inter := new(interfacetype)
+	types := make([]_type, n)
+	tabs := make([]*itab, n)
+	ok = true
+	for i := range tabs {
+		types[i].hash = fastrand1()
+		tabs[i] = &itab{inter: inter, _type: &types[i]}
+		if t.count >= 3*(t.size/4) {
+			t = t.grow()
+		}
+		t.add(tabs[i])
+		if t.find(inter, &types[i]) != tabs[i] || t.find(inter, &types[i/2]) != tabs[i/2] {
+			ok = false
+		}
+	}
+	for i := range tabs {
+		if t.find(inter, &types[i]) != tabs[i] {
+			ok = false
+		}
+	}
+	return int(t.size), ok
+}
+
+// AddStaticItab builds the itab for the dynamic type of x and the
+// interface pi points to, as the linker would, and registers it through
+// itablinks and itabsinit. It returns that itab and what getitab then
+// finds for the pair, or two nils if the pair already has an itab.
+func AddStaticItab(x, pi interface{}) (static, found unsafe.Pointer) {
+	typ := (*eface)(unsafe.Pointer(&x))._type
+	inter := (*interfacetype)(unsafe.Pointer((*ptrtype)(unsafe.Pointer((*eface)(unsafe.Pointer(&pi))._type)).elem))
+	if itabTable.find(inter, typ) != nil {
+		return nil, nil
+	}
+	ni := len(inter.mhdr)
+	m := (*itab)(persistentalloc(unsafe.Sizeof(itab{})+uintptr(ni-1)*ptrSize, 0, &memstats.other_sys))
+	m.inter = inter
+	m._type = typ
+	for k := range inter.mhdr {
+		i := &inter.mhdr[k]
+		for j := range typ.x.mhdr {
+			t := &typ.x.mhdr[j]
+			if t.mtyp == i._type && *t.name == *i.name && t.pkgpath == i.pkgpath {
+				*(*unsafe.Pointer)(add(unsafe.Pointer(&m.fun[0]), uintptr(k)*ptrSize)) = t.ifn
+			}
+		}
+	}
+
+	old := itablinks
+	itablinks = []*itab{m}
+	itabsinit()
+	itablinks = old
+	return unsafe.Pointer(m), unsafe.Pointer(getitab(inter, typ, false))
+}
+
+type TypeSwitch typeSwitch
+
+// NewTypeSwitch returns a type switch whose cases are the element types
+// of the pointers in cases, so (*I1)(nil) makes a case I1.
+func NewTypeSwitch(cases ...interface{}) *TypeSwitch {
+	s := new(TypeSwitch)
+	for _, c := range cases {
+		pt := (*ptrtype)(unsafe.Pointer((*eface)(unsafe.Pointer(&c))._type))
+		s.cases = append(s.cases, pt.elem)
+	}
+	return s
+}
+
+// Case returns the case the dynamic type of x selects and whether an
+// itab came with it.
+func (s *TypeSwitch) Case(x interface{}) (cas int, tab bool) {
+	c, t := typeSwitchCase((*typeSwitch)(s), (*eface)(unsafe.Pointer(&x))._type)
+	return c, t != nil
+}
+
+const TypeSwitchCacheMax = typeSwitchCacheMax
+
+// CaseMadeUp runs s on n made-up concrete dynamic types and returns how
+// many types s has cached afterwards. s must have no interface cases.
+func (s *TypeSwitch) CaseMadeUp(n int) int {
+	types := make([]_type, n)
+	for i := range types {
+		types[i].hash = fastrand1()
+		if c, _ := typeSwitchCase((*typeSwitch)(s), &types[i]); c != -1 {
+			return -1
+		}
+	}
+	return s.Cached()
+}
+
+// Cached returns the number of dynamic types cached for s.
+func (s *TypeSwitch) Cached() int {
+	if s.cache == nil {
+		return 0
+	}
+	return int((*typeSwitchCache)(s.cache).count)
+}
+
+// SetChanStats sets GODEBUG=chanstats and returns the old value.
+func SetChanStats(n int32) int32 {
+	old := debug.chanstats
+	debug.chanstats = n
+	return old
+}
+
+// SetIfaceStats sets GODEBUG=ifacestats and returns the old value.
+func SetIfaceStats(n int32) int32 {
+	old := debug.ifacestats
+	debug.ifacestats = n
+	return old
+}
+
+// SetChanSyncSpin turns spinning before parking on synchronous channels
+// on or off and returns the previous setting.
+func SetChanSyncSpin(on bool) bool {
+	old := !chanspinoff
+	chanspinoff = !on
+	return old
+}
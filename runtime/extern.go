@@ -27,6 +27,57 @@ It is a comma-separated list of name=val pairs setting these named variables:
 	allocfreetrace: setting allocfreetrace=1 causes every allocation to be
 	profiled and a stack trace printed on each object's allocation and free.
 
+	allocprefetch: allocprefetch selects how the allocator prefetches the next
+	free object of a size class after taking one: 0 (the default) uses a
+	non-temporal prefetch (PREFETCHNTA), 1 prefetches into all cache levels
+	(PREFETCHT0) and 2 disables the prefetch. The best choice depends on the
+	processor. See also SetAllocPrefetch.
+
+	alloctrace: setting alloctrace=1 causes every allocation to be reported
+	with its size, size class, type and the allocating runtime function, either to
+	the hook registered with SetAllocHook or, without one, as a line on standard
+	error. Unlike allocfreetrace it does not print stack traces.
+
+	arenaaslr: setting arenaaslr=1 randomizes the address of the heap arena on
+	64-bit systems: the candidate addresses are tried in a random order and shifted
+	by a random offset of up to 8 GB. By default the arena is placed at the first
+	free address of the form 0x00XXc000000000, which is easy to recognize in
+	debuggers and crash dumps. Because the arena is set up before the environment
+	is fully processed, arenaaslr is not supported on Windows and Plan 9.
+
+	blackbox: setting blackbox=1 causes a fatal runtime error to also write a
+	snapshot of memory statistics, span occupancy, the itab table and all goroutine
+	stacks to standard error. See SetBlackbox and WriteBlackbox.
+
+	cgotrack: setting cgotrack=1 causes the runtime to record the Go call stack
+	of every C allocation made on behalf of cgo. The stacks are written to heap
+	dumps along with the outstanding C blocks.
+
+	chanleak: setting chanleak=N makes the runtime check every N seconds for
+	goroutines that have been parked on a channel operation for more than N
+	seconds, and print each of them with the channel it waits on, the
+	channel's make site and the goroutine's stack.
+
+	chanlifo: setting chanlifo=N makes goroutines blocked on a channel be woken
+	most recently blocked first instead of in arrival order, which keeps the data
+	and the woken goroutine warm in the cache. To bound unfairness, after N
+	consecutive such wakeups on a wait queue the longest waiting goroutine is
+	woken instead. Channel wait priorities are still honored.
+
+	chanpanicdetail: setting chanpanicdetail=1 makes a send on a closed channel
+	print the channel's element type, buffer occupancy and capacity, and the
+	goroutine and call site that closed it, before panicking.
+
+	chanregistry: setting chanregistry=1 records every channel created by make
+	so that runtime.LiveChannels can list the channels that are still live,
+	with their creation site, element type and buffer occupancy.
+
+	checkzero: setting checkzero=1 causes the allocator to verify that every
+	object it returns zeroed really is all zero, and to crash the program, printing
+	the span and size class of the object, if it is not. It checks the delayed
+	zeroing of freed objects by the sweeper at the cost of reading all newly
+	allocated memory.
+
 	efence: setting efence=1 causes the allocator to run in a mode
 	where each object is allocated on a unique page and addresses are
 	never recycled.
@@ -72,6 +123,28 @@ It is a comma-separated list of name=val pairs setting these named variables:
 	If the line ends with "(forced)", this GC was forced by a
 	runtime.GC() call and all phases are STW.
 
+	guardpage: setting guardpage=N causes every object of at least N bytes to be
+	allocated in its own run of pages followed by an inaccessible guard page, so
+	that writing past the last page of the object faults immediately.
+
+	hugepages: setting hugepages=1 makes the heap grow in whole huge pages and
+	asks the kernel to back the arena with transparent huge pages (Linux only).
+	The arena is always reserved aligned to the huge page size. Memory mapped
+	before GODEBUG is parsed at startup is not covered.
+
+	largetrack: setting largetrack=1 causes the runtime to record the call stack
+	of every allocation of an object larger than 32 kB, instead of only the
+	runtime function that allocated it. See ReadLargeObjects.
+
+	madvdontneed: setting madvdontneed=1 makes the scavenger on Linux return
+	memory to the operating system with MADV_DONTNEED, which frees the pages at
+	once, instead of MADV_FREE, which lets the kernel take them only under memory
+	pressure. MemStats.HeapReleasedLazy reports memory released the lazy way.
+
+	mallocpoison: setting mallocpoison=1 causes the sweeper to fill freed small
+	objects with a poison pattern and the allocator to check the pattern when it
+	reuses them, crashing the program if a freed object was written to.
+
 	memprofilerate: setting memprofilerate=X will update the value of runtime.MemProfileRate.
 	When set to 0 memory profiling is disabled.  Refer to the description of
 	MemProfileRate for the default value.
@@ -82,6 +155,16 @@ It is a comma-separated list of name=val pairs setting these named variables:
 	This should only be used as a temporary workaround to diagnose buggy code.
 	The real fix is to not store integers in pointer-typed locations.
 
+	numa: setting numa=1 on a Linux machine with several NUMA nodes binds each
+	chunk of newly grown heap memory to the node of the thread that grew it and
+	makes mcentral prefer spans from the current thread's node when refilling an
+	mcache. Supported on linux/amd64 and linux/arm64.
+
+	oomgc: setting oomgc=1 makes an allocation that fails because the heap
+	cannot grow run a blocking garbage collection and try once more before the
+	program dies with an out of memory error. A handler registered with
+	SetOOMHandler does the same and can free memory before the collection.
+
 	sbrk: setting sbrk=1 replaces the memory allocator and garbage collector
 	with a trivial allocator that obtains memory from the operating system and
 	never reclaims any memory.
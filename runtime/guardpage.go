@@ -0,0 +1,54 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Guard page allocation mode, GODEBUG=guardpage=N.
+//
+// 大小不小于 N 字节的对象(N=1 就是所有对象)不再走 sizeclass，而是单独占用一个 page run，
+// 后面再多申请一页作为 guard page，用 sysFault 保护起来。
+// 写越过了对象所在的最后一页就会马上触发 fault，而不是悄悄地破坏相邻的对象。
+//
+//	+-----------------------------------+-------+
+//	| object ...             | 页内剩余  | guard |
+//	+-----------------------------------+-------+
+//	^ s.start<<_PageShift                ^ s.npages-1 页
+//
+// 对象必须从 span 的开始放起，GC 通过 span 的起始地址找到对象并按 bitmap 扫描，
+// 所以对象大小不是页大小整数倍时，越界写到页内剩余的部分是发现不了的。
+// span 的 elemsize 包括了 guard page，GC 扫描在 bitmap 的 dead 标记处就停止了，不会读到它。
+// span 被 sweep 释放回 heap 之前要先把 guard page 恢复成可读写的，见 guardFree。
+//
+// 物理页比 _PageSize 大的平台(ppc64)上没法只保护一页，这个模式不起作用。
+
+package runtime
+
+import "unsafe"
+
+// guardEnabled 判断大小为 size 的对象是否要用 guard page 分配。
+func guardEnabled(size uintptr) bool {
+	return debug.guardpage > 0 && size >= uintptr(debug.guardpage) && _PhysPageSize <= _PageSize
+}
+
+// guardAlloc 在 system stack 上运行, 分配 size 大小的对象和后面的 guard page。
+func guardAlloc(size uintptr, flag uint32) *mspan {
+	s := largeAlloc(size+_PageSize, flag)
+	if s == nil {
+		return nil
+	}
+	s.limit = uintptr(s.start)<<_PageShift + size
+	s.guardpage = 1
+	sysFault(unsafe.Pointer(guardPageAddr(s)), _PageSize)
+	return s
+}
+
+// guardFree 由 mSpan_Sweep 在把 guard span 还给 heap 之前调用。
+func guardFree(s *mspan) {
+	var stat uint64
+	// sysFault 之后这一页仍然在 arena 中被映射着(只是没有权限)，所以按 reserved 重新映射。
+	sysMap(unsafe.Pointer(guardPageAddr(s)), _PageSize, true, &stat)
+	s.guardpage = 0
+}
+
+func guardPageAddr(s *mspan) uintptr {
+	return uintptr(s.start+pageID(s.npages)-1) << _PageShift
+}
@@ -47,6 +47,8 @@ const (
 	tagPanic           = 15
 	tagMemProf         = 16
 	tagAllocSample     = 17
+	tagCgoAlloc        = 18
+	tagLargeObject     = 19
 )
 
 var dumpfd uintptr // fd to write the dump to.
@@ -350,7 +352,7 @@ func dumpgoroutine(gp *g) {
 	dumpbool(isSystemGoroutine(gp))
 	dumpbool(false) // isbackground
 	dumpint(uint64(gp.waitsince))
-	dumpstr(gp.waitreason)
+	dumpstr(gp.waitreason.String())
 	dumpint(uint64(uintptr(gp.sched.ctxt)))
 	dumpint(uint64(uintptr(unsafe.Pointer(gp.m))))
 	dumpint(uint64(uintptr(unsafe.Pointer(gp._defer))))
@@ -476,6 +478,11 @@ func dumpobjs() {
 				freemark[j] = false
 				continue
 			}
+			if s.guardpage != 0 {
+				// 不能读 guard page, 见 guardpage.go
+				dumpobj(unsafe.Pointer(p), size-_PageSize, makeheapobjbv(p, size-_PageSize))
+				continue
+			}
 			dumpobj(unsafe.Pointer(p), size, makeheapobjbv(p, size))
 		}
 	}
@@ -636,6 +643,37 @@ func dumpmemprof() {
 	}
 }
 
+// 输出所有还没有释放的 cmalloc 内存块: 地址, 大小, 调用栈深度, 调用栈的 pc(只有 GODEBUG=cgotrack=1 时才有)。
+func dumpcgoblocks() {
+	iterate_cgoblocks(func(p, size uintptr, stk []uintptr) {
+		dumpint(tagCgoAlloc)
+		dumpint(uint64(p))
+		dumpint(uint64(size))
+		dumpint(uint64(len(stk)))
+		for _, pc := range stk {
+			dumpint(uint64(pc))
+		}
+	})
+}
+
+// 输出所有登记的大对象: 地址, 大小, 类型名, 调用栈深度, 调用栈的 pc(没有 GODEBUG=largetrack=1 时只有一个)。
+func dumplargeobjs() {
+	iterate_largeobjs(func(p, size uintptr, typ *_type, stk []uintptr) {
+		dumpint(tagLargeObject)
+		dumpint(uint64(p))
+		dumpint(uint64(size))
+		if typ != nil {
+			dumpstr(*typ._string)
+		} else {
+			dumpstr("")
+		}
+		dumpint(uint64(len(stk)))
+		for _, pc := range stk {
+			dumpint(uint64(pc))
+		}
+	})
+}
+
 var dumphdr = []byte("go1.5 heap dump\n")
 
 func mdump() {
@@ -656,6 +694,8 @@ func mdump() {
 	dumproots()
 	dumpmemstats()
 	dumpmemprof()
+	dumpcgoblocks()
+	dumplargeobjs()
 	dumpint(tagEOF)
 	flush()
 }
@@ -663,7 +703,7 @@ func mdump() {
 func writeheapdump_m(fd uintptr) {
 	_g_ := getg()
 	casgstatus(_g_.m.curg, _Grunning, _Gwaiting)
-	_g_.waitreason = "dumping heap"
+	_g_.waitreason = waitReasonDumpingHeap
 
 	// Update stats so we can dump them.
 	// As a side effect, flushes all the MCaches so the MSpan.freelist
@@ -0,0 +1,153 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Implementation of runtime/debug.WriteHeapLayout.
+//
+// heap dump 输出的是所有的对象，文件很大，而且只关心对象之间的引用关系。
+// 分析碎片只需要分配器自己的元数据，所以这里只输出 arena 的范围、每个 span 的状态、
+// spans 数组的映射以及 mcentral 的链表，工具可以离线分析，不用去读 runtime 的内存。
+//
+// 格式和 heap dump 一样，开头是 "go1.5 heap layout\n"，后面是一串记录，
+// 每个记录以一个 tag 开头，所有的整数都是 encoding/binary 的 uvarint:
+//
+//	layoutArena   arena_start arena_used arena_end arena_limit pagesize
+//	layoutSpan    base npages state sizeclass elemsize ref nfree incache needzero npreleased
+//	layoutSpans   first npages base     spans 数组中从第 first 页开始连续 npages 页都属于起始地址为 base 的 span,
+//	                                    base 为 0 表示没有 span(free span 的中间页, 或者是两个 chunk 之间的空洞)
+//	layoutCentral sizeclass list n base...  list 是 0 (nonempty) 或者 1 (empty)
+//	layoutEOF
+
+package runtime
+
+import "unsafe"
+
+const (
+	layoutEOF     = 0
+	layoutArena   = 1
+	layoutSpan    = 2
+	layoutSpans   = 3
+	layoutCentral = 4
+)
+
+var layouthdr = []byte("go1.5 heap layout\n")
+
+//go:linkname runtime_debug_WriteHeapLayout runtime/debug.WriteHeapLayout
+func runtime_debug_WriteHeapLayout(fd uintptr) {
+	stopTheWorld("write heap layout")
+
+	systemstack(func() {
+		writeheaplayout_m(fd)
+	})
+
+	startTheWorld()
+}
+
+func writeheaplayout_m(fd uintptr) {
+	// 把 mcache 的 span 和 largecache 都还回去，span 的 freelist 才是完整的。
+	updatememstats(nil)
+
+	dumpfd = fd
+	dwrite(unsafe.Pointer(&layouthdr[0]), uintptr(len(layouthdr)))
+	layoutarena()
+	layoutspans()
+	layoutspanmap()
+	layoutcentral()
+	dumpint(layoutEOF)
+	flush()
+	dumpfd = 0
+}
+
+func layoutarena() {
+	h := &mheap_
+	dumpint(layoutArena)
+	dumpint(uint64(h.arena_start))
+	dumpint(uint64(h.arena_used))
+	dumpint(uint64(h.arena_end))
+	dumpint(uint64(h.arena_limit))
+	dumpint(_PageSize)
+}
+
+func layoutspans() {
+	for i := uintptr(0); i < uintptr(mheap_.nspan); i++ {
+		s := h_allspans[i]
+		if s.state == _MSpanDead {
+			continue
+		}
+		var nfree uintptr
+		if s.state == _MSpanInUse && s.sizeclass != 0 {
+			_, n, _ := s.layout()
+			for v := s.freelist; v.ptr() != nil && nfree <= n; v = v.ptr().next {
+				nfree++
+			}
+		}
+		dumpint(layoutSpan)
+		dumpint(uint64(s.base()))
+		dumpint(uint64(s.npages))
+		dumpint(uint64(s.state))
+		dumpint(uint64(s.sizeclass))
+		dumpint(uint64(s.elemsize))
+		dumpint(uint64(s.ref))
+		dumpint(uint64(nfree))
+		dumpbool(s.incache)
+		dumpint(uint64(s.needzero))
+		dumpint(uint64(s.npreleased))
+	}
+}
+
+// layoutspanmap 把 spans 数组按连续指向同一个 span 的页合并后输出。
+func layoutspanmap() {
+	npages := (mheap_.arena_used - mheap_.arena_start) >> _PageShift
+	for i := uintptr(0); i < npages; {
+		s := layoutspanat(i)
+		j := i + 1
+		for j < npages && layoutspanat(j) == s {
+			j++
+		}
+		var base uintptr
+		if s != nil {
+			base = s.base()
+		}
+		dumpint(layoutSpans)
+		dumpint(uint64(i))
+		dumpint(uint64(j - i))
+		dumpint(uint64(base))
+		i = j
+	}
+}
+
+// layoutspanat 返回第 i 页所在的 span。
+// free span 只设置了第一页和最后一页，中间的页可能还指向已经合并掉的旧 span, 这些都当成 nil。
+func layoutspanat(i uintptr) *mspan {
+	s := h_spans[i]
+	if s == nil || s.state == _MSpanDead {
+		return nil
+	}
+	p := pageID((mheap_.arena_start >> _PageShift) + i)
+	if p < s.start || p >= s.start+pageID(s.npages) {
+		return nil
+	}
+	return s
+}
+
+func layoutcentral() {
+	for i := 1; i < _NumSizeClasses; i++ {
+		c := &mheap_.central[i].mcentral
+		layoutspanlist(i, 0, &c.nonempty)
+		layoutspanlist(i, 1, &c.empty)
+	}
+}
+
+func layoutspanlist(sizeclass, list int, head *mspan) {
+	n := 0
+	for s := head.next; s != head; s = s.next {
+		n++
+	}
+	dumpint(layoutCentral)
+	dumpint(uint64(sizeclass))
+	dumpint(uint64(list))
+	dumpint(uint64(n))
+	for s := head.next; s != head; s = s.next {
+		dumpint(uint64(s.base()))
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Heap soft limit.
+//
+// 默认没有 limit。设置 GODEBUG=heaplimit=1 时 mallocinit 用 memlimit() 的结果
+// (RLIMIT_AS, cgroup 的内存限制)作为初始的 limit，也可以用 SetHeapLimit 设置。有 limit 时:
+//
+//	1. GC 结束时算出的 next_gc 不超过 limit 的 15/16，接近 limit 时 GC 更频繁(gcMark)。
+//	2. 大对象分配前如果会超过 limit，先做一次阻塞的 GC(mallocgc, heapLimitGC)。
+//	   GC 之后仍然超过 limit 时，要等下一次 GC 完成之后才会再这样做，
+//	   否则每个大对象都做一次阻塞的 GC, 程序只剩下 GC 了。
+//	3. mHeap_Grow 增长 heap 会超过 limit 时，先把所有空闲的页还给 OS，
+//	   仍然不够就打印原因并返回失败，调用者会报告 out of memory，
+//	   而不是一直 map 下去直到被 OOM killer 杀掉。
+//
+// 这里的 heap 大小是 heap_sys - heap_released，即 heap 实际占用的内存。
+
+package runtime
+
+var (
+	heapLimit     uint64 // 0 表示没有限制
+	heapLimitGCAt uint32 // heapLimitGC 上次强制 GC 之后的 memstats.numgc+1, 原子操作
+)
+
+// SetHeapLimit sets a soft limit on the memory held by the heap and
+// returns the previous limit. A zero limit removes it. There is no
+// limit by default; with GODEBUG=heaplimit=1 the initial limit is
+// derived from RLIMIT_AS and, on Linux, the memory limit of the
+// process's cgroup.
+//
+// When the heap approaches the limit the garbage collector runs more
+// often. If the live heap does not fit under the limit, allocation
+// fails with an out of memory error instead of growing the heap.
+func SetHeapLimit(limit uint64) uint64 {
+	old := atomicload64(&heapLimit)
+	atomicstore64(&heapLimit, limit)
+	return old
+}
+
+// heapLimitGoal 返回 next_gc 的上限, 没有限制时返回 0。
+// 留出 1/16 给碎片和 GC 期间新分配的内存。
+func heapLimitGoal() uint64 {
+	limit := atomicload64(&heapLimit)
+	return limit - limit/16
+}
+
+// heapOverLimit 判断 heap 再增长 n 字节是否会超过 limit。
+func heapOverLimit(n uintptr) bool {
+	limit := atomicload64(&heapLimit)
+	return limit != 0 && memstats.heap_sys-memstats.heap_released+uint64(n) > limit
+}
+
+// heapLimitGC 在分配 size 字节的大对象之前调用, 会超过 limit 时做一次阻塞的 GC。
+// 上次强制的 GC 之后没有再完成过 GC 就什么都不做: 那次 GC 已经没能让 heap 回到 limit 以下,
+// 马上再来一次也不会更好。分配照常进行, heap 真的要增长到 limit 以上时由 mHeap_Grow 失败。
+func heapLimitGC(size uintptr) {
+	if !heapOverLimit(size) || atomicload(&heapLimitGCAt) == atomicload(&memstats.numgc)+1 {
+		return
+	}
+	startGC(gcForceBlockMode, false)
+	atomicstore(&heapLimitGCAt, atomicload(&memstats.numgc)+1)
+}
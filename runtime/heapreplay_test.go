@@ -0,0 +1,351 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime_test
+
+import (
+	. "runtime"
+	"sort"
+	"testing"
+)
+
+// Deterministic replay of allocation traces against a heap checkpoint.
+//
+// replayHeap models the span level of the allocator: small objects go to
+// the lowest free slot of the lowest-addressed span of their size class
+// that has room, new spans and large objects take the best fitting run of
+// free pages (like bestFit in mheap.go), and empty spans go back to the
+// page runs, coalescing with their neighbours. The size class tables are
+// parameters, so two allocator versions can replay the same trace from
+// the same checkpoint and compare the resulting fragmentation.
+
+// A replayOp allocates Size bytes, or frees the object allocated by
+// op number Free if Size is 0.
+type replayOp struct {
+	Size uintptr
+	Free int
+}
+
+type replayStats struct {
+	Objects        int
+	ObjectBytes    uintptr // requested bytes of live objects
+	InusePages     uintptr // pages in spans
+	FreeRuns       int     // runs of free pages below the top of the heap
+	LargestFree    uintptr // pages in the largest free run
+	HeapPages      uintptr // top of the heap
+	SmallSpans     int
+	SmallSpanSlots int // total object slots in small object spans
+}
+
+// Fragmentation returns the fraction of in-use span memory not used by
+// live objects.
+func (s replayStats) Fragmentation(pageSize uintptr) float64 {
+	if s.InusePages == 0 {
+		return 0
+	}
+	return 1 - float64(s.ObjectBytes)/float64(s.InusePages*pageSize)
+}
+
+type replaySpan struct {
+	page, npages uintptr
+	class        int
+	used         []bool // nil for large objects and spans the model doesn't own
+	nused        int
+}
+
+type replayObj struct {
+	span *replaySpan
+	slot int
+	size uintptr
+}
+
+type replayHeap struct {
+	pageSize   uintptr
+	maxSmall   uintptr
+	classSize  []uint32
+	classPages []uint32
+
+	top     uintptr             // pages below top are either in spans or free
+	free    map[uintptr]uintptr // free runs, first page -> npages
+	partial [][]*replaySpan     // per class, spans with free slots
+	objs    []replayObj
+	stats   replayStats
+}
+
+// newReplayHeap builds the model from a checkpoint, using classSize and
+// classPages instead of the checkpoint's tables for new spans.
+func newReplayHeap(c *HeapCheckpoint, classSize, classPages []uint32) *replayHeap {
+	h := &replayHeap{
+		pageSize:   c.PageSize,
+		maxSmall:   c.MaxSmall,
+		classSize:  classSize,
+		classPages: classPages,
+		free:       make(map[uintptr]uintptr),
+		partial:    make([][]*replaySpan, len(classSize)),
+	}
+	for _, cs := range c.Spans {
+		page := cs.Base / c.PageSize
+		if end := page + cs.NPages; end > h.top {
+			h.top = end
+		}
+		switch {
+		case cs.State == SpanFree:
+			h.addFree(page, cs.NPages)
+		case cs.State == SpanInUse && cs.SizeClass != 0:
+			// Existing small object spans keep the checkpoint's object size.
+			size := uintptr(c.ClassSize[cs.SizeClass])
+			s := &replaySpan{page: page, npages: cs.NPages, class: -1, used: make([]bool, cs.NPages*c.PageSize/size)}
+			for i := range s.used {
+				s.used[i] = true
+			}
+			s.nused = len(s.used)
+			for _, off := range cs.Free {
+				s.used[off/size] = false
+				s.nused--
+			}
+			h.stats.InusePages += s.npages
+		default:
+			// Large objects, stacks, arenas: pages the replay can't touch.
+			h.stats.InusePages += cs.NPages
+		}
+	}
+	return h
+}
+
+func (h *replayHeap) class(size uintptr) int {
+	for c := 1; c < len(h.classSize); c++ {
+		if uintptr(h.classSize[c]) >= size {
+			return c
+		}
+	}
+	panic("no size class")
+}
+
+func (h *replayHeap) addFree(page, npages uintptr) {
+	if n, ok := h.free[page+npages]; ok {
+		delete(h.free, page+npages)
+		npages += n
+	}
+	for p, n := range h.free {
+		if p+n == page {
+			h.free[p] = n + npages
+			return
+		}
+	}
+	h.free[page] = npages
+}
+
+func (h *replayHeap) allocPages(npages uintptr) uintptr {
+	best, bestN := ^uintptr(0), ^uintptr(0)
+	for p, n := range h.free {
+		if n >= npages && (n < bestN || n == bestN && p < best) {
+			best, bestN = p, n
+		}
+	}
+	h.stats.InusePages += npages
+	if bestN == ^uintptr(0) {
+		p := h.top
+		h.top += npages
+		return p
+	}
+	delete(h.free, best)
+	if bestN > npages {
+		h.free[best+npages] = bestN - npages
+	}
+	return best
+}
+
+func (h *replayHeap) alloc(size uintptr) {
+	h.stats.Objects++
+	h.stats.ObjectBytes += size
+	if size > h.maxSmall {
+		npages := (size + h.pageSize - 1) / h.pageSize
+		s := &replaySpan{page: h.allocPages(npages), npages: npages}
+		h.objs = append(h.objs, replayObj{s, 0, size})
+		return
+	}
+	c := h.class(size)
+	var s *replaySpan
+	if l := h.partial[c]; len(l) > 0 {
+		s = l[0]
+	} else {
+		npages := uintptr(h.classPages[c])
+		s = &replaySpan{page: h.allocPages(npages), npages: npages, class: c}
+		s.used = make([]bool, npages*h.pageSize/uintptr(h.classSize[c]))
+		h.insertPartial(s)
+	}
+	slot := 0
+	for s.used[slot] {
+		slot++
+	}
+	s.used[slot] = true
+	s.nused++
+	if s.nused == len(s.used) {
+		h.removePartial(s)
+	}
+	h.objs = append(h.objs, replayObj{s, slot, size})
+}
+
+func (h *replayHeap) free1(i int) {
+	o := h.objs[i]
+	h.objs[i] = replayObj{}
+	h.stats.Objects--
+	h.stats.ObjectBytes -= o.size
+	s := o.span
+	if s.used == nil {
+		h.stats.InusePages -= s.npages
+		h.addFree(s.page, s.npages)
+		return
+	}
+	if s.nused == len(s.used) && s.class > 0 {
+		h.insertPartial(s)
+	}
+	s.used[o.slot] = false
+	s.nused--
+	if s.nused == 0 && s.class > 0 {
+		h.removePartial(s)
+		h.stats.InusePages -= s.npages
+		h.addFree(s.page, s.npages)
+	}
+}
+
+func (h *replayHeap) insertPartial(s *replaySpan) {
+	l := h.partial[s.class]
+	i := sort.Search(len(l), func(i int) bool { return l[i].page > s.page })
+	l = append(l, nil)
+	copy(l[i+1:], l[i:])
+	l[i] = s
+	h.partial[s.class] = l
+}
+
+func (h *replayHeap) removePartial(s *replaySpan) {
+	l := h.partial[s.class]
+	i := sort.Search(len(l), func(i int) bool { return l[i].page >= s.page })
+	h.partial[s.class] = append(l[:i], l[i+1:]...)
+}
+
+// replay runs trace against a model built from c and returns the
+// statistics at the end.
+func replay(c *HeapCheckpoint, classSize, classPages []uint32, trace []replayOp) replayStats {
+	h := newReplayHeap(c, classSize, classPages)
+	// Objects of the checkpoint occupy no op numbers.
+	for _, op := range trace {
+		if op.Size == 0 {
+			h.free1(op.Free)
+			h.objs = append(h.objs, replayObj{})
+		} else {
+			h.alloc(op.Size)
+		}
+	}
+	st := h.stats
+	st.HeapPages = h.top
+	for _, n := range h.free {
+		st.FreeRuns++
+		if n > st.LargestFree {
+			st.LargestFree = n
+		}
+	}
+	for _, l := range h.partial {
+		for _, s := range l {
+			st.SmallSpans++
+			st.SmallSpanSlots += len(s.used)
+		}
+	}
+	return st
+}
+
+// replayTrace returns a deterministic trace of n operations: mostly small
+// objects with a tail of large ones, each freed with probability 1/2.
+func replayTrace(n int, seed uint32) []replayOp {
+	var trace []replayOp
+	var live []int
+	next := func() uint32 {
+		seed = seed*1664525 + 1013904223
+		return seed >> 8
+	}
+	for len(trace) < n {
+		if len(live) > 0 && next()%2 == 0 {
+			i := int(next()) % len(live)
+			trace = append(trace, replayOp{Free: live[i]})
+			live[i] = live[len(live)-1]
+			live = live[:len(live)-1]
+			continue
+		}
+		size := uintptr(next()%512 + 1)
+		switch next() % 16 {
+		case 0:
+			size = uintptr(next()%(32<<10) + 1)
+		case 1:
+			size = uintptr(next()%(256<<10) + 1)
+		}
+		live = append(live, len(trace))
+		trace = append(trace, replayOp{Size: size})
+	}
+	return trace
+}
+
+// pow2Classes is an alternative allocator version with power of two size
+// classes and one page spans where they fit.
+func pow2Classes(c *HeapCheckpoint) (size, pages []uint32) {
+	size, pages = []uint32{0}, []uint32{0}
+	for s := uint32(8); uintptr(s) <= c.MaxSmall; s *= 2 {
+		size = append(size, s)
+		p := uint32(1)
+		if uintptr(s) > c.PageSize {
+			p = uint32(uintptr(s) / c.PageSize)
+		}
+		pages = append(pages, p)
+	}
+	return
+}
+
+func TestHeapCheckpoint(t *testing.T) {
+	c := ReadHeapCheckpoint()
+	if len(c.ClassSize) == 0 || len(c.ClassSize) != len(c.ClassPages) {
+		t.Fatalf("bad size class tables: %d sizes, %d page counts", len(c.ClassSize), len(c.ClassPages))
+	}
+	spans := append([]CheckpointSpan(nil), c.Spans...)
+	sort.Sort(spansByBase(spans))
+	for i, s := range spans {
+		if s.Base%c.PageSize != 0 || s.NPages == 0 {
+			t.Errorf("span %#x has %d pages", s.Base, s.NPages)
+		}
+		if i > 0 && spans[i-1].Base+spans[i-1].NPages*c.PageSize > s.Base {
+			t.Errorf("spans at %#x and %#x overlap", spans[i-1].Base, s.Base)
+		}
+		if s.State != SpanInUse || s.SizeClass == 0 {
+			continue
+		}
+		size := uintptr(c.ClassSize[s.SizeClass])
+		for _, off := range s.Free {
+			if off%size != 0 || off >= s.NPages*c.PageSize {
+				t.Errorf("span %#x class %d: bad free object at offset %#x", s.Base, s.SizeClass, off)
+			}
+		}
+	}
+}
+
+type spansByBase []CheckpointSpan
+
+func (s spansByBase) Len() int           { return len(s) }
+func (s spansByBase) Less(i, j int) bool { return s[i].Base < s[j].Base }
+func (s spansByBase) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func TestHeapReplay(t *testing.T) {
+	c := ReadHeapCheckpoint()
+	trace := replayTrace(20000, 1)
+
+	real1 := replay(c, c.ClassSize, c.ClassPages, trace)
+	real2 := replay(c, c.ClassSize, c.ClassPages, trace)
+	if real1 != real2 {
+		t.Fatalf("replay is not deterministic:\n%+v\n%+v", real1, real2)
+	}
+	size, pages := pow2Classes(c)
+	alt := replay(c, size, pages, trace)
+	if alt.Objects != real1.Objects || alt.ObjectBytes != real1.ObjectBytes {
+		t.Fatalf("live objects differ between versions: %+v and %+v", real1, alt)
+	}
+	t.Logf("size classes:    %+v, fragmentation %.3f", real1, real1.Fragmentation(c.PageSize))
+	t.Logf("power of two:    %+v, fragmentation %.3f", alt, alt.Fragmentation(c.PageSize))
+}
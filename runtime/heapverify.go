@@ -0,0 +1,166 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Consistency checks of the allocator metadata.
+//
+// 改 mcache/mcentral/mheap 的代码时，元数据出错往往要过很久才以奇怪的方式崩溃。
+// VerifyHeap 在 stop the world 的时候检查所有的 span:
+//
+//	spans 数组     正在使用的 span 的每一页都指向它，free span 的第一页和最后一页指向它
+//	sizeclass      小对象 span 的 elemsize 和页数和 class_to_size/class_to_allocnpages 一致，
+//	               大对象 span 的 elemsize 是整个 span 的大小
+//	freelist       每个空闲对象都在 span 内、在对象的边界上，没有环，
+//	               而且空闲对象的个数 + ref == span 中对象的个数
+//	mcentral       链表上的 span 都是这个 sizeclass 的正在使用的 span
+//
+// 发现第一个不一致的地方就打印 span 的信息然后 throw。
+
+package runtime
+
+// VerifyHeap checks the consistency of the allocator's metadata: the
+// span table, the size class of every span, the free lists of small
+// object spans and the central span lists. It stops the world while it
+// runs and crashes the program with a description of the first
+// inconsistency it finds. It is meant for debugging the allocator.
+func VerifyHeap() {
+	stopTheWorld("verify heap")
+	var s *mspan
+	var msg string
+	systemstack(func() {
+		s, msg = verifyheap_m()
+	})
+	if msg != "" {
+		systemstack(func() {
+			verifyHeapFail(s, msg)
+		})
+	}
+	startTheWorld()
+}
+
+func verifyHeapFail(s *mspan, msg string) {
+	print("runtime: heap verification failed: ", msg, "\n")
+	if s != nil {
+		print("runtime: span ", s, " base ", hex(s.base()), " npages ", s.npages, " state ", s.state,
+			" sizeclass ", s.sizeclass, " elemsize ", s.elemsize, " ref ", s.ref, " incache ", s.incache, "\n")
+	}
+	throw("heap verification failed")
+}
+
+// verifyheap_m 检查所有的 span, 返回第一个有问题的 span 和问题的描述，都没有问题时返回 "".
+// 必须在 stop the world 的时候在 system stack 上调用。
+func verifyheap_m() (*mspan, string) {
+	h := &mheap_
+	lock(&h.lock)
+	defer unlock(&h.lock)
+
+	for i := uintptr(0); i < uintptr(h.nspan); i++ {
+		s := h_allspans[i]
+		if msg := verifyspan(h, s); msg != "" {
+			return s, msg
+		}
+	}
+	for i := 1; i < _NumSizeClasses; i++ {
+		c := &h.central[i].mcentral
+		if s, msg := verifycentrallist(c, &c.nonempty); msg != "" {
+			return s, msg
+		}
+		if s, msg := verifycentrallist(c, &c.empty); msg != "" {
+			return s, msg
+		}
+	}
+	return nil, ""
+}
+
+func verifyspan(h *mheap, s *mspan) string {
+	switch s.state {
+	case _MSpanDead:
+		return ""
+	case _MSpanInUse, _MSpanStack, _MSpanFree, _MSpanCached, _MSpanManual:
+	default:
+		return "invalid span state"
+	}
+	if s.npages == 0 {
+		return "span with no pages"
+	}
+	if s.base() < h.arena_start || s.base()+s.npages<<_PageShift > h.arena_used {
+		return "span outside the arena"
+	}
+
+	// spans 数组。
+	first := (s.base() - h.arena_start) >> _PageShift
+	last := first + s.npages - 1
+	if h_spans[first] != s || h_spans[last] != s {
+		return "spans table does not map the first and last page to the span"
+	}
+	if s.state == _MSpanInUse {
+		for p := first; p <= last; p++ {
+			if h_spans[p] != s {
+				return "spans table does not map every page of the span to the span"
+			}
+		}
+	}
+	if s.state != _MSpanInUse {
+		return ""
+	}
+
+	// sizeclass 和 elemsize。
+	if s.sizeclass >= _NumSizeClasses {
+		return "invalid size class"
+	}
+	if s.sizeclass == 0 {
+		if s.elemsize != s.npages<<_PageShift {
+			return "large object span elemsize is not the span size"
+		}
+		if s.ref > 1 {
+			return "large object span with more than one object"
+		}
+		return ""
+	}
+	if s.elemsize != uintptr(class_to_size[s.sizeclass]) {
+		return "elemsize does not match class_to_size"
+	}
+	if s.npages != uintptr(class_to_allocnpages[s.sizeclass]) {
+		return "npages does not match class_to_allocnpages"
+	}
+
+	// freelist。
+	size, n, _ := s.layout()
+	base := s.base()
+	limit := base + n*size
+	nfree := uintptr(0)
+	for v := s.freelist; v.ptr() != nil; v = v.ptr().next {
+		p := uintptr(v)
+		if p < base || p >= limit {
+			return "free list entry outside the span"
+		}
+		if (p-base)%size != 0 {
+			return "free list entry not at an object boundary"
+		}
+		nfree++
+		if nfree > n {
+			return "free list has a cycle or more entries than objects in the span"
+		}
+	}
+	if nfree+uintptr(s.ref) != n {
+		print("runtime: span has ", n, " objects, ", nfree, " on the free list, ref ", s.ref, "\n")
+		return "free list length plus ref does not match the number of objects"
+	}
+	return ""
+}
+
+func verifycentrallist(c *mcentral, list *mspan) (*mspan, string) {
+	n := uintptr(0)
+	for s := list.next; s != list; s = s.next {
+		if s.state != _MSpanInUse {
+			return s, "span on a central list is not in use"
+		}
+		if int32(s.sizeclass) != c.sizeclass {
+			return s, "span on the central list of another size class"
+		}
+		if n++; n > uintptr(mheap_.nspan) {
+			return s, "central span list has a cycle"
+		}
+	}
+	return nil, ""
+}
@@ -6,15 +6,158 @@ package runtime
 
 import "unsafe"
 
+// itab 的 hash 表。
+//
+// 开放寻址, 大小是 2 的幂, 用二次探测(依次跳过 1, 2, 3, ... 个位置, 能走遍所有位置)解决冲突。
+// itab 只增不删, 查找在遇到空位置时就可以确定表中没有:
+//
+//	查找: 原子地读 itabTable 和每个位置, 不加锁
+//	插入: 持有 ifaceLock, 填好 itab 的所有字段之后才原子地写进空位置
+//	扩容: 装满 3/4 时分配两倍大的新表, 把所有 itab 复制过去之后才原子地替换 itabTable
+//
+// 所以不加锁的查找看到的表总是完整的, 最多是没看到正在插入的那一个, 这时 getitab 加锁再找一次。
+// 旧表不会被释放, 不加锁的查找可能还在读它; itab 本身也是 persistentalloc 分配的, 同样不会释放。
+//
+// 找不到时花时间的是匹配方法和创建 itab, 不是插入。这一步按 (inter, typ) 的 hash
+// 加 itabLocks 中的一个锁, 同一对类型总是用同一个锁, 所以不会创建两次;
+// 不相关的类型对(例如启动时大量的类型转换)用不同的锁, 互相不等待。
+// 只有最后插入时才短暂地持有全局的 ifaceLock。加锁的顺序总是先 itabLocks 再 ifaceLock。
 const (
-	hashSize = 1009
+	itabInitSize   = 512 // 初始大小, 必须是 2 的幂
+	itabLockShards = 64
 )
 
 var (
-	ifaceLock mutex // lock for accessing hash
-	hash      [hashSize]*itab
+	ifaceLock     mutex // lock for writing to itabTable
+	itabTable     = &itabTableInit
+	itabTableInit = itabTableType{size: itabInitSize}
 )
 
+var itabLocks [itabLockShards]struct {
+	lock mutex
+	pad  [_CacheLineSize - unsafe.Sizeof(mutex{})]byte
+}
+
+// itabLock 返回创建 inter 和 typ 的 itab 时要持有的锁。
+func itabLock(inter *interfacetype, typ *_type) *mutex {
+	return &itabLocks[itabhash(inter, typ)%itabLockShards].lock
+}
+
+// itabstats 由 ReadItabStats 读取, 在 itabAdd 中持有 ifaceLock 修改。
+var itabstats struct {
+	nstatic    uint64 // itabsinit 加入的 itab 数
+	nbad       uint64 // bad 的 itab 数
+	itabbytes  uint64 // itab 占用的 persistentalloc 内存
+	tablebytes uint64 // 扩容分配的 itabTable 占用的内存, 包括已经不再使用的旧表
+}
+
+type itabTableType struct {
+	size    uintptr             // 位置的个数, 2 的幂
+	count   uintptr             // 已经有的 itab 数
+	entries [itabInitSize]*itab // 实际上有 size 个
+}
+
+func itabhash(inter *interfacetype, typ *_type) uintptr {
+	// compiler has provided some good hash codes for us.
+	// 类型的 hash 值是在编译时计算好的
+	h := inter.typ.hash
+	h += 17 * typ.hash
+	// TODO(rsc): h += 23 * x.mhash ?
+	return uintptr(h)
+}
+
+func (t *itabTableType) entry(i uintptr) **itab {
+	return (**itab)(add(unsafe.Pointer(&t.entries), i*ptrSize))
+}
+
+// find 查找 inter 和 typ 的 itab, 可以不加锁调用。
+func (t *itabTableType) find(inter *interfacetype, typ *_type) *itab {
+	mask := t.size - 1
+	h := itabhash(inter, typ) & mask
+	for i := uintptr(1); ; i++ {
+		m := (*itab)(atomicloadp(unsafe.Pointer(t.entry(h))))
+		if m == nil {
+			return nil
+		}
+		if m.inter == inter && m._type == typ {
+			return m
+		}
+		h += i
+		h &= mask
+	}
+}
+
+// add 把 m 放到第一个空位置上, 调用者持有 ifaceLock 并且保证表没有满。
+func (t *itabTableType) add(m *itab) {
+	mask := t.size - 1
+	h := itabhash(m.inter, m._type) & mask
+	for i := uintptr(1); ; i++ {
+		p := t.entry(h)
+		if *p == nil {
+			atomicstorep(unsafe.Pointer(p), unsafe.Pointer(m))
+			t.count++
+			return
+		}
+		h += i
+		h &= mask
+	}
+}
+
+// itabAdd 把新的 itab m 加到 itabTable 中, 必要时先扩容。调用者持有 ifaceLock。
+func itabAdd(m *itab) {
+	if m.bad != 0 {
+		itabstats.nbad++
+	}
+	t := itabTable
+	if t.count >= 3*(t.size/4) {
+		t = t.grow()
+		itabstats.tablebytes += uint64(itabTableBytes(t.size))
+		atomicstorep(unsafe.Pointer(&itabTable), unsafe.Pointer(t))
+	}
+	t.add(m)
+}
+
+// itablinks 是编译器为静态已知的转换(例如把 *bytes.Buffer 赋值给 io.Reader)生成的 itab, 由链接器填写。
+// 它是一个单独的符号, 不放在 moduledata 中: moduledata 的布局由链接器写死(-linkshared 时
+// typelinks 后面紧接着就是 modulename 和 modulehashes), 改变它必须同时修改 cmd/internal/ld/symtab.go。
+// 链接器还不填写它的时候它就是一个空的 slice。所有 module 共用这一个符号,
+// 所以 -linkshared 时只有链接器为整个程序收集的那些 itab。
+var itablinks []*itab // linker symbol
+
+// itabsinit 把 itablinks 中的 itab 加到 hash 表里。这些 itab 的 fun 已经填好,
+// 之后 getitab 第一次遇到这些类型对时也能直接找到, 不用再匹配方法。
+// schedinit 在任何 getitab 之前调用: 编译出来的代码直接使用这些 itab, 如果 getitab 为同一对类型
+// 另外创建了一个, 两个 interface 值的 tab 不同, 比较时会被当作不相等。
+// 同一对类型出现多次时只加入第一个。
+func itabsinit() {
+	lock(&ifaceLock)
+	for _, m := range itablinks {
+		if itabTable.find(m.inter, m._type) == nil {
+			itabAdd(m)
+			itabstats.nstatic++
+		}
+	}
+	unlock(&ifaceLock)
+}
+
+// itabTableBytes 返回有 size 个位置的 itabTableType 的大小。
+func itabTableBytes(size uintptr) uintptr {
+	return unsafe.Sizeof(itabTableType{}) + (size-itabInitSize)*ptrSize
+}
+
+// grow 返回一个两倍大小、包含 t 中所有 itab 的新表。
+func (t *itabTableType) grow() *itabTableType {
+	size := t.size * 2
+	t2 := (*itabTableType)(persistentalloc(itabTableBytes(size), 0, &memstats.other_sys))
+	t2.size = size
+	for i := uintptr(0); i < t.size; i++ {
+		if m := *t.entry(i); m != nil {
+			t2.add(m)
+		}
+	}
+	return t2
+}
+
 // fInterface is our standard non-empty interface.  We use it instead
 // of interface{f()} in function prototypes because gofmt insists on
 // putting lots of newlines in the otherwise concise interface{f()}.
@@ -34,57 +177,41 @@ func getitab(inter *interfacetype, typ *_type, canfail bool) *itab {
 		if canfail {
 			return nil
 		}
-		panic(&TypeAssertionError{"", *typ._string, *inter.typ._string, *inter.mhdr[0].name})
+		panic(&TypeAssertionError{concrete: typ, asserted: &inter.typ, missingMethod: *inter.mhdr[0].name})
 	}
 
-	// compiler has provided some good hash codes for us.
-	// 类型的 hash 值是在编译时计算好的
-	h := inter.typ.hash
-	h += 17 * typ.hash
-	// TODO(rsc): h += 23 * x.mhash ?
-	h %= hashSize
-
-	// look twice - once without lock, once with.
-	// common case will be no lock contention.
-	var m *itab
-	var locked int
 	// 在 hash 表中找到 itab，itab 相当于 interface 类型和一个类型实体的合体。
 	// 以 bytes.Buffer 和 io.Reader 为例, 当 bytes.Buffer 要转换成类型 io.Reader 使用时
 	// 就要找到这俩类型的 itab。
 	//
-	// 这里对 hash 表进行两次查找，第一次不带锁，如果没找到，对 hash 表加锁进行第二次查找。
-	// 因为，如果每一次查找都对 hash 表加锁，对于并发而言，这无疑是个灾难。
-	// 但如果 hash 表中找不到，需要对两个类型进行匹配，匹配成功创建新的 itab，匹配成功了对 hash 表进行修改，这时的修改就要加锁操作了。
-	//
-	// 加锁后再找以便，是因为有可能，在第二次循环开始前，其他 goroutine 对这个 hash 表进行了改写操作。所以锁后再找一便。
-	for locked = 0; locked < 2; locked++ {
-		if locked != 0 {
-			lock(&ifaceLock)
+	// 先不加锁找一次, 这是最常见的情况。
+	// 找不到时需要对两个类型进行匹配, 创建新的 itab 放到 hash 表里, 这要加 itabLock 的锁。
+	// 加锁后再找一遍, 是因为其他 goroutine 可能刚刚把它放进去。
+	var m *itab
+	var locked *mutex
+	t := (*itabTableType)(atomicloadp(unsafe.Pointer(&itabTable)))
+	if m = t.find(inter, typ); m == nil {
+		locked = itabLock(inter, typ)
+		lock(locked)
+		// itabTable 由持有 ifaceLock 的 goroutine 修改, 仍然要原子地读
+		t = (*itabTableType)(atomicloadp(unsafe.Pointer(&itabTable)))
+		m = t.find(inter, typ)
+	}
+	if m != nil {
+		if locked != nil {
+			unlock(locked)
 		}
-		for m = (*itab)(atomicloadp(unsafe.Pointer(&hash[h]))); m != nil; m = m.link {
-			if m.inter == inter && m._type == typ {
-				if m.bad != 0 {
-					// 这种情况只有，之前匹配过，但没成功，而且当时 canfail = true 时，才会出现。
-					// 所以多次执行 _, ok := xx.(some_interface)，并不会每次都重新匹配，hash 表里已经对这种情况进行了 cache
-					// 但 yy := xx.(some_interface) 这种情况，就会每次都对两个类型进行匹配，这就对性能很伤了。
-					m = nil
-					if !canfail { // 不允许失败，进行重新匹配。
-						// this can only happen if the conversion
-						// was already done once using the , ok form
-						// and we have a cached negative result.
-						// the cached result doesn't record which
-						// interface function was missing, so jump
-						// down to the interface check, which will
-						// do more work but give a better error.
-						goto search
-					}
-				}
-				if locked != 0 {
-					unlock(&ifaceLock)
-				}
-				return m
-			}
+		if m.bad == 0 {
+			return m
+		}
+		ifacestat(&ifacestats.neghit)
+		// 这种情况只有，之前匹配过，但没成功，而且当时 canfail = true 时，才会出现。
+		// 所以多次执行 _, ok := xx.(some_interface)，并不会每次都重新匹配，hash 表里已经对这种情况进行了 cache。
+		// 缓存里记下了第一个找不到的方法, yy := xx.(some_interface) 也不用重新匹配就能报告是哪个方法。
+		if canfail {
+			return nil
 		}
+		panic(&TypeAssertionError{concrete: typ, asserted: &inter.typ, missingMethod: *inter.mhdr[m.missing].name})
 	}
 
 	// itab 没有找到，新建一个 itab。这里是为 itab 类型申请内存空间
@@ -92,7 +219,6 @@ func getitab(inter *interfacetype, typ *_type, canfail bool) *itab {
 	m.inter = inter
 	m._type = typ
 
-search:
 	// both inter and typ have method sorted by name,
 	// and interface names are unique,
 	// so can iterate over both in lock step;
@@ -111,38 +237,60 @@ search:
 		for ; j < nt; j++ {
 			t := &x.mhdr[j]
 			if t.mtyp == itype && (t.name == iname || *t.name == *iname) && t.pkgpath == ipkgpath {
-				if m != nil {
-					*(*unsafe.Pointer)(add(unsafe.Pointer(&m.fun[0]), uintptr(k)*ptrSize)) = t.ifn
-				}
+				*(*unsafe.Pointer)(add(unsafe.Pointer(&m.fun[0]), uintptr(k)*ptrSize)) = t.ifn
 				goto nextimethod
 			}
 		}
 		// didn't find method
 		// interface 中的某一个函数，在这个类型中没有找到对应的 method，表示匹配失败了。
 		if !canfail { // 匹配失败，不允许失败，直接 panic。
-			if locked != 0 {
-				unlock(&ifaceLock)
-			}
-			panic(&TypeAssertionError{"", *typ._string, *inter.typ._string, *iname})
+			unlock(locked)
+			panic(&TypeAssertionError{concrete: typ, asserted: &inter.typ, missingMethod: *iname})
 		}
-		// 匹配失败，但允许失败。设置 bad 为 1，并把这个 m 放到 hash 表中。
+		// 匹配失败，但允许失败。设置 bad 为 1，记下找不到的方法，并把这个 m 放到 hash 表中。
 		m.bad = 1
+		m.missing = int32(k)
 		break
 	nextimethod:
 	}
-	if locked == 0 {
+	if locked == nil {
 		throw("invalid itab locking")
 	}
 	// 把新的 itab 放到 hash 表中
-	m.link = hash[h]
-	atomicstorep(unsafe.Pointer(&hash[h]), unsafe.Pointer(m))
+	lock(&ifaceLock)
+	itabstats.itabbytes += uint64(unsafe.Sizeof(itab{}) + uintptr(ni-1)*ptrSize)
+	itabAdd(m)
 	unlock(&ifaceLock)
+	unlock(locked)
 	if m.bad != 0 {
 		return nil
 	}
 	return m
 }
 
+// convT2I 用编译器提供的 cache 记住每个转换点的 itab, 类型断言(assertE2I/assertI2I 等)
+// 和 convI2I 的动态类型在每次调用时都可能不同, 没有这样的 cache, 每次都要查 hash 表。
+// 所以每个 M 上有一个按 itabhash 直接映射的小 cache, 记住最近断言成功的 itab,
+// 反复执行的 type switch 和断言大多在这里就能找到。
+//
+// 读写 cache 不加锁: getitab 可能阻塞, 之后 goroutine 可能已经换到了另一个 M 上,
+// 写入的是原来那个 M 的 cache。cache 中的 itab 都是完整的而且永远不会被释放,
+// 写入的只是一个指针, 读到的要么是这个 itab 要么是另一个, 比较 inter 和 _type 之后再用, 所以没有关系。
+const itabCacheSize = 16 // 必须是 2 的幂
+
+// getitabcached 和 getitab 一样, 先查当前 M 的 itabcache。
+func getitabcached(inter *interfacetype, typ *_type, canfail bool) *itab {
+	slot := &getg().m.itabcache[itabhash(inter, typ)&(itabCacheSize-1)]
+	if m := *slot; m != nil && m.inter == inter && m._type == typ {
+		return m
+	}
+	m := getitab(inter, typ, canfail)
+	if m != nil {
+		*slot = m
+	}
+	return m
+}
+
 func typ2Itab(t *_type, inter *interfacetype, cache **itab) *itab {
 	tab := getitab(inter, t, false)
 	atomicstorep(unsafe.Pointer(cache), unsafe.Pointer(tab))
@@ -151,6 +299,7 @@ func typ2Itab(t *_type, inter *interfacetype, cache **itab) *itab {
 
 // 普通类型转换成 interface{} 类型
 func convT2E(t *_type, elem unsafe.Pointer, x unsafe.Pointer) (e interface{}) {
+	ifacestat(&ifacestats.convT2E)
 	ep := (*eface)(unsafe.Pointer(&e))
 	// 参以下 eface 的类型, 有一个成员是 data unsafe.Pointer，是一个指向真正数据的指针
 	// isDirectIface 就是表示，这个类型能否直接存入指针中，而不是新申请一个内存存数据，再用指针指过去。
@@ -160,10 +309,16 @@ func convT2E(t *_type, elem unsafe.Pointer, x unsafe.Pointer) (e interface{}) {
 		typedmemmove(t, unsafe.Pointer(&ep.data), elem)
 	} else {
 		if x == nil {
-			x = newobject(t)
+			// 小整数和零值不用分配, 见 convT2Enoalloc。
+			if x = convT2Enoalloc(t, elem); x != nil {
+				ep._type = t
+				ep.data = x
+				return
+			}
+			// 马上要把数据 copy 过去，不含指针的类型就不用先清零了。
+			x = newobjectcopy(t)
+			ifacestat(&ifacestats.alloc)
 		}
-		// TODO: We allocate a zeroed object only to overwrite it with
-		// actual data.  Figure out how to avoid zeroing.  Also below in convT2I.
 		typedmemmove(t, x, elem) // 新建对象，把数据 copy 过去
 		ep._type = t
 		ep.data = x // 数据指针指向新数据。
@@ -175,6 +330,7 @@ func convT2E(t *_type, elem unsafe.Pointer, x unsafe.Pointer) (e interface{}) {
 // 参数中会给一个 cache，函数会看 cache 中是否有 itab，如果有就不从 hash 表里找了，如果没有再找，并把查到的 itab 放入 cache 中。、
 // 整体上，和转成 interface{} 差不多，只是 interface{} 中存的是 type 类型，interface{...} 中存的是 itab。
 func convT2I(t *_type, inter *interfacetype, cache **itab, elem unsafe.Pointer, x unsafe.Pointer) (i fInterface) {
+	ifacestat(&ifacestats.convT2I)
 	tab := (*itab)(atomicloadp(unsafe.Pointer(cache)))
 	if tab == nil {
 		tab = getitab(inter, t, false)
@@ -186,7 +342,13 @@ func convT2I(t *_type, inter *interfacetype, cache **itab, elem unsafe.Pointer,
 		typedmemmove(t, unsafe.Pointer(&pi.data), elem)
 	} else {
 		if x == nil {
-			x = newobject(t)
+			if x = convT2Enoalloc(t, elem); x != nil {
+				pi.tab = tab
+				pi.data = x
+				return
+			}
+			x = newobjectcopy(t)
+			ifacestat(&ifacestats.alloc)
 		}
 		typedmemmove(t, x, elem)
 		pi.tab = tab
@@ -195,23 +357,180 @@ func convT2I(t *_type, inter *interfacetype, cache **itab, elem unsafe.Pointer,
 	return
 }
 
-func panicdottype(have, want, iface *_type) {
-	haveString := ""
-	if have != nil {
-		haveString = *have._string
+// 装箱不含指针的小整数和零值不用分配内存。
+//
+// 接口中的数据从来不会被修改, 所以可以指向共享的只读数据:
+//
+//	大小不超过 8 字节、不含指针、当作无符号整数看小于 256 的值, 指向 staticuint64s 中对应的元素
+//	零值指向 t.zero (reflect 创建的类型可能还没有设置 t.zero)
+//
+// convT2E16/32/64/string/slice 是给编译器用的入口, 已经知道元素的大小, 省掉按 t.size 的判断。
+// 调用者要保证 t 不含指针 (string 和 slice 除外) 而且不是 isDirectIface 的。
+
+// staticuint64s[v] 的值是 v, 大端机器上较小的整数在它的最后几个字节。
+var staticuint64s = [256]uint64{
+	0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
+	0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+	0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17,
+	0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f,
+	0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x27,
+	0x28, 0x29, 0x2a, 0x2b, 0x2c, 0x2d, 0x2e, 0x2f,
+	0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37,
+	0x38, 0x39, 0x3a, 0x3b, 0x3c, 0x3d, 0x3e, 0x3f,
+	0x40, 0x41, 0x42, 0x43, 0x44, 0x45, 0x46, 0x47,
+	0x48, 0x49, 0x4a, 0x4b, 0x4c, 0x4d, 0x4e, 0x4f,
+	0x50, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57,
+	0x58, 0x59, 0x5a, 0x5b, 0x5c, 0x5d, 0x5e, 0x5f,
+	0x60, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67,
+	0x68, 0x69, 0x6a, 0x6b, 0x6c, 0x6d, 0x6e, 0x6f,
+	0x70, 0x71, 0x72, 0x73, 0x74, 0x75, 0x76, 0x77,
+	0x78, 0x79, 0x7a, 0x7b, 0x7c, 0x7d, 0x7e, 0x7f,
+	0x80, 0x81, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+	0x88, 0x89, 0x8a, 0x8b, 0x8c, 0x8d, 0x8e, 0x8f,
+	0x90, 0x91, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97,
+	0x98, 0x99, 0x9a, 0x9b, 0x9c, 0x9d, 0x9e, 0x9f,
+	0xa0, 0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+	0xa8, 0xa9, 0xaa, 0xab, 0xac, 0xad, 0xae, 0xaf,
+	0xb0, 0xb1, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7,
+	0xb8, 0xb9, 0xba, 0xbb, 0xbc, 0xbd, 0xbe, 0xbf,
+	0xc0, 0xc1, 0xc2, 0xc3, 0xc4, 0xc5, 0xc6, 0xc7,
+	0xc8, 0xc9, 0xca, 0xcb, 0xcc, 0xcd, 0xce, 0xcf,
+	0xd0, 0xd1, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7,
+	0xd8, 0xd9, 0xda, 0xdb, 0xdc, 0xdd, 0xde, 0xdf,
+	0xe0, 0xe1, 0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7,
+	0xe8, 0xe9, 0xea, 0xeb, 0xec, 0xed, 0xee, 0xef,
+	0xf0, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7,
+	0xf8, 0xf9, 0xfa, 0xfb, 0xfc, 0xfd, 0xfe, 0xff,
+}
+
+// staticint 返回 staticuint64s 中值为 v 的 size 字节整数的地址。
+func staticint(v uint8, size uintptr) unsafe.Pointer {
+	p := unsafe.Pointer(&staticuint64s[v])
+	if _BigEndian != 0 {
+		p = add(p, 8-size)
+	}
+	return p
+}
+
+// convT2Enoalloc 返回不用分配内存就能表示 *elem 的指针, 不行的时候返回 nil。
+func convT2Enoalloc(t *_type, elem unsafe.Pointer) unsafe.Pointer {
+	size := uintptr(t.size)
+	if t.kind&kindNoPointers != 0 && size <= 8 {
+		low := uintptr(0) // 最低位字节
+		if _BigEndian != 0 {
+			low = size - 1
+		}
+		small := true
+		for i := uintptr(0); i < size; i++ {
+			if i != low && *(*uint8)(add(elem, i)) != 0 {
+				small = false
+				break
+			}
+		}
+		if small {
+			return staticint(*(*uint8)(add(elem, low)), size)
+		}
+	}
+	if t.zero != nil && memequal(elem, unsafe.Pointer(t.zero), size) {
+		return unsafe.Pointer(t.zero)
+	}
+	return nil
+}
+
+func convT2E16(t *_type, elem unsafe.Pointer) (e interface{}) {
+	ifacestat(&ifacestats.convT2E)
+	var x unsafe.Pointer
+	if v := *(*uint16)(elem); v < uint16(len(staticuint64s)) {
+		x = staticint(uint8(v), 2)
+	} else {
+		x = mallocgc(2, t, flagNoScan|flagNoZero)
+		ifacestat(&ifacestats.alloc)
+		*(*uint16)(x) = v
+	}
+	ep := (*eface)(unsafe.Pointer(&e))
+	ep._type = t
+	ep.data = x
+	return
+}
+
+func convT2E32(t *_type, elem unsafe.Pointer) (e interface{}) {
+	ifacestat(&ifacestats.convT2E)
+	var x unsafe.Pointer
+	if v := *(*uint32)(elem); v < uint32(len(staticuint64s)) {
+		x = staticint(uint8(v), 4)
+	} else {
+		x = mallocgc(4, t, flagNoScan|flagNoZero)
+		ifacestat(&ifacestats.alloc)
+		*(*uint32)(x) = v
+	}
+	ep := (*eface)(unsafe.Pointer(&e))
+	ep._type = t
+	ep.data = x
+	return
+}
+
+func convT2E64(t *_type, elem unsafe.Pointer) (e interface{}) {
+	ifacestat(&ifacestats.convT2E)
+	var x unsafe.Pointer
+	if v := *(*uint64)(elem); v < uint64(len(staticuint64s)) {
+		x = staticint(uint8(v), 8)
+	} else {
+		x = mallocgc(8, t, flagNoScan|flagNoZero)
+		ifacestat(&ifacestats.alloc)
+		*(*uint64)(x) = v
 	}
-	panic(&TypeAssertionError{*iface._string, haveString, *want._string, ""})
+	ep := (*eface)(unsafe.Pointer(&e))
+	ep._type = t
+	ep.data = x
+	return
+}
+
+func convT2Estring(t *_type, elem unsafe.Pointer) (e interface{}) {
+	ifacestat(&ifacestats.convT2E)
+	var x unsafe.Pointer
+	if *(*string)(elem) == "" && t.zero != nil {
+		x = unsafe.Pointer(t.zero)
+	} else {
+		x = newobject(t)
+		ifacestat(&ifacestats.alloc)
+		*(*string)(x) = *(*string)(elem)
+	}
+	ep := (*eface)(unsafe.Pointer(&e))
+	ep._type = t
+	ep.data = x
+	return
+}
+
+func convT2Eslice(t *_type, elem unsafe.Pointer) (e interface{}) {
+	ifacestat(&ifacestats.convT2E)
+	var x unsafe.Pointer
+	if v := *(*slice)(elem); v.array == nil && v.len == 0 && v.cap == 0 && t.zero != nil {
+		x = unsafe.Pointer(t.zero)
+	} else {
+		x = newobject(t)
+		ifacestat(&ifacestats.alloc)
+		*(*slice)(x) = v
+	}
+	ep := (*eface)(unsafe.Pointer(&e))
+	ep._type = t
+	ep.data = x
+	return
+}
+
+func panicdottype(have, want, iface *_type) {
+	panic(&TypeAssertionError{_interface: iface, concrete: have, asserted: want})
 }
 
 // 下面 4 个 assert 函数是用来断言 interface{} 或 interface{...} 是否是某类型的。
 func assertI2T(t *_type, i fInterface, r unsafe.Pointer) {
+	ifacestat(&ifacestats.assert)
 	ip := (*iface)(unsafe.Pointer(&i))
 	tab := ip.tab
 	if tab == nil {
-		panic(&TypeAssertionError{"", "", *t._string, ""})
+		panic(&TypeAssertionError{asserted: t})
 	}
 	if tab._type != t {
-		panic(&TypeAssertionError{*tab.inter.typ._string, *tab._type._string, *t._string, ""})
+		panic(&TypeAssertionError{_interface: &tab.inter.typ, concrete: tab._type, asserted: t})
 	}
 	if r != nil {
 		if isDirectIface(t) {
@@ -223,6 +542,7 @@ func assertI2T(t *_type, i fInterface, r unsafe.Pointer) {
 }
 
 func assertI2T2(t *_type, i fInterface, r unsafe.Pointer) bool {
+	ifacestat(&ifacestats.assert)
 	ip := (*iface)(unsafe.Pointer(&i))
 	tab := ip.tab
 	if tab == nil || tab._type != t {
@@ -242,12 +562,13 @@ func assertI2T2(t *_type, i fInterface, r unsafe.Pointer) bool {
 }
 
 func assertE2T(t *_type, e interface{}, r unsafe.Pointer) {
+	ifacestat(&ifacestats.assert)
 	ep := (*eface)(unsafe.Pointer(&e))
 	if ep._type == nil {
-		panic(&TypeAssertionError{"", "", *t._string, ""})
+		panic(&TypeAssertionError{asserted: t})
 	}
 	if ep._type != t {
-		panic(&TypeAssertionError{"", *ep._type._string, *t._string, ""})
+		panic(&TypeAssertionError{concrete: ep._type, asserted: t})
 	}
 	if r != nil {
 		if isDirectIface(t) {
@@ -260,6 +581,7 @@ func assertE2T(t *_type, e interface{}, r unsafe.Pointer) {
 
 // The compiler ensures that r is non-nil.
 func assertE2T2(t *_type, e interface{}, r unsafe.Pointer) bool {
+	ifacestat(&ifacestats.assert)
 	ep := (*eface)(unsafe.Pointer(&e))
 	if ep._type != t {
 		memclr(r, uintptr(t.size))
@@ -287,11 +609,12 @@ func convI2E(i fInterface) (r interface{}) {
 }
 
 func assertI2E(inter *interfacetype, i fInterface, r *interface{}) {
+	ifacestat(&ifacestats.assert)
 	ip := (*iface)(unsafe.Pointer(&i))
 	tab := ip.tab
 	if tab == nil {
 		// explicit conversions require non-nil interface value.
-		panic(&TypeAssertionError{"", "", *inter.typ._string, ""})
+		panic(&TypeAssertionError{asserted: &inter.typ})
 	}
 	rp := (*eface)(unsafe.Pointer(r))
 	rp._type = tab._type
@@ -301,6 +624,7 @@ func assertI2E(inter *interfacetype, i fInterface, r *interface{}) {
 
 // The compiler ensures that r is non-nil.
 func assertI2E2(inter *interfacetype, i fInterface, r *interface{}) bool {
+	ifacestat(&ifacestats.assert)
 	ip := (*iface)(unsafe.Pointer(&i))
 	tab := ip.tab
 	if tab == nil {
@@ -314,6 +638,7 @@ func assertI2E2(inter *interfacetype, i fInterface, r *interface{}) bool {
 
 // interface{...} 之间的转换
 func convI2I(inter *interfacetype, i fInterface) (r fInterface) {
+	ifacestat(&ifacestats.convI2I)
 	ip := (*iface)(unsafe.Pointer(&i))
 	tab := ip.tab
 	if tab == nil {
@@ -325,17 +650,18 @@ func convI2I(inter *interfacetype, i fInterface) (r fInterface) {
 		rp.data = ip.data
 		return
 	}
-	rp.tab = getitab(inter, tab._type, false)
+	rp.tab = getitabcached(inter, tab._type, false)
 	rp.data = ip.data
 	return
 }
 
 func assertI2I(inter *interfacetype, i fInterface, r *fInterface) {
+	ifacestat(&ifacestats.assert)
 	ip := (*iface)(unsafe.Pointer(&i))
 	tab := ip.tab
 	if tab == nil {
 		// explicit conversions require non-nil interface value.
-		panic(&TypeAssertionError{"", "", *inter.typ._string, ""})
+		panic(&TypeAssertionError{asserted: &inter.typ})
 	}
 	rp := (*iface)(unsafe.Pointer(r))
 	if tab.inter == inter {
@@ -343,11 +669,12 @@ func assertI2I(inter *interfacetype, i fInterface, r *fInterface) {
 		rp.data = ip.data
 		return
 	}
-	rp.tab = getitab(inter, tab._type, false)
+	rp.tab = getitabcached(inter, tab._type, false)
 	rp.data = ip.data
 }
 
 func assertI2I2(inter *interfacetype, i fInterface, r *fInterface) bool {
+	ifacestat(&ifacestats.assert)
 	ip := (*iface)(unsafe.Pointer(&i))
 	tab := ip.tab
 	if tab == nil {
@@ -357,7 +684,7 @@ func assertI2I2(inter *interfacetype, i fInterface, r *fInterface) bool {
 		return false
 	}
 	if tab.inter != inter {
-		tab = getitab(inter, tab._type, true)
+		tab = getitabcached(inter, tab._type, true)
 		if tab == nil {
 			if r != nil {
 				*r = nil
@@ -374,20 +701,22 @@ func assertI2I2(inter *interfacetype, i fInterface, r *fInterface) bool {
 }
 
 func assertE2I(inter *interfacetype, e interface{}, r *fInterface) {
+	ifacestat(&ifacestats.assert)
 	ep := (*eface)(unsafe.Pointer(&e))
 	t := ep._type
 	if t == nil {
 		// explicit conversions require non-nil interface value.
-		panic(&TypeAssertionError{"", "", *inter.typ._string, ""})
+		panic(&TypeAssertionError{asserted: &inter.typ})
 	}
 	rp := (*iface)(unsafe.Pointer(r))
-	rp.tab = getitab(inter, t, false)
+	rp.tab = getitabcached(inter, t, false)
 	rp.data = ep.data
 }
 
 var testingAssertE2I2GC bool
 
 func assertE2I2(inter *interfacetype, e interface{}, r *fInterface) bool {
+	ifacestat(&ifacestats.assert)
 	if testingAssertE2I2GC {
 		GC()
 	}
@@ -399,7 +728,7 @@ func assertE2I2(inter *interfacetype, e interface{}, r *fInterface) bool {
 		}
 		return false
 	}
-	tab := getitab(inter, t, true)
+	tab := getitabcached(inter, t, true)
 	if tab == nil {
 		if r != nil {
 			*r = nil
@@ -420,16 +749,18 @@ func reflect_ifaceE2I(inter *interfacetype, e interface{}, dst *fInterface) {
 }
 
 func assertE2E(inter *interfacetype, e interface{}, r *interface{}) {
+	ifacestat(&ifacestats.assert)
 	ep := (*eface)(unsafe.Pointer(&e))
 	if ep._type == nil {
 		// explicit conversions require non-nil interface value.
-		panic(&TypeAssertionError{"", "", *inter.typ._string, ""})
+		panic(&TypeAssertionError{asserted: &inter.typ})
 	}
 	*r = e
 }
 
 // The compiler ensures that r is non-nil.
 func assertE2E2(inter *interfacetype, e interface{}, r *interface{}) bool {
+	ifacestat(&ifacestats.assert)
 	ep := (*eface)(unsafe.Pointer(&e))
 	if ep._type == nil {
 		*r = nil
@@ -439,6 +770,9 @@ func assertE2E2(inter *interfacetype, e interface{}, r *interface{}) bool {
 	return true
 }
 
+// 两个 interface 的比较(==)由 alg.go 中的 ifaceeq/efaceeq 实现: 先比较 tab/_type,
+// 相同时再用类型的 alg.equal 比较数据, 动态类型不可比较时 panic。
+
 // interface{...} 所表示的实际类型的 hash 值
 func ifacethash(i fInterface) uint32 {
 	ip := (*iface)(unsafe.Pointer(&i))
@@ -459,10 +793,58 @@ func efacethash(e interface{}) uint32 {
 	return t.hash
 }
 
+// ItabStats describes the itabs, the method tables the runtime builds
+// the first time a concrete type is converted to an interface type.
+// They are never freed.
+type ItabStats struct {
+	Itabs      uint64 // itabs built, including Static and Bad
+	Static     uint64 // itabs the compiler built for conversions known at link time
+	Bad        uint64 // cached failures of comma-ok assertions to an interface type
+	ItabBytes  uint64 // bytes of the itabs built at run time
+	TableBytes uint64 // bytes of the itab hash table, including tables replaced as it grew
+	TableSize  uint64 // slots in the itab hash table
+	MaxProbe   uint64 // most slots a lookup has to look at to find an itab
+}
+
+// ReadItabStats returns statistics about the itabs.
+func ReadItabStats() ItabStats {
+	lock(&ifaceLock)
+	t := itabTable
+	s := ItabStats{
+		Itabs:      uint64(t.count),
+		Static:     itabstats.nstatic,
+		Bad:        itabstats.nbad,
+		ItabBytes:  itabstats.itabbytes,
+		TableBytes: uint64(unsafe.Sizeof(itabTableInit)) + itabstats.tablebytes,
+		TableSize:  uint64(t.size),
+	}
+	mask := t.size - 1
+	for i := uintptr(0); i < t.size; i++ {
+		m := *t.entry(i)
+		if m == nil {
+			continue
+		}
+		// 从 m 的 hash 位置开始按 find 的顺序走到 i
+		h := itabhash(m.inter, m._type) & mask
+		n := uintptr(1)
+		for ; h != i; n++ {
+			h += n
+			h &= mask
+		}
+		if uint64(n) > s.MaxProbe {
+			s.MaxProbe = uint64(n)
+		}
+	}
+	unlock(&ifaceLock)
+	return s
+}
+
+// iterate_itabs 对每个 itab 调用 fn, 调用者持有 ifaceLock 或者已经 stop the world。
 func iterate_itabs(fn func(*itab)) {
-	for _, h := range &hash {
-		for ; h != nil; h = h.link {
-			fn(h)
+	t := itabTable
+	for i := uintptr(0); i < t.size; i++ {
+		if m := *t.entry(i); m != nil {
+			fn(m)
 		}
 	}
 }
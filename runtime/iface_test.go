@@ -6,7 +6,9 @@ package runtime_test
 
 import (
 	"runtime"
+	"strings"
 	"testing"
+	"unsafe"
 )
 
 type I1 interface {
@@ -21,6 +23,7 @@ type I2 interface {
 type TS uint16
 type TM uintptr
 type TL [2]uintptr
+type TH [32]uintptr
 
 func (TS) Method1() {}
 func (TS) Method2() {}
@@ -28,6 +31,8 @@ func (TM) Method1() {}
 func (TM) Method2() {}
 func (TL) Method1() {}
 func (TL) Method2() {}
+func (TH) Method1() {}
+func (TH) Method2() {}
 
 var (
 	e  interface{}
@@ -37,6 +42,7 @@ var (
 	ts TS
 	tm TM
 	tl TL
+	th TH
 	ok bool
 )
 
@@ -57,6 +63,35 @@ func TestCmpIfaceConcreteAlloc(t *testing.T) {
 	}
 }
 
+var dirtyTH []*TH
+
+// convT2E does not zero pointer-free values before copying them in,
+// so the copy has to cover the whole value.
+func TestConvT2EOverwritesGarbage(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		x := new(TH)
+		for j := range x {
+			x[j] = ^uintptr(0)
+		}
+		dirtyTH = append(dirtyTH, x)
+	}
+	dirtyTH = nil
+	runtime.GC()
+
+	var v TH
+	v[len(v)/2] = 1
+	for i := 0; i < 1000; i++ {
+		e = v
+		if e.(TH) != v {
+			t.Fatalf("convT2E copied %v, want %v", e, v)
+		}
+		i1 = v
+		if i1.(TH) != v {
+			t.Fatalf("convT2I copied %v, want %v", i1, v)
+		}
+	}
+}
+
 func BenchmarkEqEfaceConcrete(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		_ = e == ts
@@ -99,6 +134,12 @@ func BenchmarkConvT2ELarge(b *testing.B) {
 	}
 }
 
+func BenchmarkConvT2EHuge(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		e = th
+	}
+}
+
 func BenchmarkConvT2ISmall(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		i1 = ts
@@ -117,6 +158,12 @@ func BenchmarkConvT2ILarge(b *testing.B) {
 	}
 }
 
+func BenchmarkConvT2IHuge(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		i1 = th
+	}
+}
+
 func BenchmarkConvI2E(b *testing.B) {
 	i2 = tm
 	for i := 0; i < b.N; i++ {
@@ -261,3 +308,336 @@ func TestNonEscapingConvT2I(t *testing.T) {
 		t.Fatalf("want 0 allocs, got %v", n)
 	}
 }
+
+func TestItabTableGrow(t *testing.T) {
+	const n = 3000
+	size, ok := runtime.ItabTableCheck(n)
+	if !ok {
+		t.Fatalf("itab lookup failed while the table grew to %d entries", size)
+	}
+	if size < n*4/3 || size&(size-1) != 0 {
+		t.Fatalf("itab table has %d entries for %d itabs", size, n)
+	}
+}
+
+type T1 uint8
+
+func (T1) Method1() {}
+
+// A failed comma-ok assertion caches a bad itab; a later assertion
+// without ok must still name the missing method.
+func TestAssertMissingMethod(t *testing.T) {
+	var x interface{} = T1(0)
+	for i := 0; i < 2; i++ {
+		if _, ok := x.(I2); ok {
+			t.Fatalf("T1 satisfies I2")
+		}
+	}
+	defer func() {
+		err, _ := recover().(*runtime.TypeAssertionError)
+		if err == nil {
+			t.Fatalf("assertion to I2 did not panic with a TypeAssertionError")
+		}
+		if want := "missing method Method2"; !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %q does not contain %q", err.Error(), want)
+		}
+	}()
+	i2 = x.(I2)
+}
+
+func TestConvT2ENoAlloc(t *testing.T) {
+	type pair struct{ a, b uint32 }
+	var (
+		u16 uint16 = 200
+		i64 int64  = 255
+		b   [3]byte
+		p   pair
+		s   string
+	)
+	b[0] = 7
+	n := testing.AllocsPerRun(1000, func() {
+		e = u16
+		e = i64
+		e = b
+		e = p
+		e = s
+		e = ts
+		i1 = tm
+	})
+	if n != 0 {
+		t.Fatalf("boxing small values: %v allocs, want 0", n)
+	}
+	for _, c := range []struct{ got, want interface{} }{
+		{interface{}(u16), uint16(200)},
+		{interface{}(i64), int64(255)},
+		{interface{}(b), [3]byte{7}},
+		{interface{}(pair{1, 0}), pair{1, 0}},
+		{interface{}(pair{0, 1}), pair{0, 1}},
+		{interface{}(int64(-1)), int64(-1)},
+		{interface{}(uint16(256)), uint16(256)},
+	} {
+		if c.got != c.want {
+			t.Errorf("boxed %v, want %v", c.got, c.want)
+		}
+	}
+}
+
+type TStatic int
+
+func (x TStatic) Static() int { return int(x) + 1 }
+
+// IStatic is only ever converted to through the itab AddStaticItab registers.
+type IStatic interface {
+	Static() int
+}
+
+// An itab from itablinks must be the one getitab hands out afterwards,
+// otherwise interface values built by compiled code would compare unequal
+// to ones built at run time.
+func TestStaticItab(t *testing.T) {
+	before := runtime.ReadItabStats()
+	static, found := runtime.AddStaticItab(TStatic(1), (*IStatic)(nil))
+	if static == nil {
+		t.Skip("TStatic already has an itab for IStatic")
+	}
+	if found != static {
+		t.Fatalf("getitab returned %p, want the static itab %p", found, static)
+	}
+	var x interface{} = TStatic(1)
+	i := x.(IStatic)
+	if tab := *(*unsafe.Pointer)(unsafe.Pointer(&i)); tab != static {
+		t.Errorf("assertion used itab %p, want the static itab %p", tab, static)
+	}
+	if got := i.Static(); got != 2 {
+		t.Errorf("Static() = %d, want 2", got)
+	}
+	after := runtime.ReadItabStats()
+	if after.Static != before.Static+1 {
+		t.Errorf("Static = %d after registering one itab, was %d", after.Static, before.Static)
+	}
+}
+
+func TestReadItabStats(t *testing.T) {
+	var x interface{} = T1(0)
+	if _, ok := x.(I2); ok {
+		t.Fatalf("T1 satisfies I2")
+	}
+	i1 = tm
+	s := runtime.ReadItabStats()
+	if s.Itabs == 0 || s.Bad == 0 || s.Bad > s.Itabs {
+		t.Errorf("Itabs = %d, Bad = %d", s.Itabs, s.Bad)
+	}
+	if s.Static > s.Itabs || s.ItabBytes < (s.Itabs-s.Static)*3*uint64(unsafe.Sizeof(uintptr(0))) {
+		t.Errorf("ItabBytes = %d for %d itabs, %d static", s.ItabBytes, s.Itabs, s.Static)
+	}
+	if s.TableSize&(s.TableSize-1) != 0 || s.Itabs > s.TableSize*3/4 {
+		t.Errorf("TableSize = %d for %d itabs", s.TableSize, s.Itabs)
+	}
+	if s.TableBytes < s.TableSize*uint64(unsafe.Sizeof(uintptr(0))) {
+		t.Errorf("TableBytes = %d for %d slots", s.TableBytes, s.TableSize)
+	}
+	if s.MaxProbe == 0 || s.MaxProbe > s.TableSize {
+		t.Errorf("MaxProbe = %d", s.MaxProbe)
+	}
+}
+
+func TestIfaceEq(t *testing.T) {
+	nan := 0.0
+	nan /= nan
+	for _, c := range []struct {
+		x, y interface{}
+		eq   bool
+	}{
+		{nil, nil, true},
+		{TM(1), TM(1), true},
+		{TM(1), TM(2), false},
+		{TM(1), TS(1), false}, // 同样的值, 不同的类型
+		{TH{1}, TH{1}, true},
+		{"a", "a", true},
+		{nan, nan, false},
+		{TM(0), nil, false},
+	} {
+		if eq := c.x == c.y; eq != c.eq {
+			t.Errorf("%#v == %#v: got %v, want %v", c.x, c.y, eq, c.eq)
+		}
+		x, xok := c.x.(I1)
+		y, yok := c.y.(I1)
+		if (xok || c.x == nil) && (yok || c.y == nil) {
+			if eq := x == y; eq != c.eq {
+				t.Errorf("I1(%#v) == I1(%#v): got %v, want %v", c.x, c.y, eq, c.eq)
+			}
+		}
+	}
+
+	// 动态类型不可比较时 panic, 但类型不同时不会比较数据, 也就不会 panic。
+	var x, y interface{} = []int{1}, []int{1}
+	if (interface{})(x) == TM(1) {
+		t.Errorf("slice == TM")
+	}
+	defer func() {
+		if err, ok := recover().(runtime.Error); !ok || !strings.Contains(err.Error(), "comparing uncomparable type []int") {
+			t.Errorf("comparing slices in interfaces: recovered %v", err)
+		}
+	}()
+	ok = x == y
+	t.Errorf("comparing slices in interfaces did not panic")
+}
+
+// 同一个 M 上交替断言很多类型对, itabcache 中的位置会互相替换。
+func TestAssertItabCache(t *testing.T) {
+	vals := []interface{}{TS(1), TM(2), TL{3}, TH{4}, T1(5)}
+	for i := 0; i < 100; i++ {
+		for _, v := range vals {
+			x, ok1 := v.(I1)
+			y, ok2 := v.(I2)
+			if !ok1 || x != v {
+				t.Fatalf("%T.(I1) = %v, %v", v, x, ok1)
+			}
+			if _, isT1 := v.(T1); ok2 == isT1 || ok2 && y != v {
+				t.Fatalf("%T.(I2) = %v, %v", v, y, ok2)
+			}
+			if ok2 {
+				if z := I1(y); z != v {
+					t.Fatalf("I1(%T as I2) = %v", v, z)
+				}
+			}
+		}
+	}
+}
+
+func TestTypeSwitchCache(t *testing.T) {
+	s := runtime.NewTypeSwitch((*TS)(nil), (*I2)(nil), (*I1)(nil), (*interface{})(nil))
+	tests := []struct {
+		x   interface{}
+		cas int
+		tab bool
+	}{
+		{TS(1), 0, false},
+		{TM(2), 1, true},
+		{TL{3}, 1, true},
+		{T1(4), 2, true},
+		{4, 3, false},
+		{"x", 3, false},
+	}
+	for i := 0; i < 3; i++ {
+		for _, tt := range tests {
+			if cas, tab := s.Case(tt.x); cas != tt.cas || tab != tt.tab {
+				t.Fatalf("Case(%T) = %d, %v, want %d, %v", tt.x, cas, tab, tt.cas, tt.tab)
+			}
+		}
+	}
+	if n := s.Cached(); n != len(tests) {
+		t.Errorf("cached %d types, want %d", n, len(tests))
+	}
+
+	s = runtime.NewTypeSwitch((*TS)(nil))
+	if cas, _ := s.Case(TM(1)); cas != -1 {
+		t.Errorf("Case(TM) with no matching case = %d, want -1", cas)
+	}
+}
+
+func TestTypeSwitchCacheMax(t *testing.T) {
+	s := runtime.NewTypeSwitch((*int)(nil))
+	if n := s.CaseMadeUp(2 * runtime.TypeSwitchCacheMax); n != runtime.TypeSwitchCacheMax {
+		t.Errorf("type switch cached %d types, want %d", n, runtime.TypeSwitchCacheMax)
+	}
+}
+
+var ifaceStatsSink interface{}
+
+func TestReadIfaceStats(t *testing.T) {
+	defer runtime.SetIfaceStats(runtime.SetIfaceStats(1))
+	before := runtime.ReadIfaceStats()
+	v := TL{1000, 2000}
+	for i := 0; i < 10; i++ {
+		ifaceStatsSink = v
+		if _, ok := ifaceStatsSink.(I1); !ok {
+			t.Fatalf("TL does not implement I1")
+		}
+		if _, ok := interface{}(T1(5)).(I2); ok {
+			t.Fatalf("T1 implements I2")
+		}
+	}
+	after := runtime.ReadIfaceStats()
+	if n := after.ConvT2E - before.ConvT2E; n < 10 {
+		t.Errorf("ConvT2E grew by %d, want at least 10", n)
+	}
+	if n := after.Allocs - before.Allocs; n < 10 {
+		t.Errorf("Allocs grew by %d, want at least 10", n)
+	}
+	if n := after.Assertions - before.Assertions; n < 20 {
+		t.Errorf("Assertions grew by %d, want at least 20", n)
+	}
+	if n := after.NegativeHit - before.NegativeHit; n < 9 {
+		t.Errorf("NegativeHit grew by %d, want at least 9", n)
+	}
+
+	runtime.SetIfaceStats(0)
+	before = runtime.ReadIfaceStats()
+	ifaceStatsSink = v
+	if after = runtime.ReadIfaceStats(); after != before {
+		t.Errorf("counters changed with ifacestats=0: %+v -> %+v", before, after)
+	}
+}
+
+type ptrWrapper struct {
+	p *int
+}
+
+type ptrWrapperArray [1]ptrWrapper
+
+func (w ptrWrapper) Method1()      {}
+func (w ptrWrapperArray) Method1() {}
+
+// 只包含一个指针的 struct 和数组直接放在接口里, 转换和断言都不用分配。
+func TestConvT2EPointerWrapperNoAlloc(t *testing.T) {
+	x := new(int)
+	w := ptrWrapper{x}
+	a := ptrWrapperArray{w}
+	n := testing.AllocsPerRun(1000, func() {
+		e = w
+		i1 = a
+		if e.(ptrWrapper).p != x || i1.(ptrWrapperArray)[0].p != x {
+			t.Fatalf("pointer wrapper changed in interface")
+		}
+	})
+	if n != 0 {
+		t.Fatalf("want 0 allocs, got %v", n)
+	}
+}
+
+func assertionError(f func()) (err *runtime.TypeAssertionError) {
+	defer func() {
+		err, _ = recover().(*runtime.TypeAssertionError)
+	}()
+	f()
+	return nil
+}
+
+func TestTypeAssertionErrorFields(t *testing.T) {
+	var (
+		x  interface{} = T1(0)
+		i  I1          = TS(1)
+		en interface{}
+	)
+	tests := []struct {
+		f                                  func()
+		inter, concrete, asserted, missing string
+	}{
+		{func() { i2 = x.(I2) }, "", "runtime_test.T1", "runtime_test.I2", "Method2"},
+		{func() { tm = i.(TM) }, "runtime_test.I1", "runtime_test.TS", "runtime_test.TM", ""},
+		{func() { i1 = en.(I1) }, "", "", "runtime_test.I1", ""},
+	}
+	for n, tt := range tests {
+		err := assertionError(tt.f)
+		if err == nil {
+			t.Errorf("#%d: no TypeAssertionError", n)
+			continue
+		}
+		if err.Interface() != tt.inter || err.Concrete() != tt.concrete || err.Asserted() != tt.asserted || err.MissingMethod() != tt.missing {
+			t.Errorf("#%d: got (%q, %q, %q, %q), want (%q, %q, %q, %q)", n,
+				err.Interface(), err.Concrete(), err.Asserted(), err.MissingMethod(),
+				tt.inter, tt.concrete, tt.asserted, tt.missing)
+		}
+	}
+}
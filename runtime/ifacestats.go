@@ -0,0 +1,59 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Interface conversion and assertion counters.
+//
+// 设置 GODEBUG=ifacestats=1 时统计 interface 装箱和类型断言的次数,
+// 不用 CPU profile 也能知道程序在 interface 上花了多少:
+//
+//	convT2E  convT2E 以及 convT2E16/32/64/string/slice 的调用次数
+//	convT2I  convT2I 的调用次数
+//	convI2I  convI2I 的调用次数
+//	assert   assert* 的调用次数, 包括断言成具体类型、interface{} 和 interface{...}
+//	alloc    convT2E/convT2I 中为数据分配了内存的次数, 直接放在接口里的、小整数和零值不算
+//	neghit   getitab 在 itab 表中找到匹配失败过的 itab 的次数, 也就是负缓存命中
+//
+// 没有设置时每次调用只多读一次 debug.ifacestats。计数用 ReadIfaceStats 读出来。
+
+package runtime
+
+var ifacestats struct {
+	convT2E uint64
+	convT2I uint64
+	convI2I uint64
+	assert  uint64
+	alloc   uint64
+	neghit  uint64
+}
+
+// IfaceStats counts interface conversions and type assertions.
+// The counters are cumulative and only advance while GODEBUG=ifacestats=1.
+type IfaceStats struct {
+	ConvT2E     uint64 // conversions of concrete values to interface{}
+	ConvT2I     uint64 // conversions of concrete values to non-empty interfaces
+	ConvI2I     uint64 // conversions between non-empty interfaces
+	Assertions  uint64 // type assertions and interface cases of type switches
+	Allocs      uint64 // ConvT2E and ConvT2I calls that allocated a box for the value
+	NegativeHit uint64 // itab lookups answered by a cached failed match
+}
+
+// ReadIfaceStats returns the interface conversion counters.
+// Unlike ReadMemStats, it does not stop the world.
+func ReadIfaceStats() IfaceStats {
+	return IfaceStats{
+		ConvT2E:     atomicload64(&ifacestats.convT2E),
+		ConvT2I:     atomicload64(&ifacestats.convT2I),
+		ConvI2I:     atomicload64(&ifacestats.convI2I),
+		Assertions:  atomicload64(&ifacestats.assert),
+		Allocs:      atomicload64(&ifacestats.alloc),
+		NegativeHit: atomicload64(&ifacestats.neghit),
+	}
+}
+
+// ifacestat 在打开 ifacestats 时给计数器 p 加一。
+func ifacestat(p *uint64) {
+	if debug.ifacestats != 0 {
+		xadd64(p, 1)
+	}
+}
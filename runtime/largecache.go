@@ -0,0 +1,71 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Large object span cache.
+//
+// 大于 32K 的对象每次都要经过 largeAlloc → mHeap_Alloc, 在全局的 heap lock 下分配，
+// 释放的时候 mSpan_Sweep → mHeap_Free 也一样。反复申请释放同样大小的大 buffer 的程序，
+// heap lock 的竞争会很厉害。
+//
+// 所以每个 P 的 mcache 里缓存几个刚被 sweep 释放的大对象 span, 状态是 _MSpanCached:
+// 不在 heap 的 free 列表里，也不会被 GC 当成对象(指针查找都要求 _MSpanInUse)。
+// largeAlloc 先在缓存里找 npages 一样的 span, 找到了就不需要加锁。
+// 缓存的 span 仍然算在 heap_inuse 里。为了不让它们一直占着内存，
+// 每次 GC 和 ReadMemStats 的 flushallmcaches 都会把它们还给 heap。
+
+package runtime
+
+import "unsafe"
+
+const (
+	largeCacheSpans    = 4   // 每个 mcache 缓存的 span 个数
+	largeCacheMaxPages = 128 // 只缓存不超过这么多页的 span, 防止占用太多内存
+)
+
+// largeCachePut 由 mSpan_Sweep 调用，把释放的大对象 span s 放到 c 的缓存里。
+// 缓存满了或者 s 不适合缓存时返回 false, 由调用者还给 heap。
+func largeCachePut(c *mcache, s *mspan) bool {
+	if s.npages > largeCacheMaxPages || debug.efence > 0 || gcphase != _GCoff {
+		return false
+	}
+	for i := range c.largecache {
+		if c.largecache[i] == nil {
+			s.state = _MSpanCached
+			c.largecache[i] = s
+			return true
+		}
+	}
+	return false
+}
+
+// largeCacheGet 在 c 的缓存里找一个 npages 页的 span, 重新设置成可以分配的状态。
+// 在 system stack 上运行。
+func largeCacheGet(c *mcache, npages uintptr, needzero bool) *mspan {
+	for i, s := range c.largecache {
+		if s == nil || s.npages != npages {
+			continue
+		}
+		c.largecache[i] = nil
+		if needzero && s.needzero != 0 {
+			memclr(unsafe.Pointer(s.start<<_PageShift), s.npages<<_PageShift)
+		}
+		s.needzero = 0
+		// 和 mHeap_Alloc_m 一样，先设置 sweepgen 再改成 _MSpanInUse。
+		// 持有 mallocing 的 M 不会被 stop the world, 所以 sweepgen 在这期间不会变。
+		atomicstore(&s.sweepgen, mheap_.sweepgen)
+		s.state = _MSpanInUse
+		return s
+	}
+	return nil
+}
+
+// largeCacheFlush 把 c 缓存的 span 全部还给 heap。
+func largeCacheFlush(c *mcache) {
+	for i, s := range c.largecache {
+		if s != nil {
+			c.largecache[i] = nil
+			mHeap_Free(&mheap_, s, 0)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Side table of large objects.
+//
+// 大对象(> 32K)独占一个 span, span 上只记录了 limit, 看不出是谁分配的、是什么类型。
+// 大对象的个数很少，所以和 cgomem.go 一样用一个以 span 起始地址为 key 的 hash 表
+// 记录每个活着的大对象的大小、类型和分配的 pc, mSpan_Sweep/rawfree 释放大对象时删除。
+// 设置 GODEBUG=largetrack=1 时记录分配的调用栈，而不只是调用 mallocgc 的 pc。
+// 表的内容可以用 ReadLargeObjects 读出来，heap dump 中以 tagLargeObject 记录输出。
+
+package runtime
+
+import "unsafe"
+
+const (
+	largeObjHashSize = 1 << 10
+	largeObjStack    = 8 // largetrack 模式下记录的调用栈深度
+)
+
+type largeObj struct {
+	next *largeObj
+	p    uintptr
+	size uintptr
+	typ  *_type
+	stk  [largeObjStack]uintptr // 没有 largetrack 时只有 stk[0], 是调用 mallocgc 的 pc
+}
+
+var largeObjs struct {
+	lock mutex
+	hash *[largeObjHashSize]*largeObj // 第一次用时才用 sysAlloc 申请
+	free *largeObj                    // 从 hash 中删除的 largeObj, 重复使用
+	n    int                          // hash 中的记录数
+}
+
+func largeObjHash(p uintptr) uintptr {
+	return (p >> _PageShift) % largeObjHashSize
+}
+
+// largeObjRecord 登记 mallocgc 分配的大对象 p, pc 是调用 mallocgc 的 pc。
+func largeObjRecord(p unsafe.Pointer, size uintptr, typ *_type, pc uintptr) {
+	var stk [largeObjStack]uintptr
+	if debug.largetrack != 0 {
+		// 跳过 callers, largeObjRecord 和 mallocgc
+		callers(3, stk[:])
+	} else {
+		stk[0] = pc
+	}
+
+	lock(&largeObjs.lock)
+	if largeObjs.hash == nil {
+		largeObjs.hash = (*[largeObjHashSize]*largeObj)(sysAlloc(unsafe.Sizeof(*largeObjs.hash), &memstats.other_sys))
+		if largeObjs.hash == nil {
+			throw("runtime: cannot allocate memory")
+		}
+	}
+	h := largeObjHash(uintptr(p))
+	b := largeObjs.hash[h]
+	for ; b != nil; b = b.next {
+		if b.p == uintptr(p) {
+			// 释放时漏删了(比如 efence 模式), 直接覆盖。
+			break
+		}
+	}
+	if b == nil {
+		b = largeObjs.free
+		if b != nil {
+			largeObjs.free = b.next
+		} else {
+			b = (*largeObj)(persistentalloc(unsafe.Sizeof(largeObj{}), 0, &memstats.other_sys))
+		}
+		b.next = largeObjs.hash[h]
+		largeObjs.hash[h] = b
+		largeObjs.n++
+	}
+	b.p = uintptr(p)
+	b.size = size
+	b.typ = typ
+	b.stk = stk
+	unlock(&largeObjs.lock)
+}
+
+// largeObjForget 删除大对象 p 的登记，由 mSpan_Sweep 和 rawfree 在释放大对象时调用。
+func largeObjForget(p uintptr) {
+	lock(&largeObjs.lock)
+	if largeObjs.hash != nil {
+		for bp := &largeObjs.hash[largeObjHash(p)]; *bp != nil; bp = &(*bp).next {
+			b := *bp
+			if b.p == p {
+				*bp = b.next
+				*b = largeObj{}
+				b.next = largeObjs.free
+				largeObjs.free = b
+				largeObjs.n--
+				break
+			}
+		}
+	}
+	unlock(&largeObjs.lock)
+}
+
+// iterate_largeobjs 对每一个登记的大对象调用 fn，调用时持有 largeObjs.lock。
+func iterate_largeobjs(fn func(p, size uintptr, typ *_type, stk []uintptr)) {
+	lock(&largeObjs.lock)
+	if largeObjs.hash != nil {
+		for _, b := range largeObjs.hash {
+			for ; b != nil; b = b.next {
+				n := 0
+				for n < len(b.stk) && b.stk[n] != 0 {
+					n++
+				}
+				fn(b.p, b.size, b.typ, b.stk[:n])
+			}
+		}
+	}
+	unlock(&largeObjs.lock)
+}
+
+// A LargeObject describes a live object larger than 32 kB.
+type LargeObject struct {
+	Addr   uintptr                // address of the object
+	Size   uintptr                // size of the span holding the object
+	Type   string                 // name of the object's type, "" if unknown
+	Stack0 [largeObjStack]uintptr // allocation stack trace; ends at first 0 entry
+}
+
+// Stack returns the stack trace of the allocation of the object, a
+// prefix of o.Stack0. Unless GODEBUG=largetrack=1 is set, it holds
+// only the PC of the runtime function that allocated the object, such
+// as newobject or makeslice.
+func (o *LargeObject) Stack() []uintptr {
+	for i, v := range o.Stack0 {
+		if v == 0 {
+			return o.Stack0[0:i]
+		}
+	}
+	return o.Stack0[0:]
+}
+
+// ReadLargeObjects returns n, the number of live large objects the
+// runtime knows about. If len(p) >= n, it copies their descriptions
+// into p and returns n, true. If len(p) < n, it does not change p and
+// returns n, false. Objects that are unreachable but not yet swept are
+// still reported.
+func ReadLargeObjects(p []LargeObject) (n int, ok bool) {
+	lock(&largeObjs.lock)
+	n = largeObjs.n
+	unlock(&largeObjs.lock)
+	if len(p) < n {
+		return n, false
+	}
+	n = 0
+	iterate_largeobjs(func(addr, size uintptr, typ *_type, stk []uintptr) {
+		if n == len(p) {
+			return
+		}
+		r := &p[n]
+		r.Addr = addr
+		r.Size = size
+		r.Type = ""
+		if typ != nil {
+			r.Type = *typ._string
+		}
+		r.Stack0 = [largeObjStack]uintptr{}
+		copy(r.Stack0[:], stk)
+		n++
+	})
+	return n, true
+}
@@ -59,7 +59,9 @@
 //	4. If the heap has too much memory, return some to the
 //	   operating system.
 //
-//	TODO(rsc): Step 4 is not implemented.
+// Step 4 is done by the scavenger (mHeap_Scavenge), which sysmon runs
+// every few minutes, and sooner when a burst of allocation has left a
+// lot of idle memory behind (see mHeap_ScavengeNeeded).
 //
 // Allocating and freeing a large object uses the page heap
 // directly, bypassing the MCache and MCentral free lists.
@@ -156,10 +158,12 @@ const (
 	// See https://golang.org/issue/5402 and https://golang.org/issue/5236.
 	// On other 64-bit platforms, we limit the arena to 512GB, or 39 bits.
 	// On 32-bit, we don't bother limiting anything, so we use the full 32-bit address.
-	// On Darwin/arm64, we cannot reserve more than ~5GB of virtual memory,
-	// but as most devices have less than 4GB of physical memory anyway, we
-	// try to be conservative here, and only ask for a 2GB heap.
-	_MHeapMap_TotalBits = (_64bit*goos_windows)*35 + (_64bit*(1-goos_windows)*(1-goos_darwin*goarch_arm64))*39 + goos_darwin*goarch_arm64*31 + (1-_64bit)*32
+	// On Darwin/arm64, older devices cannot reserve more than ~5GB of virtual
+	// memory, while newer machines have far more. The arena is limited to 64GB,
+	// or 36 bits, and mallocinit probes at startup how much of that can really
+	// be reserved, down to the old 2GB heap (31 bits), see arenaProbeBits.
+	// Allocation sizes are then checked against what was reserved, see maxMem.
+	_MHeapMap_TotalBits = (_64bit*goos_windows)*35 + (_64bit*(1-goos_windows)*(1-goos_darwin*goarch_arm64))*39 + goos_darwin*goarch_arm64*36 + (1-_64bit)*32
 	_MHeapMap_Bits      = _MHeapMap_TotalBits - _PageShift
 
 	_MaxMem = uintptr(1<<_MHeapMap_TotalBits - 1) // 512GB
@@ -176,6 +180,20 @@ type pageID uintptr
 
 const _MaxArena32 = 2 << 30
 
+// maxMem 是 makeslice、makechan、newarray 等检查分配大小时用的上限。
+// _MaxMem 是编译时的上限, 决定了 bitmap_chunks 这样的数组的大小; darwin/arm64 上
+// mallocinit 实际 reserve 下来的 arena 可能比它小得多(见 arenaProbeBits), 这时 maxMem
+// 换成 arena 的大小, 放不下的分配在检查时就 panic, 而不是到 mHeap_Grow 才 out of memory。
+var maxMem uintptr = _MaxMem
+
+// arena 不再是一整块 reserve 好的内存，而是一个 _ArenaChunk 一个 _ArenaChunk 地增长，
+// 每个 chunk 可以在 [arena_start, arena_limit) 中的任何位置, 见 mHeap_SysAlloc。
+// bitmap 也是按 chunk map 的, 见 mHeap_MapBits。
+const (
+	_ArenaChunkShift = 26
+	_ArenaChunk      = 1 << _ArenaChunkShift // 64M
+)
+
 // OS-defined helpers:
 //
 // sysAlloc obtains a large chunk of zeroed memory from the
@@ -213,6 +231,10 @@ const _MaxArena32 = 2 << 30
 //
 // SysFault marks a (already sysAlloc'd) region to fault
 // if accessed.  Used only for debugging the runtime.
+//
+// 这些函数的实现在 mem_linux.go, mem_darwin.go, mem_bsd.go, mem_windows.go 和 mem_plan9.go 中，
+// 分别基于 mmap/munmap/madvise 和 VirtualAlloc/VirtualFree。
+// 第三个参数 sysStat 指向 memstats 中的某个 xxx_sys 字段，由它们负责记账。
 
 func mallocinit() {
 
@@ -224,116 +246,453 @@ func mallocinit() {
 		throw("bad TinySizeClass")
 	}
 
-	var p, bitmapSize, spansSize, pSize, limit uintptr
-	var reserved bool
+	var limit uintptr
 
-	// limit = runtime.memlimit();
-	// See https://golang.org/issue/5049
-	// TODO(rsc): Fix after 1.1.
+	// 设置了 GODEBUG=heaplimit=1 时 memlimit 的结果作为 heap 的 limit, 见 heaplimit.go。
+	// 默认没有 limit: 超过 limit 时分配会失败, 不能让没有要求的程序突然改变行为。
+	// 64 位系统上 limit 不影响 arena 的 reserve: sysReserve 只在真正 map 的时候才占用内存，
+	// 见 https://golang.org/issue/5049
+	// 32 位系统上地址空间本来就小，memlimit 用来缩小 arena, 见 reserveArena32。
+	if earlydebugvar("heaplimit") != 0 {
+		heapLimit = uint64(memlimit())
+	}
 	limit = 0
+	if ptrSize == 4 {
+		limit = uintptr(memlimit())
+	}
 
-	// Set up the allocation arena, a contiguous area of memory where
+	var l arenaLayout
+	// Set up the allocation arena, an area of memory where
 	// allocated data will be found.  The arena begins with a bitmap large
 	// enough to hold 4 bits per allocated word.
+	// Only the bitmap, the spans array and the first chunk of the arena
+	// are reserved here; the arena grows chunk by chunk, see mHeap_SysAlloc.
 	if ptrSize == 8 && (limit == 0 || limit > 1<<30) {
-		// On a 64-bit machine, allocate from a single contiguous reservation.
-		// 512 GB (MaxMem) should be big enough for now.
-		//
-		// The code will work with the reservation at any address, but ask
-		// SysReserve to use 0x0000XXc000000000 if possible (XX=00...7f).
-		// Allocating a 512 GB region takes away 39 bits, and the amd64
-		// doesn't let us choose the top 17 bits, so that leaves the 9 bits
-		// in the middle of 0x00c0 for us to choose.  Choosing 0x00c0 means
-		// that the valid memory addresses will begin 0x00c0, 0x00c1, ..., 0x00df.
-		// In little-endian, that's c0 00, c1 00, ..., df 00. None of those are valid
-		// UTF-8 sequences, and they are otherwise as far away from
-		// ff (likely a common byte) as possible.  If that fails, we try other 0xXXc0
-		// addresses.  An earlier attempt to use 0x11f8 caused out of memory errors
-		// on OS X during thread allocations.  0x00c0 causes conflicts with
-		// AddressSanitizer which reserves all memory up to 0x0100.
-		// These choices are both for debuggability and to reduce the
-		// odds of a conservative garbage collector (as is still used in gccgo)
-		// not collecting memory because some non-pointer block of memory
-		// had a bit pattern that matched a memory address.
-		//
-		// Actually we reserve 544 GB (because the bitmap ends up being 32 GB)
-		// but it hardly matters: e0 00 is not valid UTF-8 either.
-		//
-		// If this fails we fall back to the 32 bit memory mechanism
-		//
-		// However, on arm64, we ignore all this advice above and slam the
-		// allocation at 0x40 << 32 because when using 4k pages with 3-level
-		// translation buffers, the user address space is limited to 39 bits
-		// On darwin/arm64, the address space is even smaller.
-		arenaSize := round(_MaxMem, _PageSize) // 512G
-
-		// arena 中的每个字(8byte)都要有 4位的标志位。
-		// bitmapSize 空间用来存放标志位，来表示 512G arena的每个字的标志。
-		// 下面这个表达式不好理解，转换一下, arenaSize / ptrSize * 4 / 8
-		// arenaSize 总共 arenaSize / ptrSize 个字，每个字需要 4bit
-		// 所以总共需要 arenaSize / ptrSize * 4 位来存放这些标志
-		// 而这些位除以8就是字节数了，所以
-		// arenaSize / ptrSize * 4 / 8 = arenaSize / (ptrSize * 8 / 4) = 32G
-		bitmapSize = arenaSize / (ptrSize * 8 / 4) // 32G
-
-		// spanSize用来存放所有 span 的地址
-		// arena 可以放下 arenaSize / _PageSize 个 span
-		// 每个 span 的地址需要 ptrSize 大小空间来存。
-		spansSize = arenaSize / _PageSize * ptrSize // 512M
-		spansSize = round(spansSize, _PageSize)     // 512M
-		for i := 0; i <= 0x7f; i++ {
-			switch {
-			case GOARCH == "arm64" && GOOS == "darwin":
-				p = uintptr(i)<<40 | uintptrMask&(0x0013<<28)
-			case GOARCH == "arm64":
-				p = uintptr(i)<<40 | uintptrMask&(0x0040<<32)
-			default:
-				p = uintptr(i)<<40 | uintptrMask&(0x00c0<<32)
-			}
+		if arenaTotalBits(GOOS, GOARCH) != _MHeapMap_TotalBits {
+			throw("mallocinit: arenaTotalBits out of sync with _MHeapMap_TotalBits")
+		}
+		if GOOS == "linux" && hugePageSize > _PageSize && arenaAlign(GOOS, GOARCH) != hugePageSize {
+			throw("mallocinit: arenaAlign out of sync with hugePageSize")
+		}
+		var seed uint32
+		if earlydebugvar("arenaaslr") != 0 {
+			seed = arenaSeed()
+		}
+		bits := uintptr(_MHeapMap_TotalBits)
+		if GOOS == "darwin" && GOARCH == "arm64" {
+			bits = arenaProbeBits(31, bits, sysReserve, sysUnreserve)
+		}
+		l = reserveArena(GOOS, GOARCH, bits, seed, sysReserve)
+		if l.p != 0 {
+			maxMem = 1<<bits - 1
+		}
+	}
 
-			// 总共申请内存大小, 32G + 512M + 512G + 8K = 544.5G
-			pSize = bitmapSize + spansSize + arenaSize + _PageSize
+	// 32 位系统，或者 64 位系统上所有的 hint 地址都 reserve 失败了。
+	if l.p == 0 {
+		probes := l.probes
+		l = reserveArena32(limit, firstmoduledata.end, sysReserve)
+		l.probes += probes
+		if l.p == 0 {
+			throw("runtime: cannot reserve arena virtual address space")
+		}
+		reserveProbes.arena32 = true
+	}
+	reserveProbes.arena = uint32(l.probes)
+	reserveProbes.layout = l
 
-			// 申请连续地址空间, sysReserve 对不同的操作系统进行了封装
-			p = uintptr(sysReserve(unsafe.Pointer(p), pSize, &reserved))
-			if p != 0 {
-				break
-			}
+	mheap_.spans = (**mspan)(unsafe.Pointer(l.spans))
+	mheap_.bitmap = l.bitmap
+	mheap_.arena_start = l.arenaStart
+	mheap_.arena_used = mheap_.arena_start
+	mheap_.arena_alloc = mheap_.arena_start
+	mheap_.arena_chunk = mheap_.arena_start
+	mheap_.arena_end = l.arenaEnd
+	mheap_.arena_limit = l.arenaLimit
+	mheap_.arena_reserved = l.reserved
+	mheap_.meta_reserved = l.reserved
+
+	if mheap_.arena_start&(_PageSize-1) != 0 {
+		println("bad pagesize", hex(l.p), hex(l.spans), hex(l.spansSize), hex(l.bitmapSize), hex(_PageSize), "start", hex(mheap_.arena_start))
+		throw("misrounded allocation in mallocinit")
+	}
+
+	// 初始化 mheap 结构中的其他字段
+	mHeap_Init(&mheap_, l.spansSize)
+	_g_ := getg()
+	_g_.m.mcache = allocmcache()
+}
+
+// arenaLayout 记录 mallocinit 算出来的地址空间布局, 各字段的含义见 reserveArena 里的图示。
+type arenaLayout struct {
+	p          uintptr // sysReserve 返回的地址
+	pSize      uintptr // 向 sysReserve 申请的总大小
+	spansSize  uintptr
+	bitmapSize uintptr
+	spans      uintptr // mheap_.spans
+	bitmap     uintptr // mheap_.bitmap
+	arenaStart uintptr // mheap_.arena_start
+	arenaEnd   uintptr // mheap_.arena_end, 第一个 chunk 的结尾
+	arenaLimit uintptr // mheap_.arena_limit, bitmap 和 spans 能描述的 arena 的结尾
+	reserved   bool
+	probes     int     // 调用 reserve 的次数
+	hint       uintptr // reserve 成功的那次传入的地址
+}
+
+// arenaTotalBits 是 _MHeapMap_TotalBits 在 64 位系统上的函数形式。
+// 常量只能反映编译时的平台，把计算写成函数，测试就可以验证 _MHeapMap_TotalBits 注释里提到的每一种平台。
+// mallocinit 会检查它和 _MHeapMap_TotalBits 是否一致。
+//
+// riscv64 和 loong64 还不能作为 GOARCH 编译这个 runtime(没有汇编、系统调用和信号的定义),
+// 这里先给出它们的布局, 由测试验证: riscv64 在 Sv39 分页下用户空间只有 256GB(38 位),
+// arena 限制为 128GB, 即 37 位; loong64 有 47 位的用户空间, 和其它平台一样用 39 位。
+func arenaTotalBits(goos, goarch string) uintptr {
+	switch {
+	case goos == "windows":
+		return 35
+	case goos == "darwin" && goarch == "arm64":
+		return 36 // 上限, 实际大小见 arenaProbeBits
+	case goarch == "riscv64":
+		return 37
+	}
+	return 39
+}
+
+// arenaFootprint 返回 bits 位的 arena 最终要占用的地址空间: arena 本身加上 bitmap 和 spans。
+func arenaFootprint(bits uintptr) uintptr {
+	arenaSize := round(1<<bits-1, _PageSize)
+	return arenaSize + arenaSize/(ptrSize*8/4) + round(arenaSize/_PageSize*ptrSize, _PageSize)
+}
+
+// arenaProbeBits 在 [lo, hi] 中二分查找能完整 reserve 下来的最大的 arena, 返回它的位数。
+// 每次试探 reserve 的是整个 arenaFootprint, 成功后马上用 release 释放。
+// darwin/arm64 上能 reserve 的地址空间跟设备有关, 老的设备只有 ~5GB, 新的机器大得多，
+// 所以 mallocinit 在启动时试探, 而不是写死一个保守的常量。连 lo 都失败时返回 lo,
+// 交给 reserveArena 和 reserveArena32 按原来的方式处理。
+func arenaProbeBits(lo, hi uintptr, reserve func(v unsafe.Pointer, n uintptr, reserved *bool) unsafe.Pointer, release func(v unsafe.Pointer, n uintptr)) uintptr {
+	best := lo
+	for lo <= hi {
+		mid := lo + (hi-lo)/2
+		n := arenaFootprint(mid)
+		var reserved bool
+		if p := reserve(nil, n, &reserved); p != nil {
+			release(p, n)
+			best = mid
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	return best
+}
+
+// sysUnreserve 释放 sysReserve 保留的地址空间。sysReserve 不记账，给 sysFree 一个临时的 stat。
+func sysUnreserve(v unsafe.Pointer, n uintptr) {
+	stat := uint64(n)
+	sysFree(v, n, &stat)
+}
+
+// arenaAlign 返回 arena_start 需要对齐的大小。在支持透明大页的 Linux 上对齐到大页，
+// 这样 GODEBUG=hugepages=1 时 arena 可以完整地用大页映射，见 mHeap_SysAlloc。
+// 在 Linux 上它跟 hugePageSize 是一致的, mallocinit 会检查。
+func arenaAlign(goos, goarch string) uintptr {
+	if goos == "linux" || goos == "android" {
+		switch goarch {
+		case "amd64", "riscv64":
+			return 2 << 20
+		case "loong64":
+			return 32 << 20
 		}
 	}
+	return _PageSize
+}
+
+// arenaHint 返回第 i 次尝试 reserve arena 时使用的地址, 见 mallocinit 中的说明。
+func arenaHint(i int, goos, goarch string) uintptr {
+	switch {
+	case goarch == "arm64" && goos == "darwin":
+		return uintptr(i)<<40 | uintptrMask&(0x0013<<28)
+	case goarch == "arm64":
+		return uintptr(i)<<40 | uintptrMask&(0x0040<<32)
+	case goarch == "riscv64":
+		// Sv39 下只有 0x0000_0000_0000 ~ 0x003f_ffff_ffff 可用, 136G 的 reservation 只能放在 0x0010<<32 开始的位置,
+		// i > 0 的地址只有 Sv48 的机器上才可能成功。
+		return uintptr(i)<<40 | uintptrMask&(0x0010<<32)
+	default:
+		return uintptr(i)<<40 | uintptrMask&(0x00c0<<32)
+	}
+}
+
+// arenaHintASLR 是 GODEBUG=arenaaslr=1 时使用的 arenaHint: 按 seed 打乱尝试的顺序，
+// 再加上一个随机的、按 32M 对齐的偏移，最多 8G。
+// darwin/arm64 的地址空间太小，只打乱顺序。
+func arenaHintASLR(i int, seed uint32, goos, goarch string) uintptr {
+	start := int(seed & 0x7f)
+	step := int(seed>>7&0x7f) | 1 // 奇数步长，i 从 0 到 0x7f 时正好把 0 到 0x7f 都试一遍
+	hint := arenaHint((start+i*step)&0x7f, goos, goarch)
+	if goos == "darwin" && goarch == "arm64" {
+		return hint
+	}
+	return hint + uintptr(seed>>24)<<25
+}
 
-	// ...
-	// 这里删掉了针对 32位系统的处理代码
+// arenaSeed 返回 arenaHintASLR 用的随机数。mallocinit 的时候 fastrand1 还没有初始化，
+// 用 cputicks 和栈的地址(栈本身是被 OS 随机化过的)混合一下。
+func arenaSeed() uint32 {
+	var x uint32
+	seed := uint32(cputicks()) ^ uint32(uintptr(unsafe.Pointer(&x))>>4)
+	seed ^= seed >> 16
+	seed *= 0x85ebca6b
+	seed ^= seed >> 13
+	seed *= 0xc2b2ae35
+	seed ^= seed >> 16
+	if seed == 0 {
+		seed = 1
+	}
+	return seed
+}
+
+// reserveArena 是 mallocinit 中 64 位系统的 arena 初始化部分，计算 bitmap/spans/arena 的大小并申请地址空间。
+// mallocinit 传入的 reserve 就是 sysReserve, 测试时可以传入假的实现, 一步步验证不同 GOOS/GOARCH 下的结果。
+// bits 是 arena 的位数，一般就是 arenaTotalBits, darwin/arm64 上是 arenaProbeBits 的结果。
+// seed 不为 0 时用 arenaHintASLR 随机化 arena 的地址。
+// 如果所有的地址都 reserve 失败，返回的 l.p 为 0。
+func reserveArena(goos, goarch string, bits uintptr, seed uint32, reserve func(v unsafe.Pointer, n uintptr, reserved *bool) unsafe.Pointer) (l arenaLayout) {
+	// On a 64-bit machine, the arena is a 512 GB (MaxMem) window.
+	// 512 GB should be big enough for now.
+	// Only the bitmap and spans array for the whole window and the first
+	// _ArenaChunk of the arena are reserved up front; the rest of the arena
+	// is reserved chunk by chunk anywhere in the window as the heap grows.
+	// Reserving 544 GB at once fails under RLIMIT_AS and in some sandboxes.
+	//
+	// The code will work with the reservation at any address, but ask
+	// SysReserve to use 0x0000XXc000000000 if possible (XX=00...7f).
+	// Allocating a 512 GB region takes away 39 bits, and the amd64
+	// doesn't let us choose the top 17 bits, so that leaves the 9 bits
+	// in the middle of 0x00c0 for us to choose.  Choosing 0x00c0 means
+	// that the valid memory addresses will begin 0x00c0, 0x00c1, ..., 0x00df.
+	// In little-endian, that's c0 00, c1 00, ..., df 00. None of those are valid
+	// UTF-8 sequences, and they are otherwise as far away from
+	// ff (likely a common byte) as possible.  If that fails, we try other 0xXXc0
+	// addresses.  An earlier attempt to use 0x11f8 caused out of memory errors
+	// on OS X during thread allocations.  0x00c0 causes conflicts with
+	// AddressSanitizer which reserves all memory up to 0x0100.
+	// These choices are both for debuggability and to reduce the
+	// odds of a conservative garbage collector (as is still used in gccgo)
+	// not collecting memory because some non-pointer block of memory
+	// had a bit pattern that matched a memory address.
+	//
+	// The window is actually 544 GB (because the bitmap ends up being 32 GB)
+	// but it hardly matters: e0 00 is not valid UTF-8 either.
+	//
+	// If this fails we fall back to the 32 bit memory mechanism
+	//
+	// However, on arm64, we ignore all this advice above and slam the
+	// allocation at 0x40 << 32 because when using 4k pages with 3-level
+	// translation buffers, the user address space is limited to 39 bits
+	// On darwin/arm64, the address space may be even smaller, see arenaProbeBits.
+	// riscv64 is the same story with Sv39 paging, see arenaHint.
+	arenaSize := round(1<<bits-1, _PageSize) // 512G
+
+	// arena 中的每个字(8byte)都要有 4位的标志位。
+	// bitmapSize 空间用来存放标志位，来表示 512G arena的每个字的标志。
+	// 下面这个表达式不好理解，转换一下, arenaSize / ptrSize * 4 / 8
+	// arenaSize 总共 arenaSize / ptrSize 个字，每个字需要 4bit
+	// 所以总共需要 arenaSize / ptrSize * 4 位来存放这些标志
+	// 而这些位除以8就是字节数了，所以
+	// arenaSize / ptrSize * 4 / 8 = arenaSize / (ptrSize * 8 / 4) = 32G
+	l.bitmapSize = arenaSize / (ptrSize * 8 / 4) // 32G
+
+	// spanSize用来存放所有 span 的地址
+	// arena 可以放下 arenaSize / _PageSize 个 span
+	// 每个 span 的地址需要 ptrSize 大小空间来存。
+	l.spansSize = arenaSize / _PageSize * ptrSize // 512M
+	l.spansSize = round(l.spansSize, _PageSize)   // 512M
+
+	// 总共申请内存大小, 32G + 512M + 64M + 8K, arena 只先 reserve 一个 chunk。
+	// 为了 arena_start 的对齐要多申请 align 大小, 一般就是 8K 的 PageSize。
+	align := arenaAlign(goos, goarch)
+	l.pSize = l.bitmapSize + l.spansSize + _ArenaChunk + align
+	for i := 0; i <= 0x7f; i++ {
+		// 申请连续地址空间, sysReserve 对不同的操作系统进行了封装
+		hint := arenaHint(i, goos, goarch)
+		if seed != 0 {
+			hint = arenaHintASLR(i, seed, goos, goarch)
+		}
+		l.probes++
+		l.p = uintptr(reserve(unsafe.Pointer(hint), l.pSize, &l.reserved))
+		if l.p != 0 {
+			l.hint = hint
+			break
+		}
+	}
 
 	// PageSize can be larger than OS definition of page size,
 	// so SysReserve can give us a PageSize-unaligned pointer.
 	// To overcome this we ask for PageSize more and round up the pointer.
-	p1 := round(p, _PageSize)
+	// 需要大页对齐时是让 arena_start 对齐, spans 和 bitmap 的大小都是 PageSize 的倍数，所以 p1 仍然是页对齐的。
+	p1 := round(l.p+l.spansSize+l.bitmapSize, align) - (l.spansSize + l.bitmapSize)
 	//
-	//      +         +                 +                                          +
-	//      |  512M   |      32G        |                     512G                 |
+	//      +         +                 +           +                              +
+	//      |  512M   |      32G        |    64M    |           512G               |
 	//      +----------------------------------------------------------------------+
-	//      |  span   |     bitmap      |                arena                     |
+	//      |  span   |     bitmap      | arena     |   (not reserved yet)         |
 	//      +----------------------------------------------------------------------+
-	//      ^         ^                 ^                 ^                        ^
-	// mheap.spans  mheap.bitmap   mheap.arena_start     mheap.arena_used       mheap.arena_end
+	//      ^         ^                 ^           ^                              ^
+	// mheap.spans  mheap.bitmap   mheap.arena_start  mheap.arena_end        mheap.arena_limit
+	l.spans = p1
+	l.bitmap = p1 + l.spansSize
+	l.arenaStart = p1 + (l.spansSize + l.bitmapSize)
+	l.arenaEnd = l.p + l.pSize
+	l.arenaLimit = l.arenaStart + arenaSize
+	return
+}
 
-	mheap_.spans = (**mspan)(unsafe.Pointer(p1))
-	mheap_.bitmap = p1 + spansSize
-	mheap_.arena_start = p1 + (spansSize + bitmapSize)
-	mheap_.arena_used = mheap_.arena_start
-	mheap_.arena_end = p + pSize
-	mheap_.arena_reserved = reserved
+// reserveArena32 是 mallocinit 中 32 位系统的 arena 初始化部分。
+// 32 位系统上没办法一次 reserve 很大的地址空间，所以 arena 先只 reserve 512M，
+// 不够的时候 mHeap_SysAlloc 再一个 chunk 一个 chunk 地 reserve, 直到 _MaxArena32。
+// 但是 bitmap 和 spans 是按照 _MaxArena32 的大小一次分配好的。
+// end 是程序 data+bss 段的结尾，reserve 的地址从它后面开始。
+func reserveArena32(limit, end uintptr, reserve func(v unsafe.Pointer, n uintptr, reserved *bool) unsafe.Pointer) (l arenaLayout) {
+	// On a 32-bit machine, we can't typically get away
+	// with a giant virtual address space reservation.
+	// Instead we map the memory information bitmap
+	// immediately after the data+bss segments.
+	// That bitmap must be >= 2 GB, so we
+	// reserve that amount immediately and then
+	// the arena grows after that until we run out of
+	// address space.
+	//
+	// If we fail to allocate, try again with a smaller arena.
+	// This is necessary on Android L where we share a process
+	// with ART, which reserves virtual memory aggressively.
+	arenaSizes := [...]uintptr{
+		512 << 20,
+		256 << 20,
+		128 << 20,
+	}
 
-	if mheap_.arena_start&(_PageSize-1) != 0 {
-		println("bad pagesize", hex(p), hex(p1), hex(spansSize), hex(bitmapSize), hex(_PageSize), "start", hex(mheap_.arena_start))
-		throw("misrounded allocation in mallocinit")
+	var window uintptr // bitmap 和 spans 能描述的 arena 大小
+	for _, arenaSize := range arenaSizes {
+		window = _MaxArena32
+		l.bitmapSize = _MaxArena32 / (ptrSize * 8 / 4)  // 256M
+		l.spansSize = _MaxArena32 / _PageSize * ptrSize // 1M
+		if limit > 0 && arenaSize+l.bitmapSize+l.spansSize > limit {
+			// 地址空间被限制了，按 arena : bitmap = 8 : 1 分配 limit。
+			l.bitmapSize = (limit / 9) &^ ((1 << _PageShift) - 1)
+			arenaSize = l.bitmapSize * 8
+			l.spansSize = arenaSize / _PageSize * ptrSize
+			window = arenaSize
+		}
+		l.spansSize = round(l.spansSize, _PageSize)
+
+		// SysReserve treats the address we ask for, end, as a hint,
+		// not as an absolute requirement.  If we ask for the end
+		// of the data segment but the operating system requires
+		// a little more space before we can start allocating, it will
+		// give out a slightly higher pointer.  Except QEMU, which
+		// is buggy, as usual: it won't adjust the pointer upward.
+		// So adjust it upward a little bit ourselves: 1/4 MB to get
+		// away from the running binary image and then round up
+		// to a MB boundary.
+		hint := round(end+(1<<18), 1<<20)
+		l.pSize = l.bitmapSize + l.spansSize + arenaSize + _PageSize
+		l.probes++
+		l.p = uintptr(reserve(unsafe.Pointer(hint), l.pSize, &l.reserved))
+		if l.p != 0 {
+			l.hint = hint
+			break
+		}
+	}
+	if l.p == 0 {
+		return
 	}
 
-	// 初始化 mheap 结构中的其他字段
-	mHeap_Init(&mheap_, spansSize)
-	_g_ := getg()
-	_g_.m.mcache = allocmcache()
+	// PageSize can be larger than OS definition of page size,
+	// so SysReserve can give us a PageSize-unaligned pointer.
+	// To overcome this we ask for PageSize more and round up the pointer.
+	p1 := round(l.p, _PageSize)
+	l.spans = p1
+	l.bitmap = p1 + l.spansSize
+	l.arenaStart = p1 + (l.spansSize + l.bitmapSize)
+	l.arenaEnd = l.p + l.pSize
+	l.arenaLimit = l.arenaStart + window
+	return
+}
+
+// 为了诊断，记录 reserve 地址空间时尝试了多少个地址、最后用的是哪个地址，见 ReadReserveStats。
+var reserveProbes struct {
+	arena   uint32      // mallocinit reserve arena 的次数
+	arena32 bool        // 是否用的是 reserveArena32
+	layout  arenaLayout // mallocinit 最终的 arena 布局
+	high    uint32      // sysReserveHigh 累计的次数, 原子操作
+	highOK  uint32      // sysReserveHigh 成功的次数, 原子操作
+	// 最近一次成功的 sysReserveHigh 的结果, 原子操作
+	highHint     uintptr
+	highAddr     uintptr
+	highReserved uint32
+}
+
+// ReserveStats describes how the runtime reserved its address space.
+type ReserveStats struct {
+	// The reservation of the heap arena by the runtime at startup.
+	ArenaProbes   int     // candidate addresses tried
+	ArenaHint     uintptr // address asked for by the successful attempt, 0 to let the kernel choose
+	ArenaReserved bool    // whether the OS really reserved the region or only checked it was free
+	Arena32       bool    // whether the small 32-bit style layout was used
+	ReserveStart  uintptr // start of the reserved region
+	ReserveSize   uintptr // size of the reserved region
+	SpansStart    uintptr // start of the span table
+	BitmapStart   uintptr // start of the heap bitmap
+	ArenaStart    uintptr // start of the arena
+	ArenaEnd      uintptr // end of the first reserved chunk of the arena
+	ArenaLimit    uintptr // end of the address range the arena may grow into
+
+	// Reservations high in the address space after startup.
+	HighProbes   int     // candidate addresses tried in total
+	HighCount    int     // successful reservations
+	HighHint     uintptr // address asked for by the last successful reservation
+	HighAddr     uintptr // address returned by the last successful reservation
+	HighReserved bool    // whether the last successful reservation was really reserved
+}
+
+// ReadReserveStats returns statistics about the runtime's address space
+// reservations, for debugging startup under containers or sandboxes
+// that restrict virtual memory. Large probe counts mean that the
+// preferred addresses were already taken by other mappings, for example
+// of a C library.
+func ReadReserveStats() ReserveStats {
+	l := &reserveProbes.layout
+	return ReserveStats{
+		ArenaProbes:   int(reserveProbes.arena),
+		ArenaHint:     l.hint,
+		ArenaReserved: l.reserved,
+		Arena32:       reserveProbes.arena32,
+		ReserveStart:  l.p,
+		ReserveSize:   l.pSize,
+		SpansStart:    l.spans,
+		BitmapStart:   l.bitmap,
+		ArenaStart:    l.arenaStart,
+		ArenaEnd:      l.arenaEnd,
+		ArenaLimit:    l.arenaLimit,
+		HighProbes:    int(atomicload(&reserveProbes.high)),
+		HighCount:     int(atomicload(&reserveProbes.highOK)),
+		HighHint:      uintptr(atomicloadp(unsafe.Pointer(&reserveProbes.highHint))),
+		HighAddr:      uintptr(atomicloadp(unsafe.Pointer(&reserveProbes.highAddr))),
+		HighReserved:  atomicload(&reserveProbes.highReserved) != 0,
+	}
+}
+
+// sysReserveHighDone 记录一次成功的 sysReserveHigh。
+func sysReserveHighDone(hint, p uintptr, reserved bool) {
+	r := uint32(0)
+	if reserved {
+		r = 1
+	}
+	xchguintptr(&reserveProbes.highHint, hint)
+	xchguintptr(&reserveProbes.highAddr, p)
+	atomicstore(&reserveProbes.highReserved, r)
+	xadd(&reserveProbes.highOK, 1)
 }
 
 // sysReserveHigh reserves space somewhere high in the address space.
@@ -344,48 +703,66 @@ func mallocinit() {
 // mode, so don't do that. Pick a high address instead.
 func sysReserveHigh(n uintptr, reserved *bool) unsafe.Pointer {
 	if ptrSize == 4 {
-		return sysReserve(nil, n, reserved)
+		p := sysReserve(nil, n, reserved)
+		if p != nil {
+			sysReserveHighDone(0, uintptr(p), *reserved)
+		}
+		return p
 	}
 
 	for i := 0; i <= 0x7f; i++ {
-		p := uintptr(i)<<40 | uintptrMask&(0x00c0<<32)
+		hint := arenaHint(i, GOOS, GOARCH)
+		xadd(&reserveProbes.high, 1)
 		*reserved = false
-		p = uintptr(sysReserve(unsafe.Pointer(p), n, reserved))
+		p := uintptr(sysReserve(unsafe.Pointer(hint), n, reserved))
 		if p != 0 {
+			sysReserveHighDone(hint, p, *reserved)
 			return unsafe.Pointer(p)
 		}
 	}
 
-	return sysReserve(nil, n, reserved)
+	p := sysReserve(nil, n, reserved)
+	if p != nil {
+		sysReserveHighDone(0, uintptr(p), *reserved)
+	}
+	return p
 }
 
 // 在 arena区间的 used 内存扩充(增加) n。并对 span 和 bitmap 区间相应的进行设置。
+//
+// arena 是按 _ArenaChunk 增长的, h.arena_alloc 到 h.arena_end 是当前 chunk 中还没用的部分。
+// 当前 chunk 不够用了就再 reserve 一个, 先试着紧接在 arena_end 后面, 这样 heap 还是连续的;
+// 如果 OS 把它放在了别的地方(被别的 mapping 占了, 或者 OS 不理会地址提示),
+// 只要还在 [arena_start, arena_limit) 中就可以用。chunk 之间空出来的地址在 h_spans 中是 nil,
+// 所以 arena_start <= p < arena_used 只能说明 p 可能在 heap 中, 还要再查 h_spans。
 func mHeap_SysAlloc(h *mheap, n uintptr) unsafe.Pointer {
+	if allocFault.Sites != 0 && allocShouldFail(AllocFaultSys, n) {
+		return nil
+	}
 
-	// 要扩充的 n 已经超过 arena 整个空间，这在 64 位系统上是不太可能的，毕竟 500G 内存空间啊。
-	if n > uintptr(h.arena_end)-uintptr(h.arena_used) {
-		// We are in 32-bit mode, maybe we didn't use all possible address space yet.
-		// Reserve some more space.
-		p_size := round(n+_PageSize, 256<<20)
-		new_end := h.arena_end + p_size // 扩充后 arena_end 指向的内存地址
-		if new_end <= h.arena_start+_MaxArena32 {
-			// TODO: It would be bad if part of the arena
-			// is reserved and part is not.
+	if n > h.arena_end-h.arena_alloc {
+		// 当前 chunk 不够了，再 reserve 一块。
+		p_size := round(n+_PageSize, _ArenaChunk)
+		if h.arena_end+p_size > h.arena_end && h.arena_end+p_size <= h.arena_limit {
 			var reserved bool
 			p := uintptr(sysReserve((unsafe.Pointer)(h.arena_end), p_size, &reserved))
 			if p == h.arena_end {
-				h.arena_end = new_end
+				// 紧接着上一个 chunk, 当前 chunk 剩下的部分也可以接着用。
+				// 64 位上第一个 chunk 大于 4GB, sysReserve 只检查了没有 reserve, 后面的 chunk 却真的 reserve 了,
+				// 两部分要各自按自己的 reserved 来 map: 对 reserve 过的地址用 mmap_fixed 会和自己的 mapping 冲突。
+				h.arena_prevres = h.arena_reserved
+				h.arena_chunk = p
+				h.arena_end = p + p_size
 				h.arena_reserved = reserved
-			} else if p+p_size <= h.arena_start+_MaxArena32 {
+			} else if p >= h.arena_start && p+p_size <= h.arena_limit {
 				// Keep everything page-aligned.
 				// Our pages are bigger than hardware pages.
+				// 上一个 chunk 剩下的部分就不要了。
+				h.arena_alloc = p + (-uintptr(p) & (_PageSize - 1))
+				h.arena_chunk = h.arena_alloc
 				h.arena_end = p + p_size
-				used := p + (-uintptr(p) & (_PageSize - 1))
-				mHeap_MapBits(h, used)
-				mHeap_MapSpans(h, used)
-				h.arena_used = used
 				h.arena_reserved = reserved
-			} else {
+			} else if p != 0 {
 				var stat uint64
 				sysFree((unsafe.Pointer)(p), p_size, &stat)
 			}
@@ -393,13 +770,27 @@ func mHeap_SysAlloc(h *mheap, n uintptr) unsafe.Pointer {
 	}
 
 	// 其实核心就在这个 if 语句里，其他的都是各种异常的判断
-	if n <= uintptr(h.arena_end)-uintptr(h.arena_used) {
+	if n <= h.arena_end-h.arena_alloc {
 		// Keep taking from our reservation.
-		p := h.arena_used
-		sysMap((unsafe.Pointer)(p), n, h.arena_reserved, &memstats.heap_sys)
-		mHeap_MapBits(h, p+n)  // 更新 bitmap 信息
-		mHeap_MapSpans(h, p+n) // 更新 span 信息
-		h.arena_used = p + n
+		p := h.arena_alloc
+		if p < h.arena_chunk {
+			// 上一个 chunk 剩下的部分不够, 所以一定会用到新的 chunk。
+			sysMap((unsafe.Pointer)(p), h.arena_chunk-p, h.arena_prevres, &memstats.heap_sys)
+			sysMap((unsafe.Pointer)(h.arena_chunk), p+n-h.arena_chunk, h.arena_reserved, &memstats.heap_sys)
+		} else {
+			sysMap((unsafe.Pointer)(p), n, h.arena_reserved, &memstats.heap_sys)
+		}
+		if debug.hugepages != 0 {
+			sysHugePage((unsafe.Pointer)(p), n)
+		}
+		used := h.arena_used
+		if p+n > used {
+			used = p + n
+		}
+		mHeap_MapBits(h, p, n)  // 更新 bitmap 信息
+		mHeap_MapSpans(h, used) // 更新 span 信息
+		h.arena_alloc = p + n
+		h.arena_used = used
 
 		if uintptr(p)&(_PageSize-1) != 0 {
 			throw("misrounded allocation in MHeap_SysAlloc")
@@ -407,13 +798,8 @@ func mHeap_SysAlloc(h *mheap, n uintptr) unsafe.Pointer {
 		return (unsafe.Pointer)(p)
 	}
 
-	// If using 64-bit, our reservation is all we have.
-	if uintptr(h.arena_end)-uintptr(h.arena_start) >= _MaxArena32 {
-		return nil
-	}
-
-	// On 32-bit, once the reservation is gone we can
-	// try to get memory at a location chosen by the OS
+	// The window is full or the OS put the new chunk outside of it.
+	// Try to get memory at a location chosen by the OS
 	// and hope that it is in the range we allocated bitmap for.
 	p_size := round(n, _PageSize) + _PageSize
 	p := uintptr(sysAlloc(p_size, &memstats.heap_sys))
@@ -421,24 +807,20 @@ func mHeap_SysAlloc(h *mheap, n uintptr) unsafe.Pointer {
 		return nil
 	}
 
-	if p < h.arena_start || uintptr(p)+p_size-uintptr(h.arena_start) >= _MaxArena32 {
-		print("runtime: memory allocated by OS (", p, ") not in usable range [", hex(h.arena_start), ",", hex(h.arena_start+_MaxArena32), ")\n")
+	if p < h.arena_start || p+p_size > h.arena_limit {
+		print("runtime: memory allocated by OS (", p, ") not in usable range [", hex(h.arena_start), ",", hex(h.arena_limit), ")\n")
 		sysFree((unsafe.Pointer)(p), p_size, &memstats.heap_sys)
 		return nil
 	}
 
-	p_end := p + p_size
 	p += -p & (_PageSize - 1)
+	mHeap_MapBits(h, p, n)
 	if uintptr(p)+n > uintptr(h.arena_used) {
-		mHeap_MapBits(h, p+n)
 		mHeap_MapSpans(h, p+n)
 		h.arena_used = p + n
-		if p_end > h.arena_end {
-			h.arena_end = p_end
-		}
-		if raceenabled {
-			racemapshadow((unsafe.Pointer)(p), n)
-		}
+	}
+	if raceenabled {
+		racemapshadow((unsafe.Pointer)(p), n)
 	}
 
 	if uintptr(p)&(_PageSize-1) != 0 {
@@ -466,16 +848,27 @@ func mallocgc(size uintptr, typ *_type, flags uint32) unsafe.Pointer {
 		return unsafe.Pointer(&zerobase)
 	}
 
+	if allocFault.Sites != 0 && allocShouldFail(AllocFaultMalloc, size) {
+		mallocFault(size)
+	}
+
+	// 大对象会超过 heap limit 时先做一次 GC，看能不能腾出空间, 见 heaplimit.go。
+	if size > maxSmallSize {
+		heapLimitGC(size)
+	}
+
 	// Set mp.mallocing to keep from being preempted by GC.
 	// 获取线程 M，
 	mp := acquirem()
 	if mp.mallocing != 0 {
-		throw("malloc deadlock")
+		mallocDeadlock(mp, size, getcallerpc(unsafe.Pointer(&size)))
 	}
 	if mp.gsignal == getg() {
 		throw("malloc during signal")
 	}
 	mp.mallocing = 1
+	mp.mallocpc = getcallerpc(unsafe.Pointer(&size))
+	mp.mallocsize = size
 
 	shouldhelpgc := false
 	dataSize := size
@@ -485,7 +878,7 @@ func mallocgc(size uintptr, typ *_type, flags uint32) unsafe.Pointer {
 	var s *mspan
 	var x unsafe.Pointer
 	// 空间较小的内存申请, 小于 32k
-	if size <= maxSmallSize {
+	if size <= maxSmallSize && !guardEnabled(size) {
 		// 如果申请的是 tiny 大小的对象，也就是小于 16 字节
 		if flags&flagNoScan != 0 && size < maxTinySize {
 			// Tiny allocator.
@@ -533,27 +926,33 @@ func mallocgc(size uintptr, typ *_type, flags uint32) unsafe.Pointer {
 				x = add(c.tiny, off)
 				c.tinyoffset = off + size
 				c.local_tinyallocs++
+				c.local_tinybytes += size
+				c.palloc_nmalloc++
+				c.palloc_ntiny++
+				c.palloc_bytes += uint64(size)
+				if debug.checkzero != 0 {
+					checkZero(x, size, c.alloc[tinySizeClass])
+				}
 				mp.mallocing = 0
 				releasem(mp)
+				if debug.alloctrace != 0 || allocHook != nil {
+					allocTrace(size, tinySizeClass, typ, getcallerpc(unsafe.Pointer(&size)))
+				}
 				return x
 			}
 			// Allocate a new maxTinySize block.
 			// tiny 空间不够，从 span 列表中申请一个过来给 tiny
-			s = c.alloc[tinySizeClass]
-			v := s.freelist
-			if v.ptr() == nil { // 这个 span 已经用不了了，是空的
-				systemstack(func() {
-					mCache_Refill(c, tinySizeClass) // 冲新填充 mcache 的 span 列表
-				})
-				shouldhelpgc = true
-				s = c.alloc[tinySizeClass]
-				v = s.freelist
+			var v gclinkptr
+			v, s, shouldhelpgc = nextFree(c, tinySizeClass)
+			if s == nil {
+				mp.mallocing = 0
+				releasem(mp)
+				return mallocgcOOM(size, typ, flags)
 			}
-			s.freelist = v.ptr().next
-			s.ref++
-			// prefetchnta offers best performance, see change list message.
-			prefetchnta(uintptr(v.ptr().next))
 			x = unsafe.Pointer(v)
+			if debug.mallocpoison != 0 {
+				mallocPoisonCheck(x, maxTinySize)
+			}
 			// 下面两句相当于置0了。tinySize是16byte，也就是长度为2的uint64的数组，都置成0，相当于 memset 了
 			(*[2]uint64)(x)[0] = 0
 			(*[2]uint64)(x)[1] = 0
@@ -565,7 +964,12 @@ func mallocgc(size uintptr, typ *_type, flags uint32) unsafe.Pointer {
 				c.tiny = x
 				c.tinyoffset = size
 			}
+			c.local_tinybytes += size
+			c.local_tinyblocks++
+			// 和上面的 fast path 一样只算请求的大小, 不算整个 tiny block。
+			c.palloc_bytes += uint64(size)
 			size = maxTinySize
+			c.palloc_ntiny++
 		} else {
 			// 不是 tiny 类型的，直接从 alloc 表里面取一个适当大小的 span
 			// 整体逻辑和上面的 tiny 差不多
@@ -578,27 +982,27 @@ func mallocgc(size uintptr, typ *_type, flags uint32) unsafe.Pointer {
 			}
 
 			size = uintptr(class_to_size[sizeclass])
-			s = c.alloc[sizeclass]
-			v := s.freelist
-			if v.ptr() == nil { // span 没有空间了
-				systemstack(func() {
-					mCache_Refill(c, int32(sizeclass)) // 重新填充这个 sizeclass 的span
-				})
-				shouldhelpgc = true
-				s = c.alloc[sizeclass]
-				v = s.freelist
+			var v gclinkptr
+			v, s, shouldhelpgc = nextFree(c, int32(sizeclass))
+			if s == nil {
+				mp.mallocing = 0
+				releasem(mp)
+				return mallocgcOOM(size, typ, flags)
 			}
-			s.freelist = v.ptr().next
-			s.ref++
-			// prefetchnta offers best performance, see change list message.
-			prefetchnta(uintptr(v.ptr().next))
 			x = unsafe.Pointer(v)
+			if debug.mallocpoison != 0 {
+				mallocPoisonCheck(x, size)
+			}
 			if flags&flagNoZero == 0 { // 这个flag表示，是否对新拿到的内存清0。
 				v.ptr().next = 0
 				if size > 2*ptrSize && ((*[2]uintptr)(x))[1] != 0 {
 					memclr(unsafe.Pointer(v), size)
 				}
+				if debug.checkzero != 0 {
+					checkZero(x, size, s)
+				}
 			}
+			c.palloc_bytes += uint64(size)
 		}
 		c.local_cachealloc += size
 	} else {
@@ -606,11 +1010,31 @@ func mallocgc(size uintptr, typ *_type, flags uint32) unsafe.Pointer {
 		var s *mspan
 		shouldhelpgc = true
 		systemstack(func() {
-			s = largeAlloc(size, uint32(flags))
+			if guardEnabled(size) {
+				s = guardAlloc(size, uint32(flags))
+			} else {
+				s = largeAlloc(size, uint32(flags))
+			}
 		})
+		if s == nil {
+			// mHeap_Grow 已经重试过了, 见 mHeap_SysAllocRetry。
+			mp.mallocing = 0
+			releasem(mp)
+			return mallocgcOOM(size, typ, flags)
+		}
 		x = unsafe.Pointer(uintptr(s.start << pageShift))
 		size = uintptr(s.elemsize)
+		largeObjRecord(x, size, typ, getcallerpc(unsafe.Pointer(&size)))
+		if flags&flagNoZero == 0 && debug.checkzero != 0 {
+			n := size
+			if s.guardpage != 0 {
+				n -= _PageSize // guard page 不能读
+			}
+			checkZero(x, n, s)
+		}
+		c.palloc_bytes += uint64(size)
 	}
+	c.palloc_nmalloc++
 
 	// 到这里内存分配就结束了，分配的结果就是变量 x
 	// 下面的代码主要和 gc，debug，race 有关。
@@ -633,9 +1057,11 @@ func mallocgc(size uintptr, typ *_type, flags uint32) unsafe.Pointer {
 			// element.
 			if typ.ptrdata != 0 {
 				c.local_scan += dataSize - typ.size + typ.ptrdata
+				c.palloc_scan += uint64(dataSize - typ.size + typ.ptrdata)
 			}
 		} else {
 			c.local_scan += typ.ptrdata
+			c.palloc_scan += uint64(typ.ptrdata)
 		}
 
 		// Ensure that the stores above that initialize x to
@@ -660,6 +1086,22 @@ func mallocgc(size uintptr, typ *_type, flags uint32) unsafe.Pointer {
 	mp.mallocing = 0
 	releasem(mp)
 
+	if debug.alloctrace != 0 || allocHook != nil {
+		var sizeclass int32
+		if s != nil {
+			sizeclass = int32(s.sizeclass)
+		}
+		allocTrace(dataSize, sizeclass, typ, getcallerpc(unsafe.Pointer(&size)))
+	}
+
+	if rate := allocSampleRate; rate > 0 {
+		if int32(size) < c.next_allocsample {
+			c.next_allocsample -= int32(size)
+		} else {
+			allocSampleRecord(size, typ)
+		}
+	}
+
 	if shouldhelpgc && shouldtriggergc() {
 		startGC(gcBackgroundMode, false)
 	} else if gcBlackenEnabled != 0 {
@@ -682,10 +1124,106 @@ func mallocgc(size uintptr, typ *_type, flags uint32) unsafe.Pointer {
 		}
 	}
 
+	// 超过 SetRSSWatchdog 设置的阈值时提前 GC 和 scavenge, 见 rsswatch.go。
+	if shouldhelpgc {
+		rssWatchCheck()
+	}
+
 	return x
 }
 
-// 为大对象(>=32K)申请 size 大小的内存空间
+// nextFree 从 c 中 sizeclass 对应的 span 里取出一个空闲对象，tiny 和小对象的分配都用它。
+// 常见情况下只是从 freelist 上摘下第一个，span 用完了才走 nextFreeSlow。
+// shouldhelpgc 表示这次分配 refill 过 span, mallocgc 据此决定要不要检查是否开始 GC。
+// heap 增长不了，拿不到新的 span 时 s 是 nil。
+func nextFree(c *mcache, sizeclass int32) (v gclinkptr, s *mspan, shouldhelpgc bool) {
+	s = c.alloc[sizeclass]
+	v = s.freelist
+	if v.ptr() == nil { // span 没有空间了
+		s = nextFreeSlow(c, sizeclass)
+		if s == nil {
+			return 0, nil, true
+		}
+		v = s.freelist
+		shouldhelpgc = true
+	}
+	s.freelist = v.ptr().next
+	s.ref++
+	// 默认的 prefetchnta 是 change list 里测出来最快的，
+	// 但和具体的处理器有关，可以用 GODEBUG=allocprefetch 或 SetAllocPrefetch 换掉。
+	switch debug.allocprefetch {
+	case AllocPrefetchNTA:
+		prefetchnta(uintptr(v.ptr().next))
+	case AllocPrefetchT0:
+		prefetcht0(uintptr(v.ptr().next))
+	}
+	return
+}
+
+// Prefetch strategies of the small object allocator, see SetAllocPrefetch.
+const (
+	AllocPrefetchNTA  = 0 // non-temporal prefetch (PREFETCHNTA), the default
+	AllocPrefetchT0   = 1 // prefetch into all cache levels (PREFETCHT0)
+	AllocPrefetchNone = 2 // no prefetch
+)
+
+// SetAllocPrefetch sets how the allocator prefetches the next free
+// object after allocating a small object and returns the previous
+// strategy. The initial strategy is AllocPrefetchNTA unless set with
+// GODEBUG=allocprefetch. Which one is fastest depends on the processor.
+func SetAllocPrefetch(mode int) int {
+	if mode < AllocPrefetchNTA || mode > AllocPrefetchNone {
+		panic("runtime: invalid alloc prefetch mode")
+	}
+	old := int(debug.allocprefetch)
+	debug.allocprefetch = int32(mode)
+	return old
+}
+
+// nextFreeSlow 重新填充 c 中 sizeclass 的 span, 返回新的 span, heap 增长不了时返回 nil。
+// 单独放在一个函数里，让 nextFree 的快路径尽量短。
+func nextFreeSlow(c *mcache, sizeclass int32) *mspan {
+	var s *mspan
+	systemstack(func() {
+		s = mCache_Refill(c, sizeclass) // 重新填充这个 sizeclass 的span
+	})
+	return s
+}
+
+// mallocDeadlock 在 mallocgc 重入时打印出错的现场然后 throw:
+// 当前的 M 和 G, 是不是在 gsignal/g0 上, 外层和这一次分配的调用者和大小。
+// 一般是改过的 runtime 代码在持有 mallocing 时(比如 mCache_Refill、sweep 里)又分配了内存。
+func mallocDeadlock(mp *m, size, pc uintptr) {
+	gp := getg()
+	print("runtime: malloc deadlock: M", mp.id, " mallocing=", mp.mallocing, " locks=", mp.locks, "\n")
+	print("runtime: g=", gp.goid, " gsignal=", gp == mp.gsignal, " g0=", gp == mp.g0)
+	if mp.curg != nil {
+		print(" curg=", mp.curg.goid)
+	}
+	print("\n")
+	print("runtime: outer allocation of ", mp.mallocsize, " bytes from ")
+	printmallocpc(mp.mallocpc)
+	print("runtime: this allocation of ", size, " bytes from ")
+	printmallocpc(pc)
+	throw("malloc deadlock")
+}
+
+func printmallocpc(pc uintptr) {
+	f := findfunc(pc)
+	if f == nil {
+		print("pc=", hex(pc), " ?\n")
+		return
+	}
+	// pc 是返回地址, 行号取 call 指令所在的行。
+	tracepc := pc
+	if tracepc > f.entry {
+		tracepc--
+	}
+	file, line := funcline(f, tracepc)
+	print(funcname(f), " pc=", hex(pc), "\n\t", file, ":", line, "\n")
+}
+
+// 为大对象(>=32K)申请 size 大小的内存空间, heap 增长不了时返回 nil。
 func largeAlloc(size uintptr, flag uint32) *mspan {
 	// print("largeAlloc size=", size, "\n")
 
@@ -697,14 +1235,18 @@ func largeAlloc(size uintptr, flag uint32) *mspan {
 		npages++
 	}
 
-	// Deduct credit for this span allocation and sweep if
-	// necessary. mHeap_Alloc will also sweep npages, so this only
-	// pays the debt down to npage pages.
-	deductSweepCredit(npages*_PageSize, npages)
-	// 直接从 heap 里拿
-	s := mHeap_Alloc(&mheap_, npages, 0, true, flag&_FlagNoZero == 0)
+	// 先看 mcache 里有没有刚释放的一样大小的 span, 有的话不用加 heap lock, 见 largecache.go。
+	s := largeCacheGet(getg().m.mcache, npages, flag&_FlagNoZero == 0)
 	if s == nil {
-		throw("out of memory")
+		// Deduct credit for this span allocation and sweep if
+		// necessary. mHeap_Alloc will also sweep npages, so this only
+		// pays the debt down to npage pages.
+		deductSweepCredit(npages*_PageSize, npages)
+		// 直接从 heap 里拿
+		s = mHeap_Alloc(&mheap_, npages, 0, true, flag&_FlagNoZero == 0)
+		if s == nil {
+			return nil // mallocgc 决定是 GC 之后再试一次还是 throw
+		}
 	}
 	// 限制这块儿内存的使用界限。因为虽申请的是 size 大小，而实际 s 的内存可能要大于 size 的。所以这里限定以下。多出 size 部分的内存不能用。
 	s.limit = uintptr(s.start)<<_PageShift + size
@@ -721,6 +1263,15 @@ func newobject(typ *_type) unsafe.Pointer {
 	return mallocgc(uintptr(typ.size), typ, flags)
 }
 
+// newobjectcopy 和 newobject 一样，但是调用者保证马上用 typedmemmove 把整个对象覆盖掉，
+// 所以不含指针的对象不需要先清零。含指针的对象还是要清零，见 newarraycopy。
+func newobjectcopy(typ *_type) unsafe.Pointer {
+	if typ.kind&kindNoPointers != 0 {
+		return mallocgc(uintptr(typ.size), typ, flagNoScan|flagNoZero)
+	}
+	return mallocgc(uintptr(typ.size), typ, 0)
+}
+
 //go:linkname reflect_unsafe_New reflect.unsafe_New
 func reflect_unsafe_New(typ *_type) unsafe.Pointer {
 	return newobject(typ)
@@ -732,12 +1283,25 @@ func newarray(typ *_type, n uintptr) unsafe.Pointer {
 	if typ.kind&kindNoPointers != 0 {
 		flags |= flagNoScan
 	}
-	if int(n) < 0 || (typ.size > 0 && n > _MaxMem/uintptr(typ.size)) {
+	if int(n) < 0 || (typ.size > 0 && n > maxMem/uintptr(typ.size)) {
 		panic("runtime: allocation size out of range")
 	}
 	return mallocgc(uintptr(typ.size)*n, typ, flags)
 }
 
+// newarraycopy 和 newarray 一样，但是调用者保证马上把所有的元素都覆盖掉。
+// 只有不含指针的类型可以不清零：mallocgc 返回之前可能会开始 GC,
+// 这时候新对象只被栈引用着，GC 扫描到它的时候就会把里面没有清零的垃圾当成指针。
+func newarraycopy(typ *_type, n uintptr) unsafe.Pointer {
+	if typ.kind&kindNoPointers == 0 {
+		return newarray(typ, n)
+	}
+	if int(n) < 0 || (typ.size > 0 && n > maxMem/uintptr(typ.size)) {
+		panic("runtime: allocation size out of range")
+	}
+	return mallocgc(uintptr(typ.size)*n, typ, flagNoScan|flagNoZero)
+}
+
 //go:linkname reflect_unsafe_NewArray reflect.unsafe_NewArray
 func reflect_unsafe_NewArray(typ *_type, n uintptr) unsafe.Pointer {
 	return newarray(typ, n)
@@ -773,8 +1337,28 @@ func profilealloc(mp *m, x unsafe.Pointer, size uintptr) {
 }
 
 type persistentAlloc struct {
-	base unsafe.Pointer
-	off  uintptr
+	base  unsafe.Pointer
+	off   uintptr
+	chunk uintptr // 当前 chunk 的大小, 见 persistentNextChunk
+}
+
+const (
+	persistentMinChunk = 64 << 10 // P 和 globalAlloc 的第一个 chunk 的大小
+	persistentMaxChunk = 1 << 20  // chunk 最大加倍到这么大
+	persistentMChunk   = 16 << 10 // 没有 P 的 M 自己的 chunk 的大小
+)
+
+// persistentNextChunk 返回 a 的下一个 chunk 的大小。
+// 用完一个 chunk 说明这里分配得多(比如启动时大量创建 itab), 下一个 chunk 加倍，
+// 直到 persistentMaxChunk; 很少用到 persistentalloc 的 P 只占用 persistentMinChunk。
+func persistentNextChunk(a *persistentAlloc) uintptr {
+	if a.chunk == 0 {
+		return persistentMinChunk
+	}
+	if a.chunk >= persistentMaxChunk {
+		return persistentMaxChunk
+	}
+	return a.chunk * 2
 }
 
 var globalAlloc struct {
@@ -799,7 +1383,6 @@ func persistentalloc(size, align uintptr, sysStat *uint64) unsafe.Pointer {
 //go:systemstack
 func persistentalloc1(size, align uintptr, sysStat *uint64) unsafe.Pointer {
 	const (
-		chunk    = 256 << 10
 		maxBlock = 64 << 10 // VM reservation granularity is 64K on windows
 	)
 
@@ -817,21 +1400,39 @@ func persistentalloc1(size, align uintptr, sysStat *uint64) unsafe.Pointer {
 		align = 8
 	}
 
+	if allocFault.Sites != 0 && allocShouldFail(AllocFaultPersistent, size) {
+		persistentallocFault(size)
+	}
+
 	if size >= maxBlock {
-		return sysAlloc(size, sysStat)
+		p := sysAlloc(size, sysStat)
+		if p != nil {
+			persistentStatLarge(size, sysStat)
+		}
+		return p
 	}
 
+	// 有 P 时用 P 的 chunk, 不用加锁。没有 P 的 M(启动时、cgo 回调、sysmon 等)
+	// 先用 M 自己的小 chunk, 放不下的才用全局加锁的 globalAlloc。
 	mp := acquirem()
 	var persistent *persistentAlloc
+	var chunkSize uintptr
 	if mp != nil && mp.p != 0 {
 		persistent = &mp.p.ptr().palloc
+		chunkSize = persistentNextChunk(persistent)
+	} else if mp != nil && size <= persistentMChunk/4 {
+		persistent = &mp.palloc
+		chunkSize = persistentMChunk
+		xadd64(&persistentStats.nop, 1)
 	} else {
 		lock(&globalAlloc.mutex)
 		persistent = &globalAlloc.persistentAlloc
+		chunkSize = persistentNextChunk(persistent)
+		xadd64(&persistentStats.global, 1)
 	}
 	persistent.off = round(persistent.off, align)
-	if persistent.off+size > chunk || persistent.base == nil {
-		persistent.base = sysAlloc(chunk, &memstats.other_sys)
+	if persistent.off+size > persistent.chunk || persistent.base == nil {
+		persistent.base = sysAlloc(chunkSize, &memstats.other_sys)
 		if persistent.base == nil {
 			if persistent == &globalAlloc.persistentAlloc {
 				unlock(&globalAlloc.mutex)
@@ -839,6 +1440,9 @@ func persistentalloc1(size, align uintptr, sysStat *uint64) unsafe.Pointer {
 			throw("runtime: cannot allocate memory")
 		}
 		persistent.off = 0
+		persistent.chunk = chunkSize
+		xadd64(&persistentStats.chunks, 1)
+		xadd64(&persistentStats.chunkBytes, int64(chunkSize))
 	}
 	p := add(persistent.base, persistent.off)
 	persistent.off += size
@@ -846,6 +1450,7 @@ func persistentalloc1(size, align uintptr, sysStat *uint64) unsafe.Pointer {
 	if persistent == &globalAlloc.persistentAlloc {
 		unlock(&globalAlloc.mutex)
 	}
+	persistentStatAlloc(size, sysStat)
 
 	if sysStat != &memstats.other_sys {
 		mSysStatInc(sysStat, size)
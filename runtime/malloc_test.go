@@ -5,8 +5,14 @@
 package runtime_test
 
 import (
+	"bufio"
+	"encoding/binary"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
 	. "runtime"
+	"strings"
 	"testing"
 	"time"
 	"unsafe"
@@ -65,6 +71,979 @@ func TestMemStats(t *testing.T) {
 	}
 }
 
+func TestReserveArena(t *testing.T) {
+	if PtrSize != 8 {
+		t.Skip("arena layout is only computed on 64-bit systems")
+	}
+	tests := []struct {
+		goos, goarch string
+		arena        uint64
+		bitmap       uint64
+		spans        uint64
+		hint         uint64
+		align        uint64
+	}{
+		{"linux", "amd64", 512 << 30, 32 << 30, 512 << 20, 0x00c0 << 32, 2 << 20},
+		{"linux", "arm64", 512 << 30, 32 << 30, 512 << 20, 0x0040 << 32, 8 << 10},
+		{"darwin", "amd64", 512 << 30, 32 << 30, 512 << 20, 0x00c0 << 32, 8 << 10},
+		{"darwin", "arm64", 64 << 30, 4 << 30, 64 << 20, 0x0013 << 28, 8 << 10},
+		{"windows", "amd64", 32 << 30, 2 << 30, 32 << 20, 0x00c0 << 32, 8 << 10},
+		{"linux", "riscv64", 128 << 30, 8 << 30, 128 << 20, 0x0010 << 32, 2 << 20},
+		{"linux", "loong64", 512 << 30, 32 << 30, 512 << 20, 0x00c0 << 32, 32 << 20},
+	}
+	for _, tt := range tests {
+		// The first two probes fail, the third one lands 4K past the hint,
+		// like an OS whose pages are smaller than ours.
+		var hints []uintptr
+		l := ReserveArena(tt.goos, tt.goarch, func(v unsafe.Pointer, n uintptr, reserved *bool) unsafe.Pointer {
+			hints = append(hints, uintptr(v))
+			if len(hints) < 3 {
+				return nil
+			}
+			*reserved = true
+			return unsafe.Pointer(uintptr(v) + 4096)
+		})
+		name := tt.goos + "/" + tt.goarch
+		arena, bitmap, spans, hint, align := uintptr(tt.arena), uintptr(tt.bitmap), uintptr(tt.spans), uintptr(tt.hint), uintptr(tt.align)
+		if l.BitmapSize != bitmap || l.SpansSize != spans {
+			t.Errorf("%s: bitmapSize=%#x spansSize=%#x, want %#x %#x", name, l.BitmapSize, l.SpansSize, bitmap, spans)
+		}
+		if want := bitmap + spans + ArenaChunk + align; l.PSize != want {
+			t.Errorf("%s: pSize=%#x, want %#x", name, l.PSize, want)
+		}
+		if l.Probes != 3 || len(hints) != 3 {
+			t.Fatalf("%s: probes=%d, want 3", name, l.Probes)
+		}
+		for i, h := range hints {
+			if want := uintptr(i)<<40 | hint; h != want || ArenaHint(i, tt.goos, tt.goarch) != want {
+				t.Errorf("%s: probe %d at %#x, want %#x", name, i, h, want)
+			}
+		}
+		if !l.Reserved {
+			t.Errorf("%s: reserved=false, want true", name)
+		}
+		if want := uintptr(len(hints)-1)<<40 | hint; l.Hint != want {
+			t.Errorf("%s: hint=%#x, want the third probe %#x", name, l.Hint, want)
+		}
+		if l.Spans&8191 != 0 || l.Spans < l.P {
+			t.Errorf("%s: spans=%#x not page aligned above p=%#x", name, l.Spans, l.P)
+		}
+		if l.ArenaStart%align != 0 {
+			t.Errorf("%s: arena_start=%#x not aligned to %#x", name, l.ArenaStart, align)
+		}
+		if l.Bitmap != l.Spans+spans || l.ArenaStart != l.Bitmap+bitmap {
+			t.Errorf("%s: bad layout spans=%#x bitmap=%#x arena_start=%#x", name, l.Spans, l.Bitmap, l.ArenaStart)
+		}
+		if l.ArenaEnd != l.P+l.PSize || l.ArenaEnd-l.ArenaStart < ArenaChunk {
+			t.Errorf("%s: first chunk [%#x, %#x) smaller than %#x", name, l.ArenaStart, l.ArenaEnd, ArenaChunk)
+		}
+		if l.ArenaLimit != l.ArenaStart+arena {
+			t.Errorf("%s: arena_limit=%#x, want %#x", name, l.ArenaLimit, l.ArenaStart+arena)
+		}
+	}
+}
+
+func TestArenaProbeBits(t *testing.T) {
+	if PtrSize != 8 {
+		t.Skip("arena size is only probed on 64-bit systems")
+	}
+	for _, tt := range []struct {
+		limit uint64 // largest reservation the fake OS allows
+		want  uintptr
+	}{
+		{5 << 30, 32},   // old devices: 4G arena plus 256M bitmap fits, 8G does not
+		{3 << 30, 31},   // 2G arena plus metadata
+		{1 << 30, 31},   // nothing fits, fall back to the smallest size
+		{100 << 30, 36}, // everything fits
+		{20 << 30, 34},
+	} {
+		var live, probes int
+		bits := ArenaProbeBits(31, 36, func(v unsafe.Pointer, n uintptr, reserved *bool) unsafe.Pointer {
+			probes++
+			if uint64(n) > tt.limit {
+				return nil
+			}
+			live++
+			*reserved = true
+			return unsafe.Pointer(uintptr(1 << 20))
+		}, func(v unsafe.Pointer, n uintptr) {
+			live--
+		})
+		if bits != tt.want {
+			t.Errorf("limit %#x: probed %d bits, want %d", tt.limit, bits, tt.want)
+		}
+		if live != 0 {
+			t.Errorf("limit %#x: %d probe reservations not released", tt.limit, live)
+		}
+		if probes > 3 {
+			t.Errorf("limit %#x: %d probes, want a binary search", tt.limit, probes)
+		}
+		if tt.want > 31 && uint64(ArenaFootprint(bits)) > tt.limit {
+			t.Errorf("limit %#x: footprint of %d bits is %#x", tt.limit, bits, ArenaFootprint(bits))
+		}
+	}
+}
+
+// When the arena probed at startup is smaller than _MaxMem, sizes it
+// cannot hold must be rejected by the size checks, not by an out of
+// memory throw in the allocator.
+func TestMaxMemSizeChecks(t *testing.T) {
+	old := SetMaxMem(1 << 20)
+	defer SetMaxMem(old)
+	n := 2 << 20
+	for _, tt := range []struct {
+		name string
+		f    func()
+		want string
+	}{
+		{"makeslice", func() { _ = make([]byte, n) }, "makeslice: len out of range"},
+		{"growslice", func() { _ = append([]byte(nil), make([]byte, n/4)...) }, ""},
+		{"makechan", func() { _ = make(chan [1024]byte, n/1024) }, "makechan: size out of range"},
+	} {
+		func() {
+			defer func() {
+				r := recover()
+				if tt.want == "" {
+					if r != nil {
+						t.Errorf("%s: unexpected panic %v", tt.name, r)
+					}
+					return
+				}
+				if r == nil || !strings.HasSuffix(fmt.Sprint(r), tt.want) {
+					t.Errorf("%s: got panic %v, want %q", tt.name, r, tt.want)
+				}
+			}()
+			tt.f()
+		}()
+	}
+}
+
+func TestNUMAChunks(t *testing.T) {
+	const c = HeapAllocChunk
+	base := uintptr(1 << 30)
+	for _, tt := range []struct {
+		v, n       uintptr
+		start, end uintptr
+	}{
+		{base, 2 * c, 0, 2},
+		{base + c/2, 2 * c, 1, 2}, // partial chunks at both ends keep their node
+		{base + c/2, 3*c + c/2, 1, 4},
+		{base + c/4, c / 2, 1, 1}, // inside one chunk: nothing is labeled
+	} {
+		start, end := NUMAChunks(base, tt.v, tt.n)
+		if start != tt.start || end != tt.end {
+			t.Errorf("NUMAChunks(%#x, %#x) = [%d, %d), want [%d, %d)", tt.v-base, tt.n, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestArenaHintASLR(t *testing.T) {
+	if PtrSize != 8 {
+		t.Skip("arena hints are only used on 64-bit systems")
+	}
+	const low40 = uint64(1)<<40 - 1
+	for _, seed := range []uint32{1, 0x12345678, 0xdeadbeef, 0xffffffff} {
+		off := uintptr(seed>>24) << 25
+		seen := make(map[uintptr]bool)
+		for i := 0; i < 0x80; i++ {
+			h := ArenaHintASLR(i, seed, "linux", "amd64")
+			base := h - off
+			if uint64(base)&low40 != 0x00c0<<32 {
+				t.Fatalf("seed %#x: hint %d = %#x, want 0x00c0<<32 plus %#x", seed, i, h, off)
+			}
+			if seen[base] {
+				t.Fatalf("seed %#x: hint %d = %#x tried twice", seed, i, h)
+			}
+			seen[base] = true
+		}
+		// darwin/arm64 only shuffles the order.
+		if h, want := ArenaHintASLR(0, seed, "darwin", "arm64"), ArenaHint(int(seed&0x7f), "darwin", "arm64"); h != want {
+			t.Errorf("seed %#x: darwin/arm64 hint %#x, want %#x", seed, h, want)
+		}
+	}
+}
+
+func TestReadReserveStats(t *testing.T) {
+	st := ReadReserveStats()
+	if st.ArenaProbes < 1 || st.HighProbes < 0 {
+		t.Errorf("ArenaProbes=%d, HighProbes=%d; want at least one arena probe", st.ArenaProbes, st.HighProbes)
+	}
+	if st.ReserveStart == 0 || st.ReserveSize == 0 {
+		t.Fatalf("no arena reservation recorded: %+v", st)
+	}
+	if !(st.ReserveStart <= st.SpansStart && st.SpansStart < st.BitmapStart && st.BitmapStart < st.ArenaStart &&
+		st.ArenaStart < st.ArenaEnd && st.ArenaEnd <= st.ArenaLimit) {
+		t.Errorf("arena geometry out of order: %+v", st)
+	}
+	if st.ReserveStart+st.ReserveSize != st.ArenaEnd {
+		t.Errorf("reservation [%#x, +%#x) does not end at arena_end %#x", st.ReserveStart, st.ReserveSize, st.ArenaEnd)
+	}
+	if PtrSize == 4 && !st.Arena32 {
+		t.Errorf("Arena32=false on a 32-bit system")
+	}
+	if st.HighCount > st.HighProbes && PtrSize == 8 {
+		t.Errorf("HighCount=%d > HighProbes=%d", st.HighCount, st.HighProbes)
+	}
+}
+
+func TestReserveArena32(t *testing.T) {
+	const maxArena32 = 2 << 30
+	ptrSize := uint64(PtrSize)
+	tests := []struct {
+		limit  uint64
+		fails  int // number of leading probes that fail
+		arena  uint64
+		bitmap uint64
+		spans  uint64
+		window uint64
+	}{
+		{0, 0, 512 << 20, maxArena32 / (ptrSize * 2), maxArena32 / 8192 * ptrSize, maxArena32},
+		{0, 1, 256 << 20, maxArena32 / (ptrSize * 2), maxArena32 / 8192 * ptrSize, maxArena32},
+		{0, 2, 128 << 20, maxArena32 / (ptrSize * 2), maxArena32 / 8192 * ptrSize, maxArena32},
+		{90 << 20, 0, (90 << 20) / 9 &^ 8191 * 8, (90 << 20) / 9 &^ 8191, ((90<<20)/9&^8191*8/8192*ptrSize + 8191) &^ 8191, (90 << 20) / 9 &^ 8191 * 8},
+	}
+	const end = 0x08123456
+	for i, tt := range tests {
+		var hints []uintptr
+		l := ReserveArena32(uintptr(tt.limit), end, func(v unsafe.Pointer, n uintptr, reserved *bool) unsafe.Pointer {
+			hints = append(hints, uintptr(v))
+			if len(hints) <= tt.fails {
+				return nil
+			}
+			return unsafe.Pointer(uintptr(v) + 4096)
+		})
+		arena, bitmap, spans := uintptr(tt.arena), uintptr(tt.bitmap), uintptr(tt.spans)
+		if l.BitmapSize != bitmap || l.SpansSize != spans {
+			t.Errorf("#%d: bitmapSize=%#x spansSize=%#x, want %#x %#x", i, l.BitmapSize, l.SpansSize, bitmap, spans)
+		}
+		if want := bitmap + spans + arena + 8192; l.PSize != want {
+			t.Errorf("#%d: pSize=%#x, want %#x", i, l.PSize, want)
+		}
+		if l.Probes != tt.fails+1 {
+			t.Errorf("#%d: probes=%d, want %d", i, l.Probes, tt.fails+1)
+		}
+		for _, h := range hints {
+			if h != 0x08200000 {
+				t.Errorf("#%d: probe at %#x, want 0x08200000", i, h)
+			}
+		}
+		if l.Spans&8191 != 0 || l.Bitmap != l.Spans+spans || l.ArenaStart != l.Bitmap+bitmap {
+			t.Errorf("#%d: bad layout spans=%#x bitmap=%#x arena_start=%#x", i, l.Spans, l.Bitmap, l.ArenaStart)
+		}
+		if l.ArenaEnd != l.P+l.PSize || l.ArenaEnd-l.ArenaStart < arena {
+			t.Errorf("#%d: arena [%#x, %#x) smaller than %#x", i, l.ArenaStart, l.ArenaEnd, arena)
+		}
+		if l.ArenaLimit != l.ArenaStart+uintptr(tt.window) {
+			t.Errorf("#%d: arena_limit=%#x, want %#x", i, l.ArenaLimit, l.ArenaStart+uintptr(tt.window))
+		}
+	}
+}
+
+var freeOSMemorySink [][]byte
+
+func TestFreeOSMemory(t *testing.T) {
+	if GOARCH == "ppc64" || GOARCH == "ppc64le" {
+		t.Skip("physical pages are larger than heap pages, scavenger is disabled")
+	}
+	for i := 0; i < 16; i++ {
+		freeOSMemorySink = append(freeOSMemorySink, make([]byte, 1<<20))
+	}
+	freeOSMemorySink = nil
+
+	released := FreeOSMemory()
+	if released < 16<<20 {
+		t.Errorf("FreeOSMemory released %d bytes, want at least %d", released, 16<<20)
+	}
+
+	// 1MB 的对象被 sweep 释放时会放进 largecache, FreeOSMemory 也要把它们还给 OS。
+	// 只有 4 个的话 sweep 之后可能全部留在 largecache 里。
+	for i := 0; i < 4; i++ {
+		freeOSMemorySink = append(freeOSMemorySink, make([]byte, 1<<20))
+	}
+	freeOSMemorySink = nil
+	if released := FreeOSMemory(); released < 4<<20 {
+		t.Errorf("FreeOSMemory released %d bytes of cached 1MB spans, want at least %d", released, 4<<20)
+	}
+	var st MemStats
+	ReadMemStats(&st)
+	if st.HeapReleased < released {
+		t.Errorf("HeapReleased=%d < released=%d", st.HeapReleased, released)
+	}
+	if st.HeapReleasedLazy > st.HeapReleased {
+		t.Errorf("HeapReleasedLazy=%d > HeapReleased=%d", st.HeapReleasedLazy, st.HeapReleased)
+	}
+}
+
+var tinySink []*[5]byte
+
+func TestTinyAllocStats(t *testing.T) {
+	var before, after MemStats
+	ReadMemStats(&before)
+	for i := 0; i < 1000; i++ {
+		tinySink = append(tinySink, new([5]byte))
+	}
+	ReadMemStats(&after)
+	tinySink = nil
+
+	blocks := after.TinyBlocks - before.TinyBlocks
+	bytes := after.TinyBytes - before.TinyBytes
+	if bytes < 5000 {
+		t.Errorf("TinyBytes grew by %d, want at least 5000", bytes)
+	}
+	// Three 5-byte objects fit in a block.
+	if blocks < 1000/3 {
+		t.Errorf("TinyBlocks grew by %d, want at least %d", blocks, 1000/3)
+	}
+	// Blocks taken before the first ReadMemStats may be filled afterwards.
+	if bytes > 16*(blocks+uint64(GOMAXPROCS(-1))) {
+		t.Errorf("TinyBytes grew by %d, more than fits in %d new blocks", bytes, blocks)
+	}
+	t.Logf("tiny allocator utilization: %d bytes in %d blocks (%.2f)", bytes, blocks, float64(bytes)/float64(16*blocks))
+}
+
+func TestCgoMemStats(t *testing.T) {
+	// Only the addresses are recorded, so Go memory stands in for C memory.
+	var blocks [3]uint64
+	p1 := unsafe.Pointer(&blocks[0])
+	p2 := unsafe.Pointer(&blocks[1])
+	var before, after MemStats
+	ReadMemStats(&before)
+	CgoTrackAlloc(p1, 100)
+	CgoTrackAlloc(p2, 200)
+	CgoTrackFree(p1)
+	CgoTrackFree(unsafe.Pointer(&blocks[2])) // not registered, ignored
+	ReadMemStats(&after)
+	if d := after.CgoAlloc - before.CgoAlloc; d != 200 {
+		t.Errorf("CgoAlloc grew by %d, want 200", d)
+	}
+	if d := after.CgoMallocs - before.CgoMallocs; d != 2 {
+		t.Errorf("CgoMallocs grew by %d, want 2", d)
+	}
+	if d := after.CgoFrees - before.CgoFrees; d != 1 {
+		t.Errorf("CgoFrees grew by %d, want 1", d)
+	}
+	CgoTrackFree(p2)
+}
+
+type allocHookT struct {
+	p *int
+	x [10]int
+}
+
+var allocHookSink *allocHookT
+
+func TestSetAllocHook(t *testing.T) {
+	var n, class int32
+	var size uintptr
+	SetAllocHook(func(sz uintptr, sizeclass int32, typ string, pc uintptr) {
+		if typ == "runtime_test.allocHookT" {
+			n++
+			size, class = sz, sizeclass
+		}
+	})
+	for i := 0; i < 10; i++ {
+		allocHookSink = new(allocHookT)
+	}
+	SetAllocHook(nil)
+	allocHookSink = new(allocHookT)
+	if n != 10 {
+		t.Errorf("hook saw %d allocations, want 10", n)
+	}
+	if want := unsafe.Sizeof(allocHookT{}); size != want || class == 0 {
+		t.Errorf("hook saw size=%d class=%d, want size=%d and a small size class", size, class, want)
+	}
+}
+
+var sizeClassSink [][]byte
+
+func TestReadSizeClassStats(t *testing.T) {
+	before := ReadSizeClassStats()
+	for i := 0; i < 100; i++ {
+		sizeClassSink = append(sizeClassSink, make([]byte, 1000))
+	}
+	sizeClassSink = append(sizeClassSink, make([]byte, 1<<20))
+	after := ReadSizeClassStats()
+	sizeClassSink = nil
+
+	if len(after) != len(before) || len(after) < 2 {
+		t.Fatalf("got %d and %d size classes", len(before), len(after))
+	}
+	if after[0].Size != 0 || after[0].Mallocs <= before[0].Mallocs {
+		t.Errorf("large objects: size=%d mallocs %d -> %d", after[0].Size, before[0].Mallocs, after[0].Mallocs)
+	}
+	var n uint64
+	for i := 1; i < len(after); i++ {
+		st := after[i]
+		if st.Size <= after[i-1].Size {
+			t.Errorf("class %d: size %d not above class %d size %d", i, st.Size, i-1, after[i-1].Size)
+		}
+		if st.Frees > st.Mallocs || st.InuseBytes != (st.Mallocs-st.Frees)*uint64(st.Size) {
+			t.Errorf("class %d: mallocs=%d frees=%d inuse=%d", i, st.Mallocs, st.Frees, st.InuseBytes)
+		}
+		if st.Size >= 1000 && (i == 1 || after[i-1].Size < 1000) {
+			n = st.Mallocs - before[i].Mallocs
+		}
+	}
+	if n < 100 {
+		t.Errorf("size class for 1000 bytes saw %d new mallocs, want at least 100", n)
+	}
+}
+
+func TestSizeClassLockStats(t *testing.T) {
+	defer GOMAXPROCS(GOMAXPROCS(4))
+	before := ReadSizeClassStats()
+	// 20000 objects of 1000 bytes take a few hundred spans, each one
+	// fetched from the mcentral under its lock.
+	done := make(chan [][]byte)
+	for g := 0; g < 4; g++ {
+		go func() {
+			var keep [][]byte
+			for i := 0; i < 5000; i++ {
+				keep = append(keep, make([]byte, 1000))
+			}
+			done <- keep
+		}()
+	}
+	for g := 0; g < 4; g++ {
+		sizeClassSink = append(sizeClassSink, <-done...)
+	}
+	after := ReadSizeClassStats()
+	sizeClassSink = nil
+
+	for i := 1; i < len(after); i++ {
+		st := after[i]
+		if st.LockContended > st.LockAcquires || st.LockWaitNs < 0 {
+			t.Errorf("class %d: acquires=%d contended=%d wait=%dns", i, st.LockAcquires, st.LockContended, st.LockWaitNs)
+		}
+		if st.LockAcquires < before[i].LockAcquires {
+			t.Errorf("class %d: lock acquisitions went down from %d to %d", i, before[i].LockAcquires, st.LockAcquires)
+		}
+		if st.Size >= 1000 && after[i-1].Size < 1000 {
+			if d := st.LockAcquires - before[i].LockAcquires; d < 100 {
+				t.Errorf("size class for 1000 bytes saw %d lock acquisitions, want at least 100", d)
+			}
+			t.Logf("size class %d: %d acquisitions, %d contended, %dns waiting", st.Size,
+				st.LockAcquires-before[i].LockAcquires, st.LockContended-before[i].LockContended, st.LockWaitNs-before[i].LockWaitNs)
+		}
+	}
+}
+
+type pAllocT struct {
+	p *int
+	n [7]int
+}
+
+var pAllocSink []*pAllocT
+
+func TestReadPAllocStats(t *testing.T) {
+	sum := func(stats []PAllocStats) (s PAllocStats) {
+		for _, st := range stats {
+			s.Mallocs += st.Mallocs
+			s.AllocBytes += st.AllocBytes
+			s.ScanBytes += st.ScanBytes
+		}
+		return
+	}
+	before := ReadPAllocStats()
+	for i := 0; i < 100; i++ {
+		pAllocSink = append(pAllocSink, new(pAllocT))
+	}
+	after := ReadPAllocStats()
+	pAllocSink = nil
+
+	if len(after) != GOMAXPROCS(-1) {
+		t.Errorf("got %d Ps, want %d", len(after), GOMAXPROCS(-1))
+	}
+	for i, st := range after {
+		if st.ID != int32(i) || st.TinyAllocs > st.Mallocs || st.ScanBytes > st.AllocBytes {
+			t.Errorf("P %d: %+v", i, st)
+		}
+	}
+	b, a := sum(before), sum(after)
+	if a.Mallocs < b.Mallocs+100 {
+		t.Errorf("mallocs %d -> %d, want at least 100 more", b.Mallocs, a.Mallocs)
+	}
+	if n := 100 * uint64(unsafe.Sizeof(pAllocT{})); a.AllocBytes < b.AllocBytes+n {
+		t.Errorf("alloc bytes %d -> %d, want at least %d more", b.AllocBytes, a.AllocBytes, n)
+	}
+	if a.ScanBytes < b.ScanBytes+100*uint64(PtrSize) {
+		t.Errorf("scan bytes %d -> %d, want at least %d more", b.ScanBytes, a.ScanBytes, 100*PtrSize)
+	}
+}
+
+var pAllocTinySink [4000]*byte
+
+// Tiny objects count the bytes they ask for whether or not they start a
+// new tiny block, so 4000 one-byte objects are about 4000 bytes, not the
+// 16 bytes of every block they start on top.
+func TestPAllocStatsTiny(t *testing.T) {
+	sum := func(stats []PAllocStats) (n uint64) {
+		for _, st := range stats {
+			n += st.AllocBytes
+		}
+		return
+	}
+	// ReadPAllocStats allocates its result; measure that first.
+	first := sum(ReadPAllocStats())
+	before := sum(ReadPAllocStats())
+	overhead := before - first
+	for i := range pAllocTinySink {
+		pAllocTinySink[i] = new(byte)
+	}
+	after := sum(ReadPAllocStats())
+	pAllocTinySink = [4000]*byte{}
+
+	n := uint64(len(pAllocTinySink))
+	if got := after - before - overhead; got < n || got > n+n/2 {
+		t.Errorf("alloc bytes grew by %d for %d one-byte objects", got, n)
+	}
+}
+
+type allocSampleT struct {
+	p *int
+	n [100]int
+}
+
+var allocSampleSink []*allocSampleT
+
+func TestAllocSamples(t *testing.T) {
+	old := SetAllocSampleRate(1)
+	defer SetAllocSampleRate(old)
+	buf := make([]AllocSample, 512)
+	ReadAllocSamples(buf) // drain
+
+	for i := 0; i < 10; i++ {
+		allocSampleSink = append(allocSampleSink, new(allocSampleT))
+	}
+	SetAllocSampleRate(0)
+	allocSampleSink = nil
+
+	n, _ := ReadAllocSamples(buf)
+	found := 0
+	for _, s := range buf[:n] {
+		if s.Type != "runtime_test.allocSampleT" {
+			continue
+		}
+		found++
+		if s.Size < unsafe.Sizeof(allocSampleT{}) {
+			t.Errorf("sample size %d, want at least %d", s.Size, unsafe.Sizeof(allocSampleT{}))
+		}
+		if len(s.Stack()) == 0 {
+			t.Errorf("sample has no stack")
+		}
+	}
+	if found < 10 {
+		t.Errorf("found %d samples of allocSampleT in %d samples, want 10", found, n)
+	}
+	if n, _ := ReadAllocSamples(buf); n != 0 {
+		t.Errorf("ReadAllocSamples returned %d samples after drain", n)
+	}
+}
+
+var largeCacheSink []byte
+
+func TestLargeCacheReuseZeroed(t *testing.T) {
+	const size = 64 << 10
+	for i := 0; i < 10; i++ {
+		b := make([]byte, size)
+		for j := range b {
+			if b[j] != 0 {
+				t.Fatalf("round %d: byte %d of a new large object is %#x", i, j, b[j])
+			}
+			b[j] = 0xff
+		}
+		largeCacheSink = b
+		largeCacheSink = nil
+		GC()
+	}
+}
+
+func TestPersistentRegion(t *testing.T) {
+	r := NewPersistentRegion()
+	var ps []unsafe.Pointer
+	for i := 0; i < 10000; i++ {
+		align := uintptr(1) << uint(i%5)
+		p := r.Alloc(uintptr(1+i%100), align)
+		if uintptr(p)%align != 0 {
+			t.Fatalf("Alloc(%d, %d) = %p, not aligned", 1+i%100, align, p)
+		}
+		*(*byte)(p) = 0xff
+		ps = append(ps, p)
+	}
+	big := r.Alloc(1<<20, 0)
+	*(*byte)(unsafe.Pointer(uintptr(big) + 1<<20 - 1)) = 0xff
+	if r.Sys() < 1<<20+100*10000/2 {
+		t.Errorf("region holds %d bytes, want more", r.Sys())
+	}
+
+	r.Reset()
+	if r.Sys() == 0 || r.Sys() > 256<<10 {
+		t.Errorf("after Reset region holds %d bytes, want one chunk", r.Sys())
+	}
+	for i := 0; i < 1000; i++ {
+		p := r.Alloc(64, 8)
+		for j := uintptr(0); j < 64; j++ {
+			if b := *(*byte)(unsafe.Pointer(uintptr(p) + j)); b != 0 {
+				t.Fatalf("byte %d of reused memory is %#x", j, b)
+			}
+		}
+		*(*byte)(p) = 0xff
+	}
+
+	r.Free()
+	if r.Sys() != 0 {
+		t.Errorf("after Free region holds %d bytes", r.Sys())
+	}
+	// A freed region can be used again.
+	*(*byte)(r.Alloc(8, 0)) = 1
+	r.Free()
+}
+
+func TestReadPersistentAllocStats(t *testing.T) {
+	otherSys := func(s PersistentAllocStats) PersistentAllocSys {
+		for _, x := range s.BySys {
+			if x.Name == "OtherSys" {
+				return x
+			}
+		}
+		t.Fatalf("no OtherSys in %+v", s.BySys)
+		return PersistentAllocSys{}
+	}
+	before := ReadPersistentAllocStats()
+	for i := 0; i < 100; i++ {
+		PersistentAlloc(48)
+	}
+	PersistentAlloc(128 << 10)
+	after := ReadPersistentAllocStats()
+
+	b, a := otherSys(before), otherSys(after)
+	if a.Allocs < b.Allocs+101 || a.Bytes < b.Bytes+100*48+128<<10 {
+		t.Errorf("OtherSys went from %+v to %+v, want at least 101 allocations of %d bytes", b, a, 100*48+128<<10)
+	}
+	if after.Large < before.Large+1 || after.LargeBytes < before.LargeBytes+128<<10 {
+		t.Errorf("large allocations went from %d (%d bytes) to %d (%d bytes)", before.Large, before.LargeBytes, after.Large, after.LargeBytes)
+	}
+	if after.Chunks == 0 || after.ChunkBytes < after.Chunks*16<<10 {
+		t.Errorf("%d chunks of %d bytes in total", after.Chunks, after.ChunkBytes)
+	}
+	var total uint64
+	for _, x := range after.BySys {
+		total += x.Bytes
+	}
+	if total > after.ChunkBytes+after.LargeBytes {
+		t.Errorf("%d bytes allocated from %d bytes of chunks and %d large bytes", total, after.ChunkBytes, after.LargeBytes)
+	}
+}
+
+func TestRawFree(t *testing.T) {
+	for _, size := range []uintptr{16, 1000, 100 << 10} {
+		GC()
+		reused := 0
+		for i := 0; i < 100; i++ {
+			p := RawMem(size)
+			*(*byte)(p) = 1
+			RawFree(p, size)
+			q := RawMem(size)
+			if q == p {
+				reused++
+			}
+			RawFree(q, size)
+		}
+		// GC may run concurrently and rawfree then leaves the memory to it,
+		// but most of the frees should be reused right away.
+		if reused == 0 {
+			t.Errorf("size %d: freed memory never reused", size)
+		}
+	}
+}
+
+// Freeing every object of the span cached by this P must not leave a
+// cached span with no objects in use, which uncaching it at the next GC
+// would reject.
+func TestRawFreeCachedSpan(t *testing.T) {
+	const size = 1024
+	for i := 0; i < 10; i++ {
+		ps := make([]unsafe.Pointer, 100)
+		for j := range ps {
+			ps[j] = RawMem(size)
+		}
+		// The last objects come from the span this P has cached, free them first.
+		for j := len(ps) - 1; j >= 0; j-- {
+			RawFree(ps[j], size)
+		}
+		GC()
+	}
+}
+
+func TestRawFreeProfile(t *testing.T) {
+	defer func(old int) { MemProfileRate = old }(MemProfileRate)
+	MemProfileRate = 1
+	for i := 0; i < 100; i++ {
+		p := RawMem(1000)
+		RawFree(p, 1000)
+	}
+	MemProfileRate = 0
+	// Frees show up in the profile after two GCs, like allocations.
+	GC()
+	GC()
+
+	var p []MemProfileRecord
+	n, ok := MemProfile(nil, true)
+	for !ok {
+		p = make([]MemProfileRecord, n+50)
+		n, ok = MemProfile(p, true)
+	}
+	for _, r := range p[:n] {
+		for _, pc := range r.Stack() {
+			if f := FuncForPC(pc); f != nil && f.Name() == "runtime_test.TestRawFreeProfile" {
+				if r.FreeObjects == 0 || r.FreeObjects > r.AllocObjects {
+					t.Errorf("profile has %d allocs and %d frees, want frees for rawfree", r.AllocObjects, r.FreeObjects)
+				}
+				return
+			}
+		}
+	}
+	t.Errorf("no profile record for RawMem")
+}
+
+var allocFaultSink []byte
+
+func TestAllocFault(t *testing.T) {
+	defer SetAllocFault(AllocFault{})
+
+	// The third allocation of at least 1000 bytes panics.
+	SetAllocFault(AllocFault{Sites: AllocFaultMalloc, Nth: 3, MinSize: 1000, Panic: true, Goroutine: true})
+	before := AllocFaults()
+	failed := -1
+	for i := 0; i < 5 && failed < 0; i++ {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					if _, ok := r.(Error); !ok {
+						t.Errorf("panic value %v is not a runtime.Error", r)
+					}
+					failed = i
+				}
+			}()
+			allocFaultSink = make([]byte, 1000)
+			allocFaultSink = make([]byte, 10) // too small to count
+		}()
+	}
+	SetAllocFault(AllocFault{})
+	if failed != 2 {
+		t.Errorf("allocation %d failed, want 2", failed)
+	}
+	if n := AllocFaults() - before; n != 1 {
+		t.Errorf("%d faults injected, want 1", n)
+	}
+}
+
+func TestSysAllocRetry(t *testing.T) {
+	var st MemStats
+	ReadMemStats(&st)
+	size := st.HeapIdle + 16<<20
+	if size > 256<<20 {
+		t.Skipf("heap has %d idle bytes, growing it would take too much memory", st.HeapIdle)
+	}
+	// The first try to grow the heap fails, the retry succeeds.
+	defer SetAllocFault(AllocFault{})
+	SetAllocFault(AllocFault{Sites: AllocFaultSys, Nth: 1, Goroutine: true})
+	before := AllocFaults()
+	allocFaultSink = make([]byte, size)
+	SetAllocFault(AllocFault{})
+	allocFaultSink = nil
+	if n := AllocFaults() - before; n != 1 {
+		t.Errorf("%d faults injected, want 1", n)
+	}
+}
+
+func TestOOMHandler(t *testing.T) {
+	var st MemStats
+	ReadMemStats(&st)
+	size := st.HeapIdle + 16<<20
+	if size > 256<<20 {
+		t.Skipf("heap has %d idle bytes, growing it would take too much memory", st.HeapIdle)
+	}
+	// Growing the heap fails until the handler "frees memory" by
+	// turning fault injection off.
+	var calls int
+	var asked uintptr
+	defer SetOOMHandler(SetOOMHandler(func(n uintptr) bool {
+		calls++
+		asked = n
+		SetAllocFault(AllocFault{})
+		return true
+	}))
+	defer SetAllocFault(AllocFault{})
+	SetAllocFault(AllocFault{Sites: AllocFaultSys, Goroutine: true})
+	allocFaultSink = make([]byte, size)
+	allocFaultSink = nil
+	if calls != 1 || uint64(asked) < size {
+		t.Errorf("handler called %d times for %d bytes, want once for %d bytes", calls, asked, size)
+	}
+}
+
+func TestArena(t *testing.T) {
+	type point struct {
+		x, y int64
+		tag  byte
+	}
+	a := NewArena()
+	var pts []*point
+	for i := 0; i < 10000; i++ {
+		p := (*point)(a.New(point{}))
+		if uintptr(unsafe.Pointer(p))%unsafe.Alignof(*p) != 0 {
+			t.Fatalf("object %d at %p is not aligned", i, p)
+		}
+		if p.x != 0 || p.y != 0 || p.tag != 0 {
+			t.Fatalf("object %d is not zeroed: %+v", i, *p)
+		}
+		p.x, p.y, p.tag = int64(i), int64(-i), byte(i)
+		pts = append(pts, p)
+	}
+	big := (*[1 << 20]byte)(a.NewArray(byte(0), 1<<20))
+	big[len(big)-1] = 1
+
+	// The garbage collector leaves arena memory alone.
+	GC()
+	for i, p := range pts {
+		if p.x != int64(i) || p.y != int64(-i) || p.tag != byte(i) {
+			t.Fatalf("object %d changed to %+v", i, *p)
+		}
+	}
+	if n := a.Size(); n < 10000*unsafe.Sizeof(point{})+1<<20 {
+		t.Errorf("arena size %d is too small", n)
+	}
+
+	a.Free()
+	if n := a.Size(); n != 0 {
+		t.Errorf("arena size %d after Free, want 0", n)
+	}
+	// The arena can be used again.
+	if p := (*point)(a.New(point{})); p.x != 0 || p.y != 0 {
+		t.Errorf("object after Free is not zeroed: %+v", *p)
+	}
+	a.Free()
+
+	func() {
+		defer func() {
+			if _, ok := recover().(Error); !ok {
+				t.Errorf("arena allocation of a type with pointers did not panic with a runtime.Error")
+			}
+		}()
+		a.New(&point{})
+	}()
+}
+
+func TestMallocPoison(t *testing.T) {
+	for _, words := range []uintptr{2, 3, 8} {
+		buf := make([]uintptr, words)
+		buf[0] = 1 // freelist link, not poisoned
+		p := unsafe.Pointer(&buf[0])
+		MallocPoison(uintptr(p), words*PtrSize)
+		for i := 1; i < len(buf); i++ {
+			if buf[i] == 0 {
+				t.Fatalf("%d words: word %d not poisoned", words, i)
+			}
+		}
+		if buf[0] != 1 {
+			t.Errorf("%d words: freelist link overwritten", words)
+		}
+		MallocPoisonCheck(p, words*PtrSize)
+		if words == 2 && buf[1] != 0 {
+			t.Errorf("2 words: second word %#x not cleared after check", buf[1])
+		}
+	}
+}
+
+func TestCheckZeroOffset(t *testing.T) {
+	buf := make([]byte, 40)
+	if off := CheckZeroOffset(unsafe.Pointer(&buf[0]), uintptr(len(buf))); off != uintptr(len(buf)) {
+		t.Fatalf("zero buffer: got offset %d, want %d", off, len(buf))
+	}
+	for _, i := range []int{0, 7, 8, 20, 39} {
+		buf[i] = 1
+		if off := CheckZeroOffset(unsafe.Pointer(&buf[0]), uintptr(len(buf))); off != uintptr(i) {
+			t.Errorf("byte %d set: got offset %d", i, off)
+		}
+		buf[i] = 0
+	}
+}
+
+var checkZeroSink []interface{}
+
+func TestCheckZero(t *testing.T) {
+	old := SetCheckZero(true)
+	defer SetCheckZero(old)
+	// Fill objects of every kind with garbage, free them and allocate
+	// again, so that reused memory goes through the delayed zeroing.
+	for round := 0; round < 4; round++ {
+		for _, n := range []int{1, 8, 16, 24, 100, 1000, 5000, 40000} {
+			for i := 0; i < 64; i++ {
+				b := make([]byte, n)
+				for j := range b {
+					b[j] = 0xff
+				}
+				checkZeroSink = append(checkZeroSink, b, make([]*byte, n/8+1))
+			}
+		}
+		checkZeroSink = nil
+		GC()
+	}
+}
+
+func TestSetHeapLimit(t *testing.T) {
+	old := SetHeapLimit(1 << 40)
+	defer SetHeapLimit(old)
+	// A limit far above the live heap must not get in the way.
+	for i := 0; i < 16; i++ {
+		freeOSMemorySink = append(freeOSMemorySink, make([]byte, 1<<20))
+	}
+	freeOSMemorySink = nil
+	if got := SetHeapLimit(old); got != 1<<40 {
+		t.Errorf("SetHeapLimit returned %d, want %d", got, uint64(1<<40))
+	}
+}
+
+var rssWatchSink []byte
+
+func TestRSSWatchdog(t *testing.T) {
+	// Any process is over a limit of one byte, so every large allocation
+	// makes the watchdog act: scavenge, collect, scavenge again...
+	old := SetRSSWatchdog(1)
+	defer SetRSSWatchdog(old)
+	before := ReadRSSWatchdogStats()
+	for i := 0; i < 100; i++ {
+		rssWatchSink = make([]byte, 64<<10)
+		after := ReadRSSWatchdogStats()
+		if after.GCs > before.GCs && after.Scavenges > before.Scavenges {
+			break
+		}
+		Gosched()
+	}
+	rssWatchSink = nil
+	if got := SetRSSWatchdog(0); got != 1 {
+		t.Errorf("SetRSSWatchdog returned %d, want 1", got)
+	}
+	after := ReadRSSWatchdogStats()
+	if after.Over <= before.Over {
+		t.Errorf("watchdog never found the process over the limit: %+v", after)
+	}
+	if after.GCs <= before.GCs || after.Scavenges <= before.Scavenges {
+		t.Errorf("watchdog went from %+v to %+v, want at least one GC and one scavenge", before, after)
+	}
+
+	// Disabled, it does nothing.
+	before = ReadRSSWatchdogStats()
+	for i := 0; i < 10; i++ {
+		rssWatchSink = make([]byte, 64<<10)
+	}
+	rssWatchSink = nil
+	if after := ReadRSSWatchdogStats(); after != before {
+		t.Errorf("disabled watchdog went from %+v to %+v", before, after)
+	}
+}
+
 func TestStringConcatenationAllocs(t *testing.T) {
 	n := testing.AllocsPerRun(1e3, func() {
 		b := make([]byte, 10)
@@ -124,6 +1103,48 @@ func BenchmarkMallocTypeInfo16(b *testing.B) {
 	mallocSink = x
 }
 
+func BenchmarkMallocTiny(b *testing.B) {
+	var x uintptr
+	for i := 0; i < b.N; i++ {
+		p := new(int32)
+		x ^= uintptr(unsafe.Pointer(p))
+	}
+	mallocSink = x
+}
+
+func BenchmarkMalloc128(b *testing.B) {
+	var x uintptr
+	for i := 0; i < b.N; i++ {
+		p := new([16]int64)
+		x ^= uintptr(unsafe.Pointer(p))
+	}
+	mallocSink = x
+}
+
+func BenchmarkMalloc1K(b *testing.B) {
+	var x uintptr
+	for i := 0; i < b.N; i++ {
+		p := new([128]int64)
+		x ^= uintptr(unsafe.Pointer(p))
+	}
+	mallocSink = x
+}
+
+func benchmarkMallocPrefetch(b *testing.B, mode int) {
+	old := SetAllocPrefetch(mode)
+	defer SetAllocPrefetch(old)
+	var x uintptr
+	for i := 0; i < b.N; i++ {
+		p := new([8]int64)
+		x ^= uintptr(unsafe.Pointer(p))
+	}
+	mallocSink = x
+}
+
+func BenchmarkMallocPrefetchNTA(b *testing.B)  { benchmarkMallocPrefetch(b, AllocPrefetchNTA) }
+func BenchmarkMallocPrefetchT0(b *testing.B)   { benchmarkMallocPrefetch(b, AllocPrefetchT0) }
+func BenchmarkMallocPrefetchNone(b *testing.B) { benchmarkMallocPrefetch(b, AllocPrefetchNone) }
+
 type LargeStruct struct {
 	x [16][]byte
 }
@@ -223,3 +1244,192 @@ func BenchmarkGoroutineIdle(b *testing.B) {
 	close(quit)
 	time.Sleep(10 * time.Millisecond)
 }
+
+func TestWriteHeapLayout(t *testing.T) {
+	f, err := ioutil.TempFile("", "heaplayout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	WriteHeapLayout(f.Fd())
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(f)
+	hdr, err := r.ReadString('\n')
+	if err != nil || hdr != "go1.5 heap layout\n" {
+		t.Fatalf("bad header %q, %v", hdr, err)
+	}
+	read := func(n int) []uint64 {
+		v := make([]uint64, n)
+		for i := range v {
+			if v[i], err = binary.ReadUvarint(r); err != nil {
+				t.Fatalf("truncated layout: %v", err)
+			}
+		}
+		return v
+	}
+	var arena []uint64
+	spans := make(map[uint64][]uint64)
+	var mapped uint64
+	var central []uint64
+	for {
+		switch tag := read(1)[0]; tag {
+		case 0:
+			if arena == nil || len(spans) == 0 {
+				t.Fatalf("layout without arena or spans")
+			}
+			if want := (arena[1] - arena[0]) / arena[4]; mapped != want {
+				t.Errorf("spans array covers %d pages, want %d", mapped, want)
+			}
+			for _, base := range central {
+				if s := spans[base]; s == nil || s[2] != 0 || s[3] == 0 {
+					t.Errorf("mcentral span %#x is not an in-use small object span", base)
+				}
+			}
+			return
+		case 1:
+			arena = read(5)
+		case 2:
+			s := read(10)
+			spans[s[0]] = s
+		case 3:
+			run := read(3)
+			if run[0] != mapped {
+				t.Fatalf("spans run starts at page %d, want %d", run[0], mapped)
+			}
+			if base := run[2]; base != 0 && spans[base] == nil {
+				t.Errorf("spans array points to unknown span %#x", base)
+			}
+			mapped += run[1]
+		case 4:
+			n := read(3)[2]
+			central = append(central, read(int(n))...)
+		default:
+			t.Fatalf("unknown tag %d", tag)
+		}
+	}
+}
+
+var flushMCacheSink [][]byte
+
+func TestFlushMCache(t *testing.T) {
+	// Stay on one P between flushing and looking at its cache.
+	defer GOMAXPROCS(GOMAXPROCS(1))
+	for size := 8; size <= 64<<10; size *= 2 {
+		flushMCacheSink = append(flushMCacheSink, make([]byte, size))
+	}
+	FlushMCache()
+	if spans, stack := MCacheCached(); spans != 0 || stack != 0 {
+		t.Errorf("after FlushMCache: %d spans and %d stack bytes cached", spans, stack)
+	}
+	for size := 8; size <= 64<<10; size *= 2 {
+		flushMCacheSink = append(flushMCacheSink, make([]byte, size))
+	}
+	FlushMCaches()
+	if spans, stack := MCacheCached(); spans != 0 || stack != 0 {
+		t.Errorf("after FlushMCaches: %d spans and %d stack bytes cached", spans, stack)
+	}
+	// The caches refill as usual.
+	flushMCacheSink = append(flushMCacheSink, make([]byte, 128))
+	if spans, _ := MCacheCached(); spans == 0 {
+		t.Errorf("allocation did not refill the mcache")
+	}
+	flushMCacheSink = nil
+}
+
+var verifyHeapSink [][]byte
+
+func TestVerifyHeap(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		verifyHeapSink = append(verifyHeapSink, make([]byte, 8+i%300), make([]byte, i<<6))
+		if i%3 == 0 {
+			verifyHeapSink[i/2] = nil
+		}
+	}
+	if msg := VerifyHeapErr(nil); msg != "" {
+		t.Fatalf("healthy heap: %s", msg)
+	}
+	GC()
+	if msg := VerifyHeapErr(nil); msg != "" {
+		t.Fatalf("healthy heap after GC: %s", msg)
+	}
+	VerifyHeap()
+
+	obj := make([]byte, 100)
+	verifyHeapSink = append(verifyHeapSink, obj)
+	if msg := VerifyHeapErr(unsafe.Pointer(&obj[0])); msg == "" {
+		t.Errorf("span with a wrong ref count passed verification")
+	} else {
+		t.Logf("span with a wrong ref count: %s", msg)
+	}
+	verifyHeapSink = nil
+}
+
+var largeObjSink []byte
+
+func readLargeObjects() []LargeObject {
+	var p []LargeObject
+	for {
+		n, ok := ReadLargeObjects(p)
+		if ok {
+			return p[:n]
+		}
+		p = make([]LargeObject, n+10)
+	}
+}
+
+func TestReadLargeObjects(t *testing.T) {
+	largeObjSink = make([]byte, 100<<10)
+	addr := uintptr(unsafe.Pointer(&largeObjSink[0]))
+	found := false
+	for _, o := range readLargeObjects() {
+		if o.Addr != addr {
+			continue
+		}
+		found = true
+		if o.Size < 100<<10 {
+			t.Errorf("large object %#x has size %d, want at least %d", addr, o.Size, 100<<10)
+		}
+		if o.Type != "uint8" {
+			t.Errorf("large object %#x has type %q, want uint8", addr, o.Type)
+		}
+		if len(o.Stack()) == 0 {
+			t.Errorf("large object %#x has no allocation stack", addr)
+		}
+	}
+	if !found {
+		t.Fatalf("large object %#x not reported", addr)
+	}
+
+	largeObjSink = nil
+	GC()
+	GC()
+	for _, o := range readLargeObjects() {
+		if o.Addr == addr {
+			t.Errorf("freed large object %#x still reported", addr)
+		}
+	}
+}
+
+// 把 heap 扩大到超过第一个 chunk, 新 chunk 和第一个 chunk 剩下的部分 reserve 的方式可能不同。
+func TestHeapGrowPastArenaChunk(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	var keep [][]byte
+	var ms MemStats
+	ReadMemStats(&ms)
+	for want := ms.HeapSys + 2*ArenaChunk; ms.HeapSys < want; ReadMemStats(&ms) {
+		b := make([]byte, 1<<20)
+		b[0], b[len(b)-1] = 1, 1
+		keep = append(keep, b)
+	}
+	for i, b := range keep {
+		if b[0] != 1 || b[len(b)-1] != 1 {
+			t.Fatalf("block %d lost its contents", i)
+		}
+	}
+}
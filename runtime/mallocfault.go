@@ -0,0 +1,111 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Allocation fault injection.
+//
+// 真正的内存不足很难在测试里制造出来，sysAlloc 失败的时候 runtime 直接 throw，
+// 所以 out of memory 的处理路径平时都测试不到。SetAllocFault 可以让某一类分配按照
+// 指定的规则失败：从现在开始的第 N 次、随机的 1/N、或者不小于某个大小的分配。
+//
+//	AllocFaultMalloc     mallocgc 失败, throw "out of memory", 或者 panic 一个 runtime.Error
+//	AllocFaultPersistent persistentalloc 失败, throw "out of memory": 调用者都不检查 nil, 返回 nil 只会变成 SIGSEGV
+//	AllocFaultSys        mHeap_SysAlloc 返回 nil, 走 mHeap_Grow 真正的 out of memory 处理
+//
+// mallocgc 只在普通的 goroutine 上而且没有持有锁的时候才 panic，其他情况还是 throw。
+// 规则是全局的, GC 和后台 sweep 自己的分配也会受影响。测试里设置 Goroutine,
+// 只让调用 SetAllocFault 的 goroutine 的分配失败(system stack 上的分配按 m.curg 算)。
+
+package runtime
+
+import "unsafe"
+
+// Allocation sites for fault injection, see AllocFault.
+const (
+	AllocFaultMalloc     = 1 << iota // heap allocations in mallocgc
+	AllocFaultPersistent             // persistentalloc, for runtime metadata
+	AllocFaultSys                    // growing the heap with memory from the OS
+)
+
+// AllocFault describes which allocations SetAllocFault makes fail.
+// An allocation fails if it happens at one of Sites, is at least MinSize
+// bytes, and Nth or OneIn selects it. If both Nth and OneIn are zero,
+// every matching allocation fails.
+type AllocFault struct {
+	Sites   int     // AllocFaultMalloc, AllocFaultPersistent, AllocFaultSys or'ed together; 0 disables
+	Nth     uint64  // fail only the Nth matching allocation after SetAllocFault, counting from 1
+	OneIn   uint32  // fail a random one in OneIn matching allocations
+	MinSize uintptr // ignore allocations smaller than MinSize bytes
+	Panic   bool    // make mallocgc panic with a runtime.Error instead of throwing
+
+	// Goroutine restricts the policy to allocations made by the
+	// goroutine that calls SetAllocFault.
+	Goroutine bool
+}
+
+var allocFault struct {
+	AllocFault
+	count uint64  // 匹配的分配次数, 原子操作
+	fired uint64  // 已经注入的失败次数, 原子操作
+	gp    uintptr // Goroutine 时是调用 SetAllocFault 的 g, 否则是 0
+}
+
+// SetAllocFault installs the fault injection policy f and returns the
+// previous one. The zero AllocFault turns fault injection off.
+// Like SetAllocHook, it is not synchronized with running allocations
+// and should be called while the program is quiescent.
+func SetAllocFault(f AllocFault) AllocFault {
+	old := allocFault.AllocFault
+	allocFault.AllocFault = f
+	allocFault.gp = 0
+	if f.Goroutine {
+		allocFault.gp = uintptr(unsafe.Pointer(getg()))
+	}
+	atomicstore64(&allocFault.count, 0)
+	return old
+}
+
+// AllocFaults returns the number of allocation failures injected so far.
+func AllocFaults() uint64 {
+	return atomicload64(&allocFault.fired)
+}
+
+// allocFaultError is the panic value of an injected mallocgc failure.
+var allocFaultError = error(errorString("out of memory (injected by SetAllocFault)"))
+
+// allocShouldFail 判断 site 上这次 size 大小的分配是否要失败。
+// 不能分配内存，不能加锁，在 system stack 上也可以调用。
+func allocShouldFail(site int, size uintptr) bool {
+	f := &allocFault.AllocFault
+	if f.Sites&site == 0 || size < f.MinSize {
+		return false
+	}
+	if allocFault.gp != 0 && allocFault.gp != uintptr(unsafe.Pointer(getg().m.curg)) {
+		return false
+	}
+	n := xadd64(&allocFault.count, 1)
+	if f.Nth != 0 && n != f.Nth {
+		return false
+	}
+	if f.OneIn != 0 && fastrand1()%f.OneIn != 0 {
+		return false
+	}
+	xadd64(&allocFault.fired, 1)
+	return true
+}
+
+// mallocFault 处理 mallocgc 中注入的失败。
+func mallocFault(size uintptr) {
+	gp := getg()
+	if allocFault.Panic && gp != gp.m.g0 && gp.m.locks == 0 && gp.m.mallocing == 0 {
+		panic(allocFaultError)
+	}
+	print("runtime: injected allocation failure of ", size, " bytes\n")
+	throw("out of memory")
+}
+
+// persistentallocFault 处理 persistentalloc 中注入的失败。
+func persistentallocFault(size uintptr) {
+	print("runtime: injected persistentalloc failure of ", size, " bytes\n")
+	throw("out of memory")
+}
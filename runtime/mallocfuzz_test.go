@@ -0,0 +1,221 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime_test
+
+import (
+	"flag"
+	. "runtime"
+	"sort"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// Randomized checks of the allocation entry points. Sizes come from a
+// list of edge cases around the size classes and the tiny, small and
+// large boundaries, and from a seeded generator, so a failure can be
+// reproduced with -mallocfuzz.seed.
+
+var (
+	mallocFuzzSeed = flag.Uint64("mallocfuzz.seed", 1, "seed of the allocator fuzz tests")
+	mallocFuzzN    = flag.Int("mallocfuzz.n", 20000, "number of sizes tried by the allocator fuzz tests")
+)
+
+var mallocFuzzEdges = []uintptr{
+	0, 1, 7, 8, 9, 15, 16, 17, 31, 32, 33,
+	1016, 1017, 1023, 1024, 1025, 2047, 2048, 2049,
+	MaxSmallSize - 1, MaxSmallSize, MaxSmallSize + 1,
+	HeapPageSize - 1, HeapPageSize, HeapPageSize + 1,
+	2*MaxSmallSize - 1, 2 * MaxSmallSize, 1<<20 + 1,
+}
+
+type mallocFuzzRand uint64
+
+func (r *mallocFuzzRand) next() uint64 {
+	// xorshift64*
+	x := uint64(*r)
+	x ^= x >> 12
+	x ^= x << 25
+	x ^= x >> 27
+	*r = mallocFuzzRand(x)
+	return x * 2685821657736338717
+}
+
+// size returns a size to allocate: an edge case, a size next to a size
+// class boundary, or a random size below max.
+func (r *mallocFuzzRand) size(max uintptr) uintptr {
+	switch r.next() % 4 {
+	case 0:
+		return mallocFuzzEdges[r.next()%uint64(len(mallocFuzzEdges))]
+	case 1:
+		s := RoundupSize(uintptr(r.next()%uint64(MaxSmallSize)) + 1)
+		return s + uintptr(r.next()%3) - 1
+	case 2:
+		return uintptr(r.next() % 64)
+	}
+	return uintptr(r.next() % uint64(max))
+}
+
+func newMallocFuzzRand() *mallocFuzzRand {
+	r := mallocFuzzRand(*mallocFuzzSeed)
+	if r == 0 {
+		r = 1
+	}
+	return &r
+}
+
+func checkRoundupSize(t *testing.T, size uintptr) {
+	r := RoundupSize(size)
+	switch {
+	case size+HeapPageSize < size:
+		if r != size {
+			t.Errorf("RoundupSize(%#x) = %#x, want the size unchanged on overflow", size, r)
+		}
+	case r < size:
+		t.Errorf("RoundupSize(%#x) = %#x, smaller than the size", size, r)
+	case size < MaxSmallSize:
+		if r > MaxSmallSize || RoundupSize(r) != r {
+			t.Errorf("RoundupSize(%#x) = %#x, not a size class", size, r)
+		}
+	default:
+		if r%HeapPageSize != 0 || r-size >= HeapPageSize {
+			t.Errorf("RoundupSize(%#x) = %#x, want size rounded up to a page", size, r)
+		}
+	}
+}
+
+func TestMallocFuzzRoundupSize(t *testing.T) {
+	r := newMallocFuzzRand()
+	for _, size := range mallocFuzzEdges {
+		checkRoundupSize(t, size)
+	}
+	maxMem := uintptr(MaxMem) // MaxMem+1 overflows on 32-bit systems
+	for _, size := range []uintptr{maxMem - 1, maxMem, maxMem + 1, ^uintptr(0) - HeapPageSize, ^uintptr(0) - HeapPageSize + 1, ^uintptr(0)} {
+		checkRoundupSize(t, size)
+	}
+	for i := 0; i < *mallocFuzzN; i++ {
+		checkRoundupSize(t, r.size(MaxMem))
+		checkRoundupSize(t, uintptr(r.next()))
+	}
+}
+
+type mallocFuzzObj struct {
+	p    unsafe.Pointer
+	size uintptr
+}
+
+type mallocFuzzObjs []mallocFuzzObj
+
+func (s mallocFuzzObjs) Len() int           { return len(s) }
+func (s mallocFuzzObjs) Less(i, j int) bool { return uintptr(s[i].p) < uintptr(s[j].p) }
+func (s mallocFuzzObjs) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// mallocFuzzBytes returns the first n bytes at p.
+func mallocFuzzBytes(p unsafe.Pointer, n uintptr) []byte {
+	return (*[1 << 30]byte)(p)[:n:n]
+}
+
+func TestMallocFuzz(t *testing.T) {
+	r := newMallocFuzzRand()
+	n := *mallocFuzzN
+	if testing.Short() {
+		n /= 10
+	}
+	const batch = 512
+	for done := 0; done < n; done += batch {
+		var live mallocFuzzObjs
+		for i := 0; i < batch; i++ {
+			size := r.size(256 << 10)
+			noscan := r.next()%2 == 0
+			nozero := noscan && r.next()%2 == 0 // no unzeroed memory with pointers for the GC to see
+			p := MallocGC(size, noscan, nozero)
+			if !noscan {
+				size = (size + PtrSize - 1) &^ (PtrSize - 1)
+			}
+			if p == nil {
+				t.Fatalf("MallocGC(%d, noscan=%v, nozero=%v) = nil", size, noscan, nozero)
+			}
+			if size == 0 {
+				continue
+			}
+			if align := uintptr(PtrSize); size >= align && uintptr(p)%align != 0 && !(noscan && size < 16) {
+				t.Errorf("MallocGC(%d, noscan=%v) = %p, not aligned to %d", size, noscan, p, align)
+			}
+			// Small objects own their whole size class slot; tiny objects
+			// share a block with others and own only what they asked for.
+			usable := RoundupSize(size)
+			if noscan && size < 16 {
+				usable = size
+			}
+			b := mallocFuzzBytes(p, usable)
+			if !nozero {
+				for j, v := range b {
+					if v != 0 {
+						t.Fatalf("MallocGC(%d, noscan=%v) = %p: byte %d of %d is %#x, want 0", size, noscan, p, j, usable, v)
+					}
+				}
+			}
+			if noscan {
+				// Leave garbage behind for the next allocations of this slot.
+				for j := range b {
+					b[j] = 0xa5
+				}
+			}
+			live = append(live, mallocFuzzObj{p, size})
+		}
+		sort.Sort(live)
+		for i := 1; i < len(live); i++ {
+			if prev := live[i-1]; uintptr(prev.p)+prev.size > uintptr(live[i].p) {
+				t.Fatalf("objects %p (%d bytes) and %p (%d bytes) overlap", prev.p, prev.size, live[i].p, live[i].size)
+			}
+		}
+		live = nil
+		if done/batch%8 == 7 {
+			GC()
+		}
+	}
+}
+
+func TestMallocFuzzNewArray(t *testing.T) {
+	mustPanic := func(name string, f func()) {
+		defer func() {
+			e := recover()
+			if e == nil {
+				t.Errorf("%s did not panic", name)
+				return
+			}
+			if msg, ok := e.(string); !ok || !strings.Contains(msg, "allocation size out of range") {
+				t.Errorf("%s panicked with %v, want allocation size out of range", name, e)
+			}
+		}()
+		f()
+	}
+	mustPanic("NewArray(uint64, MaxMem/8+1)", func() { NewArray(uint64(0), MaxMem/8+1) })
+	mustPanic("NewArray(uint64, ^0/8+1)", func() { NewArray(uint64(0), ^uintptr(0)/8+1) })
+	mustPanic("NewArray([1024]byte, ^0/1024+2)", func() { NewArray([1024]byte{}, ^uintptr(0)/1024+2) })
+	mustPanic("NewArray(byte, -1)", func() { NewArray(byte(0), ^uintptr(0)) })
+	mustPanic("NewArray(*byte, -1)", func() { NewArray((*byte)(nil), ^uintptr(0)) })
+
+	r := newMallocFuzzRand()
+	for i := 0; i < *mallocFuzzN/10; i++ {
+		n := r.size(64<<10) / 8
+		var p unsafe.Pointer
+		var elem uintptr
+		if i%2 == 0 {
+			p, elem = NewArray(uint64(0), n), 8
+		} else {
+			p, elem = NewArray((*byte)(nil), n), PtrSize
+		}
+		for j, v := range mallocFuzzBytes(p, n*elem) {
+			if v != 0 {
+				t.Fatalf("NewArray(%d) = %p: byte %d is %#x, want 0", n, p, j, v)
+			}
+		}
+	}
+	// Zero sized elements never overflow.
+	if p := NewArray(struct{}{}, ^uintptr(0)>>1); p == nil {
+		t.Errorf("NewArray(struct{}, huge) = nil")
+	}
+}
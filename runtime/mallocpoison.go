@@ -0,0 +1,43 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Poisoning of freed small objects, GODEBUG=mallocpoison=1.
+//
+// sweep 把小对象放回 span 的 freelist 时，除了第一个字(freelist 的 next 指针)之外，
+// 其余的字都填上 mallocPoisonWord。mallocgc 从 freelist 取出对象时检查这些字，
+// 如果被改过了，说明有代码在对象被释放之后还在写它(use after free)，直接 throw。
+//
+// 第二个字本来就被 sweep 用来标记"需要清零"，填了 poison 之后同样不为 0，
+// 所以大于 2 个字的对象在 mallocgc 里照常被 memclr。
+
+package runtime
+
+import "unsafe"
+
+const mallocPoisonWord = uintptrMask & 0xdeadbeefdeadbeef
+
+// mallocPoison 由 mSpan_Sweep 在释放大小为 size 的对象 p 时调用。
+func mallocPoison(p, size uintptr) {
+	for off := uintptr(ptrSize); off+ptrSize <= size; off += ptrSize {
+		*(*uintptr)(unsafe.Pointer(p + off)) = mallocPoisonWord
+	}
+}
+
+// mallocPoisonCheck 由 mallocgc 在从 freelist 中取出对象 x 之后调用。
+// 第二个字不是 poison 的对象是新 span 中的(已经清零了)，或者在开启 mallocpoison 之前释放的，不检查。
+func mallocPoisonCheck(x unsafe.Pointer, size uintptr) {
+	if size < 2*ptrSize || *(*uintptr)(add(x, ptrSize)) != mallocPoisonWord {
+		return
+	}
+	for off := uintptr(2 * ptrSize); off+ptrSize <= size; off += ptrSize {
+		if v := *(*uintptr)(add(x, off)); v != mallocPoisonWord {
+			print("runtime: object ", x, " size ", size, " modified after free: word at offset ", off, " = ", hex(v), "\n")
+			throw("mallocpoison: write to freed object")
+		}
+	}
+	if size <= 2*ptrSize {
+		// mallocgc 只对大于 2 个字的对象检查第二个字并 memclr。
+		*(*uintptr)(add(x, ptrSize)) = 0
+	}
+}
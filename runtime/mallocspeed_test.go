@@ -0,0 +1,120 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"unsafe"
+)
+
+// Allocator benchmarks: tiny, small and large sizes, with and without
+// pointers, parallel allocation contending on the mcentrals, and churn
+// of large objects through the heap. The sizes are passed as variables
+// so that the compiler cannot allocate the objects on the stack.
+
+var (
+	mallocSpeedSink uintptr
+	mallocSpeedLive interface{}
+)
+
+func benchmarkMallocNoScan(b *testing.B, n int) {
+	b.SetBytes(int64(n))
+	var x uintptr
+	for i := 0; i < b.N; i++ {
+		p := make([]byte, n)
+		x ^= uintptr(unsafe.Pointer(&p[0]))
+	}
+	mallocSpeedSink = x
+}
+
+func benchmarkMallocScan(b *testing.B, n int) {
+	b.SetBytes(int64(n))
+	n /= int(unsafe.Sizeof(uintptr(0)))
+	var x uintptr
+	for i := 0; i < b.N; i++ {
+		p := make([]*byte, n)
+		x ^= uintptr(unsafe.Pointer(&p[0]))
+	}
+	mallocSpeedSink = x
+}
+
+func BenchmarkMallocSpeedTiny8(b *testing.B)       { benchmarkMallocNoScan(b, 8) }
+func BenchmarkMallocSpeedNoScan16(b *testing.B)    { benchmarkMallocNoScan(b, 16) }
+func BenchmarkMallocSpeedNoScan128(b *testing.B)   { benchmarkMallocNoScan(b, 128) }
+func BenchmarkMallocSpeedNoScan1K(b *testing.B)    { benchmarkMallocNoScan(b, 1<<10) }
+func BenchmarkMallocSpeedNoScan8K(b *testing.B)    { benchmarkMallocNoScan(b, 8<<10) }
+func BenchmarkMallocSpeedNoScan32K(b *testing.B)   { benchmarkMallocNoScan(b, 32<<10) }
+func BenchmarkMallocSpeedNoScan64K(b *testing.B)   { benchmarkMallocNoScan(b, 64<<10) }
+func BenchmarkMallocSpeedNoScan1M(b *testing.B)    { benchmarkMallocNoScan(b, 1<<20) }
+func BenchmarkMallocSpeedScan16(b *testing.B)      { benchmarkMallocScan(b, 16) }
+func BenchmarkMallocSpeedScan128(b *testing.B)     { benchmarkMallocScan(b, 128) }
+func BenchmarkMallocSpeedScan1K(b *testing.B)      { benchmarkMallocScan(b, 1<<10) }
+func BenchmarkMallocSpeedScan8K(b *testing.B)      { benchmarkMallocScan(b, 8<<10) }
+func BenchmarkMallocSpeedScan32K(b *testing.B)     { benchmarkMallocScan(b, 32<<10) }
+func BenchmarkMallocSpeedScan64K(b *testing.B)     { benchmarkMallocScan(b, 64<<10) }
+func BenchmarkMallocSpeedScan1M(b *testing.B)      { benchmarkMallocScan(b, 1<<20) }
+func BenchmarkMallocSpeedParallel16(b *testing.B)  { benchmarkMallocParallel(b, 16) }
+func BenchmarkMallocSpeedParallel1K(b *testing.B)  { benchmarkMallocParallel(b, 1<<10) }
+func BenchmarkMallocSpeedParallel32K(b *testing.B) { benchmarkMallocParallel(b, 32<<10) }
+
+// benchmarkMallocParallel allocates from all Ps at once. Each P's mcache
+// runs out of spans quickly, so the Ps contend on the same mcentral.
+func benchmarkMallocParallel(b *testing.B, n int) {
+	b.SetBytes(int64(n))
+	b.RunParallel(func(pb *testing.PB) {
+		var x uintptr
+		for pb.Next() {
+			p := make([]byte, n)
+			x ^= uintptr(unsafe.Pointer(&p[0]))
+		}
+		atomic.AddUintptr(&mallocSpeedSink, x)
+	})
+}
+
+// BenchmarkMallocSpeedMixed allocates a mix of sizes with and without
+// pointers, as a program would, keeping a window of them alive.
+func BenchmarkMallocSpeedMixed(b *testing.B) {
+	sizes := []int{8, 24, 48, 96, 200, 512, 1500, 4000, 12000, 40000}
+	var live [256]interface{}
+	for i := 0; i < b.N; i++ {
+		n := sizes[i%len(sizes)]
+		if i&1 == 0 {
+			live[i%len(live)] = make([]byte, n)
+		} else {
+			live[i%len(live)] = make([]*byte, n/8+1)
+		}
+	}
+	mallocSpeedLive = live[0]
+}
+
+// BenchmarkMallocSpeedLargeChurn allocates large objects of varying size
+// while keeping a few of them alive, so largeAlloc keeps carving and
+// coalescing spans in the heap.
+func BenchmarkMallocSpeedLargeChurn(b *testing.B) {
+	var live [16][]byte
+	seed := uint32(1)
+	for i := 0; i < b.N; i++ {
+		seed = seed*1664525 + 1013904223
+		n := 33<<10 + int(seed>>8)%(1<<20)
+		live[seed>>28] = make([]byte, n)
+	}
+	mallocSpeedLive = live[0]
+}
+
+// BenchmarkMallocSpeedLargeChurnParallel is BenchmarkMallocSpeedLargeChurn
+// on all Ps, which contend on the heap lock.
+func BenchmarkMallocSpeedLargeChurnParallel(b *testing.B) {
+	b.RunParallel(func(pb *testing.PB) {
+		var live [16][]byte
+		seed := uint32(1)
+		for pb.Next() {
+			seed = seed*1664525 + 1013904223
+			n := 33<<10 + int(seed>>8)%(1<<20)
+			live[seed>>28] = make([]byte, n)
+		}
+		atomic.AddUintptr(&mallocSpeedSink, uintptr(len(live[0])))
+	})
+}
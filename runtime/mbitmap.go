@@ -15,6 +15,8 @@
 //
 // The allocated heap comes from a subset of the memory in the range [start, used),
 // where start == mheap_.arena_start and used == mheap_.arena_used.
+// The arena grows in chunks that may leave holes in that range; the bitmap
+// is only mapped for the chunks, see mHeap_MapBits.
 // The heap bitmap comprises 2 bits for each pointer-sized word in that range,
 // stored in bytes indexed backward in memory from start.
 // That is, the byte at address start-1 holds the 2-bit entries for the four words
@@ -119,30 +121,32 @@ func subtract1(p *byte) *byte {
 	return (*byte)(unsafe.Pointer(uintptr(unsafe.Pointer(p)) - 1))
 }
 
-// mHeap_MapBits is called each time arena_used is extended.
-// It maps any additional bitmap memory needed for the new arena memory.
-// It must be called with the expected new value of arena_used,
-// *before* h.arena_used has been updated.
+// mHeap_MapBits is called each time arena memory [v, v+n) is mapped.
+// It maps the bitmap memory needed for the new arena memory,
+// one _ArenaChunk of arena at a time, so the holes between
+// arena chunks do not get any bitmap.
+// It must be called *before* h.arena_used has been updated.
 // Waiting to update arena_used until after the memory has been mapped
 // avoids faults when other threads try access the bitmap immediately
 // after observing the change to arena_used.
 //
 //go:nowritebarrier
-func mHeap_MapBits(h *mheap, arena_used uintptr) {
-	// Caller has added extra mappings to the arena.
-	// Add extra mappings of bitmap words as needed.
-	// We allocate extra bitmap pieces in chunks of bitmapChunk.
-	const bitmapChunk = 8192
-
-	n := (arena_used - mheap_.arena_start) / heapBitmapScale
-	n = round(n, bitmapChunk)
-	n = round(n, _PhysPageSize)
-	if h.bitmap_mapped >= n {
-		return
+func mHeap_MapBits(h *mheap, v, n uintptr) {
+	// bitmap 是从 arena_start 往低地址方向排的，
+	// 第 c 个 chunk 的 bitmap 是 [arena_start-(c+1)*size, arena_start-c*size)。
+	const size = _ArenaChunk / heapBitmapScale
+	for c := (v - h.arena_start) >> _ArenaChunkShift; c <= (v+n-1-h.arena_start)>>_ArenaChunkShift; c++ {
+		if h.bitmap_chunks[c/8]&(1<<(c%8)) != 0 {
+			continue
+		}
+		lo := h.arena_start - (c+1)*size
+		if lo < h.bitmap {
+			// arena_limit 不是 chunk 的整数倍时，最后一个 chunk 的 bitmap 只有一部分。
+			lo = h.bitmap
+		}
+		sysMap(unsafe.Pointer(lo), h.arena_start-c*size-lo, h.meta_reserved, &memstats.gc_sys)
+		h.bitmap_chunks[c/8] |= 1 << (c % 8)
 	}
-
-	sysMap(unsafe.Pointer(h.arena_start-n), n-h.bitmap_mapped, h.arena_reserved, &memstats.gc_sys)
-	h.bitmap_mapped = n
 }
 
 // heapBits provides access to the bitmap bits for a single heap word.
@@ -194,10 +198,11 @@ func heapBitsForObject(p uintptr) (base uintptr, hbits heapBits, s *mspan) {
 	k := p >> _PageShift
 	s = h_spans[idx]
 	if s == nil || pageID(k) < s.start || p >= s.limit || s.state != mSpanInUse {
-		if s == nil || s.state == _MSpanStack {
+		if s == nil || s.state == _MSpanStack || s.state == _MSpanManual {
 			// If s is nil, the virtual address has never been part of the heap.
 			// This pointer may be to some mmap'd region, so we allow it.
 			// Pointers into stacks are also ok, the runtime manages these explicitly.
+			// So are pointers into arenas, see arena.go.
 			return
 		}
 
@@ -429,8 +434,8 @@ func heapBitsBulkBarrier(p, size uintptr) {
 // This executes the write barriers necessary after a copy.
 // Both p and size must be pointer-aligned.
 // The type typ must have a plain bitmap, not a GC program.
-// The only use of this function is in channel sends, and the
-// 64 kB channel element limit takes care of this for us.
+// The only use of this function is in channel sends, and makechan
+// rejects element types with GC programs.
 //
 // Must not be preempted because it typically runs right after memmove,
 // and the GC must not complete between those two.
@@ -12,6 +12,7 @@ type mcache struct {
 	// The following members are accessed on every malloc,
 	// so they are grouped here for better caching.
 	next_sample      int32   // trigger heap sample after allocating this many bytes
+	next_allocsample int32   // trigger allocation sample after allocating this many bytes, see allocsample.go
 	local_cachealloc uintptr // bytes allocated from cache since last lock of heap
 	local_scan       uintptr // bytes of scannable heap allocated
 	// Allocator cache for tiny objects w/o pointers.
@@ -19,6 +20,8 @@ type mcache struct {
 	tiny             unsafe.Pointer // 大小是 maxTinySize 的 span,用来给小对象用的
 	tinyoffset       uintptr        // tiny中的偏移量，
 	local_tinyallocs uintptr        // number of tiny allocs not counted in other stats
+	local_tinybytes  uintptr        // bytes requested by tiny allocs
+	local_tinyblocks uintptr        // number of maxTinySize blocks taken by the tiny allocator
 
 	// The rest is not accessed on every malloc.
 	alloc [_NumSizeClasses]*mspan // spans to allocate from
@@ -30,6 +33,15 @@ type mcache struct {
 	local_largefree  uintptr                  // bytes freed for large objects (>maxsmallsize)
 	local_nlargefree uintptr                  // number of frees for large objects (>maxsmallsize)
 	local_nsmallfree [_NumSizeClasses]uintptr // number of frees for small objects (<=maxsmallsize)
+
+	largecache [largeCacheSpans]*mspan // freed large object spans, see largecache.go
+
+	// Per-P allocation counters. Unlike the local_ stats above
+	// they are never flushed, see ReadPAllocStats.
+	palloc_nmalloc uint64 // number of objects allocated, including tiny objects
+	palloc_ntiny   uint64 // number of objects from the tiny allocator
+	palloc_bytes   uint64 // bytes allocated; tiny objects count the size they asked for
+	palloc_scan    uint64 // bytes of scannable heap allocated
 }
 
 // A gclink is a node in a linked list of blocks, like mlink,
@@ -56,6 +68,12 @@ func (p gclinkptr) ptr() *gclink {
 type stackfreelist struct {
 	list gclinkptr // linked list of free stacks
 	size uintptr   // total size of stacks in list
+
+	// Statistics, see ReadStackCacheStats.
+	nalloc  uint64 // stacks allocated from list
+	nfree   uint64 // stacks freed to list
+	nrefill uint64 // refills from stackpool when list was empty
+	nflush  uint64 // times stacks went back to stackpool
 }
 
 // dummy MSpan that contains no free objects.
@@ -79,6 +97,7 @@ func freemcache(c *mcache) {
 	systemstack(func() {
 		mCache_ReleaseAll(c)
 		stackcache_clear(c)
+		largeCacheFlush(c)
 
 		// NOTE(rsc,rlh): If gcworkbuffree comes back, we need to coordinate
 		// with the stealing of gcworkbufs during garbage collection to avoid
@@ -87,6 +106,7 @@ func freemcache(c *mcache) {
 
 		lock(&mheap_.lock)
 		purgecachedstats(c)
+		purgestackcachestats(c)
 		fixAlloc_Free(&mheap_.cachealloc, unsafe.Pointer(c))
 		unlock(&mheap_.lock)
 	})
@@ -110,7 +130,10 @@ func mCache_Refill(c *mcache, sizeclass int32) *mspan {
 	// Get a new cached span from the central lists.
 	s = mCentral_CacheSpan(&mheap_.central[sizeclass].mcentral)
 	if s == nil {
-		throw("out of memory")
+		// heap 增长不了，由 mallocgc 处理，见 mallocgcOOM。
+		c.alloc[sizeclass] = &emptymspan
+		_g_.m.locks--
+		return nil
 	}
 	// 拿到的 span 是 empty 的，表示里面已经没有 object 空位了
 	if s.freelist.ptr() == nil {
@@ -131,3 +154,41 @@ func mCache_ReleaseAll(c *mcache) {
 		}
 	}
 }
+
+// mCache_Flush 把 c 缓存的东西全部还回去：小对象的 span 还给 mcentral, 栈还给 stackpool,
+// 大对象的 span 还给 heap, tiny 块不再引用，下次 GC 时就可以回收了。
+// 在 system stack 上运行，调用者要保证没有别人在使用 c。
+func mCache_Flush(c *mcache) {
+	mCache_ReleaseAll(c)
+	stackcache_clear(c)
+	largeCacheFlush(c)
+	c.tiny = nil
+	c.tinyoffset = 0
+}
+
+// FlushMCache returns the spans, stacks and tiny block cached by the
+// current P's allocator cache without waiting for a garbage collection.
+// The next allocations on this P refill the cache from the central lists.
+func FlushMCache() {
+	mp := acquirem()
+	c := mp.mcache
+	systemstack(func() {
+		mCache_Flush(c)
+	})
+	releasem(mp)
+}
+
+// FlushMCaches is like FlushMCache but flushes the caches of all Ps.
+// It stops the world, so idle Ps give back what they cache too.
+func FlushMCaches() {
+	stopTheWorld("flush mcaches")
+	systemstack(func() {
+		for i := 0; i < int(gomaxprocs); i++ {
+			p := allp[i]
+			if p != nil && p.mcache != nil {
+				mCache_Flush(p.mcache)
+			}
+		}
+	})
+	startTheWorld()
+}
@@ -18,6 +18,11 @@ type mcentral struct {
 	sizeclass int32
 	nonempty  mspan // 带有待释放的 object 的 mspan 链表
 	empty     mspan // 所有 mspan 可用的，其中的 span 是在 mcache 中的
+
+	// 锁竞争的统计，由 mCentral_Lock 在持有 lock 时更新，见 ReadSizeClassStats。
+	nlock      uint64 // lock 的获取次数
+	ncontended uint64 // 获取时 lock 已经被别人持有的次数
+	waitticks  int64  // 有竞争时等待 lock 的总时间，单位是 cputicks
 }
 
 // Initialize a single central free list.
@@ -27,13 +32,43 @@ func mCentral_Init(c *mcentral, sizeclass int32) {
 	mSpanList_Init(&c.empty)
 }
 
+// mCentral_Lock 获取 c.lock 并记录锁竞争: mcentral 的锁是分配的热点，
+// 统计每个 sizeclass 的竞争情况才知道该优化哪些 sizeclass。
+// 获取之前锁已经被持有就算一次竞争，只有这时才计时，不竞争的时候只多一次 load。
+func mCentral_Lock(c *mcentral) {
+	if atomicloaduintptr(&c.lock.key) == 0 {
+		lock(&c.lock)
+		c.nlock++
+		return
+	}
+	t0 := cputicks()
+	lock(&c.lock)
+	c.nlock++
+	c.ncontended++
+	c.waitticks += cputicks() - t0
+}
+
 // Allocate a span to use in an MCache.
 func mCentral_CacheSpan(c *mcentral) *mspan {
 
-	lock(&c.lock)
+	mCentral_Lock(c)
 	sg := mheap_.sweepgen
 retry:
 	var s *mspan
+	// NUMA 模式下先在 nonempty 的前几个已经清理过的 span 中找属于当前 node 的。
+	if mheap_.numa.enabled {
+		node := sysNUMANode()
+		n := 0
+		for s = c.nonempty.next; s != &c.nonempty && n < numaScanSpans; s = s.next {
+			n++
+			if s.sweepgen == sg && mHeap_NodeOf(&mheap_, uintptr(s.start)<<_PageShift) == node {
+				mSpanList_Remove(s)
+				mSpanList_InsertBack(&c.empty, s)
+				unlock(&c.lock)
+				goto havespan
+			}
+		}
+	}
 	// nonempty 里的 span 里有空闲的位置给 object 用
 	// 在 nonempty 列表中找到一个没有正在被清理的 span
 	for s = c.nonempty.next; s != &c.nonempty; s = s.next {
@@ -69,7 +104,7 @@ retry:
 			if s.freelist.ptr() != nil {
 				goto havespan
 			}
-			lock(&c.lock)
+			mCentral_Lock(c)
 			// the span is still empty after sweep
 			// it is already in the empty list, so just retry
 			goto retry
@@ -89,7 +124,7 @@ retry:
 	if s == nil {
 		return nil
 	}
-	lock(&c.lock)
+	mCentral_Lock(c)
 	mSpanList_InsertBack(&c.empty, s)
 	unlock(&c.lock)
 
@@ -110,7 +145,7 @@ havespan:
 
 // Return span from an MCache.
 func mCentral_UncacheSpan(c *mcentral, s *mspan) {
-	lock(&c.lock)
+	mCentral_Lock(c)
 
 	s.incache = false
 
@@ -154,7 +189,7 @@ func mCentral_FreeSpan(c *mcentral, s *mspan, n int32, start gclinkptr, end gcli
 		return false
 	}
 
-	lock(&c.lock)
+	mCentral_Lock(c)
 
 	// Move to nonempty if necessary.
 	// wasempty 表示的是之前是否是 empty 的，如果是，现在不空了，放到需要放到 nonempty 里了
@@ -22,6 +22,7 @@ func sysAlloc(n uintptr, sysStat *uint64) unsafe.Pointer {
 
 func sysUnused(v unsafe.Pointer, n uintptr) {
 	madvise(v, n, _MADV_FREE)
+	sysUnusedLazy = true
 }
 
 func sysUsed(v unsafe.Pointer, n uintptr) {
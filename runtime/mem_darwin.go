@@ -21,6 +21,7 @@ func sysAlloc(n uintptr, sysStat *uint64) unsafe.Pointer {
 func sysUnused(v unsafe.Pointer, n uintptr) {
 	// Linux's MADV_DONTNEED is like BSD's MADV_FREE.
 	madvise(v, n, _MADV_FREE)
+	sysUnusedLazy = true
 }
 
 func sysUsed(v unsafe.Pointer, n uintptr) {
@@ -9,8 +9,17 @@ import "unsafe"
 const (
 	_PAGE_SIZE = _PhysPageSize
 	_EACCES    = 13
+	_EEXIST    = 17
+
+	_MAP_FIXED_NOREPLACE = 0x100000 // Linux 4.17
 )
 
+// mapNoReplaceBroken 表示内核不认识 MAP_FIXED_NOREPLACE, 之后 mmap_fixed 就不再尝试了。
+var mapNoReplaceBroken bool
+
+// madvFreeBroken 表示内核不支持 MADV_FREE (Linux 4.5 之前返回 EINVAL), 之后 sysUnused 只用 MADV_DONTNEED。
+var madvFreeBroken bool
+
 // NOTE: vec must be just 1 byte long here.
 // Mincore returns ENOMEM if any of the pages are unmapped,
 // but we want to know that all of the pages are unmapped.
@@ -36,6 +45,18 @@ func addrspace_free(v unsafe.Pointer, n uintptr) bool {
 }
 
 func mmap_fixed(v unsafe.Pointer, n uintptr, prot, flags, fd int32, offset uint32) unsafe.Pointer {
+	if v != nil && !mapNoReplaceBroken {
+		// MAP_FIXED_NOREPLACE 要么正好映射到 v, 要么在 v 已经被占用时返回 EEXIST,
+		// 不会像下面 addrspace_free 之后再 MAP_FIXED 那样，在检查和映射之间被别的线程
+		// (比如 cgo)抢先映射了，然后被我们覆盖掉。
+		p := mmap(v, n, prot, flags|_MAP_FIXED_NOREPLACE, fd, offset)
+		if p == v || uintptr(p) < 4096 {
+			return p
+		}
+		// 老的内核忽略不认识的 flag, 把 v 当成普通的地址提示，返回了别的地址。
+		mapNoReplaceBroken = true
+		munmap(p, n)
+	}
 	p := mmap(v, n, prot, flags, fd, offset)
 	// On some systems, mmap ignores v without
 	// MAP_FIXED, so retry if the address space is free.
@@ -80,6 +101,17 @@ func sysUnused(v unsafe.Pointer, n uintptr) {
 		// memory for our DONTNEED regions.
 		madvise(v, n, _MADV_NOHUGEPAGE)
 	}
+	// MADV_FREE 只是告诉内核这些页可以回收，内核在内存紧张时才真正拿走，
+	// 比 MADV_DONTNEED 立即解除映射便宜得多，之后再用到这些页时也不一定要缺页。
+	// 没有被回收的页保留着原来的内容，不过释放的 span 都是 needzero 的，这没有关系。
+	if debug.madvdontneed == 0 && !madvFreeBroken {
+		if madviseErr(v, n, _MADV_FREE) == 0 {
+			sysUnusedLazy = true
+			return
+		}
+		madvFreeBroken = true
+	}
+	sysUnusedLazy = false
 	madvise(v, n, _MADV_DONTNEED)
 }
 
@@ -95,6 +127,13 @@ func sysUsed(v unsafe.Pointer, n uintptr) {
 	}
 }
 
+// sysHugePage asks the kernel to back [v, v+n) with transparent huge pages.
+func sysHugePage(v unsafe.Pointer, n uintptr) {
+	if hugePageSize != 0 {
+		madvise(v, n, _MADV_HUGEPAGE)
+	}
+}
+
 // Don't split the stack as this function may be invoked without a valid G,
 // which prevents us from allocating more stack.
 //go:nosplit
@@ -115,6 +154,7 @@ func sysReserve(v unsafe.Pointer, n uintptr, reserved *bool) unsafe.Pointer {
 	if ptrSize == 8 && uint64(n) > 1<<32 {
 		p := mmap_fixed(v, 64<<10, _PROT_NONE, _MAP_ANON|_MAP_PRIVATE, -1, 0)
 		if p != v {
+			// 包括 MAP_FIXED_NOREPLACE 返回的 EEXIST, 地址已经被占用了，换一个试试。
 			if uintptr(p) >= 4096 {
 				munmap(p, 64<<10)
 			}
@@ -0,0 +1,15 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package runtime
+
+import "unsafe"
+
+// 只有 Linux 的透明大页可以用 madvise 按区域打开。
+// Windows 的 MEM_LARGE_PAGES 需要 SeLockMemoryPrivilege 权限并且要在 VirtualAlloc 时就指定，
+// 其他系统也没有类似的接口，这里什么都不做。
+func sysHugePage(v unsafe.Pointer, n uintptr) {
+}
@@ -0,0 +1,22 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux !amd64,!arm64
+
+package runtime
+
+import "unsafe"
+
+// 只有 linux/amd64 和 linux/arm64 实现了 mbind 和 getcpu, 其他平台就当作只有一个 node。
+
+func sysNUMANodes() int32 {
+	return 1
+}
+
+func sysNUMANode() int32 {
+	return -1
+}
+
+func sysBindNode(v unsafe.Pointer, n uintptr, node int32) {
+}
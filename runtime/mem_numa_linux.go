@@ -0,0 +1,65 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build amd64 arm64
+// +build linux
+
+package runtime
+
+import "unsafe"
+
+const _MPOL_PREFERRED = 1
+
+func mbind(addr unsafe.Pointer, n uintptr, mode int32, nodemask *uint64, maxnode uintptr, flags uint32) int32
+func getcpu(cpu, node *uint32) int32
+
+var numaPossible = []byte("/sys/devices/system/node/possible\x00")
+
+// sysNUMANodes returns the number of NUMA nodes, 1 if unknown.
+func sysNUMANodes() int32 {
+	// 文件的内容是 "0" 或者 "0-3" 这样的列表，取其中最大的数字。
+	fd := open(&numaPossible[0], _O_RDONLY, 0)
+	if fd < 0 {
+		return 1
+	}
+	var buf [64]byte
+	n := read(fd, unsafe.Pointer(&buf[0]), int32(len(buf)))
+	closefd(fd)
+	if n <= 0 {
+		return 1
+	}
+	max, v := int32(0), int32(0)
+	for _, c := range buf[:n] {
+		if '0' <= c && c <= '9' {
+			v = v*10 + int32(c-'0')
+			continue
+		}
+		if v > max {
+			max = v
+		}
+		v = 0
+	}
+	if v > max {
+		max = v
+	}
+	return max + 1
+}
+
+// sysNUMANode returns the node of the CPU the current thread runs on, -1 if unknown.
+func sysNUMANode() int32 {
+	var cpu, node uint32
+	if getcpu(&cpu, &node) < 0 {
+		return -1
+	}
+	return int32(node)
+}
+
+// sysBindNode asks the kernel to place [v, v+n) on node.
+// MPOL_PREFERRED falls back to other nodes when node is out of memory.
+// The kernel reads one bit fewer than maxnode, so pass numaMaxNodes+1
+// to cover all 64 bits of the mask.
+func sysBindNode(v unsafe.Pointer, n uintptr, node int32) {
+	mask := uint64(1) << uint(node)
+	mbind(v, n, _MPOL_PREFERRED, &mask, numaMaxNodes+1, 0)
+}
@@ -2,6 +2,20 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// Windows 上的内存管理接口。
+//
+// Windows 把地址空间的保留和物理内存(commit charge)的提交分成两步，正好对应 mallocinit 中 arena 的布局：
+//
+//	sysReserve  VirtualAlloc(MEM_RESERVE)        只保留地址空间，不占用 commit charge
+//	sysMap      VirtualAlloc(MEM_COMMIT)         arena 增长时提交用到的部分
+//	sysUnused   VirtualFree(MEM_DECOMMIT)        scavenger 归还给操作系统，立刻生效，所以 sysUnusedLazy 总是 false
+//	sysUsed     VirtualAlloc(MEM_COMMIT)         重新使用归还过的页
+//	sysFree     VirtualFree(MEM_RELEASE)         只能释放整个 sysAlloc 申请的区域
+//
+// 一次 VirtualAlloc/VirtualFree 只能处理同一次 MEM_RESERVE 保留的页。arena 不够时 mHeap_SysAlloc
+// 会在 arena_end 之后再保留一段，合并后的 span 可能跨两次保留，这时 commit/decommit 会失败，
+// 见 sysCommitPieces/sysDecommitPieces。
+
 package runtime
 
 import (
@@ -31,7 +45,10 @@ func sysUnused(v unsafe.Pointer, n uintptr) {
 	if r != 0 {
 		return
 	}
+	sysDecommitPieces(v, n)
+}
 
+func sysDecommitPieces(v unsafe.Pointer, n uintptr) {
 	// Decommit failed. Usual reason is that we've merged memory from two different
 	// VirtualAlloc calls, and Windows will only let each VirtualFree handle pages from
 	// a single VirtualAlloc. It is okay to specify a subset of the pages from a single alloc,
@@ -57,10 +74,17 @@ func sysUnused(v unsafe.Pointer, n uintptr) {
 
 func sysUsed(v unsafe.Pointer, n uintptr) {
 	r := stdcall4(_VirtualAlloc, uintptr(v), n, _MEM_COMMIT, _PAGE_READWRITE)
-	if r != uintptr(v) {
+	if r == uintptr(v) {
+		return
+	}
+	if !sysCommitPieces(v, n) {
 		throw("runtime: failed to commit pages")
 	}
+}
 
+// sysCommitPieces 逐段提交 [v, v+n), 每段不跨两次 MEM_RESERVE。
+// 和 sysDecommitPieces 一样，一段失败就减半再试。失败时(一般是 commit charge 用完了)返回 false。
+func sysCommitPieces(v unsafe.Pointer, n uintptr) bool {
 	// Commit failed. See SysUnused.
 	for n > 0 {
 		small := n
@@ -69,11 +93,12 @@ func sysUsed(v unsafe.Pointer, n uintptr) {
 			small &^= 4096 - 1
 		}
 		if small < 4096 {
-			throw("runtime: failed to decommit pages")
+			return false
 		}
 		v = add(v, small)
 		n -= small
 	}
+	return true
 }
 
 // Don't split the stack as this function may be invoked without a valid G,
@@ -108,7 +133,11 @@ func sysReserve(v unsafe.Pointer, n uintptr, reserved *bool) unsafe.Pointer {
 func sysMap(v unsafe.Pointer, n uintptr, reserved bool, sysStat *uint64) {
 	mSysStatInc(sysStat, n)
 	p := stdcall4(_VirtualAlloc, uintptr(v), n, _MEM_COMMIT, _PAGE_READWRITE)
-	if p != uintptr(v) {
+	if p == uintptr(v) {
+		return
+	}
+	// 可能跨了两次 sysReserve 保留的区域，分段再试一次。
+	if !sysCommitPieces(v, n) {
 		throw("runtime: cannot map pages in arena address space")
 	}
 }
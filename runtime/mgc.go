@@ -724,7 +724,7 @@ func (s *bgMarkSignal) wait() {
 		unlock(&s.lock)
 	} else {
 		s.g = getg()
-		goparkunlock(&s.lock, "mark wait (idle)", traceEvGoBlock, 1)
+		goparkunlock(&s.lock, waitReasonGCMarkWaitIdle, traceEvGoBlock, 1)
 	}
 	s.wake = false
 	s.g = nil
@@ -893,7 +893,7 @@ func backgroundgc() {
 		gc(gcBackgroundMode)
 		lock(&bggc.lock)
 		bggc.working = 0
-		goparkunlock(&bggc.lock, "Concurrent GC wait", traceEvGoBlock, 1)
+		goparkunlock(&bggc.lock, waitReasonConcurrentGCWait, traceEvGoBlock, 1)
 	}
 }
 
@@ -1074,7 +1074,7 @@ func gc(mode int) {
 	_g_.m.traceback = 2
 	gp := _g_.m.curg
 	casgstatus(gp, _Grunning, _Gwaiting)
-	gp.waitreason = "garbage collection"
+	gp.waitreason = waitReasonGarbageCollection
 
 	// Run gc on the g0 stack.  We do this so that the g stack
 	// we're currently running on will no longer change.  Cuts
@@ -1282,7 +1282,7 @@ func gcBgMarkWorker(p *p) {
 		gopark(func(g *g, mp unsafe.Pointer) bool {
 			releasem((*m)(mp))
 			return true
-		}, unsafe.Pointer(mp), "mark worker (idle)", traceEvGoBlock, 0)
+		}, unsafe.Pointer(mp), waitReasonGCWorkerIdle, traceEvGoBlock, 0)
 
 		// Loop until the P dies and disassociates this
 		// worker. (The P may later be reused, in which case
@@ -1462,6 +1462,7 @@ func gcMark(start_time int64) {
 	// it after we start the world, but before dropping worldsema.
 	// (See issue #11465.)
 	freeStackSpans()
+	freeArenaSpans()
 
 	cachestats()
 
@@ -1500,6 +1501,11 @@ func gcMark(start_time int64) {
 	memstats.heap_marked = work.bytesMarked
 	memstats.heap_scan = uint64(gcController.scanWork)
 
+	// 有 heap limit 时让 GC 在接近 limit 之前发生, 见 heaplimit.go。
+	if goal := heapLimitGoal(); goal != 0 && memstats.next_gc > goal {
+		memstats.next_gc = goal
+	}
+
 	minNextGC := memstats.heap_live + sweepMinHeapDistance*uint64(gcpercent)/100
 	if memstats.next_gc < minNextGC {
 		// The allocated heap is already past the trigger.
@@ -18,7 +18,7 @@ func gcscan_m() {
 	// This allows it to be scanned like other goroutines.
 	mastergp := _g_.m.curg
 	casgstatus(mastergp, _Grunning, _Gwaiting)
-	mastergp.waitreason = "garbage collection scan"
+	mastergp.waitreason = waitReasonGarbageCollectionScan
 
 	// Span sweeping has been done by finishsweep_m.
 	// Long term we will want to make this goroutine runnable
@@ -48,7 +48,7 @@ func bgsweep(c chan int) {
 	lock(&sweep.lock)
 	sweep.parked = true
 	c <- 1
-	goparkunlock(&sweep.lock, "GC sweep wait", traceEvGoBlock, 1)
+	goparkunlock(&sweep.lock, waitReasonGCSweepWait, traceEvGoBlock, 1)
 
 	for {
 		for gosweepone() != ^uintptr(0) {
@@ -64,7 +64,7 @@ func bgsweep(c chan int) {
 			continue
 		}
 		sweep.parked = true
-		goparkunlock(&sweep.lock, "GC sweep wait", traceEvGoBlock, 1)
+		goparkunlock(&sweep.lock, waitReasonGCSweepWait, traceEvGoBlock, 1)
 	}
 }
 
@@ -246,6 +246,9 @@ func mSpan_Sweep(s *mspan, preserve bool) bool {
 			} else if size > ptrSize { // 小于 2 个字，但大于 1 个字
 				*(*uintptr)(unsafe.Pointer(p + ptrSize)) = 0
 			}
+			if debug.mallocpoison != 0 {
+				mallocPoison(p, size)
+			}
 			if head.ptr() == nil {
 				head = gclinkptr(p)
 			} else {
@@ -295,10 +298,14 @@ func mSpan_Sweep(s *mspan, preserve bool) bool {
 		// have mysterious crashes due to confused memory reuse.
 		// It should be possible to switch back to SysFree if we also
 		// implement and then call some kind of MHeap_DeleteSpan.
+		largeObjForget(s.base())
+		if s.guardpage != 0 {
+			guardFree(s)
+		}
 		if debug.efence > 0 {
 			s.limit = 0 // prevent mlookup from finding this span
 			sysFault(unsafe.Pointer(uintptr(s.start<<_PageShift)), size)
-		} else {
+		} else if !largeCachePut(c, s) {
 			mHeap_Free(&mheap_, s, 1)
 		}
 		c.local_nlargefree++
@@ -40,11 +40,23 @@ type mheap struct {
 
 	// range of addresses we might see in the heap
 	bitmap         uintptr
-	bitmap_mapped  uintptr
+	bitmap_chunks  [_MaxMem>>_ArenaChunkShift/8 + 1]uint8 // 哪些 _ArenaChunk 的 bitmap 已经 map 了
 	arena_start    uintptr
 	arena_used     uintptr // always mHeap_Map{Bits,Spans} before updating
-	arena_end      uintptr
-	arena_reserved bool // 默认永远是 false 好了，只有 32位系统，或64位系统被`ulimit -v`限制了地址空间，这个才为true.
+	arena_alloc    uintptr // 当前 chunk 中下一次分配的地址, 见 mHeap_SysAlloc
+	arena_chunk    uintptr // 最后 reserve 的 chunk 的开始, arena_alloc 在它前面时前面的部分按 arena_prevres map
+	arena_end      uintptr // 当前 chunk 的结尾
+	arena_limit    uintptr // bitmap 和 spans 能描述的 arena 的结尾
+	arena_reserved bool    // 默认永远是 false 好了，只有 32位系统，或64位系统被`ulimit -v`限制了地址空间，这个才为true.
+	arena_prevres  bool    // [arena_alloc, arena_chunk) 的 arena_reserved
+	meta_reserved  bool    // bitmap 和 spans 的 arena_reserved
+
+	// NUMA node of every _HeapAllocChunk of the arena, see numa.go.
+	numa struct {
+		enabled   bool
+		nodes     int32
+		chunkNode []uint8
+	}
 
 	// central free lists for small size classes.
 	// the padding makes sure that the MCentrals are
@@ -59,6 +71,7 @@ type mheap struct {
 	cachealloc            fixalloc // allocator for mcache*
 	specialfinalizeralloc fixalloc // allocator for specialfinalizer*
 	specialprofilealloc   fixalloc // allocator for specialprofile*
+	specialchanalloc      fixalloc // allocator for specialchan*
 	speciallock           mutex    // lock for special record allocators.
 }
 
@@ -90,12 +103,21 @@ var mheap_ mheap
 // * During GC (gcphase != _GCoff), a span *must not* transition from
 //   stack or in-use to free. Because concurrent GC may read a pointer
 //   and then look up its span, the span state must be monotonic.
+//
+// * A large object span freed by sweeping may be held by an mcache
+//   as _MSpanCached instead of becoming free. It goes back to in-use
+//   like a free span, and to free at any time like a stack span.
+//
+// * A span owned by an Arena has state _MSpanManual and follows the
+//   same rules as a stack span.
 const (
 	_MSpanInUse = iota // allocated for garbage collected heap
 	_MSpanStack        // allocated for use by stack allocator
 	_MSpanFree
 	_MSpanListHead
 	_MSpanDead
+	_MSpanCached // 被 mcache 缓存的大对象 span, 见 largecache.go
+	_MSpanManual // 手动管理的 Arena 的 span, 见 arena.go
 )
 
 type mspan struct {
@@ -117,11 +139,13 @@ type mspan struct {
 	incache     bool     // being used by an mcache
 	state       uint8    // mspaninuse etc
 	needzero    uint8    // needs to be zeroed before allocation
+	guardpage   uint8    // last page is a sysFault guard page, see guardpage.go
 	divShift    uint8    // for divide by elemsize - divMagic.shift
 	divShift2   uint8    // for divide by elemsize - divMagic.shift2
 	elemsize    uintptr  // computed from sizeclass or from npages
 	unusedsince int64    // first time spotted by gc in mspanfree state
 	npreleased  uintptr  // number of pages released to the os
+	nplazy      uintptr  // released pages the os reclaims only under memory pressure
 	limit       uintptr  // end of data in span
 	speciallock mutex    // guards specials list
 	specials    *special // linked list of special records sorted by offset.
@@ -278,6 +302,7 @@ func mHeap_Init(h *mheap, spans_size uintptr) {
 	fixAlloc_Init(&h.cachealloc, unsafe.Sizeof(mcache{}), nil, nil, &memstats.mcache_sys)
 	fixAlloc_Init(&h.specialfinalizeralloc, unsafe.Sizeof(specialfinalizer{}), nil, nil, &memstats.other_sys)
 	fixAlloc_Init(&h.specialprofilealloc, unsafe.Sizeof(specialprofile{}), nil, nil, &memstats.other_sys)
+	fixAlloc_Init(&h.specialchanalloc, unsafe.Sizeof(specialchan{}), nil, nil, &memstats.other_sys)
 
 	// h->mapcache needs no init
 	for i := range h.free {
@@ -287,6 +312,7 @@ func mHeap_Init(h *mheap, spans_size uintptr) {
 
 	mSpanList_Init(&h.freelarge)
 	mSpanList_Init(&h.busylarge)
+	mSpanList_Init(&arenaFreeQueue.spans)
 	for i := range h.central {
 		mCentral_Init(&h.central[i].mcentral, int32(i))
 	}
@@ -314,7 +340,7 @@ func mHeap_MapSpans(h *mheap, arena_used uintptr) {
 	if h.spans_mapped >= n {
 		return
 	}
-	sysMap(add(unsafe.Pointer(h.spans), h.spans_mapped), n-h.spans_mapped, h.arena_reserved, &memstats.other_sys)
+	sysMap(add(unsafe.Pointer(h.spans), h.spans_mapped), n-h.spans_mapped, h.meta_reserved, &memstats.other_sys)
 	h.spans_mapped = n
 }
 
@@ -496,6 +522,25 @@ func mHeap_AllocStack(h *mheap, npage uintptr) *mspan {
 	return s
 }
 
+// mHeap_AllocManual 为 Arena 分配 npage 页的 span, GC 不会管理这个 span。
+// 和 mHeap_AllocStack 一样必须在 g0 上调用。
+func mHeap_AllocManual(h *mheap, npage uintptr) *mspan {
+	_g_ := getg()
+	if _g_ != _g_.m.g0 {
+		throw("mheap_allocmanual not on g0 stack")
+	}
+	lock(&h.lock)
+	s := mHeap_AllocSpanLocked(h, npage)
+	if s != nil {
+		s.state = _MSpanManual
+		s.freelist = 0
+		s.ref = 0
+		s.limit = s.base() + npage<<_PageShift
+	}
+	unlock(&h.lock)
+	return s
+}
+
 // Allocates a span of the given size.  h must be locked.
 // The returned span has been removed from the
 // free list, but its state is still MSpanFree.
@@ -541,7 +586,9 @@ HaveSpan:
 	if s.npreleased > 0 {
 		sysUsed((unsafe.Pointer)(s.start<<_PageShift), s.npages<<_PageShift)
 		memstats.heap_released -= uint64(s.npreleased << _PageShift)
+		memstats.heap_released_lazy -= uint64(s.nplazy << _PageShift)
 		s.npreleased = 0
+		s.nplazy = 0
 	}
 
 	if s.npages > npage { // 拿到的 span 块要比需要的大，进行切割，切剩下的还给 heap
@@ -599,6 +646,35 @@ func bestFit(list *mspan, npage uintptr, best *mspan) *mspan {
 	return best
 }
 
+const (
+	sysAllocRetries    = 5
+	sysAllocRetryDelay = 1000 // 第一次重试前等待的微秒数，之后每次加倍
+)
+
+// mHeap_SysAllocRetry 在 mHeap_SysAlloc 失败之后再试几次。mmap 失败可能只是暂时的,
+// 比如别的进程占用的内存突然涨了一下。第一次重试之前先把空闲的页都还给 OS,
+// 之后每次等待的时间加倍，一共最多等 31ms。
+// 调用者持有 h.lock, 等待的时候先放开, 免得别的线程分配和释放内存也跟着等;
+// 醒来之后重新加锁, 别的线程可能已经扩充了 heap, 调用者返回之后会重新查找空闲的 span。
+func mHeap_SysAllocRetry(h *mheap, n uintptr) unsafe.Pointer {
+	for i := 0; i < sysAllocRetries; i++ {
+		if i == 0 {
+			for j := 0; j < len(h.free); j++ {
+				scavengelist(&h.free[j], ^uint64(0), 0)
+			}
+			scavengelist(&h.freelarge, ^uint64(0), 0)
+		} else {
+			unlock(&h.lock)
+			usleep(sysAllocRetryDelay << uint(i-1))
+			lock(&h.lock)
+		}
+		if v := mHeap_SysAlloc(h, n); v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
 // Try to add at least npage pages of memory to the heap,
 // returning whether it worked.
 func mHeap_Grow(h *mheap, npage uintptr) bool {
@@ -608,22 +684,53 @@ func mHeap_Grow(h *mheap, npage uintptr) bool {
 	// Allocate a multiple of 64kB.
 	npage = round(npage, (64<<10)/_PageSize) // 64K / 8K = 8页
 	// npage 一定要是 8页 的倍数，即申请的内存是 64K 的倍数。主要就是尽可能多申请。
+	if debug.hugepages != 0 && hugePageSize > _PageSize {
+		// arena_start 已经按大页对齐(见 arenaAlign)，每次都增长整数个大页，
+		// arena_alloc 就一直是对齐的，所有映射的内存都可以用大页。
+		// 不连续的 chunk 只按页对齐，大页只能尽力而为了。
+		npage = round(npage, hugePageSize/_PageSize)
+	}
+	if h.numa.enabled {
+		// 每次增长整数个 chunk, 这样每个 chunk 只属于一个 node。
+		npage = round(npage, _HeapAllocChunk/_PageSize)
+	}
 	ask := npage << _PageShift
 	if ask < _HeapAllocChunk {
 		ask = _HeapAllocChunk
 	}
 
+	if heapOverLimit(ask) {
+		ask = npage << _PageShift
+		if heapOverLimit(ask) {
+			// 先把空闲的页都还给 OS, 这些页不再计入 heap 的大小。
+			for i := 0; i < len(h.free); i++ {
+				scavengelist(&h.free[i], ^uint64(0), 0)
+			}
+			scavengelist(&h.freelarge, ^uint64(0), 0)
+		}
+		if heapOverLimit(ask) {
+			print("runtime: heap limit ", atomicload64(&heapLimit), " exceeded: cannot grow heap by ", ask, " bytes (", memstats.heap_sys-memstats.heap_released, " in use)\n")
+			return false
+		}
+	}
+
 	v := mHeap_SysAlloc(h, ask)
 	if v == nil {
 		if ask > npage<<_PageShift { // 系统内存不够了，不尽可能多申请了，需要多少来多少。
 			ask = npage << _PageShift
 			v = mHeap_SysAlloc(h, ask)
 		}
+		if v == nil {
+			v = mHeap_SysAllocRetry(h, ask)
+		}
 		if v == nil {
 			print("runtime: out of memory: cannot allocate ", ask, "-byte block (", memstats.heap_sys, " in use)\n")
 			return false
 		}
 	}
+	if h.numa.enabled {
+		mHeap_NUMABind(h, v, ask)
+	}
 
 	// Create a fake "in use" span and free it, so that the
 	// right coalescing happens.
@@ -683,6 +790,10 @@ func mHeap_Free(h *mheap, s *mspan, acct int32) {
 		mp.mcache.local_scan = 0
 		memstats.tinyallocs += uint64(mp.mcache.local_tinyallocs)
 		mp.mcache.local_tinyallocs = 0
+		memstats.tiny_bytes += uint64(mp.mcache.local_tinybytes)
+		mp.mcache.local_tinybytes = 0
+		memstats.tiny_blocks += uint64(mp.mcache.local_tinyblocks)
+		mp.mcache.local_tinyblocks = 0
 		if acct != 0 {
 			memstats.heap_objects--
 		}
@@ -707,6 +818,18 @@ func mHeap_FreeStack(h *mheap, s *mspan) {
 	unlock(&h.lock)
 }
 
+// mHeap_FreeManual 把 Arena 的 span 还给 heap, GC 期间不能调用，见 arenaFree。
+func mHeap_FreeManual(h *mheap, s *mspan) {
+	_g_ := getg()
+	if _g_ != _g_.m.g0 {
+		throw("mheap_freemanual not on g0 stack")
+	}
+	s.needzero = 1
+	lock(&h.lock)
+	mHeap_FreeSpanLocked(h, s, true, true, 0)
+	unlock(&h.lock)
+}
+
 func mHeap_FreeSpanLocked(h *mheap, s *mspan, acctinuse, acctidle bool, unusedsince int64) {
 	switch s.state {
 	case _MSpanStack:
@@ -718,6 +841,12 @@ func mHeap_FreeSpanLocked(h *mheap, s *mspan, acctinuse, acctidle bool, unusedsi
 			print("MHeap_FreeSpanLocked - span ", s, " ptr ", hex(s.start<<_PageShift), " ref ", s.ref, " sweepgen ", s.sweepgen, "/", h.sweepgen, "\n")
 			throw("MHeap_FreeSpanLocked - invalid free")
 		}
+	case _MSpanManual:
+		if s.ref != 0 {
+			throw("MHeap_FreeSpanLocked - invalid arena free")
+		}
+	case _MSpanCached:
+		// 已经 sweep 过了，sweepgen 可能是上一轮 GC 的。
 	default:
 		throw("MHeap_FreeSpanLocked - invalid span state")
 	}
@@ -738,16 +867,18 @@ func mHeap_FreeSpanLocked(h *mheap, s *mspan, acctinuse, acctidle bool, unusedsi
 		s.unusedsince = nanotime()
 	}
 	s.npreleased = 0
+	s.nplazy = 0
 
 	// Coalesce with earlier, later spans.
 	p := uintptr(s.start)
 	p -= uintptr(unsafe.Pointer(h.arena_start)) >> _PageShift
 	if p > 0 { // 表示这个 span 的前面(内存地址空间前面)还有与之相连的 span 存在
 		t := h_spans[p-1]
-		if t != nil && t.state != _MSpanInUse && t.state != _MSpanStack { // 前面这个 span 也没用了
+		if t != nil && t.state != _MSpanInUse && t.state != _MSpanStack && t.state != _MSpanCached && t.state != _MSpanManual { // 前面这个 span 也没用了
 			s.start = t.start
 			s.npages += t.npages
 			s.npreleased = t.npreleased // absorb released pages
+			s.nplazy = t.nplazy
 			s.needzero |= t.needzero
 			p -= t.npages
 			h_spans[p] = s
@@ -758,9 +889,10 @@ func mHeap_FreeSpanLocked(h *mheap, s *mspan, acctinuse, acctidle bool, unusedsi
 	}
 	if (p+s.npages)*ptrSize < h.spans_mapped { // 这个 span 不是 spans_mapped 的末尾，就表示 span 后面还有被 map 的 span 存在，尝试合并
 		t := h_spans[p+s.npages]
-		if t != nil && t.state != _MSpanInUse && t.state != _MSpanStack {
+		if t != nil && t.state != _MSpanInUse && t.state != _MSpanStack && t.state != _MSpanCached && t.state != _MSpanManual {
 			s.npages += t.npages
 			s.npreleased += t.npreleased
+			s.nplazy += t.nplazy
 			s.needzero |= t.needzero
 			h_spans[p+s.npages-1] = s
 			mSpanList_Remove(t)
@@ -778,6 +910,11 @@ func mHeap_FreeSpanLocked(h *mheap, s *mspan, acctinuse, acctidle bool, unusedsi
 	}
 }
 
+// sysUnusedLazy 表示最近一次 sysUnused 用的是 MADV_FREE 这样延迟回收的方式:
+// 内存还算在进程的 RSS 里，直到操作系统内存紧张时才真正回收。
+// heap_released_lazy 记录 heap_released 中有多少是这样释放的。
+var sysUnusedLazy bool
+
 func scavengelist(list *mspan, now, limit uint64) uintptr {
 	if _PhysPageSize > _PageSize {
 		// golang.org/issue/9993
@@ -800,12 +937,20 @@ func scavengelist(list *mspan, now, limit uint64) uintptr {
 			sumreleased += released
 			s.npreleased = s.npages
 			sysUnused((unsafe.Pointer)(s.start<<_PageShift), s.npages<<_PageShift)
+			// sysUnused 作用于整个 span, 之前释放的部分也按这次的方式重新算。
+			memstats.heap_released_lazy -= uint64(s.nplazy << _PageShift)
+			s.nplazy = 0
+			if sysUnusedLazy {
+				s.nplazy = s.npages
+				memstats.heap_released_lazy += uint64(s.npages << _PageShift)
+			}
 		}
 	}
 	return sumreleased
 }
 
-func mHeap_Scavenge(k int32, now, limit uint64) {
+// mHeap_Scavenge 把空闲超过 limit 纳秒的 span 还给操作系统，返回释放的字节数。
+func mHeap_Scavenge(k int32, now, limit uint64) uintptr {
 	h := &mheap_
 	lock(&h.lock)
 	var sumreleased uintptr
@@ -823,12 +968,48 @@ func mHeap_Scavenge(k int32, now, limit uint64) {
 		// But we can't call ReadMemStats on g0 holding locks.
 		print("scvg", k, ": inuse: ", memstats.heap_inuse>>20, ", idle: ", memstats.heap_idle>>20, ", sys: ", memstats.heap_sys>>20, ", released: ", memstats.heap_released>>20, ", consumed: ", (memstats.heap_sys-memstats.heap_released)>>20, " (MB)\n")
 	}
+	return sumreleased
+}
+
+// 如果还没有还给 OS 的空闲内存少于这个值，就不需要提前 scavenge。
+const scavengeMinRetained = 64 << 20
+
+// mHeap_ScavengeNeeded 由 sysmon 调用，判断是否要比正常的周期提前 scavenge。
+// 突发的分配过后 heap 中会留下大量空闲的 span，如果这些没有还给 OS 的空闲内存
+// 比正在使用的还多(也就是 RSS 超过了实际需要的两倍)，就不再等 5 分钟。
+// 这里不加锁读 memstats, 只是个大概的值。
+func mHeap_ScavengeNeeded() bool {
+	retained := memstats.heap_idle - memstats.heap_released
+	return retained > scavengeMinRetained && retained > memstats.heap_inuse
 }
 
 //go:linkname runtime_debug_freeOSMemory runtime/debug.freeOSMemory
 func runtime_debug_freeOSMemory() {
+	FreeOSMemory()
+}
+
+// FreeOSMemory forces a garbage collection, waits for sweeping to finish
+// and then returns as much idle heap memory to the operating system as
+// possible. It reports the number of bytes released by this call.
+func FreeOSMemory() uint64 {
+	// gcForceBlockMode 模式下，GC 结束前会同步地清理完所有的 span，
+	// 但 sweep 释放的大对象 span 有一部分放进了各个 P 的 largecache, 不在 heap 的 free 列表里。
+	// 先 stop the world 把它们都还给 heap, 这样 scavenge 时所有能释放的 span 才都在 free 列表里。
+	// 这次 GC 的 sweep 已经结束了, 下次 GC 之前不会再有 span 放进 largecache。
 	startGC(gcForceBlockMode, false)
-	systemstack(func() { mHeap_Scavenge(-1, ^uint64(0), 0) })
+	stopTheWorld("free OS memory")
+	systemstack(func() {
+		for i := 0; i < int(gomaxprocs); i++ {
+			p := allp[i]
+			if p != nil && p.mcache != nil {
+				largeCacheFlush(p.mcache)
+			}
+		}
+	})
+	startTheWorld()
+	var released uintptr
+	systemstack(func() { released = mHeap_Scavenge(-1, ^uint64(0), 0) })
+	return uint64(released)
 }
 
 // Initialize a new span with the given start and npages.
@@ -845,9 +1026,11 @@ func mSpan_Init(span *mspan, start pageID, npages uintptr) {
 	span.state = _MSpanDead
 	span.unusedsince = 0
 	span.npreleased = 0
+	span.nplazy = 0
 	span.speciallock.key = 0
 	span.specials = nil
 	span.needzero = 0
+	span.guardpage = 0
 }
 
 // Initialize an empty doubly-linked list.
@@ -896,6 +1079,7 @@ func mSpanList_InsertBack(list *mspan, span *mspan) {
 const (
 	_KindSpecialFinalizer = 1
 	_KindSpecialProfile   = 2
+	_KindSpecialChan      = 3 // 见 chanregistry.go
 	// Note: The finalizer special must be first because if we're freeing
 	// an object, a finalizer special will cause the freeing operation
 	// to abort, and we want to keep the other special records around
@@ -1074,6 +1258,13 @@ func freespecial(s *special, p unsafe.Pointer, size uintptr, freed bool) bool {
 		fixAlloc_Free(&mheap_.specialprofilealloc, (unsafe.Pointer)(sp))
 		unlock(&mheap_.speciallock)
 		return true
+	case _KindSpecialChan:
+		sc := (*specialchan)(unsafe.Pointer(s))
+		chanunregister(sc)
+		lock(&mheap_.speciallock)
+		fixAlloc_Free(&mheap_.specialchanalloc, (unsafe.Pointer)(sc))
+		unlock(&mheap_.speciallock)
+		return true
 	default:
 		throw("bad special kind")
 		panic("not reached")
@@ -28,6 +28,8 @@ type mstats struct {
 	heap_released uint64 // bytes released to the os
 	heap_objects  uint64 // total number of allocated objects
 
+	heap_released_lazy uint64 // part of heap_released the os reclaims only under memory pressure
+
 	// Statistics about allocation of low-level fixed-size structures.
 	// Protected by FixAlloc locks.
 	stacks_inuse uint64 // this number is included in heap_inuse above
@@ -52,6 +54,16 @@ type mstats struct {
 	enablegc        bool
 	debuggc         bool
 
+	// Statistics about C memory allocated through cmalloc, see cgomem.go.
+	// Updated atomically.
+	cgo_alloc   uint64 // bytes allocated and not yet freed
+	cgo_nmalloc uint64 // number of cmalloc calls
+	cgo_nfree   uint64 // number of cfree calls for registered blocks
+
+	// Statistics about the tiny allocator, see mallocgc.
+	tiny_blocks uint64 // maxTinySize blocks used by the tiny allocator
+	tiny_bytes  uint64 // bytes requested by tiny allocations
+
 	// Statistics about allocation size classes.
 
 	by_size [_NumSizeClasses]struct {
@@ -115,6 +127,11 @@ type MemStats struct {
 	HeapReleased uint64 // bytes released to the OS
 	HeapObjects  uint64 // total number of allocated objects
 
+	// HeapReleasedLazy is the part of HeapReleased that was released
+	// with MADV_FREE: the OS takes those pages back only when it runs
+	// short of memory, so until then they still count toward the RSS.
+	HeapReleasedLazy uint64
+
 	// Low-level fixed-size structure allocator statistics.
 	//	Inuse is bytes used now.
 	//	Sys is bytes obtained from system.
@@ -139,6 +156,21 @@ type MemStats struct {
 	EnableGC      bool
 	DebugGC       bool
 
+	// C memory statistics.
+	// These only cover memory allocated by the runtime on behalf of cgo,
+	// not memory the C code allocates with malloc on its own.
+	CgoAlloc   uint64 // bytes allocated and not yet freed
+	CgoMallocs uint64 // number of C allocations
+	CgoFrees   uint64 // number of C frees
+
+	// Tiny allocator statistics.
+	// Objects smaller than 16 bytes without pointers are packed into
+	// shared 16-byte blocks. TinyBytes/(16*TinyBlocks) is the fraction
+	// of the blocks used by objects; the rest is lost to alignment and
+	// to blocks that were replaced before they filled up.
+	TinyBlocks uint64 // 16-byte blocks allocated by the tiny allocator
+	TinyBytes  uint64 // bytes requested by tiny allocations
+
 	// Per-size allocation statistics.
 	// 61 is NumSizeClasses in the C code.
 	BySize [61]struct {
@@ -186,6 +218,189 @@ func readmemstats_m(stats *MemStats) {
 	stats.HeapSys -= stats.StackInuse
 }
 
+// SizeClassStats holds allocation statistics for one size class.
+type SizeClassStats struct {
+	Size         uint32 // object size; 0 for the large object entry
+	Mallocs      uint64 // number of objects allocated
+	Frees        uint64 // number of objects freed
+	InuseBytes   uint64 // bytes in live objects
+	CachedSpans  uint64 // spans cached in per-P mcaches
+	CentralSpans uint64 // spans held by the mcentral and not cached
+
+	// Contention on the size class's central span list lock, which
+	// Ps take to get spans for their caches and sweeping takes to
+	// return them.
+	LockAcquires  uint64 // times the lock was acquired
+	LockContended uint64 // acquisitions that found the lock held
+	LockWaitNs    int64  // total time spent waiting in contended acquisitions
+}
+
+// ReadSizeClassStats returns allocation statistics for every size class,
+// indexed by size class. Entry 0 describes large objects, which are
+// allocated directly from the heap and bypass the size classes.
+// Like ReadMemStats, it stops the world.
+func ReadSizeClassStats() []SizeClassStats {
+	stats := make([]SizeClassStats, _NumSizeClasses)
+	stopTheWorld("read size class stats")
+
+	systemstack(func() {
+		readsizeclassstats_m(stats)
+	})
+
+	startTheWorld()
+
+	// readsizeclassstats_m 把 cputicks 存在 LockWaitNs 里，这里再换算成纳秒。
+	tps := float64(tickspersecond())
+	for i := range stats {
+		stats[i].LockWaitNs = int64(float64(stats[i].LockWaitNs) * 1e9 / tps)
+	}
+	return stats
+}
+
+// StackCacheStats holds the statistics of the per-P stack caches
+// for one stack size.
+type StackCacheStats struct {
+	Size        uint32 // stack size in bytes
+	Allocs      uint64 // stacks allocated from a per-P cache
+	Frees       uint64 // stacks freed to a per-P cache
+	Refills     uint64 // times an empty cache was refilled from the global pool
+	Flushes     uint64 // times a cache gave stacks back to the global pool
+	CachedBytes uint64 // bytes of stacks currently held by the per-P caches
+}
+
+// ReadStackCacheStats returns the per-P stack cache statistics for
+// every cached stack size, smallest first. The counters are cumulative
+// since the program started, summed over all Ps.
+// Like ReadMemStats, it stops the world.
+func ReadStackCacheStats() []StackCacheStats {
+	stats := make([]StackCacheStats, _NumStackOrders)
+	stopTheWorld("read stack cache stats")
+
+	systemstack(func() {
+		lock(&mheap_.lock)
+		for order := range stats {
+			st, t := &stats[order], &stackcachestats[order]
+			st.Size = _FixedStack << uint(order)
+			st.Allocs, st.Frees, st.Refills, st.Flushes = t.nalloc, t.nfree, t.nrefill, t.nflush
+		}
+		unlock(&mheap_.lock)
+		for i := 0; i < int(gomaxprocs); i++ {
+			p := allp[i]
+			if p == nil || p.mcache == nil {
+				continue
+			}
+			for order := range stats {
+				st, l := &stats[order], &p.mcache.stackcache[order]
+				st.Allocs += l.nalloc
+				st.Frees += l.nfree
+				st.Refills += l.nrefill
+				st.Flushes += l.nflush
+				st.CachedBytes += uint64(l.size)
+			}
+		}
+	})
+
+	startTheWorld()
+	return stats
+}
+
+// PAllocStats holds the allocation counters of one P.
+// The counters are cumulative since the P was created;
+// they are lost when GOMAXPROCS shrinks and the P goes away.
+type PAllocStats struct {
+	ID         int32  // P id, see GOMAXPROCS
+	Mallocs    uint64 // number of objects allocated, including tiny objects
+	TinyAllocs uint64 // number of objects from the tiny allocator
+	AllocBytes uint64 // bytes allocated, rounded up to the size class except for tiny objects
+	ScanBytes  uint64 // bytes of allocated memory the GC has to scan
+}
+
+// ReadPAllocStats returns the allocation counters of every P,
+// so callers can see which Ps are allocation heavy.
+// Like ReadMemStats, it stops the world.
+func ReadPAllocStats() []PAllocStats {
+	stopTheWorld("read P alloc stats")
+
+	var stats []PAllocStats
+	for i := 0; i < int(gomaxprocs); i++ {
+		p := allp[i]
+		if p == nil || p.mcache == nil {
+			continue
+		}
+		c := p.mcache
+		stats = append(stats, PAllocStats{
+			ID:         p.id,
+			Mallocs:    c.palloc_nmalloc,
+			TinyAllocs: c.palloc_ntiny,
+			AllocBytes: c.palloc_bytes,
+			ScanBytes:  c.palloc_scan,
+		})
+	}
+
+	startTheWorld()
+	return stats
+}
+
+func readsizeclassstats_m(stats []SizeClassStats) {
+	// span 的数量要在 updatememstats flush mcache 之前统计。
+	for i := 0; ; i++ {
+		p := allp[i]
+		if p == nil {
+			break
+		}
+		c := p.mcache
+		if c == nil {
+			continue
+		}
+		for j, s := range c.alloc {
+			if s != &emptymspan {
+				stats[j].CachedSpans++
+			}
+		}
+	}
+	// 被 mcache 缓存的 span 也在 mcentral 的 empty 列表中，要减掉。
+	for i := 1; i < _NumSizeClasses; i++ {
+		c := &mheap_.central[i].mcentral
+		var n uint64
+		lock(&c.lock)
+		for s := c.nonempty.next; s != &c.nonempty; s = s.next {
+			n++
+		}
+		for s := c.empty.next; s != &c.empty; s = s.next {
+			n++
+		}
+		stats[i].LockAcquires = c.nlock
+		stats[i].LockContended = c.ncontended
+		stats[i].LockWaitNs = c.waitticks
+		unlock(&c.lock)
+		stats[i].CentralSpans = n - stats[i].CachedSpans
+	}
+
+	updatememstats(nil)
+
+	for i := 1; i < _NumSizeClasses; i++ {
+		st := &stats[i]
+		st.Size = uint32(class_to_size[i])
+		st.Mallocs = memstats.by_size[i].nmalloc
+		st.Frees = memstats.by_size[i].nfree
+		st.InuseBytes = (st.Mallocs - st.Frees) * uint64(st.Size)
+	}
+
+	// 大对象: 每个正在使用的 sizeclass 0 的 span 就是一个对象。
+	large := &stats[0]
+	lock(&mheap_.lock)
+	for i := uint32(0); i < mheap_.nspan; i++ {
+		s := h_allspans[i]
+		if s.state == mSpanInUse && s.sizeclass == 0 {
+			large.Mallocs++
+			large.InuseBytes += uint64(s.elemsize)
+		}
+	}
+	unlock(&mheap_.lock)
+	large.Frees = mheap_.nlargefree
+	large.Mallocs += large.Frees
+}
+
 //go:linkname readGCStats runtime/debug.readGCStats
 func readGCStats(pauses *[]uint64) {
 	systemstack(func() {
@@ -333,6 +548,7 @@ func flushallmcaches() {
 		}
 		mCache_ReleaseAll(c)
 		stackcache_clear(c)
+		largeCacheFlush(c)
 	}
 }
 
@@ -349,6 +565,10 @@ func purgecachedstats(c *mcache) {
 	c.local_scan = 0
 	memstats.tinyallocs += uint64(c.local_tinyallocs)
 	c.local_tinyallocs = 0
+	memstats.tiny_bytes += uint64(c.local_tinybytes)
+	c.local_tinybytes = 0
+	memstats.tiny_blocks += uint64(c.local_tinyblocks)
+	c.local_tinyblocks = 0
 	memstats.nlookup += uint64(c.local_nlookup)
 	c.local_nlookup = 0
 	h.largefree += uint64(c.local_largefree)
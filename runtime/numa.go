@@ -0,0 +1,82 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// NUMA-aware heap growth.
+//
+// 设置 GODEBUG=numa=1 并且机器有多个 NUMA node 时:
+//
+//	1. arena 按 _HeapAllocChunk(1MB) 分成一个个 chunk，mHeap_Grow 每次增长整数个 chunk，
+//	   并用 sysBindNode 把新的内存绑定(MPOL_PREFERRED)到当前线程所在的 node，
+//	   每个 chunk 属于哪个 node 记录在 h.numa.chunkNode 中。
+//	2. mcentral 给 mcache 分配 span 时(mCentral_CacheSpan)，
+//	   先在 nonempty 列表的前几个 span 中找属于当前 node 的。
+//
+// arena 仍然是一整块连续的地址空间，所以 GC 和 span 查找都不受影响。
+// 在 numa 初始化(parsedebugvars 之后)之前增长的内存不属于任何 node。
+// mheap 的空闲页合并时不区分 node，大对象也不考虑 node。
+
+package runtime
+
+import "unsafe"
+
+const (
+	numaMaxNodes  = 64 // sysBindNode 使用一个 uint64 作为 nodemask
+	numaScanSpans = 8  // mCentral_CacheSpan 最多检查几个 span
+)
+
+// mHeap_NUMAInit 在 parsedebugvars 之后由 schedinit 调用。
+func mHeap_NUMAInit(h *mheap) {
+	if debug.numa == 0 {
+		return
+	}
+	nodes := sysNUMANodes()
+	if nodes <= 1 {
+		return
+	}
+	if nodes > numaMaxNodes {
+		nodes = numaMaxNodes
+	}
+	n := (h.arena_limit - h.arena_start + _HeapAllocChunk - 1) / _HeapAllocChunk
+	p := sysAlloc(n, &memstats.other_sys)
+	if p == nil {
+		return
+	}
+	h.numa.chunkNode = (*[1 << 30]uint8)(p)[:n:n]
+	h.numa.nodes = nodes
+	h.numa.enabled = true
+}
+
+// mHeap_NUMABind 把刚从 mHeap_SysAlloc 拿到的 [v, v+n) 绑定到当前 node。
+func mHeap_NUMABind(h *mheap, v unsafe.Pointer, n uintptr) {
+	node := sysNUMANode()
+	if node < 0 || node >= h.numa.nodes {
+		return
+	}
+	sysBindNode(v, n, node)
+	// chunkNode 中保存的是 node+1, 0 表示不知道。
+	start, end := numaChunks(h.arena_start, uintptr(v), n)
+	for i := start; i < end; i++ {
+		h.numa.chunkNode[i] = uint8(node + 1)
+	}
+}
+
+// numaChunks 返回完整地落在 [v, v+n) 中的 chunk 的下标范围 [start, end)。
+// numa 初始化之前的增长和对齐到大页的增长不一定从 chunk 的边界开始, 两头不完整的 chunk
+// 里还有别的内存, 不能把它们算成这个 node 的, 保持原来的标记。
+func numaChunks(arenaStart, v, n uintptr) (start, end uintptr) {
+	start = (v - arenaStart + _HeapAllocChunk - 1) / _HeapAllocChunk
+	end = (v + n - arenaStart) / _HeapAllocChunk
+	if end < start {
+		end = start
+	}
+	return
+}
+
+// mHeap_NodeOf 返回地址 p 所在的 node，不知道时返回 -1。
+func mHeap_NodeOf(h *mheap, p uintptr) int32 {
+	if !h.numa.enabled || p < h.arena_start || p >= h.arena_used {
+		return -1
+	}
+	return int32(h.numa.chunkNode[(p-h.arena_start)/_HeapAllocChunk]) - 1
+}
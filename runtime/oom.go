@@ -0,0 +1,77 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Out of memory handling.
+//
+// heap 增长不了的时候(mHeap_Grow 已经按 mHeap_SysAllocRetry 重试过了)，mCache_Refill 和
+// largeAlloc 返回 nil, mallocgc 释放 m 之后调用 mallocgcOOM:
+//
+//	1. 如果用 SetOOMHandler 注册了回调，先调用它，让程序释放自己的缓存;
+//	   回调返回 false 表示没有办法了。
+//	2. 做一次阻塞的 GC, 把回调释放的内存真正回收。
+//	3. 重新调用 mallocgc。再失败的话重复上面的过程，最多 oomMaxRetries 次。
+//
+// 没有回调时 GODEBUG=oomgc=1 只做第 2、3 步，而且只重试一次。
+// 在 g0 上、持有锁的时候或者回调自己分配失败时都不能 GC, 只能 throw。
+
+package runtime
+
+import "unsafe"
+
+const oomMaxRetries = 3
+
+var oomHandler func(size uintptr) bool
+
+// SetOOMHandler registers f to be called when an allocation of size
+// bytes fails because the heap cannot grow. The handler should release
+// memory held by the program, such as caches, and return true to have
+// the runtime collect garbage and retry the allocation, or false to let
+// the program die with an out of memory error. If the retried
+// allocation fails again the handler is called again, up to three
+// times. A nil f removes the handler. SetOOMHandler returns the
+// previous handler.
+//
+// The handler runs on the allocating goroutine and may allocate, but
+// an allocation by the handler that runs out of memory is fatal.
+// Allocations by the runtime itself, or made while the runtime holds
+// locks, cannot call the handler and are always fatal.
+func SetOOMHandler(f func(size uintptr) bool) func(size uintptr) bool {
+	old := oomHandler
+	oomHandler = f
+	return old
+}
+
+// mallocgcOOM 由 mallocgc 在分配 size 字节失败、释放 m 之后调用，返回重试分配的结果。
+func mallocgcOOM(size uintptr, typ *_type, flags uint32) unsafe.Pointer {
+	gp := getg()
+	if gp == gp.m.g0 || gp.m.locks != 0 || gp.inoomhandler {
+		throw("out of memory")
+	}
+	f := oomHandler
+	max := uint8(oomMaxRetries)
+	if f == nil {
+		if debug.oomgc == 0 {
+			throw("out of memory")
+		}
+		max = 1
+	}
+	if gp.oomretries >= max {
+		gp.oomretries = 0
+		throw("out of memory")
+	}
+	gp.oomretries++
+	if f != nil {
+		gp.inoomhandler = true
+		retry := f(size)
+		gp.inoomhandler = false
+		if !retry {
+			gp.oomretries = 0
+			throw("out of memory")
+		}
+	}
+	startGC(gcForceBlockMode, false)
+	x := mallocgc(size, typ, flags)
+	gp.oomretries = 0
+	return x
+}
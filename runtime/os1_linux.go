@@ -236,35 +236,79 @@ func unminit() {
 	signalstack(nil)
 }
 
-func memlimit() uintptr {
-	/*
-		TODO: Convert to Go when something actually uses the result.
+var (
+	cgroup2MemMax = []byte("/sys/fs/cgroup/memory.max\x00")
+	cgroup1MemLmt = []byte("/sys/fs/cgroup/memory/memory.limit_in_bytes\x00")
+)
 
-		Rlimit rl;
-		extern byte runtime·text[], runtime·end[];
-		uintptr used;
+// memlimit returns the amount of memory the heap may use, 0 if unlimited.
+// It is the smaller of the RLIMIT_AS limit (minus an estimate of the
+// non-heap footprint) and the memory limit of the process's cgroup.
+func memlimit() uintptr {
+	limit := rlimitAS()
+	if l := cgroupMemLimit(); l != 0 && (limit == 0 || l < limit) {
+		limit = l
+	}
+	return limit
+}
 
-		if(runtime·getrlimit(RLIMIT_AS, &rl) != 0)
-			return 0;
-		if(rl.rlim_cur >= 0x7fffffff)
-			return 0;
+func rlimitAS() uintptr {
+	var rl rlimit
+	if getrlimit(_RLIMIT_AS, unsafe.Pointer(&rl)) != 0 {
+		return 0
+	}
+	if rl.rlim_cur == ^uintptr(0) { // RLIM_INFINITY
+		return 0
+	}
+	if ptrSize == 4 && rl.rlim_cur >= 0x7fffffff {
+		// 32 位系统上 2GB 以上的限制不会比地址空间本身更小。
+		return 0
+	}
 
-		// Estimate our VM footprint excluding the heap.
-		// Not an exact science: use size of binary plus
-		// some room for thread stacks.
-		used = runtime·end - runtime·text + (64<<20);
-		if(used >= rl.rlim_cur)
-			return 0;
+	// Estimate our VM footprint excluding the heap.
+	// Not an exact science: use size of binary plus
+	// some room for thread stacks.
+	used := firstmoduledata.end - firstmoduledata.text + (64 << 20)
+	if used >= rl.rlim_cur {
+		return 0
+	}
 
-		// If there's not at least 16 MB left, we're probably
-		// not going to be able to do much.  Treat as no limit.
-		rl.rlim_cur -= used;
-		if(rl.rlim_cur < (16<<20))
-			return 0;
+	// If there's not at least 16 MB left, we're probably
+	// not going to be able to do much.  Treat as no limit.
+	rl.rlim_cur -= used
+	if rl.rlim_cur < (16 << 20) {
+		return 0
+	}
 
-		return rl.rlim_cur - used;
-	*/
+	return rl.rlim_cur
+}
 
+// cgroupMemLimit 读取 cgroup v2 的 memory.max 或者 cgroup v1 的 memory.limit_in_bytes。
+// 文件中是 "max" 或者一个很大的数(v1 没有限制时)都当作没有限制。
+func cgroupMemLimit() uintptr {
+	for _, path := range [][]byte{cgroup2MemMax, cgroup1MemLmt} {
+		fd := open(&path[0], _O_RDONLY, 0)
+		if fd < 0 {
+			continue
+		}
+		var buf [32]byte
+		n := read(fd, unsafe.Pointer(&buf[0]), int32(len(buf)))
+		closefd(fd)
+		if n <= 0 {
+			continue
+		}
+		var v uint64
+		for _, c := range buf[:n] {
+			if c < '0' || c > '9' {
+				break
+			}
+			v = v*10 + uint64(c-'0')
+		}
+		if v == 0 || v >= 1<<62 || uint64(uintptr(v)) != v {
+			return 0
+		}
+		return uintptr(v)
+	}
 	return 0
 }
 
@@ -9,6 +9,8 @@ import "unsafe"
 //go:noescape
 func futex(addr unsafe.Pointer, op int32, val uint32, ts, addr2 unsafe.Pointer, val3 uint32) int32
 
+func madviseErr(addr unsafe.Pointer, n uintptr, flags int32) int32
+
 //go:noescape
 func clone(flags int32, stk, mm, gg, fn unsafe.Pointer) int32
 
@@ -87,6 +87,10 @@ func dopanic_m(gp *g, pc, sp uintptr) {
 	if gp.sig != 0 {
 		print("[signal ", hex(gp.sig), " code=", hex(gp.sigcode0), " addr=", hex(gp.sigcode1), " pc=", hex(gp.sigpc), "]\n")
 	}
+	if chandeadlock {
+		chandeadlock = false
+		printchanwaitgraph()
+	}
 
 	var docrash bool
 	_g_ := getg()
@@ -104,6 +108,9 @@ func dopanic_m(gp *g, pc, sp uintptr) {
 			tracebackothers(gp)
 		}
 	}
+	if _g_.m.throwing > 0 {
+		blackboxThrow(gp, pc, sp)
+	}
 	unlock(&paniclk)
 
 	if xadd(&panicking, -1) != 0 {
@@ -0,0 +1,141 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Resettable persistent allocator regions.
+//
+// persistentalloc 没有对应的 free 操作，适合函数、类型这类跟进程同生共死的数据。
+// 生命周期有限的数据(比如每个测试用的元数据)可以用 persistentRegion:
+// 分配的方式跟 persistentalloc 一样，从 chunk 里按顺序切出来，
+// 但是 chunk 都挂在 region 上，可以用 persistentRegionReset 整体重置，
+// 或者用 persistentRegionFree 整体通过 sysFree 还给 OS。
+// region 之间、region 和全局的 persistentalloc 之间互不影响。
+//
+//	region.chunks -> [hdr | objects ...] -> [hdr | objects ...] -> nil
+//	                  ^ region.cur 是第一个 chunk
+
+package runtime
+
+import "unsafe"
+
+const (
+	persistentRegionChunk    = 256 << 10
+	persistentRegionMaxBlock = 64 << 10 // 和 persistentalloc 一样，更大的对象单独占一个 chunk
+)
+
+type persistentRegion struct {
+	lock    mutex
+	chunks  *persistentRegionHdr // 所有的 chunk, 新的在前面
+	cur     persistentAlloc      // 当前在切分的 chunk
+	sysStat *uint64              // 记账用的 memstats 字段
+	sys     uintptr              // 从 OS 申请的总大小
+}
+
+// persistentRegionHdr 放在每个 chunk 的开头。
+type persistentRegionHdr struct {
+	next *persistentRegionHdr
+	size uintptr // 包括 hdr 在内的 chunk 大小
+}
+
+// persistentRegionInit 初始化 region, 以后从 OS 申请的内存都记在 sysStat 上。
+func persistentRegionInit(r *persistentRegion, sysStat *uint64) {
+	r.sysStat = sysStat
+}
+
+// persistentRegionAlloc 从 r 中分配 size 大小、按 align 对齐的内存，内存是清零的。
+// If align is 0, uses default align (currently 8).
+func persistentRegionAlloc(r *persistentRegion, size, align uintptr) unsafe.Pointer {
+	var p unsafe.Pointer
+	systemstack(func() {
+		p = persistentRegionAlloc1(r, size, align)
+	})
+	return p
+}
+
+func persistentRegionAlloc1(r *persistentRegion, size, align uintptr) unsafe.Pointer {
+	if size == 0 {
+		throw("persistentRegionAlloc: size == 0")
+	}
+	if align != 0 {
+		if align&(align-1) != 0 {
+			throw("persistentRegionAlloc: align is not a power of 2")
+		}
+		if align > _PageSize {
+			throw("persistentRegionAlloc: align is too large")
+		}
+	} else {
+		align = 8
+	}
+	hdrSize := round(unsafe.Sizeof(persistentRegionHdr{}), align)
+
+	lock(&r.lock)
+	if size >= persistentRegionMaxBlock {
+		// 大对象单独一个 chunk, 放在链表上但不作为当前 chunk。
+		hdr := persistentRegionNewChunk(r, hdrSize+size)
+		unlock(&r.lock)
+		return add(unsafe.Pointer(hdr), hdrSize)
+	}
+	r.cur.off = round(r.cur.off, align)
+	if r.cur.base == nil || r.cur.off+size > persistentRegionChunk {
+		r.cur.base = unsafe.Pointer(persistentRegionNewChunk(r, persistentRegionChunk))
+		r.cur.off = hdrSize
+	}
+	p := add(r.cur.base, r.cur.off)
+	r.cur.off += size
+	unlock(&r.lock)
+	return p
+}
+
+// persistentRegionNewChunk 从 OS 申请一个 n 字节的 chunk 挂到 r 上, 调用者持有 r.lock。
+func persistentRegionNewChunk(r *persistentRegion, n uintptr) *persistentRegionHdr {
+	v := sysAlloc(n, r.sysStat)
+	if v == nil {
+		unlock(&r.lock)
+		throw("runtime: cannot allocate memory")
+	}
+	hdr := (*persistentRegionHdr)(v)
+	hdr.size = n
+	hdr.next = r.chunks
+	r.chunks = hdr
+	r.sys += n
+	return hdr
+}
+
+// persistentRegionReset 让 r 中之前分配的内存全部作废，可以重新分配。
+// 只保留当前的 chunk(清零后继续使用)，其他的 chunk 都还给 OS。
+// 调用者要保证已经没有人在使用之前分配的内存了。
+func persistentRegionReset(r *persistentRegion) {
+	lock(&r.lock)
+	cur := (*persistentRegionHdr)(r.cur.base)
+	persistentRegionRelease(r, cur)
+	if cur != nil {
+		hdrSize := unsafe.Sizeof(persistentRegionHdr{})
+		memclr(add(unsafe.Pointer(cur), hdrSize), r.cur.off-hdrSize)
+		cur.next = nil
+		r.chunks = cur
+		r.cur.off = hdrSize
+	}
+	unlock(&r.lock)
+}
+
+// persistentRegionFree 把 r 的所有 chunk 都还给 OS, 之后 r 还可以继续使用。
+func persistentRegionFree(r *persistentRegion) {
+	lock(&r.lock)
+	persistentRegionRelease(r, nil)
+	r.cur.base = nil
+	r.cur.off = 0
+	unlock(&r.lock)
+}
+
+// persistentRegionRelease 把 keep 以外的 chunk 都 sysFree 掉, 调用者持有 r.lock。
+func persistentRegionRelease(r *persistentRegion, keep *persistentRegionHdr) {
+	for hdr := r.chunks; hdr != nil; {
+		next := hdr.next
+		if hdr != keep {
+			r.sys -= hdr.size
+			sysFree(unsafe.Pointer(hdr), hdr.size, r.sysStat)
+		}
+		hdr = next
+	}
+	r.chunks = nil
+}
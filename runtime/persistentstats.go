@@ -0,0 +1,105 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Statistics of persistentalloc.
+//
+// persistentalloc 分配的内存永远不释放，itab、profile bucket、finalizer block、
+// fixalloc 的 chunk 等都来自这里。按调用者传入的 sysStat (也就是 MemStats 中记账的字段)
+// 分类统计分配的次数和字节数，另外记录向操作系统申请了多少 chunk、有多少分配走了
+// 没有 P 的路径。persistentalloc1 在任何 P 上都可能并发调用，所以都是原子操作。
+
+package runtime
+
+const (
+	persistentKindOther = iota
+	persistentKindGC
+	persistentKindBuckHash
+	persistentKindMSpan
+	persistentKindMCache
+	persistentNumKinds
+)
+
+var persistentKindNames = [persistentNumKinds]string{"OtherSys", "GCSys", "BuckHashSys", "MSpanSys", "MCacheSys"}
+
+var persistentStats struct {
+	nalloc     [persistentNumKinds]uint64 // 分配次数
+	bytes      [persistentNumKinds]uint64 // 分配的字节数
+	chunks     uint64                     // 向操作系统申请的 chunk 数
+	chunkBytes uint64                     // 这些 chunk 的总大小
+	large      uint64                     // 太大、直接用 sysAlloc 的分配次数
+	largeBytes uint64
+	nop        uint64 // 没有 P 的 M 在自己的 chunk 中的分配次数
+	global     uint64 // 用全局加锁的 globalAlloc 的分配次数
+}
+
+func persistentKind(sysStat *uint64) int {
+	switch sysStat {
+	case &memstats.gc_sys:
+		return persistentKindGC
+	case &memstats.buckhash_sys:
+		return persistentKindBuckHash
+	case &memstats.mspan_sys:
+		return persistentKindMSpan
+	case &memstats.mcache_sys:
+		return persistentKindMCache
+	}
+	return persistentKindOther
+}
+
+func persistentStatAlloc(size uintptr, sysStat *uint64) {
+	k := persistentKind(sysStat)
+	xadd64(&persistentStats.nalloc[k], 1)
+	xadd64(&persistentStats.bytes[k], int64(size))
+}
+
+func persistentStatLarge(size uintptr, sysStat *uint64) {
+	persistentStatAlloc(size, sysStat)
+	xadd64(&persistentStats.large, 1)
+	xadd64(&persistentStats.largeBytes, int64(size))
+}
+
+// PersistentAllocStats describes the runtime's persistent allocations,
+// memory for runtime metadata such as itabs, profiling buckets and span
+// structures that is never freed.
+type PersistentAllocStats struct {
+	Chunks     uint64 // chunks obtained from the OS to carve allocations from
+	ChunkBytes uint64 // total size of those chunks
+	Large      uint64 // allocations too large for a chunk, obtained from the OS directly
+	LargeBytes uint64 // total size of those allocations
+	NoP        uint64 // allocations by threads without a P, from their own small chunk
+	Global     uint64 // allocations from the shared locked chunk
+
+	// BySys breaks the allocations down by the MemStats field
+	// they are accounted in.
+	BySys []PersistentAllocSys
+}
+
+// A PersistentAllocSys counts the persistent allocations accounted in
+// one MemStats field.
+type PersistentAllocSys struct {
+	Name   string // name of the MemStats field, such as "GCSys"
+	Allocs uint64 // number of allocations
+	Bytes  uint64 // bytes allocated
+}
+
+// ReadPersistentAllocStats returns statistics about persistent allocations.
+func ReadPersistentAllocStats() PersistentAllocStats {
+	s := PersistentAllocStats{
+		Chunks:     atomicload64(&persistentStats.chunks),
+		ChunkBytes: atomicload64(&persistentStats.chunkBytes),
+		Large:      atomicload64(&persistentStats.large),
+		LargeBytes: atomicload64(&persistentStats.largeBytes),
+		NoP:        atomicload64(&persistentStats.nop),
+		Global:     atomicload64(&persistentStats.global),
+	}
+	s.BySys = make([]PersistentAllocSys, persistentNumKinds)
+	for k := range s.BySys {
+		s.BySys[k] = PersistentAllocSys{
+			Name:   persistentKindNames[k],
+			Allocs: atomicload64(&persistentStats.nalloc[k]),
+			Bytes:  atomicload64(&persistentStats.bytes[k]),
+		}
+	}
+	return s
+}
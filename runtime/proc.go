@@ -118,7 +118,7 @@ func main() {
 	// let the other goroutine finish printing the panic trace.
 	// Once it does, it will exit. See issue 3934.
 	if panicking != 0 {
-		gopark(nil, nil, "panicwait", traceEvGoStop, 1)
+		gopark(nil, nil, waitReasonPanicWait, traceEvGoStop, 1)
 	}
 
 	exit(0)
@@ -149,7 +149,7 @@ func forcegchelper() {
 			throw("forcegc: phase error")
 		}
 		atomicstore(&forcegc.idle, 1)
-		goparkunlock(&forcegc.lock, "force gc (idle)", traceEvGoBlock, 1)
+		goparkunlock(&forcegc.lock, waitReasonForceGCIdle, traceEvGoBlock, 1)
 		// this goroutine is explicitly resumed by sysmon
 		if debug.gctrace > 0 {
 			println("GC forced")
@@ -168,7 +168,7 @@ func Gosched() {
 
 // Puts the current goroutine into a waiting state and calls unlockf.
 // If unlockf returns false, the goroutine is resumed.
-func gopark(unlockf func(*g, unsafe.Pointer) bool, lock unsafe.Pointer, reason string, traceEv byte, traceskip int) {
+func gopark(unlockf func(*g, unsafe.Pointer) bool, lock unsafe.Pointer, reason waitReason, traceEv byte, traceskip int) {
 	mp := acquirem()
 	gp := mp.curg
 	status := readgstatus(gp)
@@ -187,7 +187,7 @@ func gopark(unlockf func(*g, unsafe.Pointer) bool, lock unsafe.Pointer, reason s
 
 // Puts the current goroutine into a waiting state and unlocks the lock.
 // The goroutine can be made runnable again by calling goready(gp).
-func goparkunlock(lock *mutex, reason string, traceEv byte, traceskip int) {
+func goparkunlock(lock *mutex, reason waitReason, traceEv byte, traceskip int) {
 	gopark(parkunlock_c, unsafe.Pointer(lock), reason, traceEv, traceskip)
 }
 
@@ -231,6 +231,11 @@ func acquireSudog() *sudog {
 	if s.elem != nil {
 		throw("acquireSudog: found s.elem != nil in cache")
 	}
+	s.prio = getg().chanprio
+	if debug.chanstats != 0 {
+		s.stat = true
+		xadd64(&chanstats.sudogs, 1)
+	}
 	releasem(mp)
 	return s
 }
@@ -252,10 +257,18 @@ func releaseSudog(s *sudog) {
 	if s.waitlink != nil {
 		throw("runtime: sudog with non-nil waitlink")
 	}
+	if s.spin != 0 {
+		throw("runtime: sudog with non-zero spin")
+	}
 	gp := getg()
 	if gp.param != nil {
 		throw("runtime: releaseSudog with non-nil gp.param")
 	}
+	s.c = nil
+	if s.stat {
+		s.stat = false
+		xadd64(&chanstats.sudogs, -1)
+	}
 	mp := acquirem() // avoid rescheduling to another P
 	pp := mp.p.ptr()
 	if len(pp.sudogcache) == cap(pp.sudogcache) {
@@ -282,6 +295,27 @@ func releaseSudog(s *sudog) {
 	releasem(mp)
 }
 
+// sudogcacheflush moves all sudogs cached by pp to the central cache.
+// It is called when pp is destroyed by procresize.
+func sudogcacheflush(pp *p) {
+	if len(pp.sudogcache) == 0 {
+		return
+	}
+	var first, last *sudog
+	for _, s := range pp.sudogcache {
+		if first == nil {
+			first = s
+		} else {
+			last.next = s
+		}
+		last = s
+	}
+	lock(&sched.sudoglock)
+	last.next = sched.sudogcache
+	sched.sudogcache = first
+	unlock(&sched.sudoglock)
+}
+
 // funcPC returns the entry PC of the function f.
 // It assumes that f is a func value. Otherwise the behavior is undefined.
 //go:nosplit
@@ -54,11 +54,13 @@ func schedinit() {
 	moduledataverify()
 	stackinit()
 	mallocinit()
+	itabsinit() // 在任何 getitab 之前
 	mcommoninit(_g_.m)
 
 	goargs()
 	goenvs()
 	parsedebugvars()
+	mHeap_NUMAInit(&mheap_)
 	gcinit()
 
 	sched.lastpoll = uint64(nanotime())
@@ -1751,8 +1753,9 @@ func goexit0(gp *g) {
 	gp._defer = nil // should be true already but just in case.
 	gp._panic = nil // non-nil for Goexit during panic. points at stack-allocated data.
 	gp.writebuf = nil
-	gp.waitreason = ""
+	gp.waitreason = 0
 	gp.param = nil
+	gp.chanprio = 0
 
 	dropg()
 
@@ -2759,6 +2762,8 @@ func procresize(nprocs int32) *p {
 			globrunqput(p.gcBgMarkWorker)
 			p.gcBgMarkWorker = nil
 		}
+		// 缓存的 sudog 还给全局的 sched.sudogcache, 和 releaseSudog 中转移一半的做法一样
+		sudogcacheflush(p)
 		for i := range p.sudogbuf {
 			p.sudogbuf[i] = nil
 		}
@@ -2796,6 +2801,7 @@ func procresize(nprocs int32) *p {
 			traceGoStart()
 		}
 	}
+
 	var runnablePs *p
 	for i := nprocs - 1; i >= 0; i-- {
 		p := allp[i]
@@ -2953,6 +2959,7 @@ func checkdead() {
 	}
 
 	getg().m.throwing = -1 // do not dump full stacks
+	chandeadlock = true
 	throw("all goroutines are asleep - deadlock!")
 }
 
@@ -2980,6 +2987,7 @@ func sysmon() {
 	}
 
 	lasttrace := int64(0)
+	lastleakcheck := nanotime()
 	idle := 0 // how many cycles in succession we had not wokeup somebody
 	delay := uint32(0)
 	for {
@@ -3047,11 +3055,21 @@ func sysmon() {
 			mHeap_Scavenge(int32(nscavenge), uint64(now), uint64(scavengelimit))
 			lastscavenge = now
 			nscavenge++
+		} else if lastscavenge+scavengelimit/10 < now && mHeap_ScavengeNeeded() {
+			// Too much idle memory is held after a burst of allocation,
+			// release spans that have been unused for scavengelimit/10.
+			mHeap_Scavenge(int32(nscavenge), uint64(now), uint64(scavengelimit/10))
+			lastscavenge = now
+			nscavenge++
 		}
 		if debug.schedtrace > 0 && lasttrace+int64(debug.schedtrace*1000000) <= now {
 			lasttrace = now
 			schedtrace(debug.scheddetail > 0)
 		}
+		if debug.chanleak > 0 && lastleakcheck+int64(debug.chanleak)*1e9 <= now {
+			lastleakcheck = now
+			chanleakwake()
+		}
 	}
 }
 
@@ -3251,7 +3269,7 @@ func schedtrace(detailed bool) {
 		if lockedm != nil {
 			id2 = lockedm.id
 		}
-		print("  G", gp.goid, ": status=", readgstatus(gp), "(", gp.waitreason, ") m=", id1, " lockedm=", id2, "\n")
+		print("  G", gp.goid, ": status=", readgstatus(gp), "(", gp.waitreason.String(), ") m=", id1, " lockedm=", id2, "\n")
 	}
 	unlock(&allglock)
 	unlock(&sched.lock)
@@ -0,0 +1,163 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// rawfree 是 rawmem 的反操作，把不再使用的内存立刻还回去，而不用等下一次 GC。
+//
+//   - 小对象放回所在 span 的 freelist。span 在当前 P 的 mcache 中时不需要加锁；
+//     在 mcentral 中时加 mcentral 的锁，span 空了就还给 heap。
+//   - 大对象的 span 放到 mcache 的 largecache 里或者直接 mHeap_Free。
+//
+// 为了不和 GC 冲突，只在 gcphase == _GCoff 而且 span 已经被 sweep 过的时候才释放，
+// 其他情况(包括被别的 P 缓存的 span、当前 P 缓存的 span 中最后一个在用的对象、
+// tiny 分配器分配的对象)什么都不做，等 GC 回收。
+// 被 heap profile 采样的对象释放时会记一次 mProf_Free, 和 sweep 释放的时候一样。
+// 调用者要保证 p 之后不会再被使用。
+
+package runtime
+
+import "unsafe"
+
+// rawfree frees the chunk p of size bytes returned by rawmem.
+// It throws if p is not the start of a pointer-free heap object of that size.
+func rawfree(p unsafe.Pointer, size uintptr) {
+	if p == nil || size < maxTinySize {
+		// Objects obtained from tiny allocator must not be freed explicitly.
+		return
+	}
+	mp := acquirem()
+	if mp.mallocing != 0 {
+		throw("rawfree deadlock")
+	}
+	mp.mallocing = 1
+	mp.mallocpc = getcallerpc(unsafe.Pointer(&p))
+	mp.mallocsize = size
+	systemstack(func() {
+		rawfree_m(gomcache(), uintptr(p), size)
+	})
+	mp.mallocing = 0
+	releasem(mp)
+}
+
+func rawfree_m(c *mcache, p, size uintptr) {
+	s := mHeap_LookupMaybe(&mheap_, unsafe.Pointer(p))
+	if s == nil || s.state != _MSpanInUse || p != s.base()+(p-s.base())/s.elemsize*s.elemsize {
+		print("runtime: rawfree ", hex(p), " is not the start of a heap object\n")
+		throw("rawfree: bad pointer")
+	}
+	if size > s.elemsize || (s.sizeclass != 0 && roundupsize(size) != s.elemsize) {
+		print("runtime: rawfree ", hex(p), " size ", size, ", object size ", s.elemsize, "\n")
+		throw("rawfree: bad size")
+	}
+	if heapBitsForAddr(p).hasPointers(s.elemsize) {
+		print("runtime: rawfree ", hex(p), " in a span with pointers\n")
+		throw("rawfree: object has pointers")
+	}
+	if gcphase != _GCoff || atomicload(&s.sweepgen) != mheap_.sweepgen {
+		return
+	}
+	if s.specials != nil {
+		rawfreeSpecials(s, p)
+	}
+
+	if s.sizeclass == 0 {
+		// 大对象, 和 mSpan_Sweep 释放大对象的过程一样。
+		heapBitsForSpan(p).initSpan(s.layout())
+		s.needzero = 1
+		largeObjForget(s.base())
+		if s.guardpage != 0 {
+			guardFree(s)
+		}
+		if !largeCachePut(c, s) {
+			mHeap_Free(&mheap_, s, 1)
+		}
+		c.local_nlargefree++
+		c.local_largefree += s.elemsize
+		return
+	}
+
+	cl := int32(s.sizeclass)
+	rawfreeMarkZero(p, s.elemsize)
+	v := gclinkptr(p)
+	if c.alloc[cl] == s {
+		// 当前 P 缓存的 span, 只有我们会用它。
+		// 最后一个对象留给 sweep: 缓存着的 span 的 ref 不能变成 0,
+		// 否则 mCentral_UncacheSpan 会 throw("uncaching full span")。
+		if s.ref == 1 {
+			return
+		}
+		v.ptr().next = s.freelist
+		s.freelist = v
+		s.ref--
+		c.local_nsmallfree[cl]++
+		return
+	}
+
+	mc := &mheap_.central[cl].mcentral
+	lock(&mc.lock)
+	if s.incache {
+		// 被别的 P 缓存着，不能动它的 freelist。
+		unlock(&mc.lock)
+		return
+	}
+	wasempty := s.freelist.ptr() == nil
+	v.ptr().next = s.freelist
+	s.freelist = v
+	s.ref--
+	c.local_nsmallfree[cl]++
+	if wasempty {
+		mSpanList_Remove(s)
+		mSpanList_Insert(&mc.nonempty, s)
+	}
+	if s.ref != 0 {
+		unlock(&mc.lock)
+		return
+	}
+	// span 里的对象全部释放了，还给 heap, 见 mCentral_FreeSpan。
+	mSpanList_Remove(s)
+	s.needzero = 1
+	s.freelist = 0
+	unlock(&mc.lock)
+	heapBitsForSpan(s.base()).initSpan(s.layout())
+	mHeap_Free(&mheap_, s, 0)
+}
+
+// rawfreeSpecials 和 mSpan_Sweep 一样，删掉对象 p 的 special 记录。
+// 被 heap profile 采样的对象要告诉 mProf_Free, 否则 profile 里这个对象永远是 in-use 的。
+// 因为对象是现在就释放的，不用等到下一次 GC, 所以记到 recent_frees 里(freed 为 true)。
+// 设置了 finalizer 的对象不能直接释放。
+func rawfreeSpecials(s *mspan, p uintptr) {
+	var profile *special
+	off := p - s.base()
+	lock(&s.speciallock)
+	specialp := &s.specials
+	for sp := *specialp; sp != nil; sp = *specialp {
+		if uintptr(sp.offset) < off || uintptr(sp.offset) >= off+s.elemsize {
+			specialp = &sp.next
+			continue
+		}
+		if sp.kind != _KindSpecialProfile {
+			unlock(&s.speciallock)
+			print("runtime: rawfree ", hex(p), " has a finalizer\n")
+			throw("rawfree: object has a finalizer")
+		}
+		*specialp = sp.next
+		profile = sp
+	}
+	unlock(&s.speciallock)
+	if profile != nil {
+		freespecial(profile, unsafe.Pointer(p), s.elemsize, true)
+	}
+}
+
+// rawfreeMarkZero 和 mSpan_Sweep 释放小对象时一样，标记对象在下次分配时需要清零。
+func rawfreeMarkZero(p, size uintptr) {
+	if size > 2*ptrSize {
+		*(*uintptr)(unsafe.Pointer(p + ptrSize)) = uintptrMask & 0xdeaddeaddeaddead // mark as "needs to be zeroed"
+	} else if size > ptrSize {
+		*(*uintptr)(unsafe.Pointer(p + ptrSize)) = 0
+	}
+	if debug.mallocpoison != 0 {
+		mallocPoison(p, size)
+	}
+}
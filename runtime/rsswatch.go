@@ -0,0 +1,104 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Soft RSS watchdog.
+//
+// GOGC 只看 heap_live, 不管 runtime 从操作系统拿了多少内存: 突发的分配过后 heap 里留着大量
+// 空闲的 span, 要等 sysmon 的 scavenger 才还回去(见 mHeap_ScavengeNeeded)。
+// 用 SetRSSWatchdog 设置一个阈值后，mallocgc 在换 span 或者分配大对象时(shouldhelpgc)
+// 估算一次进程占用的内存，超过阈值就轮流:
+//
+//	1. 上次动作之后完成过一次 GC: 把所有空闲的页还给操作系统
+//	2. 否则，没有 GC 在进行时开始一次后台 GC, 等它结束后下一次检查时再 scavenge
+//
+// 估算的值是 heap_sys - heap_released + heap_released_lazy, 加上其他的 xxx_sys。
+// 栈是从 heap 中分配的，已经算在 heap_sys 里(stacks_sys 总是 0)。MADV_FREE 释放的内存
+// 在操作系统回收之前还算在 RSS 里，所以把 heap_released_lazy 加回来。
+// 这里不加锁读 memstats, 只是个大概的值。
+
+package runtime
+
+var rssWatch struct {
+	limit uint64 // 0 表示关闭, 原子操作
+	busy  uint32 // 同一时间只有一个 goroutine 做检查之后的动作
+	gcAt  uint32 // 上次动作时的 memstats.numgc
+
+	// 统计, 原子操作
+	nover     uint64 // 超过阈值的次数
+	ngc       uint64 // 开始的 GC 次数
+	nscavenge uint64 // scavenge 的次数
+	released  uint64 // scavenge 释放的字节数
+}
+
+// SetRSSWatchdog sets a soft limit on the memory the runtime holds from
+// the operating system and returns the previous limit. A zero limit
+// disables the watchdog, which is the default.
+//
+// While the memory held exceeds the limit, allocation alternately
+// starts a garbage collection and returns idle heap memory to the
+// operating system, instead of waiting for GOGC to trigger a collection
+// and for the periodic scavenger to release memory.
+func SetRSSWatchdog(limit uint64) uint64 {
+	old := atomicload64(&rssWatch.limit)
+	atomicstore64(&rssWatch.limit, limit)
+	return old
+}
+
+// RSSWatchdogStats counts the actions of the RSS watchdog.
+type RSSWatchdogStats struct {
+	Over      uint64 // times the memory held was found over the limit
+	GCs       uint64 // garbage collections started by the watchdog
+	Scavenges uint64 // times the watchdog returned idle memory to the OS
+	Released  uint64 // bytes returned to the OS by the watchdog
+}
+
+// ReadRSSWatchdogStats returns the counters of the RSS watchdog.
+func ReadRSSWatchdogStats() RSSWatchdogStats {
+	return RSSWatchdogStats{
+		Over:      atomicload64(&rssWatch.nover),
+		GCs:       atomicload64(&rssWatch.ngc),
+		Scavenges: atomicload64(&rssWatch.nscavenge),
+		Released:  atomicload64(&rssWatch.released),
+	}
+}
+
+// rssEstimate 估算 runtime 占用的内存，见文件开头的说明。
+func rssEstimate() uint64 {
+	heap := memstats.heap_sys - memstats.heap_released + memstats.heap_released_lazy
+	return heap + memstats.mspan_sys + memstats.mcache_sys + memstats.buckhash_sys + memstats.gc_sys + memstats.other_sys
+}
+
+// rssWatchCheck 由 mallocgc 在 shouldhelpgc 时调用。
+func rssWatchCheck() {
+	limit := atomicload64(&rssWatch.limit)
+	if limit == 0 || rssEstimate() <= limit {
+		return
+	}
+	// 和 startGC 一样，持有锁、在 g0 上或者不能被抢占时不做任何事，留给下一次分配。
+	gp := getg()
+	if gp == gp.m.g0 || gp.m.locks != 0 || gp.m.preemptoff != "" || !memstats.enablegc || panicking != 0 {
+		return
+	}
+	if !cas(&rssWatch.busy, 0, 1) {
+		return
+	}
+	xadd64(&rssWatch.nover, 1)
+	if numgc := atomicload(&memstats.numgc); numgc != rssWatch.gcAt {
+		rssWatch.gcAt = numgc
+		var released uintptr
+		systemstack(func() { released = mHeap_Scavenge(-1, ^uint64(0), 0) })
+		xadd64(&rssWatch.nscavenge, 1)
+		xadd64(&rssWatch.released, int64(released))
+		if debug.gctrace > 0 {
+			print("rsswatch: ", rssEstimate()>>20, " MB held, limit ", limit>>20, " MB, ", released>>20, " MB released\n")
+		}
+		atomicstore(&rssWatch.busy, 0)
+		return
+	}
+	atomicstore(&rssWatch.busy, 0)
+	if atomicloaduint(&bggc.working) == 0 && gcpercent >= 0 {
+		xadd64(&rssWatch.ngc, 1)
+		startGC(gcBackgroundMode, true)
+	}
+}
@@ -84,6 +84,36 @@ func goenvs_unix() {
 	}
 }
 
+// earlydebugvar 返回 GODEBUG 中 name 的值，没有设置时返回 0。
+// mallocinit 在 goenvs 和 parsedebugvars 之前就要用到个别 GODEBUG 变量，
+// 这时还不能分配内存，所以直接在 argv 后面的 envp 中查找。
+// 只支持用 goenvs_unix 的系统，其他系统总是返回 0。
+func earlydebugvar(name string) int32 {
+	if GOOS == "windows" || GOOS == "plan9" || GOOS == "js" || argv == nil {
+		return 0
+	}
+	for i := argc + 1; argv_index(argv, i) != nil; i++ {
+		env := gostringnocopy(argv_index(argv, i))
+		if !hasprefix(env, "GODEBUG=") {
+			continue
+		}
+		for p := env[len("GODEBUG="):]; p != ""; {
+			field := ""
+			j := index(p, ",")
+			if j < 0 {
+				field, p = p, ""
+			} else {
+				field, p = p[:j], p[j+1:]
+			}
+			j = index(field, "=")
+			if j >= 0 && field[:j] == name {
+				return int32(atoi(field[j+1:]))
+			}
+		}
+	}
+	return 0
+}
+
 func environ() []string {
 	return envs
 }
@@ -305,6 +335,17 @@ type dbgVar struct {
 // already have an initial value.
 var debug struct {
 	allocfreetrace    int32
+	allocprefetch     int32
+	alloctrace        int32
+	arenaaslr         int32
+	blackbox          int32
+	cgotrack          int32
+	chanleak          int32
+	chanlifo          int32
+	chanpanicdetail   int32
+	chanregistry      int32
+	chanstats         int32
+	checkzero         int32
 	efence            int32
 	gccheckmark       int32
 	gcpacertrace      int32
@@ -312,7 +353,16 @@ var debug struct {
 	gcstackbarrieroff int32
 	gcstoptheworld    int32
 	gctrace           int32
+	guardpage         int32
+	heaplimit         int32
+	hugepages         int32
+	ifacestats        int32
 	invalidptr        int32
+	largetrack        int32
+	madvdontneed      int32
+	mallocpoison      int32
+	numa              int32
+	oomgc             int32
 	sbrk              int32
 	scavenge          int32
 	scheddetail       int32
@@ -322,6 +372,17 @@ var debug struct {
 
 var dbgvars = []dbgVar{
 	{"allocfreetrace", &debug.allocfreetrace},
+	{"allocprefetch", &debug.allocprefetch},
+	{"alloctrace", &debug.alloctrace},
+	{"arenaaslr", &debug.arenaaslr},
+	{"blackbox", &debug.blackbox},
+	{"cgotrack", &debug.cgotrack},
+	{"chanleak", &debug.chanleak},
+	{"chanlifo", &debug.chanlifo},
+	{"chanpanicdetail", &debug.chanpanicdetail},
+	{"chanregistry", &debug.chanregistry},
+	{"chanstats", &debug.chanstats},
+	{"checkzero", &debug.checkzero},
 	{"efence", &debug.efence},
 	{"gccheckmark", &debug.gccheckmark},
 	{"gcpacertrace", &debug.gcpacertrace},
@@ -329,7 +390,16 @@ var dbgvars = []dbgVar{
 	{"gcstackbarrieroff", &debug.gcstackbarrieroff},
 	{"gcstoptheworld", &debug.gcstoptheworld},
 	{"gctrace", &debug.gctrace},
+	{"guardpage", &debug.guardpage},
+	{"heaplimit", &debug.heaplimit},
+	{"hugepages", &debug.hugepages},
+	{"ifacestats", &debug.ifacestats},
 	{"invalidptr", &debug.invalidptr},
+	{"largetrack", &debug.largetrack},
+	{"madvdontneed", &debug.madvdontneed},
+	{"mallocpoison", &debug.mallocpoison},
+	{"numa", &debug.numa},
+	{"oomgc", &debug.oomgc},
 	{"sbrk", &debug.sbrk},
 	{"scavenge", &debug.scavenge},
 	{"scheddetail", &debug.scheddetail},
@@ -428,9 +498,20 @@ func releasem(mp *m) {
 	}
 }
 
+// gomcache 返回当前 M 分配内存用的 mcache, 它来自 M 的 P。
+// 启动时 mallocinit 直接给 m0 分配了 mcache, 第一次 procresize 把它交给 allp[0]。
+//
+// 没有 P 的 M 不能分配内存, 这里直接 throw 而不是访问 nil mcache 出错。
+// 没有给这种 M 提供一个加锁的共享 mcache: stop the world 只停止 P, 没有 P 的 M 在 GC 的任何阶段
+// 都可能在运行, 它的分配和 mark termination 时 flush mcache、sweep 重建 freelist 之间没有同步。
+// 要在没有 P 的线程上分配内存(cgo 回调、新创建的线程)必须先拿到一个 P, 见 needm 和 exitsyscall。
 //go:nosplit
 func gomcache() *mcache {
-	return getg().m.mcache
+	c := getg().m.mcache
+	if c == nil {
+		throw("malloc called with no P")
+	}
+	return c
 }
 
 //go:linkname reflect_typelinks reflect.typelinks
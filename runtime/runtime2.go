@@ -165,6 +165,79 @@ type sudog struct {
 	releasetime int64
 	nrelease    int32  // -1 for acquire
 	waitlink    *sudog // g.waiting list
+	prio        int32  // channel wait priority, copied from g.chanprio by acquireSudog
+	c           *hchan // channel this sudog is waiting on, for the deadlock report
+	enqtime     int64  // nanotime when enqueued, only with GODEBUG=chanleak
+	spin        uint32 // sudogSpinning etc. while g spins in chansyncspin instead of parking
+	stat        bool   // counted in chanstats.sudogs, only with GODEBUG=chanstats
+}
+
+// A waitReason explains why a goroutine has been stopped.
+// See gopark. Tools that read goroutine states can rely on these
+// identifiers; add new reasons instead of re-using old ones.
+type waitReason uint8
+
+const (
+	waitReasonZero                  waitReason = iota // ""
+	waitReasonChanReceiveNilChan                      // "chan receive (nil chan)"
+	waitReasonChanSendNilChan                         // "chan send (nil chan)"
+	waitReasonChanReceive                             // "chan receive"
+	waitReasonChanSend                                // "chan send"
+	waitReasonSelectNoCases                           // "select (no cases)"
+	waitReasonSelect                                  // "select"
+	waitReasonChanLeakMonitorIdle                     // "chan leak monitor (idle)"
+	waitReasonDumpingHeap                             // "dumping heap"
+	waitReasonFinalizerWait                           // "finalizer wait"
+	waitReasonForceGCIdle                             // "force gc (idle)"
+	waitReasonGarbageCollection                       // "garbage collection"
+	waitReasonGarbageCollectionScan                   // "garbage collection scan"
+	waitReasonGCWorkerIdle                            // "mark worker (idle)"
+	waitReasonGCMarkWaitIdle                          // "mark wait (idle)"
+	waitReasonConcurrentGCWait                        // "Concurrent GC wait"
+	waitReasonGCSweepWait                             // "GC sweep wait"
+	waitReasonIOWait                                  // "IO wait"
+	waitReasonPanicWait                               // "panicwait"
+	waitReasonSemacquire                              // "semacquire"
+	waitReasonSemarelease                             // "semarelease"
+	waitReasonSleep                                   // "sleep"
+	waitReasonStackGrowth                             // "stack growth"
+	waitReasonTimerGoroutineIdle                      // "timer goroutine (idle)"
+	waitReasonTraceReaderBlocked                      // "trace reader (blocked)"
+)
+
+var waitReasonStrings = [...]string{
+	waitReasonZero:                  "",
+	waitReasonChanReceiveNilChan:    "chan receive (nil chan)",
+	waitReasonChanSendNilChan:       "chan send (nil chan)",
+	waitReasonChanReceive:           "chan receive",
+	waitReasonChanSend:              "chan send",
+	waitReasonSelectNoCases:         "select (no cases)",
+	waitReasonSelect:                "select",
+	waitReasonChanLeakMonitorIdle:   "chan leak monitor (idle)",
+	waitReasonDumpingHeap:           "dumping heap",
+	waitReasonFinalizerWait:         "finalizer wait",
+	waitReasonForceGCIdle:           "force gc (idle)",
+	waitReasonGarbageCollection:     "garbage collection",
+	waitReasonGarbageCollectionScan: "garbage collection scan",
+	waitReasonGCWorkerIdle:          "mark worker (idle)",
+	waitReasonGCMarkWaitIdle:        "mark wait (idle)",
+	waitReasonConcurrentGCWait:      "Concurrent GC wait",
+	waitReasonGCSweepWait:           "GC sweep wait",
+	waitReasonIOWait:                "IO wait",
+	waitReasonPanicWait:             "panicwait",
+	waitReasonSemacquire:            "semacquire",
+	waitReasonSemarelease:           "semarelease",
+	waitReasonSleep:                 "sleep",
+	waitReasonStackGrowth:           "stack growth",
+	waitReasonTimerGoroutineIdle:    "timer goroutine (idle)",
+	waitReasonTraceReaderBlocked:    "trace reader (blocked)",
+}
+
+func (w waitReason) String() string {
+	if w >= waitReason(len(waitReasonStrings)) {
+		return "unknown wait reason"
+	}
+	return waitReasonStrings[w]
 }
 
 type gcstats struct {
@@ -233,8 +306,8 @@ type g struct {
 	atomicstatus   uint32
 	stackLock      uint32 // sigprof/scang lock; TODO: fold in to atomicstatus
 	goid           int64
-	waitsince      int64  // approx time when the g become blocked
-	waitreason     string // if status==Gwaiting
+	waitsince      int64      // approx time when the g become blocked
+	waitreason     waitReason // if status==Gwaiting
 	schedlink      guintptr
 	preempt        bool   // preemption signal, duplicates stackguard0 = stackpreempt
 	paniconfault   bool   // panic (instead of crash) on unexpected fault address
@@ -244,6 +317,9 @@ type g struct {
 	throwsplit     bool   // must not split stack
 	raceignore     int8   // ignore race detection events
 	sysblocktraced bool   // StartTrace has emitted EvGoInSyscall about this goroutine
+	inallochook    bool   // running the hook set by SetAllocHook, see alloctrace.go
+	inoomhandler   bool   // running the handler set by SetOOMHandler, see oom.go
+	oomretries     uint8  // allocations retried after running out of memory, see oom.go
 	sysexitticks   int64  // cputicks when syscall has returned (for tracing)
 	sysexitseq     uint64 // trace seq when syscall has returned (for tracing)
 	lockedm        *m
@@ -257,6 +333,7 @@ type g struct {
 	racectx        uintptr
 	waiting        *sudog // sudog structures this g is waiting on (that have a valid elem ptr)
 	readyg         *g     // scratch for readyExecute
+	chanprio       int32  // priority of this g's channel waits, see SetChanWaitPriority
 
 	// Per-G gcController state
 	gcalloc    uintptr // bytes allocated during this GC cycle
@@ -289,6 +366,9 @@ type m struct {
 	nextp         puintptr
 	id            int32
 	mallocing     int32
+	mallocpc      uintptr         // 设置 mallocing 的 mallocgc/rawfree 的调用者, 用于 malloc deadlock 的诊断
+	mallocsize    uintptr         // 正在分配的大小
+	palloc        persistentAlloc // 没有 P 时 persistentalloc 用的小 chunk
 	throwing      int32
 	preemptoff    string // if != "", keep curg running on this m
 	locks         int32
@@ -327,6 +407,7 @@ type m struct {
 	waittraceskip int
 	startingtrace bool
 	syscalltick   uint32
+	itabcache     [itabCacheSize]*itab // 最近在类型断言中用过的 itab, 见 getitabcached
 	//#ifdef GOOS_windows
 	thread uintptr // thread handle
 	// these are here because they are too large to be on the stack
@@ -519,12 +600,12 @@ type _func struct {
 // layout of Itab known to compilers
 // allocated in non-garbage-collected memory
 type itab struct {
-	inter  *interfacetype
-	_type  *_type
-	link   *itab
-	bad    int32
-	unused int32
-	fun    [1]uintptr // variable sized
+	inter   *interfacetype
+	_type   *_type
+	link    *itab // 不再使用, 编译器按固定的偏移访问 fun, 所以保留
+	bad     int32
+	missing int32      // bad 时是 inter.mhdr 中第一个找不到的方法的下标
+	fun     [1]uintptr // variable sized
 }
 
 // Lock-free stack node.
@@ -27,3 +27,9 @@ func TestLockOSThread(t *testing.T) {
 		t.Fatalf("pid=%d but tid=%d", pid, tid)
 	}
 }
+
+func TestMmapFixedNoClobber(t *testing.T) {
+	if MmapFixedClobbers() {
+		t.Fatalf("mmap_fixed replaced an existing mapping")
+	}
+}
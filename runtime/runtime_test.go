@@ -6,8 +6,11 @@ package runtime_test
 
 import (
 	"io"
+	"io/ioutil"
+	"os"
 	. "runtime"
 	"runtime/debug"
+	"strings"
 	"testing"
 	"unsafe"
 )
@@ -301,3 +304,25 @@ func TestAppendSliceGrowth(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteBlackbox(t *testing.T) {
+	f, err := ioutil.TempFile("", "blackbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	WriteBlackbox(f.Fd())
+
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(b)
+	for _, want := range []string{"go blackbox snapshot\n", "\nmemstats:\n", "\nspans ", "\nitabs: ", "\ngoroutines:\n", "TestWriteBlackbox"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("blackbox output does not contain %q:\n%s", want, out)
+		}
+	}
+}
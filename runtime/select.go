@@ -5,6 +5,21 @@
 package runtime
 
 // This file contains the implementation of Go select statements.
+//
+// 编译器把一个 select 语句翻译成:
+//
+//	newselect(sel, size, n)               初始化栈上的 hselect
+//	selectsend/selectrecv/selectdefault   每个 case 调用一次, 填写 sel.scase[i]
+//	selectgo(sel)                         选中一个 case, 直接返回到那个 case 的代码(scase.pc)
+//
+// 只有一个 case 加 default 的 select 被编译器改写成 chan.go 中的 selectnbsend/selectnbrecv。
+// selectgoImpl 的主要步骤:
+//
+//	1. 随机打乱 case 的顺序(pollorder), 保证公平
+//	2. 按 hchan 的地址排序(lockorder), 按这个顺序加锁, 避免两个 select 互相死锁
+//	3. pass 1: 按 pollorder 找一个马上就能完成的 case, 都不行就选 default
+//	4. pass 2: 给每个 case 申请一个 sudog, 挂到对应 channel 的 sendq/recvq 上, 然后 gopark
+//	5. 被唤醒后 pass 3: 把 sudog 从其他 channel 的队列上摘下来, 唤醒我们的那个 sudog 就是选中的 case
 
 import "unsafe"
 
@@ -76,6 +91,9 @@ func selectsend(sel *hselect, c *hchan, elem unsafe.Pointer) (selected bool) {
 
 // cut in half to give stack a chance to split
 func selectsendImpl(sel *hselect, c *hchan, pc uintptr, elem unsafe.Pointer, so uintptr) {
+	if c.spsc != 0 {
+		panic("select on single-producer single-consumer channel")
+	}
 	i := sel.ncase
 	if i >= sel.tcase {
 		throw("selectsend: too many cases")
@@ -109,6 +127,9 @@ func selectrecv2(sel *hselect, c *hchan, elem unsafe.Pointer, received *bool) (s
 }
 
 func selectrecvImpl(sel *hselect, c *hchan, pc uintptr, elem unsafe.Pointer, received *bool, so uintptr) {
+	if c.spsc != 0 {
+		panic("select on single-producer single-consumer channel")
+	}
 	i := sel.ncase
 	if i >= sel.tcase {
 		throw("selectrecv: too many cases")
@@ -186,7 +207,7 @@ func selparkcommit(gp *g, sel unsafe.Pointer) bool {
 }
 
 func block() {
-	gopark(nil, nil, "select (no cases)", traceEvGoStop, 1) // forever
+	gopark(nil, nil, waitReasonSelectNoCases, traceEvGoStop, 1) // forever
 }
 
 // overwrites return pc on stack to signal which case of the select
@@ -222,6 +243,7 @@ func selectgoImpl(sel *hselect) (uintptr, uint16) {
 	// optimizing (and needing to test).
 
 	// generate permuted order
+	// pollorder 和 lockorder 的空间紧跟在 scase 数组后面, 由编译器在栈上分配, 见 selectsize。
 	pollslice := slice{unsafe.Pointer(sel.pollorder), int(sel.ncase), int(sel.ncase)}
 	pollorder := *(*[]uint16)(unsafe.Pointer(&pollslice))
 	for i := 1; i < int(sel.ncase); i++ {
@@ -275,6 +297,7 @@ func selectgoImpl(sel *hselect) (uintptr, uint16) {
 	*/
 
 	// lock all the channels involved in the select
+	// sellock 按 lockorder 加锁, 同一个 channel 出现在多个 case 中时只加一次锁。
 	sellock(sel)
 
 	var (
@@ -286,10 +309,13 @@ func selectgoImpl(sel *hselect) (uintptr, uint16) {
 		sglist *sudog
 		sgnext *sudog
 		futile byte
+		tpark  int64
 	)
 
 loop:
 	// pass 1 - look for something already waiting
+	// 和 chansend/chanrecv 的判断一样: 有缓冲的 channel 看 qcount,
+	// 同步 channel 看对面的等待队列里有没有 goroutine。
 	var dfl *scase
 	var cas *scase
 	for i := 0; i < int(sel.ncase); i++ {
@@ -335,6 +361,7 @@ loop:
 		}
 	}
 
+	// 没有能马上完成的 case, 有 default 就走 default, 不阻塞。
 	if dfl != nil {
 		selunlock(sel)
 		cas = dfl
@@ -342,6 +369,9 @@ loop:
 	}
 
 	// pass 2 - enqueue on all chans
+	// 所有 sudog 共享一个 done, 其他 goroutine 唤醒我们之前要先 cas(sg.selectdone, 0, 1),
+	// 所以多个 channel 同时就绪时只有一个能成功, 见 waitq.dequeue。
+	// sudog 通过 waitlink 串在 gp.waiting 上, 是按 pollorder 的逆序。
 	gp = getg()
 	done = 0
 	for i := 0; i < int(sel.ncase); i++ {
@@ -349,6 +379,7 @@ loop:
 		c = cas.c
 		sg := acquireSudog()
 		sg.g = gp
+		sg.c = c
 		// Note: selectdone is adjusted for stack copies in stack1.go:adjustsudogs
 		sg.selectdone = (*uint32)(noescape(unsafe.Pointer(&done)))
 		sg.elem = cas.elem
@@ -369,11 +400,15 @@ loop:
 	}
 
 	// wait for someone to wake us up
+	// selparkcommit 在 goroutine 真正停下来之后才解锁所有的 channel, 见 selunlock 上面的注释。
 	gp.param = nil
-	gopark(selparkcommit, unsafe.Pointer(sel), "select", traceEvGoBlockSelect|futile, 2)
+	tpark = chanparkstart()
+	gopark(selparkcommit, unsafe.Pointer(sel), waitReasonSelect, traceEvGoBlockSelect|futile, 2)
+	chanparkdone(tpark)
 
 	// someone woke us up
 	sellock(sel)
+	// 唤醒我们的 goroutine 把完成的那个 sudog 放在 gp.param 里; 是 nil 说明是 channel 被 close 了。
 	sg = (*sudog)(gp.param)
 	gp.param = nil
 
@@ -412,6 +447,7 @@ loop:
 		sglist = sgnext
 	}
 
+	// 被 closechan 唤醒时没有选中任何 case, 重新从 pass 1 开始, 这次会走到 rclose/sclose。
 	if cas == nil {
 		futile = traceFutileWakeup
 		goto loop
@@ -455,20 +491,23 @@ asyncrecv:
 	if cas.elem != nil {
 		typedmemmove(c.elemtype, cas.elem, chanbuf(c, c.recvx))
 	}
-	memclr(chanbuf(c, c.recvx), uintptr(c.elemsize))
+	chanbufclear(c, 1)
 	c.recvx++
 	if c.recvx == c.dataqsiz {
 		c.recvx = 0
 	}
+	if debugChan {
+		chanseqtake(c, 1, true)
+	}
 	c.qcount--
-	sg = c.sendq.dequeue()
+	sg = sendqhandoff(c)
 	if sg != nil {
 		gp = sg.g
 		selunlock(sel)
 		if sg.releasetime != 0 {
 			sg.releasetime = cputicks()
 		}
-		goready(gp, 3)
+		chanready(sg, 3)
 	} else {
 		selunlock(sel)
 	}
@@ -486,6 +525,9 @@ asyncsend:
 	if c.sendx == c.dataqsiz {
 		c.sendx = 0
 	}
+	if debugChan {
+		chanseqput(c, 1, true)
+	}
 	c.qcount++
 	sg = c.recvq.dequeue()
 	if sg != nil {
@@ -494,7 +536,7 @@ asyncsend:
 		if sg.releasetime != 0 {
 			sg.releasetime = cputicks()
 		}
-		goready(gp, 3)
+		chanready(sg, 3)
 	} else {
 		selunlock(sel)
 	}
@@ -521,7 +563,7 @@ syncrecv:
 	if sg.releasetime != 0 {
 		sg.releasetime = cputicks()
 	}
-	goready(gp, 3)
+	chanready(sg, 3)
 	goto retc
 
 rclose:
@@ -531,7 +573,7 @@ rclose:
 		*cas.receivedp = false
 	}
 	if cas.elem != nil {
-		memclr(cas.elem, uintptr(c.elemsize))
+		memclr(cas.elem, c.elemsize)
 	}
 	if raceenabled {
 		raceacquire(unsafe.Pointer(c))
@@ -555,7 +597,7 @@ syncsend:
 	if sg.releasetime != 0 {
 		sg.releasetime = cputicks()
 	}
-	goready(gp, 3)
+	chanready(sg, 3)
 
 retc:
 	if cas.releasetime > 0 {
@@ -565,6 +607,7 @@ retc:
 
 sclose:
 	// send on closed channel
+	printchanclosed(c)
 	selunlock(sel)
 	panic("send on closed channel")
 }
@@ -594,36 +637,36 @@ const (
 	selectDefault           // default
 )
 
-func (q *waitq) dequeueSudoG(sgp *sudog) {
-	x := sgp.prev
-	y := sgp.next
-	if x != nil {
-		if y != nil {
-			// middle of queue
-			x.next = y
-			y.prev = x
-			sgp.next = nil
-			sgp.prev = nil
-			return
+//go:linkname reflect_rselect reflect.rselect
+func reflect_rselect(cases []runtimeSelect) (chosen int, recvOK bool) {
+	// reflect.Select 把每个 case 描述成一个 runtimeSelect, 这里和编译器生成的代码一样
+	// 构造 hselect 再调用 selectgoImpl。scase.pc 本来是选中之后要返回的地址, 这里用来存 case 的下标,
+	// 所有接收 case 共用一个 received。
+	// flagNoScan is safe here, because all objects are also referenced from cases.
+	size := selectsize(uintptr(len(cases)))
+	sel := (*hselect)(mallocgc(size, nil, flagNoScan))
+	newselect(sel, int64(size), int32(len(cases)))
+	r := new(bool)
+	for i := range cases {
+		rc := &cases[i]
+		switch rc.dir {
+		case selectDefault:
+			selectdefaultImpl(sel, uintptr(i), 0)
+		case selectSend:
+			if rc.ch == nil {
+				break
+			}
+			selectsendImpl(sel, rc.ch, uintptr(i), rc.val, 0)
+		case selectRecv:
+			if rc.ch == nil {
+				break
+			}
+			selectrecvImpl(sel, rc.ch, uintptr(i), rc.val, r, 0)
 		}
-		// end of queue
-		x.next = nil
-		q.last = x
-		sgp.prev = nil
-		return
-	}
-	if y != nil {
-		// start of queue
-		y.prev = nil
-		q.first = y
-		sgp.next = nil
-		return
-	}
-
-	// x==y==nil.  Either sgp is the only element in the queue,
-	// or it has already been removed.  Use q.first to disambiguate.
-	if q.first == sgp {
-		q.first = nil
-		q.last = nil
 	}
+
+	pc, _ := selectgoImpl(sel)
+	chosen = int(pc)
+	recvOK = *r
+	return
 }
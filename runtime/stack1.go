@@ -154,6 +154,7 @@ func stackcacherefill(c *mcache, order uint8) {
 	unlock(&stackpoolmu)
 	c.stackcache[order].list = list
 	c.stackcache[order].size = size
+	c.stackcache[order].nrefill++
 }
 
 func stackcacherelease(c *mcache, order uint8) {
@@ -172,6 +173,7 @@ func stackcacherelease(c *mcache, order uint8) {
 	unlock(&stackpoolmu)
 	c.stackcache[order].list = x
 	c.stackcache[order].size = size
+	c.stackcache[order].nflush++
 }
 
 func stackcache_clear(c *mcache) {
@@ -181,6 +183,9 @@ func stackcache_clear(c *mcache) {
 	lock(&stackpoolmu)
 	for order := uint8(0); order < _NumStackOrders; order++ {
 		x := c.stackcache[order].list
+		if x.ptr() != nil {
+			c.stackcache[order].nflush++
+		}
 		for x.ptr() != nil {
 			y := x.ptr().next
 			stackpoolfree(x, order)
@@ -192,6 +197,20 @@ func stackcache_clear(c *mcache) {
 	unlock(&stackpoolmu)
 }
 
+// stackcachestats 累计已经被释放的 mcache 的栈缓存统计，由 mheap_.lock 保护。
+var stackcachestats [_NumStackOrders]stackfreelist
+
+// purgestackcachestats 在 mcache 被释放前把它的统计加到 stackcachestats 里, 调用者持有 mheap_.lock。
+func purgestackcachestats(c *mcache) {
+	for order := range c.stackcache {
+		l, t := &c.stackcache[order], &stackcachestats[order]
+		t.nalloc += l.nalloc
+		t.nfree += l.nfree
+		t.nrefill += l.nrefill
+		t.nflush += l.nflush
+	}
+}
+
 func stackalloc(n uint32) (stack, []stkbar) {
 	// Stackalloc must be called on scheduler stack, so that we
 	// never try to grow the stack during the code that stackalloc runs.
@@ -250,6 +269,7 @@ func stackalloc(n uint32) (stack, []stkbar) {
 			}
 			c.stackcache[order].list = x.ptr().next
 			c.stackcache[order].size -= uintptr(n)
+			c.stackcache[order].nalloc++
 		}
 		v = (unsafe.Pointer)(x)
 	} else {
@@ -312,6 +332,7 @@ func stackfree(stk stack, n uintptr) {
 			x.ptr().next = c.stackcache[order].list
 			c.stackcache[order].list = x
 			c.stackcache[order].size += n
+			c.stackcache[order].nfree++
 		}
 	} else {
 		s := mHeap_Lookup(&mheap_, v)
@@ -725,7 +746,7 @@ func newstack() {
 	// The goroutine must be executing in order to call newstack,
 	// so it must be Grunning (or Gscanrunning).
 	casgstatus(gp, _Grunning, _Gwaiting)
-	gp.waitreason = "stack growth"
+	gp.waitreason = waitReasonStackGrowth
 
 	if gp.stack.lo == 0 {
 		throw("missing stack in newstack")
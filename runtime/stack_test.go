@@ -397,6 +397,39 @@ func TestStackCache(t *testing.T) {
 	}
 }
 
+func TestStackCacheStats(t *testing.T) {
+	before := ReadStackCacheStats()
+	// Growing stacks allocates new stacks and frees the old ones.
+	req := make(chan int)
+	done := make(chan struct{})
+	go growing(req, done)
+	for i := 0; i < 100; i++ {
+		req <- 1 << 3
+		<-done
+	}
+	close(req)
+	<-done
+	after := ReadStackCacheStats()
+
+	if len(after) == 0 || after[0].Size == 0 {
+		t.Fatalf("no stack cache stats: %+v", after)
+	}
+	var allocs, frees uint64
+	for i, st := range after {
+		if i > 0 && st.Size != 2*after[i-1].Size {
+			t.Errorf("stack sizes %d and %d are not consecutive orders", after[i-1].Size, st.Size)
+		}
+		if st.Allocs < before[i].Allocs || st.Frees < before[i].Frees || st.Refills < before[i].Refills || st.Flushes < before[i].Flushes {
+			t.Errorf("size %d: counters went backwards: %+v then %+v", st.Size, before[i], st)
+		}
+		allocs += st.Allocs - before[i].Allocs
+		frees += st.Frees - before[i].Frees
+	}
+	if allocs == 0 || frees == 0 {
+		t.Errorf("stack growth used the stack caches %d allocs and %d frees, want some of both", allocs, frees)
+	}
+}
+
 func TestStackOutput(t *testing.T) {
 	b := make([]byte, 1024)
 	stk := string(b[:Stack(b, false)])
@@ -290,7 +290,7 @@ func rawbyteslice(size int) (b []byte) {
 
 // rawruneslice allocates a new rune slice. The rune slice is not zeroed.
 func rawruneslice(size int) (b []rune) {
-	if uintptr(size) > _MaxMem/4 {
+	if uintptr(size) > maxMem/4 {
 		throw("out of memory")
 	}
 	mem := roundupsize(uintptr(size) * 4)
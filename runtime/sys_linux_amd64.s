@@ -275,6 +275,16 @@ TEXT runtime·madvise(SB),NOSPLIT,$0
 	// ignore failure - maybe pages are locked
 	RET
 
+// func madviseErr(addr unsafe.Pointer, n uintptr, flags int32) int32
+TEXT runtime·madviseErr(SB),NOSPLIT,$0
+	MOVQ	addr+0(FP), DI
+	MOVQ	n+8(FP), SI
+	MOVL	flags+16(FP), DX
+	MOVQ	$28, AX	// madvise
+	SYSCALL
+	MOVL	AX, ret+24(FP)
+	RET
+
 // int64 futex(int32 *uaddr, int32 op, int32 val,
 //	struct timespec *timeout, int32 *uaddr2, int32 val2);
 TEXT runtime·futex(SB),NOSPLIT,$0
@@ -428,3 +438,26 @@ TEXT runtime·closeonexec(SB),NOSPLIT,$0
 	MOVL	$72, AX  // fcntl
 	SYSCALL
 	RET
+
+// int32 mbind(void *addr, uintptr n, int32 mode, uint64 *nodemask, uintptr maxnode, uint32 flags)
+TEXT runtime·mbind(SB),NOSPLIT,$0
+	MOVQ	addr+0(FP), DI
+	MOVQ	n+8(FP), SI
+	MOVL	mode+16(FP), DX
+	MOVQ	nodemask+24(FP), R10
+	MOVQ	maxnode+32(FP), R8
+	MOVL	flags+40(FP), R9
+	MOVL	$237, AX	// mbind
+	SYSCALL
+	MOVL	AX, ret+44(FP)
+	RET
+
+// int32 getcpu(uint32 *cpu, uint32 *node)
+TEXT runtime·getcpu(SB),NOSPLIT,$0
+	MOVQ	cpu+0(FP), DI
+	MOVQ	node+8(FP), SI
+	MOVQ	$0, DX
+	MOVL	$309, AX	// getcpu
+	SYSCALL
+	MOVL	AX, ret+16(FP)
+	RET
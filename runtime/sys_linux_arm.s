@@ -180,6 +180,16 @@ TEXT runtime·madvise(SB),NOSPLIT,$0
 	// ignore failure - maybe pages are locked
 	RET
 
+// func madviseErr(addr unsafe.Pointer, n uintptr, flags int32) int32
+TEXT runtime·madviseErr(SB),NOSPLIT,$0
+	MOVW	addr+0(FP), R0
+	MOVW	n+4(FP), R1
+	MOVW	flags+8(FP), R2
+	MOVW	$SYS_madvise, R7
+	SWI	$0
+	MOVW	R0, ret+12(FP)
+	RET
+
 TEXT runtime·setitimer(SB),NOSPLIT,$0
 	MOVW	mode+0(FP), R0
 	MOVW	new+4(FP), R1
@@ -43,6 +43,8 @@
 #define SYS_epoll_ctl		21
 #define SYS_epoll_pwait		22
 #define SYS_clock_gettime	113
+#define SYS_mbind		235
+#define SYS_getcpu		168
 
 TEXT runtime·exit(SB),NOSPLIT,$-8-4
 	MOVW	code+0(FP), R0
@@ -289,6 +291,16 @@ TEXT runtime·madvise(SB),NOSPLIT,$-8
 	// ignore failure - maybe pages are locked
 	RET
 
+// func madviseErr(addr unsafe.Pointer, n uintptr, flags int32) int32
+TEXT runtime·madviseErr(SB),NOSPLIT,$-8
+	MOVD	addr+0(FP), R0
+	MOVD	n+8(FP), R1
+	MOVW	flags+16(FP), R2
+	MOVD	$SYS_madvise, R8
+	SVC
+	MOVW	R0, ret+24(FP)
+	RET
+
 // int64 futex(int32 *uaddr, int32 op, int32 val,
 //	struct timespec *timeout, int32 *uaddr2, int32 val2);
 TEXT runtime·futex(SB),NOSPLIT,$-8
@@ -445,3 +457,26 @@ TEXT runtime·closeonexec(SB),NOSPLIT,$-8
 	MOVD	$SYS_fcntl, R8
 	SVC
 	RET
+
+// int32 mbind(void *addr, uintptr n, int32 mode, uint64 *nodemask, uintptr maxnode, uint32 flags)
+TEXT runtime·mbind(SB),NOSPLIT,$-8
+	MOVD	addr+0(FP), R0
+	MOVD	n+8(FP), R1
+	MOVW	mode+16(FP), R2
+	MOVD	nodemask+24(FP), R3
+	MOVD	maxnode+32(FP), R4
+	MOVW	flags+40(FP), R5
+	MOVD	$SYS_mbind, R8
+	SVC
+	MOVW	R0, ret+44(FP)
+	RET
+
+// int32 getcpu(uint32 *cpu, uint32 *node)
+TEXT runtime·getcpu(SB),NOSPLIT,$-8
+	MOVD	cpu+0(FP), R0
+	MOVD	node+8(FP), R1
+	MOVD	$0, R2
+	MOVD	$SYS_getcpu, R8
+	SVC
+	MOVW	R0, ret+16(FP)
+	RET
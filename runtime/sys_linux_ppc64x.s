@@ -267,6 +267,15 @@ TEXT runtime·madvise(SB),NOSPLIT,$-8
 	// ignore failure - maybe pages are locked
 	RET
 
+// func madviseErr(addr unsafe.Pointer, n uintptr, flags int32) int32
+TEXT runtime·madviseErr(SB),NOSPLIT,$-8
+	MOVD	addr+0(FP), R3
+	MOVD	n+8(FP), R4
+	MOVW	flags+16(FP), R5
+	SYSCALL	$SYS_madvise
+	MOVW	R3, ret+24(FP)
+	RET
+
 // int64 futex(int32 *uaddr, int32 op, int32 val,
 //	struct timespec *timeout, int32 *uaddr2, int32 val2);
 TEXT runtime·futex(SB),NOSPLIT,$-8
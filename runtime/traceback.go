@@ -43,6 +43,7 @@ var (
 	backgroundgcPC       uintptr
 	bgsweepPC            uintptr
 	forcegchelperPC      uintptr
+	chanleakmonitorPC    uintptr
 	timerprocPC          uintptr
 	gcBgMarkWorkerPC     uintptr
 	systemstack_switchPC uintptr
@@ -70,6 +71,7 @@ func tracebackinit() {
 	backgroundgcPC = funcPC(backgroundgc)
 	bgsweepPC = funcPC(bgsweep)
 	forcegchelperPC = funcPC(forcegchelper)
+	chanleakmonitorPC = funcPC(chanleakmonitor)
 	timerprocPC = funcPC(timerproc)
 	gcBgMarkWorkerPC = funcPC(gcBgMarkWorker)
 	systemstack_switchPC = funcPC(systemstack_switch)
@@ -632,8 +634,8 @@ func goroutineheader(gp *g) {
 	}
 
 	// Override.
-	if (gpstatus == _Gwaiting || gpstatus == _Gscanwaiting) && gp.waitreason != "" {
-		status = gp.waitreason
+	if (gpstatus == _Gwaiting || gpstatus == _Gscanwaiting) && gp.waitreason != waitReasonZero {
+		status = gp.waitreason.String()
 	}
 
 	// approx time the G is blocked, in minutes
@@ -704,6 +706,7 @@ func isSystemGoroutine(gp *g) bool {
 		pc == backgroundgcPC ||
 		pc == bgsweepPC ||
 		pc == forcegchelperPC ||
+		pc == chanleakmonitorPC ||
 		pc == timerprocPC ||
 		pc == gcBgMarkWorkerPC
 }
@@ -39,6 +39,11 @@ const (
 )
 
 // isDirectIface reports whether t is stored directly in an interface value.
+//
+// kindDirectIface 由编译器(reflect 创建的类型由 reflect)设置, 不能只在 runtime 中改变判断:
+// 方法的 wrapper 和 reflect 都按这个标志解释接口中的 data。
+// 指针、chan、map、func、unsafe.Pointer 是 direct 的, 只有一个字段的 struct 和长度为 1 的数组
+// 在字段或元素是 direct 的时候也是 direct 的, 所以 struct{ p *T } 这样的包装类型装箱时不用分配。
 func isDirectIface(t *_type) bool {
 	return t.kind&kindDirectIface != 0
 }
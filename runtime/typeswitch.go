@@ -0,0 +1,149 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Type switch dispatch cache.
+//
+// 编译器把 switch x.(type) 翻译成按顺序对每个 case 做一次类型比较或者 assertE2I2,
+// case 很多而且有 interface 类型的 case 时, 每执行一次都要调用好几次 getitab。
+// typeSwitchCase 把一个 type switch 的结果按动态类型缓存起来:
+//
+//	每个 switch 有一个 typeSwitch, 由编译器(或者生成的代码)静态分配, cases 是各个 case 的类型
+//	cache 是按 _type.hash 开放寻址的表, 记录动态类型 -> (case 下标, 这个 case 的 itab)
+//	命中时不加锁, 原子地读 cache 和每个位置的 typ; 没有命中时按顺序匹配所有 case, 再加锁插入
+//	插入时先写 cas 和 tab, 最后原子地写 typ; 装满 3/4 时复制到两倍大的新表, 填好之后原子地替换
+//
+// 和 itab 一样, cache 用 persistentalloc 分配, 不会释放。
+// 一个 switch 最多缓存 typeSwitchCacheMax 个动态类型(表最大 2048 个位置), 之后遇到的新类型
+// 不再缓存, 每次都按顺序匹配, 避免 reflect 创建的类型源源不断时一直增长。
+
+package runtime
+
+import "unsafe"
+
+const typeSwitchCacheMax = 1024
+
+// typeSwitch describes one type switch site: case i matches the
+// dynamic types that are cases[i] or, if cases[i] is an interface type,
+// implement it.
+type typeSwitch struct {
+	cache unsafe.Pointer // *typeSwitchCache, 原子读写, 开始是 nil
+	cases []*_type
+}
+
+type typeSwitchCache struct {
+	mask    uintptr // 位置的个数 - 1
+	count   uintptr
+	entries [1]typeSwitchEntry // 实际上有 mask+1 个
+}
+
+type typeSwitchEntry struct {
+	typ *_type // nil 表示空位置, 原子读写
+	cas int
+	tab *itab
+}
+
+var typeSwitchLock mutex // 插入任何 typeSwitch 的 cache 时持有
+
+func (c *typeSwitchCache) entry(i uintptr) *typeSwitchEntry {
+	return (*typeSwitchEntry)(add(unsafe.Pointer(&c.entries), i*unsafe.Sizeof(typeSwitchEntry{})))
+}
+
+// typeSwitchCase returns the index of the first case of s that the
+// dynamic type t matches, or -1 if there is none. If that case is a
+// non-empty interface type, tab is the itab for converting t to it.
+// t must not be nil; the compiler handles case nil itself.
+func typeSwitchCase(s *typeSwitch, t *_type) (cas int, tab *itab) {
+	if c := (*typeSwitchCache)(atomicloadp(unsafe.Pointer(&s.cache))); c != nil {
+		if e := c.find(t); e != nil {
+			return e.cas, e.tab
+		}
+	}
+	cas, tab = typeSwitchMatch(s, t)
+	typeSwitchAdd(s, t, cas, tab)
+	return
+}
+
+// find 查找 t 的位置, 可以不加锁调用。
+func (c *typeSwitchCache) find(t *_type) *typeSwitchEntry {
+	h := uintptr(t.hash) & c.mask
+	for i := uintptr(1); ; i++ {
+		e := c.entry(h)
+		et := (*_type)(atomicloadp(unsafe.Pointer(&e.typ)))
+		if et == t {
+			return e
+		}
+		if et == nil {
+			return nil
+		}
+		h = (h + i) & c.mask
+	}
+}
+
+// typeSwitchMatch 按顺序检查每个 case, 和编译器生成的比较一样。
+func typeSwitchMatch(s *typeSwitch, t *_type) (int, *itab) {
+	for i, ct := range s.cases {
+		if ct.kind&kindMask != kindInterface {
+			if ct == t {
+				return i, nil
+			}
+			continue
+		}
+		inter := (*interfacetype)(unsafe.Pointer(ct))
+		if len(inter.mhdr) == 0 {
+			return i, nil // interface{} 匹配所有类型
+		}
+		if tab := getitab(inter, t, true); tab != nil {
+			return i, tab
+		}
+	}
+	return -1, nil
+}
+
+// typeSwitchAdd 把 t 的结果加到 s 的 cache 中。
+func typeSwitchAdd(s *typeSwitch, t *_type, cas int, tab *itab) {
+	lock(&typeSwitchLock)
+	c := (*typeSwitchCache)(s.cache)
+	if c != nil && (c.find(t) != nil || c.count >= typeSwitchCacheMax) {
+		// 别的 goroutine 刚刚加进去, 或者已经缓存了 typeSwitchCacheMax 个类型
+		unlock(&typeSwitchLock)
+		return
+	}
+	if c == nil || (c.count+1)*4 > (c.mask+1)*3 {
+		size := uintptr(8)
+		if c != nil {
+			size = (c.mask + 1) * 2
+		}
+		c2 := (*typeSwitchCache)(persistentalloc(unsafe.Sizeof(typeSwitchCache{})+(size-1)*unsafe.Sizeof(typeSwitchEntry{}), 0, &memstats.other_sys))
+		c2.mask = size - 1
+		if c != nil {
+			for i := uintptr(0); i <= c.mask; i++ {
+				if e := c.entry(i); e.typ != nil {
+					c2.insert(e.typ, e.cas, e.tab)
+				}
+			}
+		}
+		c2.insert(t, cas, tab)
+		atomicstorep(unsafe.Pointer(&s.cache), unsafe.Pointer(c2))
+		unlock(&typeSwitchLock)
+		return
+	}
+	c.insert(t, cas, tab)
+	unlock(&typeSwitchLock)
+}
+
+// insert 把 t 放到第一个空位置上, 调用者持有 typeSwitchLock 并且保证表没有满。
+func (c *typeSwitchCache) insert(t *_type, cas int, tab *itab) {
+	h := uintptr(t.hash) & c.mask
+	for i := uintptr(1); ; i++ {
+		e := c.entry(h)
+		if e.typ == nil {
+			e.cas = cas
+			e.tab = tab
+			atomicstorep(unsafe.Pointer(&e.typ), unsafe.Pointer(t))
+			c.count++
+			return
+		}
+		h = (h + i) & c.mask
+	}
+}